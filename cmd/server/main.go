@@ -5,6 +5,7 @@ import (
 	"crypto/tls"
 	"errors"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -16,8 +17,10 @@ import (
 	"github.com/joho/godotenv"
 	"golang.org/x/crypto/acme/autocert"
 
+	"gopublic/internal/cluster"
 	"gopublic/internal/config"
 	"gopublic/internal/dashboard"
+	"gopublic/internal/devicecert"
 	"gopublic/internal/ingress"
 	"gopublic/internal/metrics"
 	"gopublic/internal/server"
@@ -69,6 +72,7 @@ func main() {
 
 	// 3. Initialize Registry
 	registry := server.NewTunnelRegistry()
+	registry.Balance = server.BalanceStrategy(cfg.TunnelBalance)
 
 	// 3.5 Initialize Metrics
 	appMetrics := metrics.NewAppMetrics()
@@ -114,6 +118,10 @@ func main() {
 				if host == cfg.Domain || strings.HasSuffix(host, "."+cfg.Domain) {
 					return nil
 				}
+				// Custom domains get certificates once their owner verified them
+				if verified, err := storage.IsVerifiedCustomDomain(host); err == nil && verified {
+					return nil
+				}
 				return errors.New("host not configured")
 			},
 			Email: cfg.Email,
@@ -121,12 +129,58 @@ func main() {
 		tlsConfig = autocertManager.TLSConfig()
 	}
 
+	// 6.1 Device certificates: agents may authenticate with a client
+	// certificate issued from the dashboard instead of their token
+	controlTLSConfig := tlsConfig
+	if cfg.DeviceCADir != "" {
+		deviceCA, err := devicecert.LoadOrCreate(cfg.DeviceCADir)
+		if err != nil {
+			log.Fatalf("Failed to load device CA: %v", err)
+		}
+		dashHandler.DeviceCA = deviceCA
+		if tlsConfig != nil {
+			controlTLSConfig = tlsConfig.Clone()
+			controlTLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			controlTLSConfig.ClientCAs = deviceCA.Pool()
+		} else {
+			log.Println("Device certificates need HTTPS; agents authenticate with tokens only")
+		}
+	}
+
+	// 6.5 Join the cluster (if configured)
+	var clusterNode *cluster.Node
+	if cfg.IsCluster() {
+		ttl := time.Duration(cfg.ClusterNodeTTLSecs) * time.Second
+		var clusterRegistry cluster.Registry
+		if cfg.ClusterRegistryURL == "" {
+			log.Printf("Cluster: node %s hosts the registry", cfg.ClusterNodeID)
+			clusterRegistry = cluster.NewMemoryRegistry(ttl)
+		} else {
+			clusterRegistry = cluster.NewRemoteRegistry(cfg.ClusterRegistryURL, cfg.ClusterSecret)
+		}
+		clusterNode = cluster.NewNode(cfg.ClusterNodeID, cfg.ClusterAdvertise, cfg.ClusterSecret, clusterRegistry)
+		clusterNode.HeartbeatInterval = ttl / 3
+		if err := clusterNode.Join(); err != nil {
+			log.Fatalf("Failed to join cluster: %v", err)
+		}
+	}
+
 	// 7. Start Control Plane
-	controlPlane := server.NewServerWithConfig(cfg, registry, tlsConfig)
+	controlPlane := server.NewServerWithConfig(cfg, registry, controlTLSConfig)
 	controlPlane.AppMetrics = appMetrics
+	controlPlane.Cluster = clusterNode
 
 	// Connect dashboard to user sessions for connection status display
-	dashHandler.SetUserSessions(controlPlane.UserSessions)
+	dashHandler.SetUserSessions(dashboardSessions{controlPlane.UserSessions})
+	dashHandler.DomainReleaser = controlPlane
+	dashHandler.LoginWalls = controlPlane
+
+	// Let the admin broadcast announcements to connected clients and
+	// hear about IPs banned for guessing tokens
+	if telegramBot != nil {
+		telegramBot.Announcer = controlPlane
+		controlPlane.Alerts = telegramBot
+	}
 
 	serverErrors := make(chan error, 4)
 
@@ -138,25 +192,54 @@ func main() {
 
 	// 8. Start Public Ingress
 	ing := ingress.NewIngressWithConfig(cfg, registry, dashHandler)
+	ing.Cluster = clusterNode
+	ing.ControlPlane = controlPlane
+	if ing.Hold != nil {
+		ing.Hold.Metrics = appMetrics
+	}
 
 	var httpServers []*http.Server
 
+	// Internal link: requests forwarded by other nodes and registry calls
+	clusterCtx, clusterCancel := context.WithCancel(context.Background())
+	defer clusterCancel()
+	if clusterNode != nil {
+		clusterServer := &http.Server{
+			Addr:    cfg.ClusterListen,
+			Handler: clusterNode.Handler(ing.Handler()),
+		}
+		httpServers = append(httpServers, clusterServer)
+
+		go func() {
+			log.Printf("Cluster: node %s listening on %s (advertised as %s)", cfg.ClusterNodeID, cfg.ClusterListen, cfg.ClusterAdvertise)
+			if err := clusterServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				serverErrors <- err
+			}
+		}()
+		go clusterNode.Run(clusterCtx)
+	}
+
 	if cfg.IsSecure() {
 		// HTTPS Mode (Production)
 		httpsServer := &http.Server{
 			Addr:      ":443",
 			Handler:   ing.Handler(),
 			TLSConfig: tlsConfig,
-			// WebSocket upgrades require connection hijacking, which is not supported
-			// when the request is served over HTTP/2. Disable HTTP/2 to ensure
-			// WebSocket-based features (e.g. Next.js HMR at /_next/webpack-hmr) work.
-			TLSNextProto: map[string]func(*http.Server, *tls.Conn, http.Handler){},
+			// HTTP/2 is negotiated with ALPN, which gRPC needs. WebSockets keep
+			// working: without extended CONNECT browsers open them over HTTP/1.1,
+			// where the upgrade can hijack the connection.
 		}
 		httpServers = append(httpServers, httpsServer)
 
+		// Peek at the SNI of every connection so passthrough tunnels get raw TLS bytes
+		httpsListener, err := net.Listen("tcp", httpsServer.Addr)
+		if err != nil {
+			log.Fatalf("Failed to listen on %s: %v", httpsServer.Addr, err)
+		}
+
 		go func() {
-			log.Println("Public Ingress listening on :443 (HTTPS)")
-			if err := httpsServer.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+			log.Println("Public Ingress listening on :443 (HTTPS, SNI passthrough enabled)")
+			if err := httpsServer.ServeTLS(ing.NewPassthroughListener(httpsListener), "", ""); err != nil && err != http.ErrServerClosed {
 				serverErrors <- err
 			}
 		}()
@@ -222,6 +305,14 @@ func main() {
 		log.Printf("Control plane shutdown error: %v", err)
 	}
 
+	// Give this node's domains back to the cluster
+	if clusterNode != nil {
+		clusterCancel()
+		if err := clusterNode.Leave(); err != nil {
+			log.Printf("Cluster leave error: %v", err)
+		}
+	}
+
 	// Stop Telegram bot
 	if telegramBot != nil {
 		telegramBot.Stop()
@@ -230,3 +321,25 @@ func main() {
 
 	log.Println("Server shutdown complete")
 }
+
+// dashboardSessions lists the sessions of a UserSessionRegistry as dashboard
+// agents.
+type dashboardSessions struct {
+	*server.UserSessionRegistry
+}
+
+func (d dashboardSessions) GetSessions(userID uint) []dashboard.AgentSession {
+	sessions := d.UserSessionRegistry.GetSessions(userID)
+	agents := make([]dashboard.AgentSession, 0, len(sessions))
+	for _, sess := range sessions {
+		agents = append(agents, dashboard.AgentSession{
+			Session:     sess.Session,
+			RemoteAddr:  sess.RemoteAddr,
+			ConnectedAt: sess.ConnectedAt,
+			Domains:     sess.Domains,
+			DeviceID:    sess.DeviceID,
+			Device:      sess.Device,
+		})
+	}
+	return agents
+}
@@ -0,0 +1,215 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tunnel login walls: the dashboard signs a visitor in and hands the tunnel
+// host a short-lived ticket, which the ingress trades for a cookie scoped to
+// that host.
+const (
+	// EdgeAuthPath is where tunnel hosts behind a login wall redeem tickets
+	EdgeAuthPath = "/_gopublic/auth"
+	// EdgeUserHeader carries the verified identity of a visitor to the client
+	EdgeUserHeader = "X-Gopublic-User"
+	// EdgeCookieName is the cookie holding a visitor's identity on a tunnel host
+	EdgeCookieName = "gopublic_edge"
+
+	edgeTicketName  = "gopublic_edge_ticket"
+	edgeLoginName   = "edge_login"
+	edgeTicketTTL   = 2 * time.Minute
+	edgeSessionTTL  = 24 * time.Hour
+	edgeLoginMaxAge = 10 * 60 // seconds
+)
+
+// ErrEdgeSessionInvalid is returned for tickets and cookies that expired or
+// belong to another host, and for tickets that were already redeemed.
+var ErrEdgeSessionInvalid = errors.New("edge session expired or issued for another host")
+
+// EdgeIdentity is a visitor signed in at the login wall of Host.
+type EdgeIdentity struct {
+	Host       string   `json:"host"`
+	Provider   string   `json:"provider"`        // Login provider that verified the visitor
+	User       string   `json:"user"`            // Sent to the client in EdgeUserHeader
+	Identities []string `json:"identities"`      // Matched against the allowlist
+	Nonce      string   `json:"nonce,omitempty"` // Set on tickets so each is redeemed once
+	CreatedAt  int64    `json:"created_at"`
+}
+
+// EdgeLogin remembers a login wall sign-in while the visitor logs in on the
+// dashboard or at the OIDC provider, and then while they confirm that Host
+// may learn who they are.
+type EdgeLogin struct {
+	Host      string        `json:"host"`
+	Next      string        `json:"next"`               // Path to return to on the tunnel host
+	State     string        `json:"state,omitempty"`    // OAuth state of an OIDC login
+	Nonce     string        `json:"nonce,omitempty"`    // Expected in the ID token of an OIDC login
+	Verifier  string        `json:"verifier,omitempty"` // PKCE code verifier of an OIDC login
+	Identity  *EdgeIdentity `json:"identity,omitempty"` // Signed-in OIDC visitor awaiting confirmation
+	CreatedAt int64         `json:"created_at"`
+}
+
+// IssueEdgeTicket signs id into a ticket that its host accepts once within
+// two minutes.
+func (sm *SessionManager) IssueEdgeTicket(id EdgeIdentity) (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	id.Nonce = hex.EncodeToString(nonce)
+	id.CreatedAt = time.Now().Unix()
+	return sm.sc.Encode(edgeTicketName, id)
+}
+
+// RedeemEdgeTicket checks a ticket presented on host. A ticket is accepted
+// only once, so one leaked from a URL or log can't be traded for another
+// cookie. Redeemed tickets are remembered by this process only.
+func (sm *SessionManager) RedeemEdgeTicket(host, ticket string) (*EdgeIdentity, error) {
+	id, err := sm.decodeEdgeIdentity(edgeTicketName, ticket, host, edgeTicketTTL)
+	if err != nil {
+		return nil, err
+	}
+	expires := time.Unix(id.CreatedAt, 0).Add(edgeTicketTTL)
+	if id.Nonce == "" || !sm.tickets.redeem(id.Nonce, expires) {
+		return nil, ErrEdgeSessionInvalid
+	}
+	id.Nonce = ""
+	return id, nil
+}
+
+// redeemedTickets remembers the nonces of redeemed tickets until the tickets
+// expire.
+type redeemedTickets struct {
+	mu   sync.Mutex
+	seen map[string]time.Time // Nonce -> expiry of its ticket
+}
+
+func newRedeemedTickets() *redeemedTickets {
+	return &redeemedTickets{seen: make(map[string]time.Time)}
+}
+
+// redeem records nonce and reports whether it was not redeemed before.
+func (t *redeemedTickets) redeem(nonce string, expires time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	for n, exp := range t.seen {
+		if now.After(exp) {
+			delete(t.seen, n)
+		}
+	}
+	if _, ok := t.seen[nonce]; ok {
+		return false
+	}
+	t.seen[nonce] = expires
+	return true
+}
+
+// SetEdgeSession sets the cookie identifying a visitor on id.Host. It has no
+// Domain attribute, so browsers send it to that host only.
+func (sm *SessionManager) SetEdgeSession(w http.ResponseWriter, id *EdgeIdentity) error {
+	data := *id
+	data.Nonce = ""
+	data.CreatedAt = time.Now().Unix()
+	encoded, err := sm.sc.Encode(EdgeCookieName, data)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     EdgeCookieName,
+		Value:    encoded,
+		Path:     "/",
+		MaxAge:   int(edgeSessionTTL.Seconds()),
+		Secure:   sm.isSecure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// GetEdgeSession reads the visitor's identity from a request to host.
+func (sm *SessionManager) GetEdgeSession(r *http.Request, host string) (*EdgeIdentity, error) {
+	cookie, err := r.Cookie(EdgeCookieName)
+	if err != nil {
+		return nil, err
+	}
+	return sm.decodeEdgeIdentity(EdgeCookieName, cookie.Value, host, edgeSessionTTL)
+}
+
+func (sm *SessionManager) decodeEdgeIdentity(name, value, host string, ttl time.Duration) (*EdgeIdentity, error) {
+	var id EdgeIdentity
+	if err := sm.sc.Decode(name, value, &id); err != nil {
+		return nil, err
+	}
+	if id.Host != host || time.Since(time.Unix(id.CreatedAt, 0)) > ttl {
+		return nil, ErrEdgeSessionInvalid
+	}
+	return &id, nil
+}
+
+// SetEdgeLogin stores a sign-in in progress in a dashboard cookie.
+func (sm *SessionManager) SetEdgeLogin(w http.ResponseWriter, login EdgeLogin) error {
+	login.CreatedAt = time.Now().Unix()
+	encoded, err := sm.sc.Encode(edgeLoginName, login)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     edgeLoginName,
+		Value:    encoded,
+		Path:     "/",
+		MaxAge:   edgeLoginMaxAge,
+		Secure:   sm.isSecure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// GetEdgeLogin returns the sign-in in progress, if any.
+func (sm *SessionManager) GetEdgeLogin(r *http.Request) (*EdgeLogin, error) {
+	cookie, err := r.Cookie(edgeLoginName)
+	if err != nil {
+		return nil, err
+	}
+
+	var login EdgeLogin
+	if err := sm.sc.Decode(edgeLoginName, cookie.Value, &login); err != nil {
+		return nil, err
+	}
+	if time.Since(time.Unix(login.CreatedAt, 0)) > edgeLoginMaxAge*time.Second {
+		return nil, ErrEdgeSessionInvalid
+	}
+	return &login, nil
+}
+
+// ClearEdgeLogin removes the sign-in in progress.
+func (sm *SessionManager) ClearEdgeLogin(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     edgeLoginName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   sm.isSecure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// SafeRedirectPath returns next if it is a path on the current host, and "/"
+// otherwise, so login redirects cannot lead visitors elsewhere.
+func SafeRedirectPath(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
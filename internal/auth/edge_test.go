@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSessionManager_EdgeTicket(t *testing.T) {
+	sm := newTestSessionManager(t)
+	ticket, err := sm.IssueEdgeTicket(EdgeIdentity{Host: "app.example.com", Provider: "dashboard", User: "tg:42", Identities: []string{"tg:42"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sm.RedeemEdgeTicket("other.example.com", ticket); err == nil {
+		t.Error("ticket accepted on another host")
+	}
+	id, err := sm.RedeemEdgeTicket("app.example.com", ticket)
+	if err != nil {
+		t.Fatalf("RedeemEdgeTicket() error = %v", err)
+	}
+	if id.User != "tg:42" || id.Provider != "dashboard" {
+		t.Errorf("RedeemEdgeTicket() = %+v", id)
+	}
+	if _, err := sm.RedeemEdgeTicket("app.example.com", ticket); err != ErrEdgeSessionInvalid {
+		t.Errorf("replayed ticket: error = %v, want ErrEdgeSessionInvalid", err)
+	}
+
+	// Tickets without a nonce can't be told apart, so they are refused
+	unmarked, err := sm.sc.Encode(edgeTicketName, EdgeIdentity{Host: "app.example.com", CreatedAt: time.Now().Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sm.RedeemEdgeTicket("app.example.com", unmarked); err != ErrEdgeSessionInvalid {
+		t.Errorf("ticket without a nonce: error = %v, want ErrEdgeSessionInvalid", err)
+	}
+
+	// A ticket is not a cookie, even on its own host
+	r := httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+	r.AddCookie(&http.Cookie{Name: EdgeCookieName, Value: ticket})
+	if _, err := sm.GetEdgeSession(r, "app.example.com"); err == nil {
+		t.Error("ticket accepted as an edge cookie")
+	}
+
+	stale, err := sm.sc.Encode(edgeTicketName, EdgeIdentity{Host: "app.example.com", CreatedAt: time.Now().Add(-time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sm.RedeemEdgeTicket("app.example.com", stale); err != ErrEdgeSessionInvalid {
+		t.Errorf("stale ticket: error = %v, want ErrEdgeSessionInvalid", err)
+	}
+}
+
+func TestSessionManager_EdgeSession(t *testing.T) {
+	sm := newTestSessionManager(t)
+	w := httptest.NewRecorder()
+	if err := sm.SetEdgeSession(w, &EdgeIdentity{Host: "app.example.com", User: "alice@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != EdgeCookieName {
+		t.Fatalf("cookies = %v", cookies)
+	}
+	if cookies[0].Domain != "" || !cookies[0].HttpOnly {
+		t.Errorf("cookie Domain = %q, HttpOnly = %v; want host-only and HttpOnly", cookies[0].Domain, cookies[0].HttpOnly)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+	r.AddCookie(cookies[0])
+	id, err := sm.GetEdgeSession(r, "app.example.com")
+	if err != nil || id.User != "alice@example.com" {
+		t.Errorf("GetEdgeSession() = %+v, %v", id, err)
+	}
+	if _, err := sm.GetEdgeSession(r, "other.example.com"); err == nil {
+		t.Error("cookie accepted on another host")
+	}
+}
+
+func TestSessionManager_EdgeLogin(t *testing.T) {
+	sm := newTestSessionManager(t)
+	w := httptest.NewRecorder()
+	if err := sm.SetEdgeLogin(w, EdgeLogin{Host: "app.example.com", Next: "/docs", State: "xyz"}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "http://app.example.org/", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	login, err := sm.GetEdgeLogin(r)
+	if err != nil || login.Host != "app.example.com" || login.Next != "/docs" || login.State != "xyz" {
+		t.Errorf("GetEdgeLogin() = %+v, %v", login, err)
+	}
+
+	w = httptest.NewRecorder()
+	sm.ClearEdgeLogin(w)
+	if cookies := w.Result().Cookies(); len(cookies) != 1 || cookies[0].MaxAge >= 0 {
+		t.Errorf("ClearEdgeLogin() cookies = %v, want an expired cookie", cookies)
+	}
+}
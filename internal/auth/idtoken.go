@@ -0,0 +1,250 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+// OIDC ID tokens of tunnel login walls are verified here: RS256 and ES256
+// signatures against the provider's JSON Web Key Set, then the claims.
+
+// idTokenLeeway is how far the clocks of the provider and the server may drift apart
+const idTokenLeeway = time.Minute
+
+var (
+	// ErrIDTokenInvalid is returned for ID tokens that are malformed, badly
+	// signed, expired, or issued for another client or login.
+	ErrIDTokenInvalid = errors.New("invalid ID token")
+	// ErrIDTokenKeyUnknown is returned when no key of the key set has the ID
+	// of the token's signing key; the provider may have rotated its keys.
+	ErrIDTokenKeyUnknown = errors.New("ID token signed with an unknown key")
+)
+
+// JWKS holds the signing keys of an OIDC provider by key ID.
+type JWKS map[string]crypto.PublicKey
+
+// jwk is one key of a JSON Web Key Set.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// ParseJWKS reads the RSA and P-256 signing keys of a JSON Web Key Set.
+// Keys of other types and encryption keys are skipped.
+func ParseJWKS(data []byte) (JWKS, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(JWKS)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key crypto.PublicKey
+		var err error
+		switch {
+		case k.Kty == "RSA":
+			key, err = k.rsaKey()
+		case k.Kty == "EC" && k.Crv == "P-256":
+			key, err = k.ecKey()
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no usable signing keys")
+	}
+	return keys, nil
+}
+
+func (k *jwk) rsaKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+	exponent := new(big.Int).SetBytes(e)
+	if len(n) < 256 || !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+		return nil, errors.New("unsupported RSA key")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+}
+
+func (k *jwk) ecKey() (*ecdsa.PublicKey, error) {
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil {
+		return nil, err
+	}
+	if len(x) != 32 || len(y) != 32 {
+		return nil, errors.New("bad P-256 coordinates")
+	}
+	// crypto/ecdh rejects points that are not on the curve
+	if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+		return nil, err
+	}
+	return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+}
+
+// IDTokenClaims are the claims of an ID token used by login walls.
+type IDTokenClaims struct {
+	Issuer          string   `json:"iss"`
+	Subject         string   `json:"sub"`
+	Audience        audience `json:"aud"`
+	AuthorizedParty string   `json:"azp"`
+	Expiry          int64    `json:"exp"`
+	IssuedAt        int64    `json:"iat"`
+	Nonce           string   `json:"nonce"`
+	Email           string   `json:"email"`
+	EmailVerified   flexBool `json:"email_verified"`
+}
+
+// audience is the aud claim, which is either a string or a list of them.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// flexBool accepts booleans sent as JSON strings, as some providers do for
+// email_verified.
+type flexBool bool
+
+func (b *flexBool) UnmarshalJSON(data []byte) error {
+	switch string(data) {
+	case "true", `"true"`:
+		*b = true
+	case "false", `"false"`, "null":
+		*b = false
+	default:
+		return fmt.Errorf("invalid boolean %s", data)
+	}
+	return nil
+}
+
+// VerifyIDToken checks that raw is signed by one of keys, was issued by
+// issuer to clientID for the login that sent nonce, and has not expired.
+// ErrIDTokenKeyUnknown means the key set should be fetched again.
+func VerifyIDToken(raw string, keys JWKS, issuer, clientID, nonce string) (*IDTokenClaims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, ErrIDTokenInvalid
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrIDTokenInvalid
+	}
+	key, ok := keys[header.Kid]
+	if !ok {
+		if header.Kid != "" || len(keys) != 1 {
+			return nil, ErrIDTokenKeyUnknown
+		}
+		// A provider with a single key may leave out the key ID
+		for _, only := range keys {
+			key = only
+		}
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrIDTokenInvalid
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if !verifySignature(header.Alg, key, digest[:], sig) {
+		return nil, ErrIDTokenInvalid
+	}
+
+	var claims IDTokenClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrIDTokenInvalid
+	}
+	now := time.Now()
+	switch {
+	case claims.Issuer != issuer, claims.Subject == "":
+		return nil, ErrIDTokenInvalid
+	case !slices.Contains(claims.Audience, clientID):
+		return nil, ErrIDTokenInvalid
+	case len(claims.Audience) > 1 && claims.AuthorizedParty != clientID:
+		return nil, ErrIDTokenInvalid
+	case claims.AuthorizedParty != "" && claims.AuthorizedParty != clientID:
+		return nil, ErrIDTokenInvalid
+	case !now.Before(time.Unix(claims.Expiry, 0).Add(idTokenLeeway)):
+		return nil, ErrIDTokenInvalid
+	case time.Unix(claims.IssuedAt, 0).After(now.Add(idTokenLeeway)):
+		return nil, ErrIDTokenInvalid
+	case nonce == "" || claims.Nonce != nonce:
+		return nil, ErrIDTokenInvalid
+	}
+	return &claims, nil
+}
+
+// verifySignature checks a SHA-256 signature made with alg. Algorithms other
+// than RS256 and ES256, "none" among them, are refused.
+func verifySignature(alg string, key crypto.PublicKey, digest, sig []byte) bool {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return alg == "RS256" && rsa.VerifyPKCS1v15(k, crypto.SHA256, digest, sig) == nil
+	case *ecdsa.PublicKey:
+		if alg != "ES256" || len(sig) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(k, digest, r, s)
+	}
+	return false
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,181 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testIssuer   = "https://id.example.com"
+	testClientID = "gopublic"
+)
+
+// signIDToken signs claims with key, which is an *rsa.PrivateKey or an *ecdsa.PrivateKey.
+func signIDToken(t *testing.T, key crypto.Signer, kid string, claims map[string]any) string {
+	t.Helper()
+	alg := "RS256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func validClaims() map[string]any {
+	now := time.Now()
+	return map[string]any{
+		"iss":            testIssuer,
+		"sub":            "248289761001",
+		"aud":            testClientID,
+		"exp":            now.Add(time.Hour).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          "n-0S6_WzA2Mj",
+		"email":          "jane@example.com",
+		"email_verified": true,
+	}
+}
+
+func TestParseJWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	set, _ := json.Marshal(map[string]any{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "r1", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "e1", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": b64(rsaKey.N.Bytes()), "e": "AQAB"},
+		{"kty": "oct", "kid": "hmac", "k": "c2VjcmV0"},
+	}})
+
+	keys, err := ParseJWKS(set)
+	if err != nil {
+		t.Fatalf("ParseJWKS() error = %v", err)
+	}
+	if len(keys) != 2 || keys["r1"] == nil || keys["e1"] == nil {
+		t.Errorf("ParseJWKS() = %v, want the RSA and EC signing keys", keys)
+	}
+
+	// A point off the curve is refused
+	bad, _ := json.Marshal(map[string]any{"keys": []map[string]string{
+		{"kty": "EC", "kid": "e1", "crv": "P-256", "x": b64(make([]byte, 32)), "y": b64(make([]byte, 32))},
+	}})
+	if _, err := ParseJWKS(bad); err == nil {
+		t.Error("ParseJWKS() accepted a point that is not on the curve")
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := JWKS{"r1": &rsaKey.PublicKey, "e1": &ecKey.PublicKey}
+	nonce := validClaims()["nonce"].(string)
+
+	for _, tc := range []struct {
+		name string
+		key  crypto.Signer
+		kid  string
+	}{{"RS256", rsaKey, "r1"}, {"ES256", ecKey, "e1"}} {
+		claims, err := VerifyIDToken(signIDToken(t, tc.key, tc.kid, validClaims()), keys, testIssuer, testClientID, nonce)
+		if err != nil {
+			t.Fatalf("%s: VerifyIDToken() error = %v", tc.name, err)
+		}
+		if claims.Subject != "248289761001" || claims.Email != "jane@example.com" || !claims.EmailVerified {
+			t.Errorf("%s: VerifyIDToken() = %+v", tc.name, claims)
+		}
+	}
+
+	if _, err := VerifyIDToken(signIDToken(t, rsaKey, "r2", validClaims()), keys, testIssuer, testClientID, nonce); !errors.Is(err, ErrIDTokenKeyUnknown) {
+		t.Errorf("unknown key: error = %v, want ErrIDTokenKeyUnknown", err)
+	}
+
+	// A token signed by someone else under a known key ID
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyIDToken(signIDToken(t, otherKey, "r1", validClaims()), keys, testIssuer, testClientID, nonce); !errors.Is(err, ErrIDTokenInvalid) {
+		t.Errorf("forged signature: error = %v, want ErrIDTokenInvalid", err)
+	}
+
+	// Unsigned tokens are refused
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"r1"}`))
+	payload := strings.Split(signIDToken(t, rsaKey, "r1", validClaims()), ".")[1]
+	if _, err := VerifyIDToken(header+"."+payload+".", keys, testIssuer, testClientID, nonce); !errors.Is(err, ErrIDTokenInvalid) {
+		t.Errorf("alg none: error = %v, want ErrIDTokenInvalid", err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(map[string]any)
+	}{
+		{"other issuer", func(c map[string]any) { c["iss"] = "https://evil.example.com" }},
+		{"other client", func(c map[string]any) { c["aud"] = "someone-else" }},
+		{"several audiences without azp", func(c map[string]any) { c["aud"] = []string{testClientID, "someone-else"} }},
+		{"other authorized party", func(c map[string]any) { c["azp"] = "someone-else" }},
+		{"expired", func(c map[string]any) { c["exp"] = time.Now().Add(-2 * idTokenLeeway).Unix() }},
+		{"issued in the future", func(c map[string]any) { c["iat"] = time.Now().Add(2 * idTokenLeeway).Unix() }},
+		{"other login", func(c map[string]any) { c["nonce"] = "replayed" }},
+		{"no nonce", func(c map[string]any) { delete(c, "nonce") }},
+		{"no subject", func(c map[string]any) { delete(c, "sub") }},
+	}
+	for _, tt := range tests {
+		claims := validClaims()
+		tt.change(claims)
+		if _, err := VerifyIDToken(signIDToken(t, rsaKey, "r1", claims), keys, testIssuer, testClientID, nonce); !errors.Is(err, ErrIDTokenInvalid) {
+			t.Errorf("%s: error = %v, want ErrIDTokenInvalid", tt.name, err)
+		}
+	}
+
+	// Several audiences are fine when the token names this client as azp
+	claims := validClaims()
+	claims["aud"] = []string{testClientID, "someone-else"}
+	claims["azp"] = testClientID
+	claims["email_verified"] = "true"
+	got, err := VerifyIDToken(signIDToken(t, ecKey, "e1", claims), keys, testIssuer, testClientID, nonce)
+	if err != nil {
+		t.Fatalf("several audiences with azp: error = %v", err)
+	}
+	if !got.EmailVerified {
+		t.Error("email_verified sent as a string was not read")
+	}
+}
@@ -31,7 +31,8 @@ type SessionConfig struct {
 // SessionManager handles secure cookie encoding/decoding
 type SessionManager struct {
 	sc       *securecookie.SecureCookie
-	isSecure bool // Whether to set Secure flag on cookies
+	isSecure bool             // Whether to set Secure flag on cookies
+	tickets  *redeemedTickets // Edge tickets already traded for a cookie
 }
 
 // SessionData represents the data stored in session cookie
@@ -73,6 +74,7 @@ func NewSessionManager(cfg SessionConfig) (*SessionManager, error) {
 	return &SessionManager{
 		sc:       sc,
 		isSecure: cfg.IsSecure,
+		tickets:  newRedeemedTickets(),
 	}, nil
 }
 
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 
 	"gopublic/internal/client/config"
@@ -15,6 +16,7 @@ import (
 	"gopublic/internal/client/stats"
 	"gopublic/internal/client/tui"
 	"gopublic/internal/client/tunnel"
+	"gopublic/internal/client/updater"
 	"gopublic/internal/version"
 
 	tea "github.com/charmbracelet/bubbletea"
@@ -51,22 +53,43 @@ func Execute() {
 
 var authCmd = &cobra.Command{
 	Use:   "auth [token]",
-	Short: "Save authentication token",
-	Args:  cobra.ExactArgs(1),
+	Short: "Save authentication token or device certificate",
+	Args:  cobra.MaximumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		token := args[0]
+		certFile, _ := cmd.Flags().GetString("cert")
+		if len(args) == 0 && certFile == "" {
+			fmt.Fprintln(os.Stderr, "Provide a token or --cert <file> from the dashboard")
+			os.Exit(1)
+		}
 		cfg, err := config.LoadConfig()
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
 			os.Exit(1)
 		}
-		cfg.Token = token
+		if len(args) == 1 {
+			cfg.Token = args[0]
+		}
+		if certFile != "" {
+			// Stored absolute so start works from any directory
+			if cfg.Cert, err = filepath.Abs(certFile); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			if _, err := cfg.ClientCertificate(); err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid device certificate: %v\n", err)
+				os.Exit(1)
+			}
+		}
 		if err := config.SaveConfig(cfg); err != nil {
 			fmt.Fprintf(os.Stderr, "Error saving config: %v\n", err)
 			os.Exit(1)
 		}
 		path, _ := config.GetConfigPath()
-		fmt.Printf("Token saved to %s\n", path)
+		if certFile != "" {
+			fmt.Printf("Device certificate %s saved to %s\n", cfg.Cert, path)
+		} else {
+			fmt.Printf("Token saved to %s\n", path)
+		}
 	},
 }
 
@@ -78,11 +101,16 @@ var startCmd = &cobra.Command{
 }
 
 func init() {
+	authCmd.Flags().String("cert", "", "Device certificate file downloaded from the dashboard")
+
 	startCmd.Flags().BoolP("all", "a", false, "Start all tunnels from gopublic.yaml")
 	startCmd.Flags().Bool("tui", true, "Enable terminal UI (default: true for interactive terminals)")
 	startCmd.Flags().Bool("no-tui", false, "Disable terminal UI")
-	startCmd.Flags().BoolP("force", "f", false, "Force connect, replacing any existing session")
+	startCmd.Flags().BoolP("force", "f", false, "Force connect, taking over domains served by another session")
 	startCmd.Flags().Bool("no-cache", false, "Add Cache-Control: no-store header to all responses (useful for development)")
+	startCmd.Flags().Bool("shared", false, "Serve the domains together with other --shared clients of your account (load balanced)")
+	startCmd.Flags().Bool("ephemeral", false, "Use a random throwaway domain that lives only while the tunnel runs")
+	startCmd.Flags().Bool("quic", false, "Connect over QUIC (UDP), falling back to TCP when UDP is blocked")
 }
 
 func runStart(cmd *cobra.Command, args []string) {
@@ -92,14 +120,32 @@ func runStart(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 
-	if cfg.Token == "" {
+	if cfg.Token == "" && cfg.Cert == "" {
 		fmt.Fprintln(os.Stderr, "No token found. Run 'gopublic auth <token>' first.")
 		os.Exit(1)
 	}
+	if _, err := cfg.ClientCertificate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading device certificate: %v\n", err)
+		os.Exit(1)
+	}
+
+	proxyURL, err := cfg.ProxyURL()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		os.Exit(1)
+	}
+	updater.SetProxy(proxyURL)
 
 	// Get flags
 	forceFlag, _ := cmd.Flags().GetBool("force")
 	noCacheFlag, _ := cmd.Flags().GetBool("no-cache")
+	sharedFlag, _ := cmd.Flags().GetBool("shared")
+	ephemeralFlag, _ := cmd.Flags().GetBool("ephemeral")
+	quicFlag, _ := cmd.Flags().GetBool("quic")
+	if ephemeralFlag && len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "--ephemeral needs a port, e.g. 'gopublic start 3000 --ephemeral'")
+		os.Exit(1)
+	}
 
 	// Check local lock file
 	if err := config.AcquireLock(); err != nil {
@@ -154,11 +200,11 @@ func runStart(cmd *cobra.Command, args []string) {
 
 	if projectErr == nil && (allFlag || len(args) == 0) {
 		// Multi-tunnel mode from gopublic.yaml
-		runMultiTunnel(ctx, cfg, projectCfg, eventBus, statsTracker, useTUI, forceFlag, noCacheFlag)
+		runMultiTunnel(ctx, cfg, projectCfg, eventBus, statsTracker, useTUI, forceFlag, noCacheFlag, sharedFlag, quicFlag)
 	} else if len(args) == 1 {
 		// Single tunnel mode
 		port := args[0]
-		runSingleTunnel(ctx, cfg, port, eventBus, statsTracker, useTUI, forceFlag, noCacheFlag)
+		runSingleTunnel(ctx, cfg, port, eventBus, statsTracker, useTUI, forceFlag, noCacheFlag, sharedFlag, ephemeralFlag, quicFlag)
 	} else {
 		fmt.Fprintln(os.Stderr, "Either provide a port or create gopublic.yaml config file")
 		os.Exit(1)
@@ -189,7 +235,7 @@ func shouldUseTUI(cmd *cobra.Command) bool {
 	return true
 }
 
-func runSingleTunnel(ctx context.Context, cfg *config.Config, port string, eventBus *events.Bus, statsTracker *stats.Stats, useTUI bool, force bool, noCache bool) {
+func runSingleTunnel(ctx context.Context, cfg *config.Config, port string, eventBus *events.Bus, statsTracker *stats.Stats, useTUI bool, force bool, noCache bool, shared bool, ephemeral bool, quic bool) {
 	// Configure replay with local port
 	inspector.SetLocalPort(port)
 
@@ -199,6 +245,13 @@ func runSingleTunnel(ctx context.Context, cfg *config.Config, port string, event
 	t.SetStats(statsTracker)
 	t.SetForce(force)
 	t.SetNoCache(noCache)
+	t.SetShared(shared)
+	t.SetEphemeral(ephemeral)
+	t.SetQUIC(quic)
+	proxyURL, _ := cfg.ProxyURL() // Checked in runStart
+	t.SetProxy(proxyURL)
+	clientCert, _ := cfg.ClientCertificate() // Checked in runStart
+	t.SetClientCert(clientCert)
 
 	if useTUI {
 		// Run with TUI
@@ -219,21 +272,44 @@ func runSingleTunnel(ctx context.Context, cfg *config.Config, port string, event
 	}
 }
 
-func runMultiTunnel(ctx context.Context, cfg *config.Config, projectCfg *config.ProjectConfig, eventBus *events.Bus, statsTracker *stats.Stats, useTUI bool, force bool, noCache bool) {
+func runMultiTunnel(ctx context.Context, cfg *config.Config, projectCfg *config.ProjectConfig, eventBus *events.Bus, statsTracker *stats.Stats, useTUI bool, force bool, noCache bool, shared bool, quic bool) {
 	manager := tunnel.NewTunnelManager(ServerAddr, cfg.Token)
 	manager.SetForce(force)
 	manager.SetEventBus(eventBus)
 	manager.SetStats(statsTracker)
 	manager.SetNoCache(noCache)
-
-	// Set first tunnel port for replay
+	manager.SetShared(shared)
+	manager.SetQUIC(quic)
+	proxyURL, _ := cfg.ProxyURL() // Checked in runStart
+	manager.SetProxy(proxyURL)
+	clientCert, _ := cfg.ClientCertificate() // Checked in runStart
+	manager.SetClientCert(clientCert)
+
+	// Set first HTTP tunnel port for replay
 	for _, t := range projectCfg.Tunnels {
+		if t.Proto == "tcp" || t.Proto == "udp" || t.Proto == "tls" {
+			continue
+		}
 		inspector.SetLocalPort(t.Addr)
 		break
 	}
 
 	for name, t := range projectCfg.Tunnels {
-		manager.AddTunnel(name, t.Addr, t.Subdomain)
+		if t.Access != nil && (t.Proto == "tcp" || t.Proto == "udp" || t.Proto == "tls") {
+			fmt.Fprintf(os.Stderr, "Warning: tunnel '%s': access policies only apply to HTTP tunnels and are ignored\n", name)
+		}
+		switch t.Proto {
+		case "tcp":
+			manager.AddTCPTunnel(name, t.Addr)
+			continue
+		case "udp":
+			manager.AddUDPTunnel(name, t.Addr)
+			continue
+		case "tls":
+			manager.AddTLSTunnel(name, t.Addr, t.Subdomain, t.Cert, t.Key)
+			continue
+		}
+		manager.AddTunnel(name, t.Addr, t.Subdomain, t.Access.Policy())
 	}
 
 	if useTUI {
@@ -99,9 +99,12 @@ func TestAuthCmd_Help(t *testing.T) {
 	if authCmd.Use != "auth [token]" {
 		t.Errorf("expected Use 'auth [token]', got '%s'", authCmd.Use)
 	}
-	if authCmd.Short != "Save authentication token" {
+	if authCmd.Short != "Save authentication token or device certificate" {
 		t.Errorf("unexpected Short: %s", authCmd.Short)
 	}
+	if authCmd.Flags().Lookup("cert") == nil {
+		t.Error("expected 'cert' flag to be registered")
+	}
 }
 
 func TestStartCmd_Help(t *testing.T) {
@@ -30,6 +30,14 @@ const (
 
 	// Tunnel info events
 	EventTunnelReady
+	EventTunnelRemoved
+
+	// Control stream events (pushed by the server after the handshake)
+	EventUsageUpdate
+	EventQuotaWarning
+	EventAnnouncement
+	EventServerDisconnect
+	EventLatency
 )
 
 // String returns a human-readable name for the event type.
@@ -55,6 +63,18 @@ func (t EventType) String() string {
 		return "log"
 	case EventTunnelReady:
 		return "tunnel_ready"
+	case EventTunnelRemoved:
+		return "tunnel_removed"
+	case EventUsageUpdate:
+		return "usage_update"
+	case EventQuotaWarning:
+		return "quota_warning"
+	case EventAnnouncement:
+		return "announcement"
+	case EventServerDisconnect:
+		return "server_disconnect"
+	case EventLatency:
+		return "latency"
 	default:
 		return "unknown"
 	}
@@ -107,6 +127,42 @@ type TunnelReadyData struct {
 	Scheme       string
 }
 
+// TunnelRemovedData contains data for EventTunnelRemoved.
+type TunnelRemovedData struct {
+	Name string
+}
+
+// UsageData contains data for EventUsageUpdate.
+type UsageData struct {
+	BandwidthToday int64 // Bytes used today
+	BandwidthTotal int64 // Total bytes used all time
+	BandwidthLimit int64 // Daily bandwidth limit in bytes
+}
+
+// QuotaWarningData contains data for EventQuotaWarning.
+type QuotaWarningData struct {
+	Used     int64
+	Limit    int64
+	Exceeded bool // Public URLs answer 429 until the limit resets
+}
+
+// AnnouncementData contains data for EventAnnouncement.
+type AnnouncementData struct {
+	Level   string // "info" or "warn"
+	Message string
+}
+
+// ServerDisconnectData contains data for EventServerDisconnect.
+type ServerDisconnectData struct {
+	Reason  string
+	Message string
+}
+
+// LatencyData contains data for EventLatency.
+type LatencyData struct {
+	RTT time.Duration
+}
+
 // LogData contains data for EventLog.
 type LogData struct {
 	Level   string // "info", "warn", "error"
@@ -261,6 +261,12 @@ func TestEventTypeString(t *testing.T) {
 		{EventRequestComplete, "request_complete"},
 		{EventError, "error"},
 		{EventTunnelReady, "tunnel_ready"},
+		{EventTunnelRemoved, "tunnel_removed"},
+		{EventUsageUpdate, "usage_update"},
+		{EventQuotaWarning, "quota_warning"},
+		{EventAnnouncement, "announcement"},
+		{EventServerDisconnect, "server_disconnect"},
+		{EventLatency, "latency"},
 		{EventType(999), "unknown"},
 	}
 
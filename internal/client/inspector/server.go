@@ -27,12 +27,13 @@ type HTTPExchange struct {
 
 // HTTPRequest captures request details
 type HTTPRequest struct {
-	Method  string              `json:"method"`
-	URL     string              `json:"url"`
-	Proto   string              `json:"proto"`
-	Headers map[string][]string `json:"headers"`
-	Body    string              `json:"body"`
-	Size    int64               `json:"size"`
+	Method     string              `json:"method"`
+	URL        string              `json:"url"`
+	Proto      string              `json:"proto"`
+	Headers    map[string][]string `json:"headers"`
+	Body       string              `json:"body"`
+	Size       int64               `json:"size"`
+	RemoteAddr string              `json:"remote_addr,omitempty"` // Public visitor, when the server sent it
 }
 
 // HTTPResponse captures response details
@@ -110,12 +111,13 @@ func (s *Server) AddExchange(req *http.Request, reqBody []byte, resp *http.Respo
 		Timestamp: time.Now(),
 		Duration:  duration.Milliseconds(),
 		Request: &HTTPRequest{
-			Method:  req.Method,
-			URL:     req.URL.String(),
-			Proto:   req.Proto,
-			Headers: req.Header,
-			Body:    truncateBody(reqBody),
-			Size:    int64(len(reqBody)),
+			Method:     req.Method,
+			URL:        req.URL.String(),
+			Proto:      req.Proto,
+			Headers:    req.Header,
+			Body:       truncateBody(reqBody),
+			Size:       int64(len(reqBody)),
+			RemoteAddr: req.RemoteAddr,
 		},
 	}
 
@@ -304,12 +306,13 @@ func AddExchange(req *http.Request, reqBody []byte, resp *http.Response, respBod
 		Timestamp: time.Now(),
 		Duration:  duration.Milliseconds(),
 		Request: &HTTPRequest{
-			Method:  req.Method,
-			URL:     req.URL.String(),
-			Proto:   req.Proto,
-			Headers: req.Header,
-			Body:    truncateBody(reqBody),
-			Size:    int64(len(reqBody)),
+			Method:     req.Method,
+			URL:        req.URL.String(),
+			Proto:      req.Proto,
+			Headers:    req.Header,
+			Body:       truncateBody(reqBody),
+			Size:       int64(len(reqBody)),
+			RemoteAddr: req.RemoteAddr,
 		},
 	}
 
@@ -280,6 +280,16 @@ func (m Model) handleEvent(event events.Event) Model {
 			}
 		}
 
+	case events.EventTunnelRemoved:
+		if data, ok := event.Data.(events.TunnelRemovedData); ok {
+			for i, t := range m.tunnels {
+				if t.Name == data.Name {
+					m.tunnels = append(m.tunnels[:i], m.tunnels[i+1:]...)
+					break
+				}
+			}
+		}
+
 	case events.EventRequestComplete:
 		if data, ok := event.Data.(events.RequestData); ok {
 			entry := RequestEntry{
@@ -302,34 +312,69 @@ func (m Model) handleEvent(event events.Event) Model {
 		if data, ok := event.Data.(events.ErrorData); ok {
 			m.lastError = fmt.Sprintf("%s: %v", data.Context, data.Error)
 			// Also add to logs
-			entry := LogEntry{
-				Level:   "error",
-				Message: m.lastError,
-				Time:    time.Now(),
-			}
-			m.logs = append([]LogEntry{entry}, m.logs...)
-			if len(m.logs) > m.maxLogs {
-				m.logs = m.logs[:m.maxLogs]
-			}
+			m = m.addLog("error", m.lastError)
 		}
 
 	case events.EventLog:
 		if data, ok := event.Data.(events.LogData); ok {
-			entry := LogEntry{
-				Level:   data.Level,
-				Message: data.Message,
-				Time:    time.Now(),
+			m = m.addLog(data.Level, data.Message)
+		}
+
+	case events.EventLatency:
+		if data, ok := event.Data.(events.LatencyData); ok {
+			m.serverLatency = data.RTT
+		}
+
+	case events.EventUsageUpdate:
+		if data, ok := event.Data.(events.UsageData); ok {
+			// Server figures already include this session's traffic
+			m.serverBandwidthToday = data.BandwidthToday
+			m.serverBandwidthTotal = data.BandwidthTotal
+			m.serverBandwidthLimit = data.BandwidthLimit
+			m.sessionBandwidth = 0
+		}
+
+	case events.EventQuotaWarning:
+		if data, ok := event.Data.(events.QuotaWarningData); ok {
+			if data.Exceeded {
+				m = m.addLog("warn", "Дневной лимит трафика исчерпан: внешний URL тоннеля будет отдавать 429 до завтра.")
+			} else {
+				m = m.addLog("warn", fmt.Sprintf("Использовано %s из %s дневного лимита трафика.", formatBytesShort(data.Used), formatBytesShort(data.Limit)))
 			}
-			m.logs = append([]LogEntry{entry}, m.logs...)
-			if len(m.logs) > m.maxLogs {
-				m.logs = m.logs[:m.maxLogs]
+		}
+
+	case events.EventAnnouncement:
+		if data, ok := event.Data.(events.AnnouncementData); ok {
+			level := data.Level
+			if level == "" {
+				level = "info"
 			}
+			m = m.addLog(level, "Сервер: "+data.Message)
+		}
+
+	case events.EventServerDisconnect:
+		if data, ok := event.Data.(events.ServerDisconnectData); ok {
+			m = m.addLog("warn", data.Message)
 		}
 	}
 
 	return m
 }
 
+// addLog prepends a log entry, keeping at most maxLogs entries.
+func (m Model) addLog(level, message string) Model {
+	entry := LogEntry{
+		Level:   level,
+		Message: message,
+		Time:    time.Now(),
+	}
+	m.logs = append([]LogEntry{entry}, m.logs...)
+	if len(m.logs) > m.maxLogs {
+		m.logs = m.logs[:m.maxLogs]
+	}
+	return m
+}
+
 // View renders the model
 func (m Model) View() string {
 	var b strings.Builder
@@ -453,6 +498,12 @@ func (m Model) renderForwarding() string {
 
 			url := fmt.Sprintf("%s://%s", t.Scheme, domain)
 			local := fmt.Sprintf("http://localhost:%s", t.LocalPort)
+			if t.Scheme == "tcp" || t.Scheme == "udp" {
+				local = t.LocalPort
+				if !strings.Contains(local, ":") {
+					local = "localhost:" + local
+				}
+			}
 
 			value := urlStyle.Render(url) + arrowStyle.Render(" -> ") + valueStyle.Render(local)
 			lines = append(lines, labelStyle.Render(label)+value)
@@ -257,6 +257,46 @@ func TestModel_HandleEvent_Error(t *testing.T) {
 	}
 }
 
+func TestModel_HandleEvent_UsageUpdate(t *testing.T) {
+	model := NewModel(nil, nil)
+	model.sessionBandwidth = 500
+
+	model = model.handleEvent(events.Event{
+		Type: events.EventUsageUpdate,
+		Data: events.UsageData{BandwidthToday: 1000, BandwidthTotal: 5000, BandwidthLimit: 10000},
+	})
+
+	if model.serverBandwidthToday != 1000 || model.serverBandwidthLimit != 10000 {
+		t.Errorf("unexpected bandwidth: today=%d limit=%d", model.serverBandwidthToday, model.serverBandwidthLimit)
+	}
+	if model.sessionBandwidth != 0 {
+		t.Errorf("expected session bandwidth reset, got %d", model.sessionBandwidth)
+	}
+}
+
+func TestModel_HandleEvent_ControlMessagesLogged(t *testing.T) {
+	model := NewModel(nil, nil)
+
+	model = model.handleEvent(events.Event{
+		Type: events.EventQuotaWarning,
+		Data: events.QuotaWarningData{Used: 100, Limit: 100, Exceeded: true},
+	})
+	model = model.handleEvent(events.Event{
+		Type: events.EventAnnouncement,
+		Data: events.AnnouncementData{Level: "info", Message: "maintenance at 22:00"},
+	})
+
+	if len(model.logs) != 2 {
+		t.Fatalf("expected 2 log entries, got %d", len(model.logs))
+	}
+	if !strings.Contains(model.logs[0].Message, "maintenance at 22:00") {
+		t.Errorf("expected newest log to be the announcement, got %q", model.logs[0].Message)
+	}
+	if model.logs[1].Level != "warn" {
+		t.Errorf("expected quota warning at warn level, got %q", model.logs[1].Level)
+	}
+}
+
 func TestModel_View_ContainsHeader(t *testing.T) {
 	model := NewModel(nil, nil)
 	model.width = 80
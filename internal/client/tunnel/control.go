@@ -0,0 +1,310 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gopublic/internal/client/events"
+	"gopublic/internal/client/logger"
+	"gopublic/internal/client/stats"
+	"gopublic/pkg/protocol"
+)
+
+// controlPingInterval is how often the client measures latency over the control stream.
+const controlPingInterval = 30 * time.Second
+
+// controlRequestTimeout bounds how long a bind/release waits for its result.
+const controlRequestTimeout = 10 * time.Second
+
+// controlFinishTimeout bounds how long a closed session waits for the
+// control stream to read what the server sent last.
+const controlFinishTimeout = time.Second
+
+var errControlClosed = errors.New("control stream closed")
+
+// controlStream is the client side of the control channel: the handshake
+// stream kept open after InitResponse for typed messages from the server.
+type controlStream struct {
+	stream  net.Conn
+	decoder *json.Decoder // Handshake decoder; may already hold buffered messages
+	publish func(events.EventType, interface{})
+	stats   *stats.Stats
+
+	mu      sync.Mutex // Serializes writes
+	enc     *json.Encoder
+	seq     uint64
+	pending map[uint64]chan *protocol.ControlMessage // Bind/release waiting for a result
+	closed  bool
+	// goingAway is the shutdown notice of a draining server, if one arrived
+	goingAway *protocol.Disconnect
+	// closedBy is the notice of a session policy closing the session, if one arrived
+	closedBy *protocol.Disconnect
+	done     chan struct{} // Closed when run returns
+}
+
+func newControlStream(stream net.Conn, decoder *json.Decoder, publish func(events.EventType, interface{}), s *stats.Stats) *controlStream {
+	return &controlStream{
+		stream:  stream,
+		decoder: decoder,
+		publish: publish,
+		stats:   s,
+		enc:     json.NewEncoder(stream),
+		pending: make(map[uint64]chan *protocol.ControlMessage),
+		done:    make(chan struct{}),
+	}
+}
+
+// run reads control messages until the stream closes, pinging the server
+// periodically to measure latency.
+func (c *controlStream) run() {
+	defer close(c.done)
+	defer c.failPending()
+	go c.pingLoop(c.done)
+
+	for {
+		var msg protocol.ControlMessage
+		if err := c.decoder.Decode(&msg); err != nil {
+			return
+		}
+		c.handle(&msg)
+	}
+}
+
+func (c *controlStream) pingLoop(done <-chan struct{}) {
+	ticker := time.NewTicker(controlPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := c.ping(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *controlStream) ping() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	return c.enc.Encode(&protocol.ControlMessage{
+		Type:   protocol.ControlPing,
+		Seq:    c.seq,
+		SentAt: time.Now().UnixNano(),
+	})
+}
+
+func (c *controlStream) send(msg *protocol.ControlMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.enc.Encode(msg)
+}
+
+// request sends a bind or release and waits for the result with the same Seq.
+func (c *controlStream) request(msgType protocol.ControlType, domain string) (*protocol.ControlMessage, error) {
+	return c.requestWithin(msgType, domain, controlRequestTimeout)
+}
+
+// notifyClose tells the server the client is shutting down, so it releases
+// the domains when the session closes instead of holding them for a
+// reconnect. It waits briefly for the server to take note; without an
+// answer the server treats the closed session as lost, as before.
+func (c *controlStream) notifyClose() {
+	c.requestWithin(protocol.ControlClose, "", controlFinishTimeout)
+}
+
+func (c *controlStream) requestWithin(msgType protocol.ControlType, domain string, timeout time.Duration) (*protocol.ControlMessage, error) {
+	result := make(chan *protocol.ControlMessage, 1)
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, errControlClosed
+	}
+	c.seq++
+	seq := c.seq
+	c.pending[seq] = result
+	err := c.enc.Encode(&protocol.ControlMessage{Type: msgType, Seq: seq, Domain: domain})
+	c.mu.Unlock()
+
+	if err != nil {
+		c.dropPending(seq)
+		return nil, err
+	}
+
+	select {
+	case msg, ok := <-result:
+		if !ok {
+			return nil, errControlClosed
+		}
+		if msg.Error != "" {
+			return nil, errors.New(msg.Error)
+		}
+		return msg, nil
+	case <-time.After(timeout):
+		c.dropPending(seq)
+		return nil, fmt.Errorf("no answer to %s %s from server", msgType, domain)
+	}
+}
+
+func (c *controlStream) dropPending(seq uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, seq)
+}
+
+// failPending wakes up every request still waiting once the stream is gone.
+func (c *controlStream) failPending() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for seq, ch := range c.pending {
+		close(ch)
+		delete(c.pending, seq)
+	}
+}
+
+// finish waits for run to read the messages the server sent before the
+// session closed, so a disconnect notice isn't missed.
+func (c *controlStream) finish() {
+	select {
+	case <-c.done:
+	case <-time.After(controlFinishTimeout):
+	}
+}
+
+// goingAwayError returns a GoingAwayError once the server announced it is
+// shutting down, or nil.
+func (c *controlStream) goingAwayError() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.goingAway == nil {
+		return nil
+	}
+	return &GoingAwayError{
+		Message:     c.goingAway.Message,
+		ReconnectIn: time.Duration(c.goingAway.ReconnectIn) * time.Second,
+	}
+}
+
+// sessionClosedError returns a SessionClosedError once the server said a
+// session policy is closing the session, or nil.
+func (c *controlStream) sessionClosedError() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closedBy == nil {
+		return nil
+	}
+	return &SessionClosedError{Code: c.closedBy.Code, Message: c.closedBy.Message}
+}
+
+// handle turns a control message into an event.
+func (c *controlStream) handle(msg *protocol.ControlMessage) {
+	switch msg.Type {
+	case protocol.ControlPing:
+		c.send(&protocol.ControlMessage{Type: protocol.ControlPong, Seq: msg.Seq, SentAt: msg.SentAt})
+
+	case protocol.ControlPong:
+		rtt := time.Since(time.Unix(0, msg.SentAt))
+		if c.stats != nil {
+			c.stats.SetServerLatency(rtt)
+		}
+		c.publish(events.EventLatency, events.LatencyData{RTT: rtt})
+
+	case protocol.ControlResult:
+		c.mu.Lock()
+		ch, ok := c.pending[msg.Seq]
+		delete(c.pending, msg.Seq)
+		c.mu.Unlock()
+		if ok {
+			ch <- msg
+		}
+
+	case protocol.ControlUsage:
+		if msg.Usage == nil {
+			return
+		}
+		c.publish(events.EventUsageUpdate, events.UsageData{
+			BandwidthToday: msg.Usage.BandwidthToday,
+			BandwidthTotal: msg.Usage.BandwidthTotal,
+			BandwidthLimit: msg.Usage.BandwidthLimit,
+		})
+
+	case protocol.ControlQuotaWarning:
+		if msg.Quota == nil {
+			return
+		}
+		if msg.Quota.Exceeded {
+			logger.Warn("Daily bandwidth limit exceeded: public URLs will answer 429 until tomorrow")
+		} else {
+			logger.Warn("Daily bandwidth usage is at %d of %d bytes", msg.Quota.Used, msg.Quota.Limit)
+		}
+		c.publish(events.EventQuotaWarning, events.QuotaWarningData{
+			Used:     msg.Quota.Used,
+			Limit:    msg.Quota.Limit,
+			Exceeded: msg.Quota.Exceeded,
+		})
+
+	case protocol.ControlAnnouncement:
+		if msg.Announcement == nil {
+			return
+		}
+		logger.Info("Server announcement: %s", msg.Announcement.Message)
+		c.publish(events.EventAnnouncement, events.AnnouncementData{
+			Level:   msg.Announcement.Level,
+			Message: msg.Announcement.Message,
+		})
+
+	case protocol.ControlDisconnect:
+		if msg.Disconnect == nil {
+			return
+		}
+		logger.Warn("Server is closing the session (%s): %s", msg.Disconnect.Reason, msg.Disconnect.Message)
+		c.mu.Lock()
+		switch msg.Disconnect.Reason {
+		case protocol.DisconnectShutdown:
+			c.goingAway = msg.Disconnect
+		case protocol.DisconnectPolicy:
+			c.closedBy = msg.Disconnect
+		}
+		c.mu.Unlock()
+		c.publish(events.EventServerDisconnect, events.ServerDisconnectData{
+			Reason:  msg.Disconnect.Reason,
+			Message: msg.Disconnect.Message,
+		})
+	}
+}
+
+// isLegacyQuotaRequest reports whether req is the fake HTTP request that
+// servers without a control stream send when the daily bandwidth limit is
+// exceeded.
+func isLegacyQuotaRequest(req *http.Request) bool {
+	return req.Header.Get("X-GoPublic-Control") == "bandwidth_exceeded" || strings.HasPrefix(req.URL.Path, "/__gopublic/control/")
+}
+
+// answerLegacyQuotaRequest reports the exceeded limit the way a control
+// stream warning would and answers the request instead of the local app.
+func answerLegacyQuotaRequest(remote net.Conn, publish func(events.EventType, interface{})) {
+	logger.Warn("Daily bandwidth limit exceeded: public URLs will answer 429 until tomorrow")
+	publish(events.EventQuotaWarning, events.QuotaWarningData{Exceeded: true})
+	resp := &http.Response{
+		StatusCode: http.StatusNoContent,
+		Status:     "204 No Content",
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Body:       io.NopCloser(strings.NewReader("")),
+	}
+	_ = resp.Write(remote)
+}
@@ -0,0 +1,279 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"gopublic/internal/client/events"
+	"gopublic/pkg/protocol"
+)
+
+func TestControlStream_PublishesEvents(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	serverConn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	bus := events.NewBus()
+	sub := bus.Subscribe()
+	publish := func(eventType events.EventType, data interface{}) {
+		bus.Publish(events.Event{Type: eventType, Data: data})
+	}
+
+	ctrl := newControlStream(clientConn, json.NewDecoder(clientConn), publish, nil)
+	done := make(chan struct{})
+	go func() {
+		ctrl.run()
+		close(done)
+	}()
+
+	enc := json.NewEncoder(serverConn)
+	enc.Encode(&protocol.ControlMessage{Type: protocol.ControlUsage, Usage: &protocol.ServerStats{BandwidthToday: 10, BandwidthLimit: 100}})
+	enc.Encode(&protocol.ControlMessage{Type: protocol.ControlDisconnect, Disconnect: &protocol.Disconnect{Reason: protocol.DisconnectReplaced, Message: "bye"}})
+
+	want := []events.EventType{events.EventUsageUpdate, events.EventServerDisconnect}
+	for _, w := range want {
+		select {
+		case ev := <-sub:
+			if ev.Type != w {
+				t.Fatalf("event = %v, want %v", ev.Type, w)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %v", w)
+		}
+	}
+
+	serverConn.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("control stream did not stop after the server closed it")
+	}
+}
+
+func TestControlStream_AnswersPing(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	serverConn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	ctrl := newControlStream(clientConn, json.NewDecoder(clientConn), func(events.EventType, interface{}) {}, nil)
+	go ctrl.run()
+
+	if err := json.NewEncoder(serverConn).Encode(&protocol.ControlMessage{Type: protocol.ControlPing, Seq: 3, SentAt: 99}); err != nil {
+		t.Fatalf("send ping: %v", err)
+	}
+	var pong protocol.ControlMessage
+	if err := json.NewDecoder(serverConn).Decode(&pong); err != nil {
+		t.Fatalf("read pong: %v", err)
+	}
+	if pong.Type != protocol.ControlPong || pong.Seq != 3 || pong.SentAt != 99 {
+		t.Errorf("unexpected pong: %+v", pong)
+	}
+}
+
+func TestControlStream_RequestWaitsForResult(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	serverConn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	ctrl := newControlStream(clientConn, json.NewDecoder(clientConn), func(events.EventType, interface{}) {}, nil)
+	go ctrl.run()
+
+	// Fake server: bind succeeds, release fails
+	go func() {
+		dec := json.NewDecoder(serverConn)
+		enc := json.NewEncoder(serverConn)
+		for {
+			var req protocol.ControlMessage
+			if err := dec.Decode(&req); err != nil {
+				return
+			}
+			result := &protocol.ControlMessage{Type: protocol.ControlResult, Seq: req.Seq}
+			if req.Type == protocol.ControlBind {
+				result.Domain = req.Domain + ".example.com"
+			} else {
+				result.Error = "domain is not bound to this session"
+			}
+			enc.Encode(result)
+		}
+	}()
+
+	msg, err := ctrl.request(protocol.ControlBind, "app")
+	if err != nil {
+		t.Fatalf("bind: %v", err)
+	}
+	if msg.Domain != "app.example.com" {
+		t.Errorf("bound domain = %q, want app.example.com", msg.Domain)
+	}
+	if _, err := ctrl.request(protocol.ControlRelease, "other"); err == nil {
+		t.Error("expected release error from server")
+	}
+
+	serverConn.Close()
+	if _, err := ctrl.request(protocol.ControlBind, "late"); err == nil {
+		t.Error("expected error after control stream closed")
+	}
+}
+
+func TestTunnel_ShutdownSendsCloseNotice(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	serverConn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	ctrl := newControlStream(clientConn, json.NewDecoder(clientConn), func(events.EventType, interface{}) {}, nil)
+	go ctrl.run()
+
+	notices := make(chan protocol.ControlMessage, 1)
+	go func() {
+		var req protocol.ControlMessage
+		if err := json.NewDecoder(serverConn).Decode(&req); err != nil {
+			return
+		}
+		notices <- req
+		json.NewEncoder(serverConn).Encode(&protocol.ControlMessage{Type: protocol.ControlResult, Seq: req.Seq})
+	}()
+
+	tun := NewTunnel("localhost:4443", "token", "3000")
+	tun.closeNotice = ctrl
+	if err := tun.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	select {
+	case msg := <-notices:
+		if msg.Type != protocol.ControlClose {
+			t.Errorf("message = %+v, want a close notice", msg)
+		}
+	default:
+		t.Error("Shutdown returned before the server got the close notice")
+	}
+}
+
+func TestControlStream_GoingAway(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	serverConn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	bus := events.NewBus()
+	sub := bus.Subscribe()
+	publish := func(eventType events.EventType, data interface{}) {
+		bus.Publish(events.Event{Type: eventType, Data: data})
+	}
+
+	ctrl := newControlStream(clientConn, json.NewDecoder(clientConn), publish, nil)
+	go ctrl.run()
+
+	if err := ctrl.goingAwayError(); err != nil {
+		t.Fatalf("goingAwayError() = %v before any notice", err)
+	}
+
+	json.NewEncoder(serverConn).Encode(&protocol.ControlMessage{
+		Type:       protocol.ControlDisconnect,
+		Disconnect: &protocol.Disconnect{Reason: protocol.DisconnectShutdown, Message: "restarting", ReconnectIn: 3},
+	})
+	select {
+	case <-sub:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the disconnect event")
+	}
+
+	err := ctrl.goingAwayError()
+	goAway, ok := err.(*GoingAwayError)
+	if !ok {
+		t.Fatalf("goingAwayError() = %v, want *GoingAwayError", err)
+	}
+	if goAway.ReconnectIn != 3*time.Second || goAway.Message != "restarting" {
+		t.Errorf("goingAwayError() = %+v", goAway)
+	}
+}
+
+func TestControlStream_PolicyDisconnect(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	serverConn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	ctrl := newControlStream(clientConn, json.NewDecoder(clientConn), func(events.EventType, interface{}) {}, nil)
+	go ctrl.run()
+
+	// The notice arrives right before the server closes the session
+	json.NewEncoder(serverConn).Encode(&protocol.ControlMessage{
+		Type:       protocol.ControlDisconnect,
+		Disconnect: &protocol.Disconnect{Reason: protocol.DisconnectPolicy, Code: protocol.ErrorCodeIdleTimeout, Message: "idle"},
+	})
+	serverConn.Close()
+	ctrl.finish()
+
+	if err := ctrl.goingAwayError(); err != nil {
+		t.Errorf("goingAwayError() = %v for a policy disconnect", err)
+	}
+	closed, ok := ctrl.sessionClosedError().(*SessionClosedError)
+	if !ok {
+		t.Fatalf("sessionClosedError() = %v, want *SessionClosedError", ctrl.sessionClosedError())
+	}
+	if closed.Code != protocol.ErrorCodeIdleTimeout || closed.Reconnect() {
+		t.Errorf("sessionClosedError() = %+v, want idle_timeout without reconnect", closed)
+	}
+}
+
+func TestSessionClosedError_Reconnect(t *testing.T) {
+	tests := []struct {
+		code protocol.ErrorCode
+		want bool
+	}{
+		{protocol.ErrorCodeSessionExpired, true},
+		{protocol.ErrorCodeIdleTimeout, false},
+		{"some_future_code", true},
+	}
+	for _, tt := range tests {
+		if got := (&SessionClosedError{Code: tt.code}).Reconnect(); got != tt.want {
+			t.Errorf("Reconnect() for %q = %v, want %v", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestProxyStream_LegacyQuotaRequest(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	serverConn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	bus := events.NewBus()
+	sub := bus.Subscribe()
+	st := NewSharedTunnel("localhost:4443", "token", map[string]string{"app.example.com": "1"})
+	st.SetEventBus(bus)
+	go st.proxyStream(clientConn)
+
+	// Old servers send this instead of a control message; it must not reach the local app
+	io.WriteString(serverConn, "GET /__gopublic/control/bandwidth_exceeded HTTP/1.1\r\nHost: gopublic-control\r\nX-GoPublic-Control: bandwidth_exceeded\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(serverConn), nil)
+	if err != nil {
+		t.Fatalf("ReadResponse() error = %v", err)
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("status = %d, want 204", resp.StatusCode)
+	}
+
+	for {
+		select {
+		case ev := <-sub:
+			if ev.Type != events.EventQuotaWarning {
+				continue
+			}
+			if data, ok := ev.Data.(events.QuotaWarningData); !ok || !data.Exceeded {
+				t.Errorf("quota warning = %+v, want exceeded", ev.Data)
+			}
+			return
+		case <-time.After(time.Second):
+			t.Fatal("no quota warning published")
+		}
+	}
+}
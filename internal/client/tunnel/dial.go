@@ -0,0 +1,88 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/url"
+	"time"
+
+	"gopublic/internal/transport"
+)
+
+// quicDialTimeout bounds the QUIC attempt. Networks that drop UDP never
+// answer, so the client gives up quickly and falls back to TCP.
+const quicDialTimeout = 5 * time.Second
+
+// webSocketDialTimeout bounds the WebSocket fallback, including the proxy.
+const webSocketDialTimeout = 15 * time.Second
+
+// clientTLSConfig builds the TLS config for connecting to the server,
+// presenting clientCert unless it is nil.
+func clientTLSConfig(cfg *TLSConfig, clientCert *tls.Certificate) *tls.Config {
+	tlsConfig := &tls.Config{}
+	if clientCert != nil {
+		tlsConfig.Certificates = []tls.Certificate{*clientCert}
+	}
+	if cfg != nil {
+		tlsConfig.InsecureSkipVerify = cfg.InsecureSkipVerify
+		if cfg.ServerName != "" {
+			tlsConfig.ServerName = cfg.ServerName
+		}
+	} else {
+		// Default: insecure for backward compatibility (TODO: make secure by default)
+		tlsConfig.InsecureSkipVerify = true
+	}
+	return tlsConfig
+}
+
+// dialTCP connects to the control plane, through proxyURL unless it is nil.
+func dialTCP(addr string, proxyURL *url.URL, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return transport.DialViaProxy(ctx, addr, proxyURL)
+}
+
+// dialTLS is dialTCP followed by a TLS handshake with the server.
+func dialTLS(addr string, proxyURL *url.URL, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conn, err := transport.DialViaProxy(ctx, addr, proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// dialQUIC opens a QUIC session to the control plane.
+func dialQUIC(addr string, tlsConfig *tls.Config) (transport.Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), quicDialTimeout)
+	defer cancel()
+	return transport.DialQUIC(ctx, addr, tlsConfig)
+}
+
+// dialWebSocket reaches the control plane through the HTTPS ingress on port
+// 443 of the server host, through the configured or environment proxy.
+func dialWebSocket(serverAddr string, tlsConfig *tls.Config, configuredProxy *url.URL) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(serverAddr)
+	if err != nil {
+		host = serverAddr
+	}
+	addr := net.JoinHostPort(host, "443")
+	proxyURL, err := transport.ProxyFor(configuredProxy, addr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), webSocketDialTimeout)
+	defer cancel()
+	return transport.DialWebSocket(ctx, addr, tlsConfig, proxyURL)
+}
@@ -1,6 +1,17 @@
 package tunnel
 
-import "errors"
+import (
+	"errors"
+	"time"
+
+	"gopublic/pkg/protocol"
+)
+
+// errCertNeedsTLS replaces the plain TCP and WebSocket fallbacks for a
+// client that authenticates with a device certificate only: neither carries
+// the certificate to the control plane, so the server would only see the
+// missing token.
+var errCertNeedsTLS = errors.New("the device certificate needs a direct TLS or QUIC connection to the server; plain TCP and WebSocket over port 443 can't carry it (add a token to use them)")
 
 // AlreadyConnectedError indicates the user already has an active session on the server.
 type AlreadyConnectedError struct {
@@ -16,3 +27,70 @@ func IsAlreadyConnectedError(err error) bool {
 	var acErr *AlreadyConnectedError
 	return errors.As(err, &acErr)
 }
+
+// IncompatibleClientError indicates the server requires a newer client release.
+type IncompatibleClientError struct {
+	Message          string
+	MinClientVersion string
+}
+
+func (e *IncompatibleClientError) Error() string {
+	return e.Message
+}
+
+// IsIncompatibleClientError checks if an error is an IncompatibleClientError.
+func IsIncompatibleClientError(err error) bool {
+	var icErr *IncompatibleClientError
+	return errors.As(err, &icErr)
+}
+
+// UnsupportedServerError indicates the server lacks a feature the
+// configuration depends on, so connecting again won't help.
+type UnsupportedServerError struct {
+	Message string
+}
+
+func (e *UnsupportedServerError) Error() string {
+	return e.Message
+}
+
+// IsUnsupportedServerError checks if an error is an UnsupportedServerError.
+func IsUnsupportedServerError(err error) bool {
+	var usErr *UnsupportedServerError
+	return errors.As(err, &usErr)
+}
+
+// GoingAwayError indicates the server drained the session because it is
+// shutting down and asked the client to reconnect after ReconnectIn.
+type GoingAwayError struct {
+	Message     string
+	ReconnectIn time.Duration
+}
+
+func (e *GoingAwayError) Error() string {
+	return e.Message
+}
+
+// IsGoingAwayError checks if an error is a GoingAwayError.
+func IsGoingAwayError(err error) bool {
+	var gaErr *GoingAwayError
+	return errors.As(err, &gaErr)
+}
+
+// SessionClosedError indicates the server closed the session under one of
+// its session policies. Code tells the reconnect loop what to do.
+type SessionClosedError struct {
+	Code    protocol.ErrorCode
+	Message string
+}
+
+func (e *SessionClosedError) Error() string {
+	return e.Message
+}
+
+// Reconnect reports whether the client should open a new session. A session
+// closed for being idle stays closed, so its domains are released until the
+// user starts the client again.
+func (e *SessionClosedError) Reconnect() bool {
+	return e.Code != protocol.ErrorCodeIdleTimeout
+}
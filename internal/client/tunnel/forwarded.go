@@ -0,0 +1,60 @@
+package tunnel
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+
+	"gopublic/pkg/protocol"
+)
+
+// setForwardedHeaders tells the local service who sent req, as reported by the
+// server in the stream header. The visitor is appended to X-Forwarded-For and
+// Forwarded like a reverse proxy would; X-Forwarded-Proto is replaced.
+func setForwardedHeaders(req *http.Request, h *protocol.StreamHeader) {
+	if h.RemoteAddr == "" {
+		return
+	}
+	req.RemoteAddr = h.RemoteAddr
+
+	ip := h.RemoteAddr
+	if host, _, err := net.SplitHostPort(h.RemoteAddr); err == nil {
+		ip = host
+	}
+	proto := "http"
+	if h.TLSVersion != "" {
+		proto = "https"
+	}
+
+	if prior := req.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+		req.Header.Set("X-Forwarded-For", strings.Join(prior, ", ")+", "+ip)
+	} else {
+		req.Header.Set("X-Forwarded-For", ip)
+	}
+	req.Header.Set("X-Forwarded-Proto", proto)
+
+	// RFC 7239 quotes IPv6 addresses
+	forIP := ip
+	if strings.Contains(ip, ":") {
+		forIP = `"[` + ip + `]"`
+	}
+	element := "for=" + forIP + ";proto=" + proto
+	if h.Domain != "" {
+		element += ";host=" + h.Domain
+	}
+	if prior := req.Header.Values("Forwarded"); len(prior) > 0 {
+		req.Header.Set("Forwarded", strings.Join(prior, ", ")+", "+element)
+	} else {
+		req.Header.Set("Forwarded", element)
+	}
+}
+
+// readHTTPStreamHeader consumes the stream header of an HTTP stream if the
+// server sent one. It returns nil for legacy streams that start with the request.
+func readHTTPStreamHeader(reader *bufio.Reader) (*protocol.StreamHeader, error) {
+	if !protocol.HasStreamHeader(reader) {
+		return nil, nil
+	}
+	return protocol.ReadStreamHeader(reader)
+}
@@ -0,0 +1,62 @@
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"gopublic/pkg/protocol"
+)
+
+func TestSetForwardedHeaders(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	setForwardedHeaders(req, &protocol.StreamHeader{
+		Proto:      protocol.StreamProtoHTTP,
+		Domain:     "app.example.com",
+		RemoteAddr: "203.0.113.7:51000",
+		TLSVersion: "TLS 1.3",
+	})
+
+	if req.RemoteAddr != "203.0.113.7:51000" {
+		t.Errorf("RemoteAddr = %q", req.RemoteAddr)
+	}
+	if got := req.Header.Get("X-Forwarded-For"); got != "10.0.0.1, 203.0.113.7" {
+		t.Errorf("X-Forwarded-For = %q", got)
+	}
+	if got := req.Header.Get("X-Forwarded-Proto"); got != "https" {
+		t.Errorf("X-Forwarded-Proto = %q", got)
+	}
+	if got := req.Header.Get("Forwarded"); got != "for=203.0.113.7;proto=https;host=app.example.com" {
+		t.Errorf("Forwarded = %q", got)
+	}
+
+	v6, _ := http.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+	setForwardedHeaders(v6, &protocol.StreamHeader{RemoteAddr: "[2001:db8::1]:443"})
+	if got := v6.Header.Get("Forwarded"); got != `for="[2001:db8::1]";proto=http` {
+		t.Errorf("Forwarded for IPv6 = %q", got)
+	}
+}
+
+func TestReadHTTPStreamHeader(t *testing.T) {
+	var buf bytes.Buffer
+	protocol.WriteStreamHeader(&buf, &protocol.StreamHeader{Proto: protocol.StreamProtoHTTP, Domain: "app.example.com", RequestID: "abc"})
+	buf.WriteString("GET / HTTP/1.1\r\nHost: app.example.com\r\n\r\n")
+
+	reader := bufio.NewReader(&buf)
+	header, err := readHTTPStreamHeader(reader)
+	if err != nil || header == nil || header.Domain != "app.example.com" || header.RequestID != "abc" {
+		t.Fatalf("readHTTPStreamHeader() = %+v, %v", header, err)
+	}
+	if _, err := http.ReadRequest(reader); err != nil {
+		t.Errorf("request after header: %v", err)
+	}
+
+	// Legacy streams start with the request itself
+	legacy := bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\nHost: app.example.com\r\n\r\n"))
+	if header, err := readHTTPStreamHeader(legacy); header != nil || err != nil {
+		t.Errorf("legacy stream: %+v, %v", header, err)
+	}
+}
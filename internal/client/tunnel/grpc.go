@@ -0,0 +1,94 @@
+package tunnel
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http2"
+)
+
+// grpcTransport speaks cleartext HTTP/2 (h2c) on connections the tunnel
+// already dialed to the local service.
+var grpcTransport = &http2.Transport{AllowHTTP: true, DisableCompression: true}
+
+// isGRPCRequest reports whether req is a gRPC call. Local gRPC servers only
+// speak HTTP/2, so these calls can't be written to them as HTTP/1.1.
+// gRPC-Web works over HTTP/1.1 and is forwarded like any other request.
+func isGRPCRequest(req *http.Request) bool {
+	ct := req.Header.Get("Content-Type")
+	return ct == "application/grpc" || strings.HasPrefix(ct, "application/grpc+") || strings.HasPrefix(ct, "application/grpc;")
+}
+
+// proxyGRPC sends req to the local service over h2c on local and streams the
+// response back to remote as chunked HTTP/1.1, with the HTTP/2 trailers
+// (grpc-status and grpc-message) after the last chunk. The request body keeps
+// streaming while the response does, so streaming calls work both ways.
+// It returns the local response and the body bytes carried in both directions.
+func proxyGRPC(remote, local net.Conn, req *http.Request) (*http.Response, int64, error) {
+	cc, err := grpcTransport.NewClientConn(local)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cc.Close()
+
+	out := req.Clone(req.Context())
+	out.RequestURI = ""
+	out.URL.Scheme = "http"
+	out.URL.Host = req.Host
+	reqBody := &countingBody{ReadCloser: req.Body}
+	if req.Body != nil && req.Body != http.NoBody {
+		out.Body = reqBody
+	}
+
+	resp, err := cc.RoundTrip(out)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	// Trailers arrive after the body; the writer reads the map once it hits EOF
+	respBody := &trailerBody{countingBody: countingBody{ReadCloser: resp.Body}, resp: resp, trailer: make(http.Header)}
+	chunked := &http.Response{
+		StatusCode:       resp.StatusCode,
+		ProtoMajor:       1,
+		ProtoMinor:       1,
+		Header:           resp.Header,
+		Body:             respBody,
+		ContentLength:    -1,
+		TransferEncoding: []string{"chunked"},
+		Trailer:          respBody.trailer,
+	}
+	err = chunked.Write(remote)
+	return resp, reqBody.n + respBody.n, err
+}
+
+// countingBody counts the bytes read through it.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// trailerBody copies the trailers of resp into trailer at the end of its body.
+type trailerBody struct {
+	countingBody
+	resp    *http.Response
+	trailer http.Header
+}
+
+func (b *trailerBody) Read(p []byte) (int, error) {
+	n, err := b.countingBody.Read(p)
+	if err == io.EOF {
+		for k, vv := range b.resp.Trailer {
+			b.trailer[k] = vv
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,98 @@
+package tunnel
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestIsGRPCRequest(t *testing.T) {
+	tests := map[string]bool{
+		"application/grpc":          true,
+		"application/grpc+proto":    true,
+		"application/grpc; charset": true,
+		"application/grpc-web":      false,
+		"application/json":          false,
+		"":                          false,
+	}
+	for ct, want := range tests {
+		req, _ := http.NewRequest(http.MethodPost, "http://app.example.com/", nil)
+		req.Header.Set("Content-Type", ct)
+		if got := isGRPCRequest(req); got != want {
+			t.Errorf("isGRPCRequest(%q) = %v, want %v", ct, got, want)
+		}
+	}
+}
+
+func TestProxyGRPC_StreamsWithTrailers(t *testing.T) {
+	// An h2c server that echoes every message as it arrives, like a
+	// bidirectional streaming call
+	local := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Errorf("local server got %s, want HTTP/2", r.Proto)
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.WriteHeader(http.StatusOK)
+		buf := make([]byte, 64)
+		for {
+			n, err := r.Body.Read(buf)
+			if n > 0 {
+				w.Write(buf[:n])
+				w.(http.Flusher).Flush()
+			}
+			if err != nil {
+				break
+			}
+		}
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	}), &http2.Server{}))
+	t.Cleanup(local.Close)
+
+	localConn, err := net.Dial("tcp", local.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer localConn.Close()
+
+	bodyReader, bodyWriter := io.Pipe()
+	req, _ := http.NewRequest(http.MethodPost, "/echo.Echo/Stream", bodyReader)
+	req.Host = "app.example.com"
+	req.Header.Set("Content-Type", "application/grpc")
+
+	remote, visitor := net.Pipe()
+	defer visitor.Close()
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := proxyGRPC(remote, localConn, req)
+		remote.Close()
+		done <- err
+	}()
+
+	// The first message comes back while the request is still open
+	bodyWriter.Write([]byte("ping"))
+	resp, err := http.ReadResponse(bufio.NewReader(visitor), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("first message = %q, %v", buf, err)
+	}
+	bodyWriter.Close()
+
+	if rest, err := io.ReadAll(resp.Body); err != nil || len(rest) != 0 {
+		t.Errorf("rest of body = %q, %v", rest, err)
+	}
+	if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+		t.Errorf("Grpc-Status trailer = %q, want 0", got)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("proxyGRPC() = %v", err)
+	}
+}
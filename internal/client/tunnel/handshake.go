@@ -0,0 +1,63 @@
+package tunnel
+
+import (
+	"fmt"
+
+	"gopublic/internal/client/logger"
+	"gopublic/internal/version"
+	"gopublic/pkg/protocol"
+)
+
+// tunnelCapabilities are the features the single-port Tunnel can handle.
+var tunnelCapabilities = []string{
+	protocol.CapabilityControlStream,
+	protocol.CapabilityStreamHeader,
+	protocol.CapabilityResume,
+	protocol.CapabilityCloseNotice,
+}
+
+// sharedTunnelCapabilities are the features SharedTunnel can handle.
+var sharedTunnelCapabilities = []string{
+	protocol.CapabilityControlStream,
+	protocol.CapabilityStreamHeader,
+	protocol.CapabilityTCPTunnels,
+	protocol.CapabilityUDPTunnels,
+	protocol.CapabilityTLSPassthrough,
+	protocol.CapabilityRuntimeBind,
+	protocol.CapabilityResume,
+	protocol.CapabilityCloseNotice,
+}
+
+// newAuthRequest builds the first handshake message, advertising this client's
+// version and capabilities. resumeToken comes from the previous session, if any.
+func newAuthRequest(token string, force bool, capabilities []string, resumeToken string) protocol.AuthRequest {
+	return protocol.AuthRequest{
+		Token:           token,
+		Force:           force,
+		ClientVersion:   version.Version,
+		ProtocolVersion: protocol.ProtocolVersion,
+		Capabilities:    capabilities,
+		ResumeToken:     resumeToken,
+	}
+}
+
+// handshakeError converts a failed InitResponse into an error, using typed
+// errors for codes the reconnect loop must not retry.
+func handshakeError(resp *protocol.InitResponse) error {
+	switch resp.ErrorCode {
+	case protocol.ErrorCodeAlreadyConnected:
+		return &AlreadyConnectedError{Message: resp.Error}
+	case protocol.ErrorCodeIncompatibleClient:
+		return &IncompatibleClientError{Message: resp.Error, MinClientVersion: resp.MinClientVersion}
+	}
+	return fmt.Errorf("server error: %s", resp.Error)
+}
+
+// logServerInfo logs what the server announced during the handshake.
+// Servers that predate negotiation send neither version nor capabilities.
+func logServerInfo(resp *protocol.InitResponse) {
+	if resp.ServerVersion == "" && resp.ProtocolVersion == 0 {
+		return
+	}
+	logger.Info("Server version %s (protocol %d), capabilities: %v", resp.ServerVersion, resp.ProtocolVersion, resp.Capabilities)
+}
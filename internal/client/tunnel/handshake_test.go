@@ -0,0 +1,56 @@
+package tunnel
+
+import (
+	"testing"
+
+	"gopublic/internal/version"
+	"gopublic/pkg/protocol"
+)
+
+func TestNewAuthRequest(t *testing.T) {
+	req := newAuthRequest("tok", true, sharedTunnelCapabilities, "resume-me")
+
+	if req.Token != "tok" || !req.Force {
+		t.Errorf("unexpected token/force: %+v", req)
+	}
+	if req.ClientVersion != version.Version {
+		t.Errorf("ClientVersion = %q, want %q", req.ClientVersion, version.Version)
+	}
+	if req.ProtocolVersion != protocol.ProtocolVersion {
+		t.Errorf("ProtocolVersion = %d, want %d", req.ProtocolVersion, protocol.ProtocolVersion)
+	}
+	if req.ResumeToken != "resume-me" {
+		t.Errorf("ResumeToken = %q, want %q", req.ResumeToken, "resume-me")
+	}
+	if !protocol.HasCapability(req.Capabilities, protocol.CapabilityStreamHeader) {
+		t.Errorf("Capabilities = %v, missing %q", req.Capabilities, protocol.CapabilityStreamHeader)
+	}
+}
+
+func TestHandshakeError(t *testing.T) {
+	tests := []struct {
+		name             string
+		code             protocol.ErrorCode
+		wantConnected    bool
+		wantIncompatible bool
+	}{
+		{"already connected", protocol.ErrorCodeAlreadyConnected, true, false},
+		{"incompatible client", protocol.ErrorCodeIncompatibleClient, false, true},
+		{"other", protocol.ErrorCodeInvalidToken, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := handshakeError(&protocol.InitResponse{Error: "boom", ErrorCode: tt.code, MinClientVersion: "v2.0.0"})
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if got := IsAlreadyConnectedError(err); got != tt.wantConnected {
+				t.Errorf("IsAlreadyConnectedError() = %v, want %v", got, tt.wantConnected)
+			}
+			if got := IsIncompatibleClientError(err); got != tt.wantIncompatible {
+				t.Errorf("IsIncompatibleClientError() = %v, want %v", got, tt.wantIncompatible)
+			}
+		})
+	}
+}
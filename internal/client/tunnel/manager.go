@@ -2,20 +2,27 @@ package tunnel
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"net/url"
 	"sync"
 
 	"gopublic/internal/client/events"
 	"gopublic/internal/client/logger"
 	"gopublic/internal/client/stats"
+	"gopublic/pkg/protocol"
 )
 
 // TunnelManager coordinates multiple tunnel connections using a shared session.
 type TunnelManager struct {
 	ServerAddr string
 	Token      string
-	Force      bool // Force disconnect existing sessions
-	NoCache    bool // Add Cache-Control: no-store to responses
+	Force      bool             // Force disconnect existing sessions
+	NoCache    bool             // Add Cache-Control: no-store to responses
+	Shared     bool             // Load balance the domains with other shared sessions
+	QUIC       bool             // Connect over QUIC, falling back to TCP
+	Proxy      *url.URL         // Outbound proxy (nil = from the environment)
+	ClientCert *tls.Certificate // Device certificate (nil = authenticate with Token)
 	tunnels    []*ManagedTunnel
 	mu         sync.Mutex
 	eventBus   *events.Bus
@@ -29,8 +36,12 @@ type TunnelManager struct {
 // ManagedTunnel wraps a tunnel with its metadata
 type ManagedTunnel struct {
 	Name      string
+	Proto     string // "http" (default), "tcp", "udp" or "tls"
 	LocalPort string
 	Subdomain string
+	CertFile  string // tls only: terminate TLS on the client with this certificate
+	KeyFile   string
+	Access    *protocol.AccessPolicy // http only: enforced by the server (nil = public)
 }
 
 // NewTunnelManager creates a new tunnel manager
@@ -62,15 +73,145 @@ func (tm *TunnelManager) SetNoCache(noCache bool) {
 	tm.NoCache = noCache
 }
 
-// AddTunnel adds a tunnel configuration to the manager
-func (tm *TunnelManager) AddTunnel(name, localPort, subdomain string) {
+// SetShared opts in to serving the domains together with other shared sessions
+func (tm *TunnelManager) SetShared(shared bool) {
+	tm.Shared = shared
+}
+
+// SetProxy routes the shared session through an outbound proxy
+func (tm *TunnelManager) SetProxy(proxyURL *url.URL) {
+	tm.Proxy = proxyURL
+}
+
+// SetQUIC makes the shared session try QUIC before TCP
+func (tm *TunnelManager) SetQUIC(quic bool) {
+	tm.QUIC = quic
+}
+
+// SetClientCert authenticates the shared session with a device certificate
+func (tm *TunnelManager) SetClientCert(cert *tls.Certificate) {
+	tm.ClientCert = cert
+}
+
+// AddTunnel adds an HTTP tunnel to the manager. If the manager is already
+// running, the subdomain is bound on the live session without reconnecting;
+// access policies can only be set before the start.
+func (tm *TunnelManager) AddTunnel(name, localPort, subdomain string, access *protocol.AccessPolicy) error {
+	tm.mu.Lock()
+	if tm.find(name) != nil {
+		tm.mu.Unlock()
+		return fmt.Errorf("tunnel '%s' already exists", name)
+	}
+	if tm.sharedTunnel != nil && access != nil {
+		tm.mu.Unlock()
+		return fmt.Errorf("tunnel '%s': access policies can't be added to running tunnels", name)
+	}
+	mt := &ManagedTunnel{
+		Name:      name,
+		LocalPort: localPort,
+		Subdomain: subdomain,
+		Access:    access,
+	}
+	tm.tunnels = append(tm.tunnels, mt)
+	st := tm.sharedTunnel
+	tm.mu.Unlock()
+
+	if st == nil {
+		return nil
+	}
+	if err := st.BindTunnel(subdomain, localPort); err != nil {
+		tm.mu.Lock()
+		tm.remove(mt)
+		tm.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// RemoveTunnel removes a tunnel from the manager. While the manager is
+// running only HTTP tunnels can be removed; their domain is released on the
+// live session and the other tunnels keep their streams.
+func (tm *TunnelManager) RemoveTunnel(name string) error {
+	tm.mu.Lock()
+	mt := tm.find(name)
+	if mt == nil {
+		tm.mu.Unlock()
+		return fmt.Errorf("tunnel '%s' not found", name)
+	}
+	st := tm.sharedTunnel
+	if st != nil && mt.Proto != "" && mt.Proto != "http" {
+		tm.mu.Unlock()
+		return fmt.Errorf("tunnel '%s': %s tunnels cannot be removed while running", name, mt.Proto)
+	}
+	tm.remove(mt)
+	tm.mu.Unlock()
+
+	if st == nil {
+		return nil
+	}
+	return st.ReleaseTunnel(mt.Subdomain)
+}
+
+// find returns the tunnel with the given name. The caller must hold tm.mu.
+func (tm *TunnelManager) find(name string) *ManagedTunnel {
+	for _, mt := range tm.tunnels {
+		if mt.Name == name {
+			return mt
+		}
+	}
+	return nil
+}
+
+// remove drops mt from the tunnel list. The caller must hold tm.mu.
+func (tm *TunnelManager) remove(mt *ManagedTunnel) {
+	for i, t := range tm.tunnels {
+		if t == mt {
+			tm.tunnels = append(tm.tunnels[:i:i], tm.tunnels[i+1:]...)
+			return
+		}
+	}
+}
+
+// AddTCPTunnel adds a raw TCP tunnel that is exposed on a public port chosen by the server
+func (tm *TunnelManager) AddTCPTunnel(name, localAddr string) {
 	tm.mu.Lock()
 	defer tm.mu.Unlock()
 
 	mt := &ManagedTunnel{
 		Name:      name,
-		LocalPort: localPort,
+		Proto:     "tcp",
+		LocalPort: localAddr,
+	}
+	tm.tunnels = append(tm.tunnels, mt)
+}
+
+// AddUDPTunnel adds a UDP tunnel that is exposed on a public port chosen by the server
+func (tm *TunnelManager) AddUDPTunnel(name, localAddr string) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	mt := &ManagedTunnel{
+		Name:      name,
+		Proto:     "udp",
+		LocalPort: localAddr,
+	}
+	tm.tunnels = append(tm.tunnels, mt)
+}
+
+// AddTLSTunnel adds a TLS passthrough tunnel. The server forwards raw TLS bytes
+// for the subdomain; if certFile and keyFile are set the client terminates TLS,
+// otherwise the local service at localAddr does.
+func (tm *TunnelManager) AddTLSTunnel(name, localAddr, subdomain, certFile, keyFile string) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	mt := &ManagedTunnel{
+		Name:      name,
+		Proto:     "tls",
+		LocalPort: localAddr,
 		Subdomain: subdomain,
+		CertFile:  certFile,
+		KeyFile:   keyFile,
 	}
 	tm.tunnels = append(tm.tunnels, mt)
 }
@@ -83,19 +224,57 @@ func (tm *TunnelManager) StartAll(ctx context.Context) error {
 		return fmt.Errorf("no tunnels configured")
 	}
 
-	// Build subdomain -> localPort mapping
+	// Build subdomain -> localPort and name -> local address mappings
 	tunnelMap := make(map[string]string)
+	tcpMap := make(map[string]string)
+	udpMap := make(map[string]string)
+	tlsMap := make(map[string]*PassthroughTunnel)
+	accessMap := make(map[string]*protocol.AccessPolicy)
 	for _, mt := range tm.tunnels {
+		switch mt.Proto {
+		case "tcp":
+			tcpMap[mt.Name] = mt.LocalPort
+			logger.Info("Configured TCP tunnel '%s': %s -> public port", mt.Name, localDialAddr(mt.LocalPort))
+			continue
+		case "udp":
+			udpMap[mt.Name] = mt.LocalPort
+			logger.Info("Configured UDP tunnel '%s': %s -> public port", mt.Name, localDialAddr(mt.LocalPort))
+			continue
+		case "tls":
+			target := &PassthroughTunnel{LocalAddr: mt.LocalPort}
+			if mt.CertFile != "" || mt.KeyFile != "" {
+				cert, err := tls.LoadX509KeyPair(mt.CertFile, mt.KeyFile)
+				if err != nil {
+					tm.mu.Unlock()
+					return fmt.Errorf("tunnel '%s': failed to load certificate: %w", mt.Name, err)
+				}
+				target.Certificate = &cert
+			}
+			tlsMap[mt.Subdomain] = target
+			logger.Info("Configured TLS tunnel '%s': %s -> %s (passthrough)", mt.Name, localDialAddr(mt.LocalPort), mt.Subdomain)
+			continue
+		}
 		tunnelMap[mt.Subdomain] = mt.LocalPort
+		if mt.Access != nil {
+			accessMap[mt.Subdomain] = mt.Access
+		}
 		logger.Info("Configured tunnel '%s': localhost:%s -> %s", mt.Name, mt.LocalPort, mt.Subdomain)
 	}
 
 	// Create shared tunnel
 	st := NewSharedTunnel(tm.ServerAddr, tm.Token, tunnelMap)
+	st.SetTCPTunnels(tcpMap)
+	st.SetUDPTunnels(udpMap)
+	st.SetTLSTunnels(tlsMap)
+	st.SetAccess(accessMap)
 	st.SetEventBus(tm.eventBus)
 	st.SetStats(tm.stats)
 	st.SetForce(tm.Force)
 	st.SetNoCache(tm.NoCache)
+	st.SetShared(tm.Shared)
+	st.SetQUIC(tm.QUIC)
+	st.SetProxy(tm.Proxy)
+	st.SetClientCert(tm.ClientCert)
 
 	tm.sharedTunnel = st
 
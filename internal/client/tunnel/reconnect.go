@@ -2,6 +2,7 @@ package tunnel
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
@@ -85,6 +86,44 @@ func (t *Tunnel) StartWithReconnect(ctx context.Context, cfg *ReconnectConfig) e
 				t.publishStatus("error", fmt.Sprintf("Session conflict: %v", err))
 				return err
 			}
+			if IsIncompatibleClientError(err) {
+				logger.Error("Client update required: %v", err)
+				t.publishStatus("error", err.Error())
+				return err
+			}
+
+			// The server drained the session before a restart: come back
+			// when it asked instead of backing off
+			var goAway *GoingAwayError
+			if errors.As(err, &goAway) {
+				logger.Info("Server is restarting, reconnecting in %v...", goAway.ReconnectIn)
+				t.publishStatus("reconnecting", fmt.Sprintf("Server is restarting, reconnecting in %v...", goAway.ReconnectIn))
+				select {
+				case <-time.After(goAway.ReconnectIn):
+				case <-ctx.Done():
+					logger.Info("Tunnel shutdown requested during reconnect wait")
+					return ctx.Err()
+				}
+				attempt = 0
+				delay = cfg.InitialDelay
+				continue
+			}
+
+			// A session policy closed the session: its code says whether to
+			// come back, and an expired session comes back right away
+			var closed *SessionClosedError
+			if errors.As(err, &closed) {
+				if !closed.Reconnect() {
+					logger.Error("Session closed by the server: %v", err)
+					t.publishStatus("error", err.Error())
+					return err
+				}
+				logger.Info("Session closed by the server (%s), reconnecting...", closed.Code)
+				t.publishStatus("reconnecting", fmt.Sprintf("Session closed by the server (%s), reconnecting...", closed.Code))
+				attempt = 0
+				delay = cfg.InitialDelay
+				continue
+			}
 
 			logger.Warn("Connection failed: %v", err)
 			t.publishStatus("connection_failed", fmt.Sprintf("Connection failed: %v (retry in %v)", err, delay))
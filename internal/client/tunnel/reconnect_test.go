@@ -2,8 +2,14 @@ package tunnel
 
 import (
 	"context"
+	"encoding/json"
+	"net"
 	"testing"
 	"time"
+
+	"github.com/hashicorp/yamux"
+
+	"gopublic/pkg/protocol"
 )
 
 func TestDefaultReconnectConfig(t *testing.T) {
@@ -116,3 +122,70 @@ func TestStartWithReconnect_MaxAttempts(t *testing.T) {
 		t.Errorf("Took too long: %v", elapsed)
 	}
 }
+
+func TestSharedTunnel_StartWithReconnect_ResumesAfterDrop(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// Fake server: completes the handshake, hands out a resume token and
+	// drops the session right away
+	tokens := make(chan string, 4)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				session, err := yamux.Server(conn, nil)
+				if err != nil {
+					return
+				}
+				defer session.Close()
+				stream, err := session.Accept()
+				if err != nil {
+					return
+				}
+				decoder := json.NewDecoder(stream)
+				var auth protocol.AuthRequest
+				var req protocol.TunnelRequest
+				if decoder.Decode(&auth) != nil || decoder.Decode(&req) != nil {
+					return
+				}
+				tokens <- auth.ResumeToken
+				json.NewEncoder(stream).Encode(protocol.InitResponse{Success: true, BoundDomains: req.RequestedDomains, ResumeToken: "resume-1"})
+			}()
+		}
+	}()
+
+	st := NewSharedTunnel(ln.Addr().String(), "test-token", map[string]string{"app": "3000"})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- st.StartWithReconnect(ctx, &ReconnectConfig{InitialDelay: 10 * time.Millisecond, MaxDelay: 50 * time.Millisecond, Multiplier: 2})
+	}()
+
+	for i, want := range []string{"", "resume-1"} {
+		select {
+		case got := <-tokens:
+			if got != want {
+				t.Errorf("connection %d: resume token = %q, want %q", i+1, got, want)
+			}
+		case err := <-done:
+			t.Fatalf("StartWithReconnect() returned %v after a dropped session", err)
+		case <-time.After(3 * time.Second):
+			t.Fatalf("connection %d never arrived", i+1)
+		}
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("StartWithReconnect() did not stop after cancellation")
+	}
+}
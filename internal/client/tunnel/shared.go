@@ -11,6 +11,7 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"strings"
 	"sync"
 	"time"
@@ -19,6 +20,7 @@ import (
 	"gopublic/internal/client/inspector"
 	"gopublic/internal/client/logger"
 	"gopublic/internal/client/stats"
+	"gopublic/internal/transport"
 	"gopublic/pkg/protocol"
 
 	"github.com/hashicorp/yamux"
@@ -30,11 +32,19 @@ type SharedTunnel struct {
 	ServerAddr string
 	Token      string
 	Force      bool
-	NoCache    bool              // Add Cache-Control: no-store to responses
-	Tunnels    map[string]string // subdomain -> localPort
+	NoCache    bool                              // Add Cache-Control: no-store to responses
+	Shared     bool                              // Serve the domains together with other shared sessions
+	QUIC       bool                              // Try QUIC before TCP; stays on TCP after a failed attempt
+	Proxy      *url.URL                          // Outbound proxy for the server connection (nil = from the environment)
+	Tunnels    map[string]string                 // subdomain -> localPort
+	TCPTunnels map[string]string                 // tunnel name -> local address for raw TCP tunnels
+	UDPTunnels map[string]string                 // tunnel name -> local address for UDP tunnels
+	TLSTunnels map[string]*PassthroughTunnel     // subdomain -> TLS passthrough target
+	Access     map[string]*protocol.AccessPolicy // subdomain -> access policy of an HTTP tunnel
 
 	// TLS configuration
-	TLSConfig *TLSConfig
+	TLSConfig  *TLSConfig
+	ClientCert *tls.Certificate // Device certificate that authenticates instead of Token (nil = token)
 
 	// Dependencies
 	eventBus *events.Bus
@@ -44,11 +54,16 @@ type SharedTunnel struct {
 	mu          sync.Mutex
 	wg          sync.WaitGroup
 	activeConns map[net.Conn]struct{}
-	session     *yamux.Session
+	session     transport.Session
+	control     *controlStream // Set while the server accepts runtime bind/release
+	closeNotice *controlStream // Set while the server accepts a close notice
 	closed      bool
 
 	// Cached connection info
 	boundDomains []string
+	resumeToken  string // Reclaims the domains on reconnect while the server reserves them
+	quicFailed   bool   // QUIC didn't connect once; reconnects go straight to TCP
+	viaWebSocket bool   // Direct dials failed once; reconnects go straight to the WebSocket
 }
 
 // NewSharedTunnel creates a new shared tunnel instance.
@@ -76,6 +91,37 @@ func (st *SharedTunnel) SetTLSConfig(cfg *TLSConfig) {
 	st.TLSConfig = cfg
 }
 
+// SetTCPTunnels sets the raw TCP tunnels (name -> local port or host:port).
+func (st *SharedTunnel) SetTCPTunnels(tunnels map[string]string) {
+	st.TCPTunnels = tunnels
+}
+
+// SetUDPTunnels sets the UDP tunnels (name -> local port or host:port).
+func (st *SharedTunnel) SetUDPTunnels(tunnels map[string]string) {
+	st.UDPTunnels = tunnels
+}
+
+// SetTLSTunnels sets the TLS passthrough tunnels (subdomain -> target).
+func (st *SharedTunnel) SetTLSTunnels(tunnels map[string]*PassthroughTunnel) {
+	st.TLSTunnels = tunnels
+}
+
+// SetAccess sets the access policies of HTTP tunnels by subdomain. The
+// server enforces them; tunnels without one are public.
+func (st *SharedTunnel) SetAccess(access map[string]*protocol.AccessPolicy) {
+	st.Access = access
+}
+
+// hasLoginWall reports whether any tunnel asks visitors to sign in.
+func (st *SharedTunnel) hasLoginWall() bool {
+	for _, p := range st.Access {
+		if p != nil && p.Login != nil {
+			return true
+		}
+	}
+	return false
+}
+
 // SetForce sets the force flag to disconnect existing session.
 func (st *SharedTunnel) SetForce(force bool) {
 	st.Force = force
@@ -86,6 +132,30 @@ func (st *SharedTunnel) SetNoCache(noCache bool) {
 	st.NoCache = noCache
 }
 
+// SetShared opts in to serving the domains together with other shared
+// sessions of the same account; the server load balances between them.
+func (st *SharedTunnel) SetShared(shared bool) {
+	st.Shared = shared
+}
+
+// SetProxy routes the server connection through an HTTP(S) or SOCKS5 proxy.
+// With nil, HTTPS_PROXY or ALL_PROXY from the environment is used.
+func (st *SharedTunnel) SetProxy(proxyURL *url.URL) {
+	st.Proxy = proxyURL
+}
+
+// SetQUIC makes the tunnel connect over QUIC when the server offers it,
+// falling back to TCP on networks that block UDP.
+func (st *SharedTunnel) SetQUIC(quic bool) {
+	st.QUIC = quic
+}
+
+// SetClientCert presents a device certificate in the TLS handshake, which
+// the server accepts instead of the token.
+func (st *SharedTunnel) SetClientCert(cert *tls.Certificate) {
+	st.ClientCert = cert
+}
+
 // BoundDomains returns the domains bound to this tunnel.
 func (st *SharedTunnel) BoundDomains() []string {
 	st.mu.Lock()
@@ -129,11 +199,7 @@ func (st *SharedTunnel) untrackConn(conn net.Conn) {
 func (st *SharedTunnel) Start(ctx context.Context) error {
 	st.publishEvent(events.EventConnecting, nil)
 
-	host, _, _ := net.SplitHostPort(st.ServerAddr)
-	if host == "" {
-		host = st.ServerAddr
-	}
-	isLocal := host == "localhost" || host == "127.0.0.1" || host == "::1"
+	isLocal := isLocalAddr(st.ServerAddr)
 
 	connectStart := time.Now()
 	dialTimeout := 10 * time.Second
@@ -147,47 +213,96 @@ func (st *SharedTunnel) Start(ctx context.Context) error {
 			st.publishEvent(events.EventError, events.ErrorData{Error: err, Context: "connect"})
 			return fmt.Errorf("failed to connect to local server: %v", err)
 		}
-		return st.handleSession(ctx, conn, connectStart)
+		return st.handleConn(ctx, conn, connectStart)
 	}
 
-	// Build TLS config
-	tlsConfig := &tls.Config{}
-	if st.TLSConfig != nil {
-		tlsConfig.InsecureSkipVerify = st.TLSConfig.InsecureSkipVerify
-		if st.TLSConfig.ServerName != "" {
-			tlsConfig.ServerName = st.TLSConfig.ServerName
-		}
-	} else {
-		tlsConfig.InsecureSkipVerify = true
-	}
+	tlsConfig := clientTLSConfig(st.TLSConfig, st.ClientCert)
 
-	st.publishStatus("dialing", fmt.Sprintf("Connecting to %s (TLS)...", st.ServerAddr))
-	dialer := &net.Dialer{Timeout: dialTimeout}
-	conn, err := tls.DialWithDialer(dialer, "tcp", st.ServerAddr, tlsConfig)
+	proxyURL, err := transport.ProxyFor(st.Proxy, st.ServerAddr)
 	if err != nil {
+		st.publishStatus("error", fmt.Sprintf("Invalid proxy settings: %v", err))
+		return fmt.Errorf("invalid proxy settings: %v", err)
+	}
+	if proxyURL != nil {
+		logger.Info("Connecting through proxy %s", proxyURL.Redacted())
+	}
+
+	if session := st.tryQUIC(tlsConfig, proxyURL); session != nil {
+		return st.handleSession(ctx, session, connectStart)
+	}
+
+	st.mu.Lock()
+	viaWebSocket := st.viaWebSocket
+	st.mu.Unlock()
+	if !viaWebSocket {
+		st.publishStatus("dialing", fmt.Sprintf("Connecting to %s (TLS)...", st.ServerAddr))
+		conn, err := dialTLS(st.ServerAddr, proxyURL, dialTimeout, tlsConfig)
+		if err == nil {
+			return st.handleConn(ctx, conn, connectStart)
+		}
+		if st.ClientCert != nil && st.Token == "" {
+			err = fmt.Errorf("%w: %v", errCertNeedsTLS, err)
+			st.publishStatus("error", err.Error())
+			st.publishEvent(events.EventError, events.ErrorData{Error: err, Context: "connect"})
+			return err
+		}
 		st.publishStatus("tls_fallback", fmt.Sprintf("TLS failed: %v, trying plain TCP...", err))
 		logger.Warn("TLS connection failed, trying plain TCP: %v", err)
-		connPlain, errPlain := net.DialTimeout("tcp", st.ServerAddr, dialTimeout)
-		if errPlain != nil {
-			st.publishStatus("error", fmt.Sprintf("Connection failed: %v", errPlain))
-			st.publishEvent(events.EventError, events.ErrorData{Error: errPlain, Context: "connect"})
-			return fmt.Errorf("failed to connect: %v", errPlain)
+		connPlain, errPlain := dialTCP(st.ServerAddr, proxyURL, dialTimeout)
+		if errPlain == nil {
+			return st.handleConn(ctx, connPlain, connectStart)
 		}
-		return st.handleSession(ctx, connPlain, connectStart)
+		// Firewalls often let only HTTPS out: try the ingress on 443
+		st.publishStatus("websocket_fallback", fmt.Sprintf("Direct connection failed: %v, trying WebSocket over 443...", errPlain))
+		logger.Warn("Direct connection failed, trying WebSocket over port 443: %v", errPlain)
 	}
 
-	return st.handleSession(ctx, conn, connectStart)
+	st.publishStatus("dialing", fmt.Sprintf("Connecting to %s (WebSocket)...", st.ServerAddr))
+	conn, err := dialWebSocket(st.ServerAddr, tlsConfig, st.Proxy)
+	if err != nil {
+		st.publishStatus("error", fmt.Sprintf("Connection failed: %v", err))
+		st.publishEvent(events.EventError, events.ErrorData{Error: err, Context: "connect"})
+		return fmt.Errorf("failed to connect: %v", err)
+	}
+	st.mu.Lock()
+	st.viaWebSocket = true
+	st.mu.Unlock()
+	return st.handleConn(ctx, conn, connectStart)
 }
 
-func (st *SharedTunnel) handleSession(ctx context.Context, conn net.Conn, connectStart time.Time) error {
-	defer conn.Close()
-
+// tryQUIC attempts a QUIC session when enabled. It returns nil, and
+// remembers the failure for later reconnects, if the server can't be
+// reached over UDP.
+func (st *SharedTunnel) tryQUIC(tlsConfig *tls.Config, proxyURL *url.URL) transport.Session {
 	st.mu.Lock()
-	if st.closed {
+	skip := !st.QUIC || st.quicFailed
+	st.mu.Unlock()
+	if skip {
+		return nil
+	}
+	if proxyURL != nil {
+		// Proxies only carry TCP
+		logger.Info("Using TCP instead of QUIC through the proxy")
+		return nil
+	}
+
+	st.publishStatus("dialing", fmt.Sprintf("Connecting to %s (QUIC)...", st.ServerAddr))
+	session, err := dialQUIC(st.ServerAddr, tlsConfig)
+	if err != nil {
+		st.publishStatus("quic_fallback", fmt.Sprintf("QUIC failed: %v, using TCP...", err))
+		logger.Warn("QUIC connection failed, falling back to TCP: %v", err)
+		st.mu.Lock()
+		st.quicFailed = true
 		st.mu.Unlock()
-		return errors.New("tunnel is closed")
+		return nil
 	}
-	st.mu.Unlock()
+	logger.Info("Connected to %s over QUIC", st.ServerAddr)
+	return session
+}
+
+// handleConn runs the tunnel over a TCP connection multiplexed with yamux.
+func (st *SharedTunnel) handleConn(ctx context.Context, conn net.Conn, connectStart time.Time) error {
+	defer conn.Close()
 
 	// Start Yamux Client
 	st.publishStatus("yamux_init", "Initializing multiplexed connection...")
@@ -196,14 +311,26 @@ func (st *SharedTunnel) handleSession(ctx context.Context, conn net.Conn, connec
 		st.publishStatus("error", fmt.Sprintf("Failed to init yamux: %v", err))
 		return fmt.Errorf("failed to start yamux: %v", err)
 	}
+	return st.handleSession(ctx, session, connectStart)
+}
 
+// handleSession runs the handshake and serves streams on a session of
+// either transport until it ends.
+func (st *SharedTunnel) handleSession(ctx context.Context, session transport.Session, connectStart time.Time) error {
 	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		session.Close()
+		return errors.New("tunnel is closed")
+	}
 	st.session = session
 	st.mu.Unlock()
 
 	defer func() {
 		st.mu.Lock()
 		st.session = nil
+		st.control = nil
+		st.closeNotice = nil
 		st.mu.Unlock()
 		session.Close()
 	}()
@@ -211,6 +338,7 @@ func (st *SharedTunnel) handleSession(ctx context.Context, conn net.Conn, connec
 	// Watch for context cancellation to close session
 	go func() {
 		<-ctx.Done()
+		st.notifyClose()
 		session.Close()
 	}()
 
@@ -227,7 +355,13 @@ func (st *SharedTunnel) handleSession(ctx context.Context, conn net.Conn, connec
 
 	// Auth
 	st.publishStatus("authenticating", "Authenticating with server...")
-	authReq := protocol.AuthRequest{Token: st.Token, Force: st.Force}
+	st.mu.Lock()
+	resumeToken := st.resumeToken
+	st.mu.Unlock()
+	if resumeToken != "" {
+		logger.Info("Resuming previous session")
+	}
+	authReq := newAuthRequest(st.Token, st.Force, sharedTunnelCapabilities, resumeToken)
 	if err := json.NewEncoder(stream).Encode(authReq); err != nil {
 		st.publishStatus("error", fmt.Sprintf("Failed to send auth: %v", err))
 		return err
@@ -235,11 +369,31 @@ func (st *SharedTunnel) handleSession(ctx context.Context, conn net.Conn, connec
 
 	// Request all subdomains
 	st.publishStatus("requesting_tunnel", "Requesting tunnels...")
+	httpTunnels := st.httpTunnels()
 	var requestedDomains []string
-	for subdomain := range st.Tunnels {
+	for subdomain := range httpTunnels {
 		requestedDomains = append(requestedDomains, subdomain)
 	}
-	tunnelReq := protocol.TunnelRequest{RequestedDomains: requestedDomains}
+	var tcpTunnels []string
+	for name := range st.TCPTunnels {
+		tcpTunnels = append(tcpTunnels, name)
+	}
+	var udpTunnels []string
+	for name := range st.UDPTunnels {
+		udpTunnels = append(udpTunnels, name)
+	}
+	var tlsDomains []string
+	for subdomain := range st.TLSTunnels {
+		tlsDomains = append(tlsDomains, subdomain)
+	}
+	tunnelReq := protocol.TunnelRequest{
+		RequestedDomains: requestedDomains,
+		TCPTunnels:       tcpTunnels,
+		UDPTunnels:       udpTunnels,
+		TLSDomains:       tlsDomains,
+		Shared:           st.Shared,
+		Access:           st.Access,
+	}
 	if err := json.NewEncoder(stream).Encode(tunnelReq); err != nil {
 		st.publishStatus("error", fmt.Sprintf("Failed to request tunnel: %v", err))
 		return err
@@ -248,8 +402,10 @@ func (st *SharedTunnel) handleSession(ctx context.Context, conn net.Conn, connec
 
 	// Read response
 	stream.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	// Keep the decoder: it may buffer control messages sent right after the response
+	decoder := json.NewDecoder(stream)
 	var resp protocol.InitResponse
-	if err := json.NewDecoder(stream).Decode(&resp); err != nil {
+	if err := decoder.Decode(&resp); err != nil {
 		st.publishStatus("error", fmt.Sprintf("Failed to read response: %v", err))
 		return err
 	}
@@ -257,15 +413,26 @@ func (st *SharedTunnel) handleSession(ctx context.Context, conn net.Conn, connec
 
 	if !resp.Success {
 		st.publishStatus("error", resp.Error)
-		if resp.ErrorCode == protocol.ErrorCodeAlreadyConnected {
-			return &AlreadyConnectedError{Message: resp.Error}
-		}
-		return fmt.Errorf("server error: %s", resp.Error)
+		return handshakeError(&resp)
+	}
+	logServerInfo(&resp)
+
+	// A server that ignores the policies would serve the tunnels to anyone
+	if len(st.Access) > 0 && !protocol.HasCapability(resp.Capabilities, protocol.CapabilityAccessPolicy) {
+		err := &UnsupportedServerError{Message: "The server does not support access policies; remove them from gopublic.yaml or update the server"}
+		st.publishStatus("error", err.Error())
+		return err
+	}
+	if st.hasLoginWall() && !protocol.HasCapability(resp.Capabilities, protocol.CapabilityLoginWall) {
+		err := &UnsupportedServerError{Message: "The server does not support login walls; remove them from gopublic.yaml or update the server"}
+		st.publishStatus("error", err.Error())
+		return err
 	}
 
 	// Store bound domains
 	st.mu.Lock()
 	st.boundDomains = resp.BoundDomains
+	st.resumeToken = resp.ResumeToken
 	st.mu.Unlock()
 
 	// Calculate latency
@@ -283,54 +450,207 @@ func (st *SharedTunnel) handleSession(ctx context.Context, conn net.Conn, connec
 	}
 	st.publishEvent(events.EventConnected, connectedData)
 
-	// Determine scheme (https for remote, http for local)
-	host, _, _ := net.SplitHostPort(st.ServerAddr)
-	if host == "" {
-		host = st.ServerAddr
-	}
-	isLocal := host == "localhost" || host == "127.0.0.1" || host == "::1"
-	scheme := "https"
-	if isLocal {
-		scheme = "http"
-	}
-
 	// Publish TunnelReady for each subdomain -> localPort mapping
 	// This populates the Forwarding section in TUI
-	for subdomain, localPort := range st.Tunnels {
-		// Find matching bound domain for this subdomain
-		var boundDomainsForTunnel []string
-		for _, bd := range resp.BoundDomains {
-			if strings.HasPrefix(bd, subdomain+".") || bd == subdomain {
-				boundDomainsForTunnel = append(boundDomainsForTunnel, bd)
-			}
-		}
-		if len(boundDomainsForTunnel) == 0 {
-			// Fallback: use any bound domain that starts with subdomain
-			for _, bd := range resp.BoundDomains {
-				if strings.Contains(bd, subdomain) {
-					boundDomainsForTunnel = append(boundDomainsForTunnel, bd)
-					break
-				}
-			}
-		}
-		if len(boundDomainsForTunnel) > 0 {
+	for subdomain, localPort := range httpTunnels {
+		st.publishHTTPTunnelReady(subdomain, localPort, resp.BoundDomains)
+	}
+
+	// Publish TunnelReady for each TLS passthrough domain
+	for _, domain := range resp.TLSDomains {
+		if subdomain, target, ok := lookupBySubdomain(st.TLSTunnels, domain); ok {
 			st.publishEvent(events.EventTunnelReady, events.TunnelReadyData{
 				Name:         subdomain,
-				LocalPort:    localPort,
-				BoundDomains: boundDomainsForTunnel,
-				Scheme:       scheme,
+				LocalPort:    target.LocalAddr,
+				BoundDomains: []string{domain},
+				Scheme:       "https",
 			})
 		}
 	}
 
+	// Publish TunnelReady for each raw TCP tunnel with its public address
+	for _, b := range resp.TCPBindings {
+		st.publishEvent(events.EventTunnelReady, events.TunnelReadyData{
+			Name:         b.Name,
+			LocalPort:    st.TCPTunnels[b.Name],
+			BoundDomains: []string{b.Addr},
+			Scheme:       "tcp",
+		})
+	}
+	for name := range st.TCPTunnels {
+		if !hasPortBinding(resp.TCPBindings, name) {
+			logger.Warn("TCP tunnel '%s' was not bound by the server (TCP tunnels disabled or port limit reached)", name)
+		}
+	}
+
+	// Publish TunnelReady for each UDP tunnel with its public address
+	for _, b := range resp.UDPBindings {
+		st.publishEvent(events.EventTunnelReady, events.TunnelReadyData{
+			Name:         b.Name,
+			LocalPort:    st.UDPTunnels[b.Name],
+			BoundDomains: []string{b.Addr},
+			Scheme:       "udp",
+		})
+	}
+	for name := range st.UDPTunnels {
+		if !hasPortBinding(resp.UDPBindings, name) {
+			logger.Warn("UDP tunnel '%s' was not bound by the server (public ports disabled or port limit reached)", name)
+		}
+	}
+
+	// The handshake stream stays open as the control channel
+	var ctrl *controlStream
+	if protocol.HasCapability(resp.Capabilities, protocol.CapabilityControlStream) {
+		ctrl = newControlStream(stream, decoder, st.publishEvent, st.stats)
+		st.mu.Lock()
+		if protocol.HasCapability(resp.Capabilities, protocol.CapabilityRuntimeBind) {
+			st.control = ctrl
+		}
+		if protocol.HasCapability(resp.Capabilities, protocol.CapabilityCloseNotice) {
+			st.closeNotice = ctrl
+		}
+		st.mu.Unlock()
+		go ctrl.run()
+	}
+
 	// Accept incoming streams
 	st.acceptStreams(session)
 
+	// A draining server said when to come back; a session policy said whether to
+	if ctrl != nil {
+		ctrl.finish()
+		if goAway := ctrl.goingAwayError(); goAway != nil {
+			return goAway
+		}
+		if closed := ctrl.sessionClosedError(); closed != nil {
+			return closed
+		}
+	}
+	return nil
+}
+
+// httpTunnels returns a copy of the HTTP tunnels, which BindTunnel and
+// ReleaseTunnel may change while the tunnel is running.
+func (st *SharedTunnel) httpTunnels() map[string]string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	tunnels := make(map[string]string, len(st.Tunnels))
+	for subdomain, localPort := range st.Tunnels {
+		tunnels[subdomain] = localPort
+	}
+	return tunnels
+}
+
+// publishHTTPTunnelReady publishes TunnelReady for an HTTP tunnel with the
+// bound domains that belong to its subdomain.
+func (st *SharedTunnel) publishHTTPTunnelReady(subdomain, localPort string, boundDomains []string) {
+	// Find matching bound domain for this subdomain
+	var boundDomainsForTunnel []string
+	for _, bd := range boundDomains {
+		if strings.HasPrefix(bd, subdomain+".") || bd == subdomain {
+			boundDomainsForTunnel = append(boundDomainsForTunnel, bd)
+		}
+	}
+	if len(boundDomainsForTunnel) == 0 {
+		// Fallback: use any bound domain that starts with subdomain
+		for _, bd := range boundDomains {
+			if strings.Contains(bd, subdomain) {
+				boundDomainsForTunnel = append(boundDomainsForTunnel, bd)
+				break
+			}
+		}
+	}
+	if len(boundDomainsForTunnel) == 0 {
+		return
+	}
+
+	// Determine scheme (https for remote, http for local)
+	scheme := "https"
+	if isLocalAddr(st.ServerAddr) {
+		scheme = "http"
+	}
+	st.publishEvent(events.EventTunnelReady, events.TunnelReadyData{
+		Name:         subdomain,
+		LocalPort:    localPort,
+		BoundDomains: boundDomainsForTunnel,
+		Scheme:       scheme,
+	})
+}
+
+// BindTunnel adds an HTTP tunnel while the tunnel is running. If the session
+// supports runtime binding the domain is bound right away; otherwise it is
+// requested on the next reconnect.
+func (st *SharedTunnel) BindTunnel(subdomain, localPort string) error {
+	st.mu.Lock()
+	if _, exists := st.Tunnels[subdomain]; exists {
+		st.mu.Unlock()
+		return fmt.Errorf("tunnel for %s already exists", subdomain)
+	}
+	if st.Tunnels == nil {
+		st.Tunnels = make(map[string]string)
+	}
+	st.Tunnels[subdomain] = localPort
+	ctrl := st.control
+	st.mu.Unlock()
+
+	if ctrl == nil {
+		return nil
+	}
+
+	result, err := ctrl.request(protocol.ControlBind, subdomain)
+	if err != nil {
+		st.mu.Lock()
+		delete(st.Tunnels, subdomain)
+		st.mu.Unlock()
+		return fmt.Errorf("failed to bind %s: %w", subdomain, err)
+	}
+
+	st.mu.Lock()
+	st.boundDomains = append(st.boundDomains, result.Domain)
+	st.mu.Unlock()
+
+	logger.Info("Bound %s -> localhost:%s", result.Domain, localPort)
+	st.publishHTTPTunnelReady(subdomain, localPort, []string{result.Domain})
+	return nil
+}
+
+// ReleaseTunnel removes an HTTP tunnel while the tunnel is running and
+// releases its domain on the server. Other tunnels are left untouched.
+func (st *SharedTunnel) ReleaseTunnel(subdomain string) error {
+	st.mu.Lock()
+	if _, exists := st.Tunnels[subdomain]; !exists {
+		st.mu.Unlock()
+		return fmt.Errorf("no tunnel for %s", subdomain)
+	}
+	delete(st.Tunnels, subdomain)
+	ctrl := st.control
+	st.mu.Unlock()
+
+	st.publishEvent(events.EventTunnelRemoved, events.TunnelRemovedData{Name: subdomain})
+	if ctrl == nil {
+		return nil
+	}
+
+	result, err := ctrl.request(protocol.ControlRelease, subdomain)
+	if err != nil {
+		return fmt.Errorf("failed to release %s: %w", subdomain, err)
+	}
+
+	st.mu.Lock()
+	for i, d := range st.boundDomains {
+		if d == result.Domain {
+			st.boundDomains = append(st.boundDomains[:i:i], st.boundDomains[i+1:]...)
+			break
+		}
+	}
+	st.mu.Unlock()
+
+	logger.Info("Released %s", result.Domain)
 	return nil
 }
 
 // acceptStreams accepts incoming streams from the server and routes them.
-func (st *SharedTunnel) acceptStreams(session *yamux.Session) {
+func (st *SharedTunnel) acceptStreams(session transport.Session) {
 	for {
 		stream, err := session.Accept()
 		if err != nil {
@@ -349,7 +669,8 @@ func (st *SharedTunnel) acceptStreams(session *yamux.Session) {
 	}
 }
 
-// proxyStream routes a stream to the correct local port based on Host header.
+// proxyStream routes a stream to the correct local port based on its stream
+// header or, for servers that send none, the Host header.
 func (st *SharedTunnel) proxyStream(remote net.Conn) {
 	defer remote.Close()
 	startTime := time.Now()
@@ -362,19 +683,54 @@ func (st *SharedTunnel) proxyStream(remote net.Conn) {
 	st.trackConn(remote)
 	defer st.untrackConn(remote)
 
-	// Read HTTP request to determine the target port
 	reader := bufio.NewReader(remote)
+
+	// Typed streams carry raw TCP, TLS or UDP traffic, or an HTTP request
+	// together with its visitor
+	var httpHeader *protocol.StreamHeader
+	if protocol.HasStreamHeader(reader) {
+		header, err := protocol.ReadStreamHeader(reader)
+		if err != nil {
+			logger.Warn("Failed to read stream header: %v", err)
+			return
+		}
+		switch header.Proto {
+		case protocol.StreamProtoHTTP:
+			httpHeader = header
+		case protocol.StreamProtoTCP:
+			st.proxyTCPStream(&bufferedConn{Conn: remote, r: reader}, header)
+			return
+		case protocol.StreamProtoTLS:
+			st.proxyTLSStream(&bufferedConn{Conn: remote, r: reader}, header)
+			return
+		case protocol.StreamProtoUDP:
+			st.proxyUDPStream(&bufferedConn{Conn: remote, r: reader}, header)
+			return
+		}
+	}
+
+	// Read HTTP request to determine the target port
 	req, err := http.ReadRequest(reader)
 	if err != nil {
 		// Not HTTP - can't route without Host header
 		logger.Warn("Failed to parse HTTP request for routing: %v", err)
 		return
 	}
+	// Servers without a control stream report an exceeded quota in-band
+	if isLegacyQuotaRequest(req) {
+		answerLegacyQuotaRequest(remote, st.publishEvent)
+		return
+	}
 
-	// Extract subdomain from Host header
-	localPort := st.getLocalPortForHost(req.Host)
+	// Route by the bound domain the server picked, or by the Host header of
+	// servers that send no stream header
+	host := req.Host
+	if httpHeader != nil && httpHeader.Domain != "" {
+		host = httpHeader.Domain
+	}
+	localPort := st.getLocalPortForHost(host)
 	if localPort == "" {
-		logger.Warn("No tunnel configured for host: %s", req.Host)
+		logger.Warn("No tunnel configured for host: %s", host)
 		// Send 502 Bad Gateway response
 		resp := &http.Response{
 			StatusCode: http.StatusBadGateway,
@@ -400,16 +756,19 @@ func (st *SharedTunnel) proxyStream(remote net.Conn) {
 	}
 	defer local.Close()
 
-	// Publish request start event
-	if req.Header.Get("X-GoPublic-Control") == "bandwidth_exceeded" || strings.HasPrefix(req.URL.Path, "/__gopublic/control/") {
-		st.publishEvent(events.EventLog, events.LogData{Level: "warn", Message: "Дневной лимит трафика исчерпан: внешний URL тоннеля будет отдавать 429 до завтра."})
-		resp := &http.Response{StatusCode: http.StatusNoContent, Status: "204 No Content", Proto: "HTTP/1.1", ProtoMajor: 1, ProtoMinor: 1, Header: make(http.Header), Body: io.NopCloser(bytes.NewReader(nil))}
-		_ = resp.Write(remote)
-		return
+	if httpHeader != nil {
+		setForwardedHeaders(req, httpHeader)
 	}
 
+	// Publish request start event
 	st.publishEvent(events.EventRequestStart, events.RequestData{Method: req.Method, Path: req.URL.Path})
 
+	// gRPC calls stream both ways and reach the local server over HTTP/2
+	if isGRPCRequest(req) {
+		st.proxyGRPCStream(remote, local, req, startTime)
+		return
+	}
+
 	// Buffer request body for inspector
 	var reqBody []byte
 	if req.Body != nil {
@@ -537,6 +896,35 @@ func (st *SharedTunnel) proxyStream(remote net.Conn) {
 	}
 }
 
+// proxyGRPCStream forwards a gRPC call to the local server. Its messages are
+// streamed, so the inspector records the headers without the bodies.
+func (st *SharedTunnel) proxyGRPCStream(remote, local net.Conn, req *http.Request, startTime time.Time) {
+	resp, totalBytes, err := proxyGRPC(remote, local, req)
+	if resp == nil {
+		logger.Error("Failed to forward gRPC call to local: %v", err)
+		inspector.AddExchange(req, nil, nil, nil, time.Since(startTime))
+		st.publishEvent(events.EventError, events.ErrorData{Error: err, Context: "grpc"})
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to stream gRPC response to remote: %v", err)
+		st.publishEvent(events.EventError, events.ErrorData{Error: err, Context: "write_response"})
+	}
+
+	duration := time.Since(startTime)
+	inspector.AddExchange(req, []byte("[gRPC streaming]"), resp, []byte("[gRPC streaming]"), duration)
+	if st.stats != nil {
+		st.stats.RecordRequest(duration, totalBytes)
+	}
+	st.publishEvent(events.EventRequestComplete, events.RequestData{
+		Method:   req.Method,
+		Path:     req.URL.Path,
+		Status:   resp.StatusCode,
+		Duration: duration,
+		Bytes:    totalBytes,
+	})
+}
+
 // copyBidirectionalWithReader copies data bidirectionally using a buffered reader
 // for one side to preserve peeked/buffered data during WebSocket upgrades.
 func (st *SharedTunnel) copyBidirectionalWithReader(remote net.Conn, local net.Conn, localReader *bufio.Reader) {
@@ -570,17 +958,101 @@ func (st *SharedTunnel) copyBidirectionalWithReader(remote net.Conn, local net.C
 	wg.Wait()
 }
 
+// proxyTCPStream pipes a raw TCP stream to the local address of its tunnel.
+func (st *SharedTunnel) proxyTCPStream(remote net.Conn, header *protocol.StreamHeader) {
+	localAddr, ok := st.TCPTunnels[header.Name]
+	if !ok {
+		logger.Warn("No TCP tunnel configured with name: %s", header.Name)
+		return
+	}
+
+	local, err := net.Dial("tcp", localDialAddr(localAddr))
+	if err != nil {
+		friendlyMsg := formatLocalDialError(localAddr, err)
+		logger.Error("%s", friendlyMsg)
+		st.publishEvent(events.EventError, events.ErrorData{Error: fmt.Errorf("%s", friendlyMsg), Context: "dial_local"})
+		return
+	}
+	defer local.Close()
+
+	logger.Info("TCP connection from %s -> %s", header.RemoteAddr, localAddr)
+	copyTCPStream(remote, local)
+}
+
+// proxyUDPStream replays the datagrams of one UDP flow to the local address of its tunnel.
+func (st *SharedTunnel) proxyUDPStream(remote net.Conn, header *protocol.StreamHeader) {
+	localAddr, ok := st.UDPTunnels[header.Name]
+	if !ok {
+		logger.Warn("No UDP tunnel configured with name: %s", header.Name)
+		return
+	}
+
+	local, err := net.Dial("udp", localDialAddr(localAddr))
+	if err != nil {
+		logger.Error("Failed to open local UDP socket for %s: %v", localAddr, err)
+		st.publishEvent(events.EventError, events.ErrorData{Error: err, Context: "dial_local"})
+		return
+	}
+	defer local.Close()
+
+	logger.Info("UDP flow from %s -> %s", header.RemoteAddr, localAddr)
+	copyUDPStream(remote, local)
+}
+
+// proxyTLSStream handles a TLS passthrough stream. With a certificate configured
+// the client terminates TLS and forwards plaintext; otherwise the raw TLS bytes
+// go to the local service, which terminates TLS itself.
+func (st *SharedTunnel) proxyTLSStream(remote net.Conn, header *protocol.StreamHeader) {
+	_, target, ok := lookupBySubdomain(st.TLSTunnels, header.Domain)
+	if !ok {
+		logger.Warn("No TLS tunnel configured for host: %s", header.Domain)
+		return
+	}
+
+	if target.Certificate != nil {
+		tlsConn := tls.Server(remote, &tls.Config{Certificates: []tls.Certificate{*target.Certificate}})
+		tlsConn.SetDeadline(time.Now().Add(10 * time.Second))
+		if err := tlsConn.Handshake(); err != nil {
+			logger.Warn("TLS handshake with %s failed: %v", header.RemoteAddr, err)
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		remote = tlsConn
+	}
+
+	local, err := net.Dial("tcp", localDialAddr(target.LocalAddr))
+	if err != nil {
+		friendlyMsg := formatLocalDialError(target.LocalAddr, err)
+		logger.Error("%s", friendlyMsg)
+		st.publishEvent(events.EventError, events.ErrorData{Error: fmt.Errorf("%s", friendlyMsg), Context: "dial_local"})
+		return
+	}
+	defer local.Close()
+
+	logger.Info("TLS connection from %s for %s -> %s", header.RemoteAddr, header.Domain, target.LocalAddr)
+	copyTCPStream(remote, local)
+}
+
 // getLocalPortForHost extracts subdomain from host and returns the local port.
 func (st *SharedTunnel) getLocalPortForHost(host string) string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	_, port, _ := lookupBySubdomain(st.Tunnels, host)
+	return port
+}
+
+// lookupBySubdomain finds the tunnel whose subdomain matches host.
+// It returns the matching subdomain key together with its value.
+func lookupBySubdomain[T any](tunnels map[string]T, host string) (string, T, bool) {
 	// Remove port if present
 	if idx := strings.LastIndex(host, ":"); idx != -1 {
 		host = host[:idx]
 	}
 
 	// Try exact match first (full hostname)
-	for subdomain, port := range st.Tunnels {
+	for subdomain, v := range tunnels {
 		if strings.HasPrefix(host, subdomain+".") || host == subdomain {
-			return port
+			return subdomain, v, true
 		}
 	}
 
@@ -590,11 +1062,8 @@ func (st *SharedTunnel) getLocalPortForHost(host string) string {
 		subdomain = host[:idx]
 	}
 
-	if port, ok := st.Tunnels[subdomain]; ok {
-		return port
-	}
-
-	return ""
+	v, ok := tunnels[subdomain]
+	return subdomain, v, ok
 }
 
 // StartWithReconnect starts the tunnel with automatic reconnection.
@@ -619,20 +1088,72 @@ func (st *SharedTunnel) StartWithReconnect(ctx context.Context, config *Reconnec
 		logger.Info("Connecting to %s...", st.ServerAddr)
 
 		err := st.Start(ctx)
-		if err == nil {
-			return nil
-		}
 
-		// Check if context was cancelled
+		// Check if context was cancelled or the tunnel shut down
 		if ctx.Err() != nil {
 			return ctx.Err()
 		}
+		if st.isClosed() {
+			return nil
+		}
+
+		// The session ended after connecting (e.g. a network drop): come
+		// back right away, presenting the resume token
+		if err == nil {
+			logger.Info("Connection ended, will reconnect...")
+			st.publishStatus("disconnected", "Connection ended, reconnecting...")
+			attempt = 0
+			delay = config.InitialDelay
+			continue
+		}
 
 		if IsAlreadyConnectedError(err) {
 			logger.Error("Session conflict: %v", err)
 			st.publishStatus("error", fmt.Sprintf("Session conflict: %v", err))
 			return err
 		}
+		if IsIncompatibleClientError(err) {
+			logger.Error("Client update required: %v", err)
+			st.publishStatus("error", err.Error())
+			return err
+		}
+		if IsUnsupportedServerError(err) {
+			logger.Error("%v", err)
+			return err
+		}
+
+		// The server drained the session before a restart: come back when it
+		// asked instead of backing off
+		var goAway *GoingAwayError
+		if errors.As(err, &goAway) {
+			logger.Info("Server is restarting, reconnecting in %v...", goAway.ReconnectIn)
+			st.publishStatus("reconnecting", fmt.Sprintf("Server is restarting, reconnecting in %v...", goAway.ReconnectIn))
+			select {
+			case <-ctx.Done():
+				logger.Info("Tunnel shutdown requested during reconnect wait")
+				return ctx.Err()
+			case <-time.After(goAway.ReconnectIn):
+			}
+			attempt = 0
+			delay = config.InitialDelay
+			continue
+		}
+
+		// A session policy closed the session: its code says whether to come
+		// back, and an expired session comes back right away
+		var closed *SessionClosedError
+		if errors.As(err, &closed) {
+			if !closed.Reconnect() {
+				logger.Error("Session closed by the server: %v", err)
+				st.publishStatus("error", err.Error())
+				return err
+			}
+			logger.Info("Session closed by the server (%s), reconnecting...", closed.Code)
+			st.publishStatus("reconnecting", fmt.Sprintf("Session closed by the server (%s), reconnecting...", closed.Code))
+			attempt = 0
+			delay = config.InitialDelay
+			continue
+		}
 
 		logger.Error("Connection failed: %v", err)
 		st.publishStatus("reconnecting", fmt.Sprintf("Connection failed, retrying in %v...", delay))
@@ -655,6 +1176,25 @@ func (st *SharedTunnel) StartWithReconnect(ctx context.Context, config *Reconnec
 	}
 }
 
+// isClosed reports whether Shutdown was called.
+func (st *SharedTunnel) isClosed() bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.closed
+}
+
+// notifyClose lets the server release the domains of the current session
+// right away instead of holding them for a reconnect. It is sent once.
+func (st *SharedTunnel) notifyClose() {
+	st.mu.Lock()
+	ctrl := st.closeNotice
+	st.closeNotice = nil
+	st.mu.Unlock()
+	if ctrl != nil {
+		ctrl.notifyClose()
+	}
+}
+
 // Shutdown gracefully shuts down the tunnel.
 func (st *SharedTunnel) Shutdown(ctx context.Context) error {
 	st.mu.Lock()
@@ -663,7 +1203,11 @@ func (st *SharedTunnel) Shutdown(ctx context.Context) error {
 		return nil
 	}
 	st.closed = true
+	st.mu.Unlock()
 
+	st.notifyClose()
+
+	st.mu.Lock()
 	if st.session != nil {
 		st.session.Close()
 	}
@@ -0,0 +1,89 @@
+package tunnel
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"gopublic/internal/client/logger"
+	"gopublic/pkg/protocol"
+)
+
+// localDialAddr turns a tunnel address ("5432" or "host:port") into a dialable address.
+func localDialAddr(addr string) string {
+	if strings.Contains(addr, ":") {
+		return addr
+	}
+	return "localhost:" + addr
+}
+
+// hasPortBinding reports whether the server bound a TCP or UDP tunnel with the given name.
+func hasPortBinding(bindings []protocol.PortBinding, name string) bool {
+	for _, b := range bindings {
+		if b.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// bufferedConn reads through a bufio.Reader that may hold bytes already
+// consumed from the connection while parsing the stream header.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// closeWrite half-closes a connection when supported and fully closes it otherwise.
+// Closing a yamux stream only closes our write side, so it is safe to call Close there.
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
+
+// copyTCPStream pipes raw bytes between a tunnel stream and a local connection.
+func copyTCPStream(remote net.Conn, local net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	// Remote -> Local
+	go func() {
+		defer wg.Done()
+		_, err := io.Copy(local, remote)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+			logger.Warn("Error copying remote->local: %v", err)
+		}
+		closeWrite(local)
+	}()
+
+	// Local -> Remote
+	go func() {
+		defer wg.Done()
+		_, err := io.Copy(remote, local)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+			logger.Warn("Error copying local->remote: %v", err)
+		}
+		closeWrite(remote)
+	}()
+
+	wg.Wait()
+}
+
+// PassthroughTunnel is the local target of a TLS passthrough tunnel.
+// When Certificate is set the client terminates TLS itself and forwards
+// plaintext; otherwise raw TLS bytes are forwarded to LocalAddr.
+type PassthroughTunnel struct {
+	LocalAddr   string
+	Certificate *tls.Certificate
+}
@@ -11,6 +11,7 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"strings"
 	"sync"
 	"time"
@@ -19,6 +20,7 @@ import (
 	"gopublic/internal/client/inspector"
 	"gopublic/internal/client/logger"
 	"gopublic/internal/client/stats"
+	"gopublic/internal/transport"
 	"gopublic/pkg/protocol"
 
 	"github.com/hashicorp/yamux"
@@ -35,12 +37,17 @@ type Tunnel struct {
 	ServerAddr string
 	Token      string
 	LocalPort  string
-	Subdomain  string // Specific subdomain to bind (empty = bind all)
-	Force      bool   // Force disconnect existing session
-	NoCache    bool   // Add Cache-Control: no-store to responses
+	Subdomain  string   // Specific subdomain to bind (empty = bind all)
+	Force      bool     // Force disconnect existing session
+	NoCache    bool     // Add Cache-Control: no-store to responses
+	Shared     bool     // Serve the domains together with other shared sessions
+	Ephemeral  bool     // Ask for a random throwaway domain instead of owned ones
+	QUIC       bool     // Try QUIC before TCP; stays on TCP after a failed attempt
+	Proxy      *url.URL // Outbound proxy for the server connection (nil = from the environment)
 
 	// TLS configuration
-	TLSConfig *TLSConfig
+	TLSConfig  *TLSConfig
+	ClientCert *tls.Certificate // Device certificate that authenticates instead of Token (nil = token)
 
 	// Dependencies (optional, for integration with TUI)
 	eventBus *events.Bus
@@ -50,11 +57,15 @@ type Tunnel struct {
 	mu          sync.Mutex
 	wg          sync.WaitGroup
 	activeConns map[net.Conn]struct{}
-	session     *yamux.Session
+	session     transport.Session
+	closeNotice *controlStream // Set while the server accepts a close notice
 	closed      bool
 
 	// Cached connection info
 	boundDomains []string
+	resumeToken  string // Reclaims the domains on reconnect while the server reserves them
+	quicFailed   bool   // QUIC didn't connect once; reconnects go straight to TCP
+	viaWebSocket bool   // Direct dials failed once; reconnects go straight to the WebSocket
 }
 
 // NewTunnel creates a new tunnel instance.
@@ -92,6 +103,36 @@ func (t *Tunnel) SetNoCache(noCache bool) {
 	t.NoCache = noCache
 }
 
+// SetShared opts in to serving the domains together with other shared
+// sessions of the same account; the server load balances between them.
+func (t *Tunnel) SetShared(shared bool) {
+	t.Shared = shared
+}
+
+// SetEphemeral asks the server for a random domain that lives only as long
+// as the session, instead of binding the account's own domains.
+func (t *Tunnel) SetEphemeral(ephemeral bool) {
+	t.Ephemeral = ephemeral
+}
+
+// SetProxy routes the server connection through an HTTP(S) or SOCKS5 proxy.
+// With nil, HTTPS_PROXY or ALL_PROXY from the environment is used.
+func (t *Tunnel) SetProxy(proxyURL *url.URL) {
+	t.Proxy = proxyURL
+}
+
+// SetQUIC makes the tunnel connect over QUIC when the server offers it,
+// falling back to TCP on networks that block UDP.
+func (t *Tunnel) SetQUIC(quic bool) {
+	t.QUIC = quic
+}
+
+// SetClientCert presents a device certificate in the TLS handshake, which
+// the server accepts instead of the token.
+func (t *Tunnel) SetClientCert(cert *tls.Certificate) {
+	t.ClientCert = cert
+}
+
 // BoundDomains returns the domains bound to this tunnel.
 func (t *Tunnel) BoundDomains() []string {
 	t.mu.Lock()
@@ -136,11 +177,7 @@ func (t *Tunnel) Start() error {
 	t.publishEvent(events.EventConnecting, nil)
 
 	// For local development, skip TLS if server is localhost/127.0.0.1
-	host, _, _ := net.SplitHostPort(t.ServerAddr)
-	if host == "" {
-		host = t.ServerAddr
-	}
-	isLocal := host == "localhost" || host == "127.0.0.1" || host == "::1"
+	isLocal := isLocalAddr(t.ServerAddr)
 
 	connectStart := time.Now()
 
@@ -156,49 +193,96 @@ func (t *Tunnel) Start() error {
 			t.publishEvent(events.EventError, events.ErrorData{Error: err, Context: "connect"})
 			return fmt.Errorf("failed to connect to local server: %v", err)
 		}
-		return t.handleSession(conn, connectStart)
+		return t.handleConn(conn, connectStart)
 	}
 
-	// Build TLS config
-	tlsConfig := &tls.Config{}
-	if t.TLSConfig != nil {
-		tlsConfig.InsecureSkipVerify = t.TLSConfig.InsecureSkipVerify
-		if t.TLSConfig.ServerName != "" {
-			tlsConfig.ServerName = t.TLSConfig.ServerName
-		}
-	} else {
-		// Default: insecure for backward compatibility (TODO: make secure by default)
-		tlsConfig.InsecureSkipVerify = true
-	}
+	tlsConfig := clientTLSConfig(t.TLSConfig, t.ClientCert)
 
-	t.publishStatus("dialing", fmt.Sprintf("Connecting to %s (TLS)...", t.ServerAddr))
-	dialer := &net.Dialer{Timeout: dialTimeout}
-	conn, err := tls.DialWithDialer(dialer, "tcp", t.ServerAddr, tlsConfig)
+	proxyURL, err := transport.ProxyFor(t.Proxy, t.ServerAddr)
 	if err != nil {
+		t.publishStatus("error", fmt.Sprintf("Invalid proxy settings: %v", err))
+		return fmt.Errorf("invalid proxy settings: %v", err)
+	}
+	if proxyURL != nil {
+		logger.Info("Connecting through proxy %s", proxyURL.Redacted())
+	}
+
+	if session := t.tryQUIC(tlsConfig, proxyURL); session != nil {
+		return t.handleSession(session, connectStart)
+	}
+
+	t.mu.Lock()
+	viaWebSocket := t.viaWebSocket
+	t.mu.Unlock()
+	if !viaWebSocket {
+		t.publishStatus("dialing", fmt.Sprintf("Connecting to %s (TLS)...", t.ServerAddr))
+		conn, err := dialTLS(t.ServerAddr, proxyURL, dialTimeout, tlsConfig)
+		if err == nil {
+			return t.handleConn(conn, connectStart)
+		}
+		if t.ClientCert != nil && t.Token == "" {
+			err = fmt.Errorf("%w: %v", errCertNeedsTLS, err)
+			t.publishStatus("error", err.Error())
+			t.publishEvent(events.EventError, events.ErrorData{Error: err, Context: "connect"})
+			return err
+		}
 		t.publishStatus("tls_fallback", fmt.Sprintf("TLS failed: %v, trying plain TCP...", err))
 		logger.Warn("TLS connection failed, trying plain TCP: %v", err)
-		connPlain, errPlain := net.DialTimeout("tcp", t.ServerAddr, dialTimeout)
-		if errPlain != nil {
-			t.publishStatus("error", fmt.Sprintf("Connection failed: %v", errPlain))
-			t.publishEvent(events.EventError, events.ErrorData{Error: errPlain, Context: "connect"})
-			return fmt.Errorf("failed to connect: %v", errPlain)
+		connPlain, errPlain := dialTCP(t.ServerAddr, proxyURL, dialTimeout)
+		if errPlain == nil {
+			return t.handleConn(connPlain, connectStart)
 		}
-		return t.handleSession(connPlain, connectStart)
+		// Firewalls often let only HTTPS out: try the ingress on 443
+		t.publishStatus("websocket_fallback", fmt.Sprintf("Direct connection failed: %v, trying WebSocket over 443...", errPlain))
+		logger.Warn("Direct connection failed, trying WebSocket over port 443: %v", errPlain)
 	}
 
-	return t.handleSession(conn, connectStart)
+	t.publishStatus("dialing", fmt.Sprintf("Connecting to %s (WebSocket)...", t.ServerAddr))
+	conn, err := dialWebSocket(t.ServerAddr, tlsConfig, t.Proxy)
+	if err != nil {
+		t.publishStatus("error", fmt.Sprintf("Connection failed: %v", err))
+		t.publishEvent(events.EventError, events.ErrorData{Error: err, Context: "connect"})
+		return fmt.Errorf("failed to connect: %v", err)
+	}
+	t.mu.Lock()
+	t.viaWebSocket = true
+	t.mu.Unlock()
+	return t.handleConn(conn, connectStart)
 }
 
-func (t *Tunnel) handleSession(conn net.Conn, connectStart time.Time) error {
-	defer conn.Close()
-
-	// Check if already closed
+// tryQUIC attempts a QUIC session when enabled. It returns nil, and
+// remembers the failure for later reconnects, if the server can't be
+// reached over UDP.
+func (t *Tunnel) tryQUIC(tlsConfig *tls.Config, proxyURL *url.URL) transport.Session {
 	t.mu.Lock()
-	if t.closed {
+	skip := !t.QUIC || t.quicFailed
+	t.mu.Unlock()
+	if skip {
+		return nil
+	}
+	if proxyURL != nil {
+		// Proxies only carry TCP
+		logger.Info("Using TCP instead of QUIC through the proxy")
+		return nil
+	}
+
+	t.publishStatus("dialing", fmt.Sprintf("Connecting to %s (QUIC)...", t.ServerAddr))
+	session, err := dialQUIC(t.ServerAddr, tlsConfig)
+	if err != nil {
+		t.publishStatus("quic_fallback", fmt.Sprintf("QUIC failed: %v, using TCP...", err))
+		logger.Warn("QUIC connection failed, falling back to TCP: %v", err)
+		t.mu.Lock()
+		t.quicFailed = true
 		t.mu.Unlock()
-		return errors.New("tunnel is closed")
+		return nil
 	}
-	t.mu.Unlock()
+	logger.Info("Connected to %s over QUIC", t.ServerAddr)
+	return session
+}
+
+// handleConn runs the tunnel over a TCP connection multiplexed with yamux.
+func (t *Tunnel) handleConn(conn net.Conn, connectStart time.Time) error {
+	defer conn.Close()
 
 	// Start Yamux Client with custom config for better sleep/wake detection
 	t.publishStatus("yamux_init", "Initializing multiplexed connection...")
@@ -211,15 +295,26 @@ func (t *Tunnel) handleSession(conn net.Conn, connectStart time.Time) error {
 		t.publishStatus("error", fmt.Sprintf("Failed to init yamux: %v", err))
 		return fmt.Errorf("failed to start yamux: %v", err)
 	}
+	return t.handleSession(session, connectStart)
+}
 
-	// Store session for graceful shutdown
+// handleSession runs the handshake and serves streams on a session of
+// either transport until it ends.
+func (t *Tunnel) handleSession(session transport.Session, connectStart time.Time) error {
+	// Check if already closed; store session for graceful shutdown
 	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		session.Close()
+		return errors.New("tunnel is closed")
+	}
 	t.session = session
 	t.mu.Unlock()
 
 	defer func() {
 		t.mu.Lock()
 		t.session = nil
+		t.closeNotice = nil
 		t.mu.Unlock()
 		session.Close()
 	}()
@@ -238,7 +333,13 @@ func (t *Tunnel) handleSession(conn net.Conn, connectStart time.Time) error {
 
 	// Auth
 	t.publishStatus("authenticating", "Authenticating with server...")
-	authReq := protocol.AuthRequest{Token: t.Token, Force: t.Force}
+	t.mu.Lock()
+	resumeToken := t.resumeToken
+	t.mu.Unlock()
+	if resumeToken != "" {
+		logger.Info("Resuming previous session")
+	}
+	authReq := newAuthRequest(t.Token, t.Force, tunnelCapabilities, resumeToken)
 	if err := json.NewEncoder(stream).Encode(authReq); err != nil {
 		t.publishStatus("error", fmt.Sprintf("Failed to send auth: %v", err))
 		return err
@@ -250,7 +351,7 @@ func (t *Tunnel) handleSession(conn net.Conn, connectStart time.Time) error {
 	if t.Subdomain != "" {
 		requestedDomains = []string{t.Subdomain}
 	}
-	tunnelReq := protocol.TunnelRequest{RequestedDomains: requestedDomains}
+	tunnelReq := protocol.TunnelRequest{RequestedDomains: requestedDomains, Shared: t.Shared, Ephemeral: t.Ephemeral}
 	if err := json.NewEncoder(stream).Encode(tunnelReq); err != nil {
 		t.publishStatus("error", fmt.Sprintf("Failed to request tunnel: %v", err))
 		return err
@@ -261,8 +362,10 @@ func (t *Tunnel) handleSession(conn net.Conn, connectStart time.Time) error {
 	// Read Response with timeout to prevent hanging
 	t.publishStatus("waiting_response", "Waiting for server response...")
 	stream.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	// Keep the decoder: it may buffer control messages sent right after the response
+	decoder := json.NewDecoder(stream)
 	var resp protocol.InitResponse
-	if err := json.NewDecoder(stream).Decode(&resp); err != nil {
+	if err := decoder.Decode(&resp); err != nil {
 		t.publishStatus("error", fmt.Sprintf("Failed to read response: %v", err))
 		return fmt.Errorf("handshake read failed: %v", err)
 	}
@@ -271,12 +374,17 @@ func (t *Tunnel) handleSession(conn net.Conn, connectStart time.Time) error {
 
 	if !resp.Success {
 		// Check for specific error code
-		if resp.ErrorCode == protocol.ErrorCodeAlreadyConnected {
+		err := handshakeError(&resp)
+		if IsAlreadyConnectedError(err) {
 			t.publishStatus("error", fmt.Sprintf("Already connected: %s", resp.Error))
-			return &AlreadyConnectedError{Message: resp.Error}
+		} else {
+			t.publishStatus("error", fmt.Sprintf("Server error: %s", resp.Error))
 		}
-		t.publishStatus("error", fmt.Sprintf("Server error: %s", resp.Error))
-		return fmt.Errorf("server error: %s", resp.Error)
+		return err
+	}
+	logServerInfo(&resp)
+	if t.Ephemeral && !protocol.HasCapability(resp.Capabilities, protocol.CapabilityEphemeralDomains) {
+		logger.Warn("Server does not support ephemeral domains, your own domains were bound instead")
 	}
 
 	// Calculate latency and record stats
@@ -288,6 +396,7 @@ func (t *Tunnel) handleSession(conn net.Conn, connectStart time.Time) error {
 	// Cache bound domains
 	t.mu.Lock()
 	t.boundDomains = resp.BoundDomains
+	t.resumeToken = resp.ResumeToken
 	t.mu.Unlock()
 
 	// Determine scheme for display
@@ -318,7 +427,19 @@ func (t *Tunnel) handleSession(conn net.Conn, connectStart time.Time) error {
 		})
 	}
 
-	stream.Close() // Handshake done
+	// The handshake stream stays open as the control channel when the server supports it
+	var ctrl *controlStream
+	if protocol.HasCapability(resp.Capabilities, protocol.CapabilityControlStream) {
+		ctrl = newControlStream(stream, decoder, t.publishEvent, t.stats)
+		if protocol.HasCapability(resp.Capabilities, protocol.CapabilityCloseNotice) {
+			t.mu.Lock()
+			t.closeNotice = ctrl
+			t.mu.Unlock()
+		}
+		go ctrl.run()
+	} else {
+		stream.Close() // Handshake done
+	}
 
 	// Start sleep/wake detection goroutine
 	// This detects when the machine wakes from sleep and proactively closes the stale connection
@@ -360,6 +481,17 @@ func (t *Tunnel) handleSession(conn net.Conn, connectStart time.Time) error {
 				return nil
 			}
 			t.publishEvent(events.EventDisconnected, nil)
+			// A draining server said when to come back; a session policy
+			// said whether to
+			if ctrl != nil {
+				ctrl.finish()
+				if goAway := ctrl.goingAwayError(); goAway != nil {
+					return goAway
+				}
+				if closed := ctrl.sessionClosedError(); closed != nil {
+					return closed
+				}
+			}
 			return fmt.Errorf("session ended: %v", err)
 		}
 
@@ -398,23 +530,35 @@ func (t *Tunnel) proxyStream(remote net.Conn) {
 
 	// To support Inspector, we parse the HTTP request
 	reader := bufio.NewReader(remote)
+	header, err := readHTTPStreamHeader(reader)
+	if err != nil {
+		logger.Warn("Failed to read stream header: %v", err)
+		return
+	}
 	req, err := http.ReadRequest(reader)
 	if err != nil {
 		// Not a valid HTTP request or error? Just copy TCP bidirectionally
 		t.copyBidirectional(local, remote)
 		return
 	}
-
-	// Publish request start event
-	if req.Header.Get("X-GoPublic-Control") == "bandwidth_exceeded" || strings.HasPrefix(req.URL.Path, "/__gopublic/control/") {
-		t.publishEvent(events.EventLog, events.LogData{Level: "warn", Message: "Дневной лимит трафика исчерпан: внешний URL тоннеля будет отдавать 429 до завтра."})
-		resp := &http.Response{StatusCode: http.StatusNoContent, Status: "204 No Content", Proto: "HTTP/1.1", ProtoMajor: 1, ProtoMinor: 1, Header: make(http.Header), Body: io.NopCloser(bytes.NewReader(nil))}
-		_ = resp.Write(remote)
+	// Servers without a control stream report an exceeded quota in-band
+	if isLegacyQuotaRequest(req) {
+		answerLegacyQuotaRequest(remote, t.publishEvent)
 		return
 	}
+	if header != nil {
+		setForwardedHeaders(req, header)
+	}
 
+	// Publish request start event
 	t.publishEvent(events.EventRequestStart, events.RequestData{Method: req.Method, Path: req.URL.Path})
 
+	// gRPC calls stream both ways and reach the local server over HTTP/2
+	if isGRPCRequest(req) {
+		t.proxyGRPCStream(remote, local, req, startTime)
+		return
+	}
+
 	// Buffer request body for inspector (with error handling)
 	var reqBody []byte
 	if req.Body != nil {
@@ -532,6 +676,35 @@ func (t *Tunnel) proxyStream(remote net.Conn) {
 	}
 }
 
+// proxyGRPCStream forwards a gRPC call to the local server. Its messages are
+// streamed, so the inspector records the headers without the bodies.
+func (t *Tunnel) proxyGRPCStream(remote, local net.Conn, req *http.Request, startTime time.Time) {
+	resp, totalBytes, err := proxyGRPC(remote, local, req)
+	if resp == nil {
+		logger.Error("Failed to forward gRPC call to local: %v", err)
+		inspector.AddExchange(req, nil, nil, nil, time.Since(startTime))
+		t.publishEvent(events.EventError, events.ErrorData{Error: err, Context: "grpc"})
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to stream gRPC response to remote: %v", err)
+		t.publishEvent(events.EventError, events.ErrorData{Error: err, Context: "write_response"})
+	}
+
+	duration := time.Since(startTime)
+	inspector.AddExchange(req, []byte("[gRPC streaming]"), resp, []byte("[gRPC streaming]"), duration)
+	if t.stats != nil {
+		t.stats.RecordRequest(duration, totalBytes)
+	}
+	t.publishEvent(events.EventRequestComplete, events.RequestData{
+		Method:   req.Method,
+		Path:     req.URL.Path,
+		Status:   resp.StatusCode,
+		Duration: duration,
+		Bytes:    totalBytes,
+	})
+}
+
 // copyBidirectional copies data between two connections with proper error handling.
 // This is used for non-HTTP traffic.
 func (t *Tunnel) copyBidirectional(local, remote net.Conn) {
@@ -608,7 +781,15 @@ func (t *Tunnel) Shutdown(ctx context.Context) error {
 		return nil
 	}
 	t.closed = true
+	ctrl := t.closeNotice
+	t.mu.Unlock()
+
+	// Let the server release the domains now instead of waiting for us
+	if ctrl != nil {
+		ctrl.notifyClose()
+	}
 
+	t.mu.Lock()
 	// Close the session to stop accepting new streams
 	if t.session != nil {
 		t.session.Close()
@@ -635,6 +816,15 @@ func (t *Tunnel) Shutdown(ctx context.Context) error {
 	}
 }
 
+// isLocalAddr reports whether a server address points at this machine.
+func isLocalAddr(addr string) bool {
+	host, _, _ := net.SplitHostPort(addr)
+	if host == "" {
+		host = addr
+	}
+	return host == "localhost" || host == "127.0.0.1" || host == "::1"
+}
+
 // formatLocalDialError returns a user-friendly error message for local port connection failures.
 func formatLocalDialError(port string, err error) string {
 	errStr := err.Error()
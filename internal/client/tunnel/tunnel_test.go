@@ -9,6 +9,7 @@ import (
 
 	"gopublic/internal/client/events"
 	"gopublic/internal/client/stats"
+	"gopublic/pkg/protocol"
 )
 
 func TestNewTunnel(t *testing.T) {
@@ -371,3 +372,90 @@ func TestTLSConfig(t *testing.T) {
 		t.Errorf("expected secure.example.com, got %s", cfg.ServerName)
 	}
 }
+
+func TestLookupBySubdomain(t *testing.T) {
+	tunnels := map[string]*PassthroughTunnel{
+		"app":  {LocalAddr: "8443"},
+		"mail": {LocalAddr: "localhost:993"},
+	}
+
+	tests := []struct {
+		host      string
+		wantKey   string
+		wantFound bool
+	}{
+		{"app.example.com", "app", true},
+		{"app.example.com:443", "app", true},
+		{"mail", "mail", true},
+		{"other.example.com", "other", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			key, target, ok := lookupBySubdomain(tunnels, tt.host)
+			if ok != tt.wantFound {
+				t.Fatalf("lookupBySubdomain(%q) found = %v, want %v", tt.host, ok, tt.wantFound)
+			}
+			if key != tt.wantKey {
+				t.Errorf("lookupBySubdomain(%q) key = %q, want %q", tt.host, key, tt.wantKey)
+			}
+			if ok && target != tunnels[tt.wantKey] {
+				t.Errorf("lookupBySubdomain(%q) returned wrong tunnel", tt.host)
+			}
+		})
+	}
+}
+
+func TestCopyUDPStream(t *testing.T) {
+	// Local UDP echo server
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], addr)
+		}
+	}()
+
+	local, err := net.Dial("udp", echo.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("dial udp: %v", err)
+	}
+
+	remote, server := net.Pipe()
+	defer server.Close()
+	server.SetDeadline(time.Now().Add(2 * time.Second))
+
+	done := make(chan struct{})
+	go func() {
+		copyUDPStream(remote, local)
+		close(done)
+	}()
+
+	if err := protocol.WriteDatagram(server, []byte("query")); err != nil {
+		t.Fatalf("WriteDatagram() error: %v", err)
+	}
+	buf := make([]byte, protocol.MaxDatagramSize)
+	n, err := protocol.ReadDatagram(server, buf)
+	if err != nil {
+		t.Fatalf("ReadDatagram() error: %v", err)
+	}
+	if string(buf[:n]) != "query" {
+		t.Errorf("reply = %q, want %q", buf[:n], "query")
+	}
+
+	// Closing the stream ends the flow
+	server.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("copyUDPStream did not finish after the stream closed")
+	}
+}
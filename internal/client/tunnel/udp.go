@@ -0,0 +1,58 @@
+package tunnel
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+
+	"gopublic/internal/client/logger"
+	"gopublic/pkg/protocol"
+)
+
+// copyUDPStream relays one UDP flow: datagram frames read from the tunnel
+// stream are sent to the local socket, and replies are framed back. The flow
+// ends when the server closes the stream (e.g. after its idle timeout).
+func copyUDPStream(remote net.Conn, local net.Conn) {
+	done := make(chan struct{})
+
+	// Local -> Remote
+	go func() {
+		defer close(done)
+		buf := make([]byte, protocol.MaxDatagramSize)
+		for {
+			n, err := local.Read(buf)
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				// Reported for an earlier datagram nobody received; keep reading
+				continue
+			}
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					logger.Warn("Error reading local UDP socket: %v", err)
+				}
+				return
+			}
+			if err := protocol.WriteDatagram(remote, buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Remote -> Local
+	buf := make([]byte, protocol.MaxDatagramSize)
+	for {
+		n, err := protocol.ReadDatagram(remote, buf)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				logger.Warn("Error reading UDP frames: %v", err)
+			}
+			break
+		}
+		if _, err := local.Write(buf[:n]); err != nil {
+			logger.Warn("Error writing to local UDP socket: %v", err)
+		}
+	}
+
+	local.Close()
+	<-done
+}
@@ -11,11 +11,14 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
 	"time"
+
+	"gopublic/internal/transport"
 )
 
 // PublicKeyBase64 is set via ldflags during build
@@ -55,7 +58,22 @@ type UpdateResult struct {
 
 // httpClient with reasonable timeouts
 var httpClient = &http.Client{
-	Timeout: 30 * time.Second,
+	Timeout:   30 * time.Second,
+	Transport: proxyTransport(nil),
+}
+
+// SetProxy routes update checks and downloads through proxyURL, like the
+// tunnel connection. With nil, HTTPS_PROXY or ALL_PROXY from the environment is used.
+func SetProxy(proxyURL *url.URL) {
+	httpClient.Transport = proxyTransport(proxyURL)
+}
+
+func proxyTransport(proxyURL *url.URL) http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = func(req *http.Request) (*url.URL, error) {
+		return transport.ProxyFor(proxyURL, req.URL.Host)
+	}
+	return t
 }
 
 // CheckForUpdate checks GitHub for a newer version
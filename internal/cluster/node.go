@@ -0,0 +1,197 @@
+package cluster
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// originHeader names the node that forwarded a public request.
+	originHeader = "X-Gopublic-Cluster-Origin"
+	// visitorHeader describes the public client of a forwarded request.
+	visitorHeader = "X-Gopublic-Cluster-Visitor"
+)
+
+type forwardedKey struct{}
+
+// Visitor is the public client of a request as the node that accepted the
+// connection saw it. The internal link is plain HTTP from the origin node, so
+// forwarded requests carry it in a signed header.
+type Visitor struct {
+	RemoteAddr string
+	TLSVersion string // Empty for plain HTTP
+	SNI        string
+}
+
+// VisitorOf returns the public client of r, also for forwarded requests.
+func VisitorOf(r *http.Request) Visitor {
+	if v, ok := r.Context().Value(forwardedKey{}).(Visitor); ok {
+		return v
+	}
+	v := Visitor{RemoteAddr: r.RemoteAddr}
+	if r.TLS != nil {
+		v.TLSVersion = tls.VersionName(r.TLS.Version)
+		v.SNI = r.TLS.ServerName
+	}
+	return v
+}
+
+func (v Visitor) encode() string {
+	return url.Values{"addr": {v.RemoteAddr}, "tls": {v.TLSVersion}, "sni": {v.SNI}}.Encode()
+}
+
+func decodeVisitor(s string) Visitor {
+	q, _ := url.ParseQuery(s)
+	return Visitor{RemoteAddr: q.Get("addr"), TLSVersion: q.Get("tls"), SNI: q.Get("sni")}
+}
+
+// Node is this server's membership in a cluster: it claims the domains of
+// local tunnels, keeps the claims alive and forwards public requests for
+// domains held by other nodes over the internal link.
+type Node struct {
+	ID       string   // Unique node name
+	Addr     string   // Internal address the other nodes reach this one at
+	Secret   string   // Shared by all nodes; signs the calls on the internal link
+	Registry Registry // A MemoryRegistry means this node hosts the registry
+
+	// HeartbeatInterval is how often Run refreshes the node's claims
+	HeartbeatInterval time.Duration
+
+	transport http.RoundTripper
+}
+
+// NewNode creates a cluster node.
+func NewNode(id, addr, secret string, registry Registry) *Node {
+	return &Node{
+		ID:                id,
+		Addr:              addr,
+		Secret:            secret,
+		Registry:          registry,
+		HeartbeatInterval: 5 * time.Second,
+		transport:         http.DefaultTransport,
+	}
+}
+
+// Join drops claims left over from a previous run of this node and
+// announces it to the registry. Call it before serving tunnels.
+func (n *Node) Join() error {
+	if err := n.Registry.ReleaseNode(n.ID); err != nil {
+		return err
+	}
+	return n.Registry.Heartbeat(n.ID)
+}
+
+// Leave gives up every domain this node holds.
+func (n *Node) Leave() error {
+	return n.Registry.ReleaseNode(n.ID)
+}
+
+// Run sends heartbeats until ctx is cancelled.
+func (n *Node) Run(ctx context.Context) {
+	ticker := time.NewTicker(n.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := n.Registry.Heartbeat(n.ID); err != nil {
+				log.Printf("Cluster: heartbeat failed: %v", err)
+			}
+		}
+	}
+}
+
+// Claim records that this node serves c.Domain. NodeID and Addr are filled
+// in from the node.
+func (n *Node) Claim(c Claim) error {
+	c.NodeID, c.Addr = n.ID, n.Addr
+	return n.Registry.Claim(c)
+}
+
+// Release gives domain back once no local session serves it.
+func (n *Node) Release(domain string) error {
+	return n.Registry.Release(domain, n.ID)
+}
+
+// Owner returns the claim on domain if another node holds it.
+func (n *Node) Owner(domain string) (Claim, bool, error) {
+	c, ok, err := n.Registry.Lookup(domain)
+	if err != nil || !ok || c.NodeID == n.ID {
+		return Claim{}, false, err
+	}
+	return c, true, nil
+}
+
+// Forward proxies a public request to the node that holds its domain. The
+// Host and X-Forwarded-* headers are kept as the visitor sent them, so the
+// other node handles it like its own traffic.
+func (n *Node) Forward(w http.ResponseWriter, r *http.Request, c Claim) {
+	visitor := VisitorOf(r)
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Scheme = "http"
+			pr.Out.URL.Host = c.Addr
+			for _, h := range []string{"Forwarded", "X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto"} {
+				if v, ok := pr.In.Header[h]; ok {
+					pr.Out.Header[h] = v
+				}
+			}
+			pr.Out.Header.Set(originHeader, n.ID)
+			pr.Out.Header.Set(visitorHeader, visitor.encode())
+			sign(pr.Out, n.Secret, nil)
+		},
+		Transport: n.transport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("Cluster: forwarding %s to node %s failed: %v", r.Host, c.NodeID, err)
+			http.Error(w, "Failed to reach the server holding this tunnel", http.StatusBadGateway)
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// Handler serves the internal link: requests forwarded by other nodes go to
+// local, and registry calls are answered when this node hosts the registry.
+// Every call must be signed with the cluster secret and is accepted once.
+func (n *Node) Handler(local http.Handler) http.Handler {
+	verifier := newVerifier(n.Secret)
+	var registry http.Handler
+	if reg, ok := n.Registry.(*MemoryRegistry); ok {
+		registry = registryHandler(reg)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !verifier.verify(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		origin := r.Header.Get(originHeader)
+		visitor := decodeVisitor(r.Header.Get(visitorHeader))
+		for _, h := range signedHeaders {
+			r.Header.Del(h)
+		}
+
+		if origin != "" {
+			local.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), forwardedKey{}, visitor)))
+			return
+		}
+		if registry != nil && strings.HasPrefix(r.URL.Path, registryPath) {
+			registry.ServeHTTP(w, r)
+			return
+		}
+		http.NotFound(w, r)
+	})
+}
+
+// Forwarded reports whether r reached this node from another one. Forwarded
+// requests are never forwarded again.
+func Forwarded(r *http.Request) bool {
+	_, ok := r.Context().Value(forwardedKey{}).(Visitor)
+	return ok
+}
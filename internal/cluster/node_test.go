@@ -0,0 +1,165 @@
+package cluster
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startNode serves n's internal link and points n.Addr at it.
+func startNode(t *testing.T, n *Node, local http.Handler) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(n.Handler(local))
+	t.Cleanup(srv.Close)
+	n.Addr = strings.TrimPrefix(srv.URL, "http://")
+	return srv
+}
+
+func TestRemoteRegistry(t *testing.T) {
+	host := NewNode("a", "", "secret", NewMemoryRegistry(0))
+	srv := startNode(t, host, http.NotFoundHandler())
+
+	remote := NewRemoteRegistry(srv.URL, "secret")
+	if err := remote.Claim(Claim{Domain: "app.example.com", NodeID: "b", Addr: "10.0.0.2:7000", UserID: 1}); err != nil {
+		t.Fatalf("Claim: %v", err)
+	}
+	if err := host.Claim(Claim{Domain: "app.example.com", UserID: 1}); !errors.Is(err, ErrClaimed) {
+		t.Errorf("claim of a remotely held domain = %v, want ErrClaimed", err)
+	}
+	if err := remote.Claim(Claim{Domain: "app.example.com", NodeID: "c"}); !errors.Is(err, ErrClaimed) {
+		t.Errorf("remote conflicting claim = %v, want ErrClaimed", err)
+	}
+
+	c, ok, err := remote.Lookup("app.example.com")
+	if err != nil || !ok || c.NodeID != "b" || c.Addr != "10.0.0.2:7000" {
+		t.Errorf("Lookup() = %+v, %v, %v", c, ok, err)
+	}
+	if err := remote.Heartbeat("b"); err != nil {
+		t.Errorf("Heartbeat: %v", err)
+	}
+	if err := remote.Release("app.example.com", "b"); err != nil {
+		t.Errorf("Release: %v", err)
+	}
+	if _, ok, err := remote.Lookup("app.example.com"); ok || err != nil {
+		t.Errorf("Lookup() after release = %v, %v", ok, err)
+	}
+
+	wrong := NewRemoteRegistry(srv.URL, "guess")
+	if err := wrong.Heartbeat("b"); err == nil {
+		t.Error("registry accepted a call with the wrong secret")
+	}
+}
+
+func TestNode_Forward(t *testing.T) {
+	registry := NewMemoryRegistry(0)
+
+	// Node b holds the tunnel and answers with what it received
+	holder := NewNode("b", "", "secret", registry)
+	startNode(t, holder, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(signatureHeader) != "" || r.Header.Get(originHeader) != "" {
+			t.Error("internal headers reached the local handler")
+		}
+		if !Forwarded(r) {
+			t.Error("forwarded request not marked")
+		}
+		if v := VisitorOf(r); v.RemoteAddr != "203.0.113.7:51000" || v.TLSVersion != "TLS 1.3" || v.SNI != "app.example.com" {
+			t.Errorf("VisitorOf() = %+v, want the origin's public client", v)
+		}
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "10.1.1.1" {
+			t.Errorf("X-Forwarded-For = %q, want the visitor's own header only", xff)
+		}
+		io.WriteString(w, r.Host+" "+r.URL.Path)
+	}))
+	if err := holder.Claim(Claim{Domain: "app.example.com", UserID: 1}); err != nil {
+		t.Fatalf("Claim: %v", err)
+	}
+
+	// Node a receives the public request
+	origin := NewNode("a", "", "secret", registry)
+	owner, ok, err := origin.Owner("app.example.com")
+	if err != nil || !ok {
+		t.Fatalf("Owner() = %v, %v", ok, err)
+	}
+	if _, ok, _ := holder.Owner("app.example.com"); ok {
+		t.Error("Owner() reported the node's own claim")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "https://app.example.com/hello", nil)
+	req.RemoteAddr = "203.0.113.7:51000"
+	req.TLS = &tls.ConnectionState{Version: tls.VersionTLS13, ServerName: "app.example.com"}
+	req.Header.Set("X-Forwarded-For", "10.1.1.1")
+	rec := httptest.NewRecorder()
+	origin.Forward(rec, req, owner)
+	if rec.Code != http.StatusOK || rec.Body.String() != "app.example.com /hello" {
+		t.Errorf("forwarded response = %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestNode_HandlerRejectsWrongSecret(t *testing.T) {
+	n := NewNode("a", "", "secret", NewMemoryRegistry(0))
+	srv := startNode(t, n, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request without a valid signature reached the local handler")
+	}))
+
+	for name, secret := range map[string]string{"unsigned": "", "wrong secret": "guess"} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/", nil)
+		req.Header.Set(originHeader, "x")
+		if secret != "" {
+			sign(req, secret, nil)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: request: %v", name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: status = %d, want 403", name, resp.StatusCode)
+		}
+	}
+}
+
+func TestNode_HandlerRejectsReplay(t *testing.T) {
+	n := NewNode("a", "", "secret", NewMemoryRegistry(0))
+	srv := startNode(t, n, http.NotFoundHandler())
+
+	body := []byte(`{"node_id":"b"}`)
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+registryPath+"heartbeat", bytes.NewReader(body))
+	sign(req, "secret", body)
+
+	send := func(header http.Header, body []byte) int {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+registryPath+"heartbeat", bytes.NewReader(body))
+		req.Header = header.Clone()
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// A captured call can't be sent again, nor with another body
+	if code := send(req.Header, []byte(`{"node_id":"c"}`)); code != http.StatusForbidden {
+		t.Errorf("tampered body: status = %d, want 403", code)
+	}
+	if code := send(req.Header, body); code != http.StatusNoContent {
+		t.Errorf("first call: status = %d, want 204", code)
+	}
+	if code := send(req.Header, body); code != http.StatusForbidden {
+		t.Errorf("replayed call: status = %d, want 403", code)
+	}
+
+	// Nor once its time is outside the window
+	req.Header.Set(nonceHeader, "fresh")
+	req.Header.Set(timeHeader, strconv.FormatInt(time.Now().Add(-2*signatureWindow).Unix(), 10))
+	req.Header.Set(signatureHeader, signature("secret", req))
+	if code := send(req.Header, body); code != http.StatusForbidden {
+		t.Errorf("stale call: status = %d, want 403", code)
+	}
+}
@@ -0,0 +1,131 @@
+// Package cluster lets several gopublic-server nodes share which node serves
+// which domain, so any node's ingress can forward a request to the node that
+// holds the tunnel.
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrClaimed is returned when another node already serves a domain.
+var ErrClaimed = errors.New("domain is served by another node")
+
+// Claim records that a node serves a domain.
+type Claim struct {
+	Domain string `json:"domain"`
+	NodeID string `json:"node_id"`
+	Addr   string `json:"addr"` // Internal address other nodes forward requests to
+	UserID uint   `json:"user_id"`
+	// Passthrough is set for TLS passthrough domains, which are only served
+	// by the node holding them
+	Passthrough bool `json:"passthrough,omitempty"`
+	// LoginProvider is the provider of the domain's login wall, if it has one
+	LoginProvider string `json:"login_provider,omitempty"`
+}
+
+// Registry maps domains to the nodes serving them.
+type Registry interface {
+	// Claim records that c.NodeID serves c.Domain. Claiming a domain the
+	// node already holds refreshes it; a domain held by another node fails
+	// with ErrClaimed.
+	Claim(c Claim) error
+	// Release drops the claim of nodeID on domain, if it still holds it.
+	Release(domain, nodeID string) error
+	// ReleaseNode drops every claim of nodeID, e.g. left over from before a restart.
+	ReleaseNode(nodeID string) error
+	// Lookup returns the claim on domain.
+	Lookup(domain string) (Claim, bool, error)
+	// Heartbeat tells the registry nodeID is alive. Claims of nodes that
+	// stop sending heartbeats expire.
+	Heartbeat(nodeID string) error
+}
+
+// MemoryRegistry is a Registry kept in the memory of one process. The node
+// hosting the registry uses it directly and serves it to the other nodes
+// through Node.Handler.
+type MemoryRegistry struct {
+	ttl time.Duration
+
+	mu       sync.Mutex
+	claims   map[string]Claim     // domain -> claim
+	lastSeen map[string]time.Time // nodeID -> last claim or heartbeat
+}
+
+// NewMemoryRegistry creates a registry whose claims expire ttl after their
+// node was last heard from (0 = never).
+func NewMemoryRegistry(ttl time.Duration) *MemoryRegistry {
+	return &MemoryRegistry{
+		ttl:      ttl,
+		claims:   make(map[string]Claim),
+		lastSeen: make(map[string]time.Time),
+	}
+}
+
+// Claim implements Registry.
+func (r *MemoryRegistry) Claim(c Claim) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if held, ok := r.live(c.Domain, now); ok && held.NodeID != c.NodeID {
+		return fmt.Errorf("%w: %s is held by node %s", ErrClaimed, c.Domain, held.NodeID)
+	}
+	r.claims[c.Domain] = c
+	r.lastSeen[c.NodeID] = now
+	return nil
+}
+
+// Release implements Registry.
+func (r *MemoryRegistry) Release(domain, nodeID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if held, ok := r.claims[domain]; ok && held.NodeID == nodeID {
+		delete(r.claims, domain)
+	}
+	return nil
+}
+
+// ReleaseNode implements Registry.
+func (r *MemoryRegistry) ReleaseNode(nodeID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for domain, held := range r.claims {
+		if held.NodeID == nodeID {
+			delete(r.claims, domain)
+		}
+	}
+	delete(r.lastSeen, nodeID)
+	return nil
+}
+
+// Lookup implements Registry.
+func (r *MemoryRegistry) Lookup(domain string) (Claim, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.live(domain, time.Now())
+	return c, ok, nil
+}
+
+// Heartbeat implements Registry.
+func (r *MemoryRegistry) Heartbeat(nodeID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastSeen[nodeID] = time.Now()
+	return nil
+}
+
+// live returns the claim on domain unless its node has gone silent, in which
+// case the claim is dropped. The caller holds r.mu.
+func (r *MemoryRegistry) live(domain string, now time.Time) (Claim, bool) {
+	c, ok := r.claims[domain]
+	if !ok {
+		return Claim{}, false
+	}
+	if r.ttl > 0 && now.Sub(r.lastSeen[c.NodeID]) > r.ttl {
+		delete(r.claims, domain)
+		return Claim{}, false
+	}
+	return c, true
+}
@@ -0,0 +1,66 @@
+package cluster
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryRegistry_Claim(t *testing.T) {
+	r := NewMemoryRegistry(0)
+
+	if err := r.Claim(Claim{Domain: "app.example.com", NodeID: "a", Addr: "10.0.0.1:7000", UserID: 1}); err != nil {
+		t.Fatalf("first claim: %v", err)
+	}
+	if err := r.Claim(Claim{Domain: "app.example.com", NodeID: "a", Addr: "10.0.0.1:7000", UserID: 1}); err != nil {
+		t.Errorf("claim by the holding node: %v", err)
+	}
+	if err := r.Claim(Claim{Domain: "app.example.com", NodeID: "b", UserID: 1}); !errors.Is(err, ErrClaimed) {
+		t.Errorf("claim by another node = %v, want ErrClaimed", err)
+	}
+
+	// Only the holder can release
+	r.Release("app.example.com", "b")
+	if c, ok, _ := r.Lookup("app.example.com"); !ok || c.NodeID != "a" || c.Addr != "10.0.0.1:7000" {
+		t.Errorf("Lookup() = %+v, %v after release by another node", c, ok)
+	}
+	r.Release("app.example.com", "a")
+	if _, ok, _ := r.Lookup("app.example.com"); ok {
+		t.Error("claim survived release by its node")
+	}
+}
+
+func TestMemoryRegistry_ReleaseNode(t *testing.T) {
+	r := NewMemoryRegistry(0)
+	r.Claim(Claim{Domain: "app.example.com", NodeID: "a"})
+	r.Claim(Claim{Domain: "api.example.com", NodeID: "a"})
+	r.Claim(Claim{Domain: "docs.example.com", NodeID: "b"})
+
+	r.ReleaseNode("a")
+	if _, ok, _ := r.Lookup("app.example.com"); ok {
+		t.Error("claim of released node still present")
+	}
+	if _, ok, _ := r.Lookup("docs.example.com"); !ok {
+		t.Error("claim of another node was released")
+	}
+}
+
+func TestMemoryRegistry_SilentNodeExpires(t *testing.T) {
+	r := NewMemoryRegistry(50 * time.Millisecond)
+	r.Claim(Claim{Domain: "app.example.com", NodeID: "a"})
+	r.Claim(Claim{Domain: "api.example.com", NodeID: "b"})
+
+	time.Sleep(30 * time.Millisecond)
+	r.Heartbeat("b")
+	time.Sleep(30 * time.Millisecond)
+
+	if _, ok, _ := r.Lookup("app.example.com"); ok {
+		t.Error("claim of a silent node did not expire")
+	}
+	if _, ok, _ := r.Lookup("api.example.com"); !ok {
+		t.Error("claim of a node sending heartbeats expired")
+	}
+	if err := r.Claim(Claim{Domain: "app.example.com", NodeID: "b"}); err != nil {
+		t.Errorf("claim of an expired domain: %v", err)
+	}
+}
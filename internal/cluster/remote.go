@@ -0,0 +1,177 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// registryPath prefixes the registry API on the internal link.
+const registryPath = "/cluster/registry/"
+
+// remoteTimeout bounds one call to the node hosting the registry.
+const remoteTimeout = 5 * time.Second
+
+// RemoteRegistry is a Registry served by another node over the internal link.
+type RemoteRegistry struct {
+	URL    string // Base URL of the hosting node, e.g. http://10.0.0.1:7000
+	Secret string // Cluster secret, signs every call
+
+	client *http.Client
+}
+
+// NewRemoteRegistry creates a client for the registry hosted at baseURL.
+func NewRemoteRegistry(baseURL, secret string) *RemoteRegistry {
+	return &RemoteRegistry{
+		URL:    strings.TrimSuffix(baseURL, "/"),
+		Secret: secret,
+		client: &http.Client{Timeout: remoteTimeout},
+	}
+}
+
+type nodeRequest struct {
+	Domain string `json:"domain,omitempty"`
+	NodeID string `json:"node_id"`
+}
+
+// Claim implements Registry.
+func (r *RemoteRegistry) Claim(c Claim) error {
+	return r.post("claim", c)
+}
+
+// Release implements Registry.
+func (r *RemoteRegistry) Release(domain, nodeID string) error {
+	return r.post("release", nodeRequest{Domain: domain, NodeID: nodeID})
+}
+
+// ReleaseNode implements Registry.
+func (r *RemoteRegistry) ReleaseNode(nodeID string) error {
+	return r.post("release-node", nodeRequest{NodeID: nodeID})
+}
+
+// Heartbeat implements Registry.
+func (r *RemoteRegistry) Heartbeat(nodeID string) error {
+	return r.post("heartbeat", nodeRequest{NodeID: nodeID})
+}
+
+// Lookup implements Registry.
+func (r *RemoteRegistry) Lookup(domain string) (Claim, bool, error) {
+	req, err := http.NewRequest(http.MethodGet, r.URL+registryPath+"lookup?domain="+url.QueryEscape(domain), nil)
+	if err != nil {
+		return Claim{}, false, err
+	}
+	sign(req, r.Secret, nil)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return Claim{}, false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var c Claim
+		if err := json.NewDecoder(resp.Body).Decode(&c); err != nil {
+			return Claim{}, false, err
+		}
+		return c, true, nil
+	case http.StatusNotFound:
+		return Claim{}, false, nil
+	default:
+		return Claim{}, false, fmt.Errorf("cluster registry lookup: %s", resp.Status)
+	}
+}
+
+func (r *RemoteRegistry) post(op string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, r.URL+registryPath+op, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	sign(req, r.Secret, data)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusOK:
+		return nil
+	case http.StatusConflict:
+		var held Claim
+		json.NewDecoder(resp.Body).Decode(&held)
+		return fmt.Errorf("%w: %s is held by node %s", ErrClaimed, held.Domain, held.NodeID)
+	default:
+		return fmt.Errorf("cluster registry %s: %s", op, resp.Status)
+	}
+}
+
+// registryHandler serves reg to RemoteRegistry clients. Callers are
+// authenticated by Node.Handler before they get here.
+func registryHandler(reg Registry) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc(registryPath+"claim", func(w http.ResponseWriter, r *http.Request) {
+		var c Claim
+		if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&c) != nil || c.Domain == "" || c.NodeID == "" {
+			http.Error(w, "bad claim", http.StatusBadRequest)
+			return
+		}
+		if err := reg.Claim(c); err != nil {
+			held, _, _ := reg.Lookup(c.Domain)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(held)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	nodeOp := func(op func(nodeRequest) error) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			var req nodeRequest
+			if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&req) != nil || req.NodeID == "" {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+			if err := op(req); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+	mux.HandleFunc(registryPath+"release", nodeOp(func(req nodeRequest) error {
+		return reg.Release(req.Domain, req.NodeID)
+	}))
+	mux.HandleFunc(registryPath+"release-node", nodeOp(func(req nodeRequest) error {
+		return reg.ReleaseNode(req.NodeID)
+	}))
+	mux.HandleFunc(registryPath+"heartbeat", nodeOp(func(req nodeRequest) error {
+		return reg.Heartbeat(req.NodeID)
+	}))
+
+	mux.HandleFunc(registryPath+"lookup", func(w http.ResponseWriter, r *http.Request) {
+		c, ok, err := reg.Lookup(r.URL.Query().Get("domain"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c)
+	})
+
+	return mux
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/hex"
 	"os"
 	"strconv"
+	"strings"
 
 	apperrors "gopublic/internal/errors"
 )
@@ -16,10 +17,46 @@ type Config struct {
 	Email        string // Email for Let's Encrypt
 	InsecureMode bool   // If true, use HTTP instead of HTTPS
 	DBPath       string // Path to SQLite database
+	HTTPPort     string // Plain HTTP ingress port override (empty = mode default)
 
 	// Control plane settings
-	ControlPlanePort string // Port for control plane (default ":4443")
-	MaxConnections   int    // Max concurrent tunnel connections
+	ControlPlanePort   string // Port for control plane (default ":4443")
+	MaxConnections     int    // Max concurrent tunnel connections
+	MinClientVersion   string // Oldest CLI release allowed to connect (empty = any)
+	ResumeGraceSecs    int    // How long a lost session's domains stay reserved for its resume token (0 = off)
+	DrainReconnectSecs int    // How long clients wait before reconnecting after a server shutdown
+	TunnelBalance      string // How shared domains pick a session: "round_robin" or "least_streams"
+	QUICEnabled        bool   // Also accept clients over QUIC on the control plane's UDP port
+	DeviceCADir        string // Directory of the CA issuing device client certificates (empty = disabled)
+
+	// Requests held while a tunnel client reconnects (disabled when TunnelHoldSecs is 0)
+	TunnelHoldSecs        int // Longest a request waits for its client to come back
+	TunnelHoldMaxRequests int // Requests held at once on this server
+	TunnelHoldPerDomain   int // Requests held at once for one domain
+
+	// Brute-force protection of token authentication on the control plane
+	AuthMaxFailures       int // Failed token attempts from one IP before it is banned (0 = no bans)
+	AuthBanSecs           int // First ban of an IP; repeated bans double up to a day
+	AuthGlobalMaxFailures int // Failed attempts per minute from all IPs before logins are throttled (0 = unlimited)
+
+	// Default session policy; users may have their own (models.SessionLimits)
+	SessionMaxMinutes  int // Tunnel sessions are closed this long after connecting (0 = unlimited)
+	SessionIdleMinutes int // Tunnel sessions without streams are closed after this long (0 = never)
+	SessionMaxStreams  int // Concurrent streams per tunnel session (0 = unlimited)
+
+	// Raw TCP and UDP tunnels (disabled when the range is empty)
+	PublicPortMin      int // First public port handed out for TCP and UDP tunnels
+	PublicPortMax      int // Last public port handed out for TCP and UDP tunnels
+	PublicPortsPerUser int // Max TCP and UDP ports one user may hold across sessions
+	UDPMaxFlows        int // Remote addresses one UDP tunnel serves at once (0 = unlimited)
+
+	// Cluster mode (disabled when ClusterSecret is empty)
+	ClusterNodeID      string // Unique name of this node (default: hostname)
+	ClusterSecret      string // Shared by all nodes; authenticates the internal link
+	ClusterListen      string // Internal listener for forwarded requests and the registry
+	ClusterAdvertise   string // Internal address other nodes use to reach this one
+	ClusterRegistryURL string // Node hosting the registry (empty = this node hosts it)
+	ClusterNodeTTLSecs int    // How long a silent node keeps its domains
 
 	// Telegram OAuth
 	TelegramBotToken      string
@@ -30,6 +67,11 @@ type Config struct {
 	YandexClientID     string
 	YandexClientSecret string
 
+	// OpenID Connect provider for tunnel login walls
+	OIDCIssuer       string // Issuer URL serving /.well-known/openid-configuration
+	OIDCClientID     string
+	OIDCClientSecret string
+
 	// Admin notifications
 	AdminTelegramID int64 // Telegram user ID for abuse reports
 
@@ -49,6 +91,7 @@ type Config struct {
 
 	// Daily bandwidth limit per user in bytes (0 = unlimited)
 	DailyBandwidthLimit int64
+	MaxRequestBody      int64 // Largest request body forwarded to a tunnel in bytes (0 = unlimited)
 
 	// Session keys (32 bytes each)
 	SessionHashKey  []byte
@@ -60,6 +103,7 @@ var (
 	ErrMissingDomain      = apperrors.New(apperrors.CodeConfigError, "DOMAIN_NAME is required in production mode")
 	ErrMissingSessionKeys = apperrors.New(apperrors.CodeConfigError, "SESSION_HASH_KEY and SESSION_BLOCK_KEY are required in production mode")
 	ErrInvalidSessionKey  = apperrors.New(apperrors.CodeConfigError, "session key must be 32 bytes hex-encoded")
+	ErrInvalidPortRange   = apperrors.New(apperrors.CodeConfigError, "PUBLIC_PORT_RANGE must look like 20000-20999")
 )
 
 // LoadFromEnv loads configuration from environment variables
@@ -80,6 +124,14 @@ func LoadFromEnv() (*Config, error) {
 		}
 	}
 
+	// Parse maximum request body size (default: unlimited)
+	var maxRequestBody int64
+	if val := os.Getenv("MAX_REQUEST_BODY_MB"); val != "" {
+		if n, err := strconv.ParseInt(val, 10, 64); err == nil && n >= 0 {
+			maxRequestBody = n * 1024 * 1024 // Convert MB to bytes
+		}
+	}
+
 	// Parse admin Telegram ID
 	var adminTelegramID int64
 	if val := os.Getenv("ADMIN_TELEGRAM_ID"); val != "" {
@@ -88,6 +140,133 @@ func LoadFromEnv() (*Config, error) {
 		}
 	}
 
+	// Parse public port range for TCP and UDP tunnels (e.g. "20000-20999");
+	// TCP_PORT_RANGE is its former name
+	publicPortMin, publicPortMax, err := parsePortRange(getEnvOrDefault("PUBLIC_PORT_RANGE", os.Getenv("TCP_PORT_RANGE")))
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse public ports per user (default: 2); TCP_PORTS_PER_USER is its former name
+	publicPortsPerUser := 2
+	if val := getEnvOrDefault("PUBLIC_PORTS_PER_USER", os.Getenv("TCP_PORTS_PER_USER")); val != "" {
+		if n, err := strconv.Atoi(val); err == nil && n > 0 {
+			publicPortsPerUser = n
+		}
+	}
+
+	// Parse UDP flows per tunnel (default: 256)
+	udpMaxFlows := 256
+	if val := os.Getenv("UDP_MAX_FLOWS"); val != "" {
+		if n, err := strconv.Atoi(val); err == nil && n >= 0 {
+			udpMaxFlows = n
+		}
+	}
+
+	// Parse resume grace period (default: 30 seconds)
+	resumeGraceSecs := 30
+	if val := os.Getenv("RESUME_GRACE_SECONDS"); val != "" {
+		if n, err := strconv.Atoi(val); err == nil && n >= 0 {
+			resumeGraceSecs = n
+		}
+	}
+
+	// Parse reconnect delay announced on shutdown (default: 5 seconds)
+	drainReconnectSecs := 5
+	if val := os.Getenv("SHUTDOWN_RECONNECT_SECONDS"); val != "" {
+		if n, err := strconv.Atoi(val); err == nil && n >= 0 {
+			drainReconnectSecs = n
+		}
+	}
+
+	// Parse token brute-force limits (default: ban after 5 failures for 15 minutes,
+	// throttle after 100 failures per minute server-wide)
+	authMaxFailures := 5
+	if val := os.Getenv("AUTH_MAX_FAILURES"); val != "" {
+		if n, err := strconv.Atoi(val); err == nil && n >= 0 {
+			authMaxFailures = n
+		}
+	}
+	authBanSecs := 900
+	if val := os.Getenv("AUTH_BAN_SECONDS"); val != "" {
+		if n, err := strconv.Atoi(val); err == nil && n > 0 {
+			authBanSecs = n
+		}
+	}
+	authGlobalMaxFailures := 100
+	if val := os.Getenv("AUTH_GLOBAL_MAX_FAILURES"); val != "" {
+		if n, err := strconv.Atoi(val); err == nil && n >= 0 {
+			authGlobalMaxFailures = n
+		}
+	}
+
+	// Parse the default session policy (default: no limits)
+	sessionMaxMinutes := 0
+	if val := os.Getenv("TUNNEL_MAX_SESSION_MINUTES"); val != "" {
+		if n, err := strconv.Atoi(val); err == nil && n >= 0 {
+			sessionMaxMinutes = n
+		}
+	}
+	sessionIdleMinutes := 0
+	if val := os.Getenv("TUNNEL_IDLE_MINUTES"); val != "" {
+		if n, err := strconv.Atoi(val); err == nil && n >= 0 {
+			sessionIdleMinutes = n
+		}
+	}
+	sessionMaxStreams := 0
+	if val := os.Getenv("TUNNEL_MAX_STREAMS"); val != "" {
+		if n, err := strconv.Atoi(val); err == nil && n >= 0 {
+			sessionMaxStreams = n
+		}
+	}
+
+	// Parse request hold while clients reconnect (default: off, 100 requests, 20 per domain)
+	tunnelHoldSecs := 0
+	if val := os.Getenv("TUNNEL_HOLD_SECONDS"); val != "" {
+		if n, err := strconv.Atoi(val); err == nil && n >= 0 {
+			tunnelHoldSecs = n
+		}
+	}
+	tunnelHoldMaxRequests := 100
+	if val := os.Getenv("TUNNEL_HOLD_MAX_REQUESTS"); val != "" {
+		if n, err := strconv.Atoi(val); err == nil && n > 0 {
+			tunnelHoldMaxRequests = n
+		}
+	}
+	tunnelHoldMaxPerDomain := 20
+	if val := os.Getenv("TUNNEL_HOLD_MAX_PER_DOMAIN"); val != "" {
+		if n, err := strconv.Atoi(val); err == nil && n > 0 {
+			tunnelHoldMaxPerDomain = n
+		}
+	}
+
+	// Parse load balancing strategy for shared domains (default: round_robin)
+	tunnelBalance := "round_robin"
+	if val := os.Getenv("TUNNEL_BALANCE"); val == "least_streams" {
+		tunnelBalance = val
+	}
+
+	// Parse cluster settings
+	clusterNodeID := os.Getenv("CLUSTER_NODE_ID")
+	if clusterNodeID == "" {
+		clusterNodeID, _ = os.Hostname()
+	}
+	clusterListen := getEnvOrDefault("CLUSTER_LISTEN", ":7000")
+	clusterAdvertise := os.Getenv("CLUSTER_ADVERTISE")
+	if clusterAdvertise == "" {
+		// Without an address to advertise only nodes on this host can reach us
+		clusterAdvertise = clusterListen
+		if strings.HasPrefix(clusterListen, ":") {
+			clusterAdvertise = "127.0.0.1" + clusterListen
+		}
+	}
+	clusterNodeTTLSecs := 15
+	if val := os.Getenv("CLUSTER_NODE_TTL_SECONDS"); val != "" {
+		if n, err := strconv.Atoi(val); err == nil && n > 0 {
+			clusterNodeTTLSecs = n
+		}
+	}
+
 	// Parse Sentry sample rate (default: 1.0)
 	sentrySampleRate := 1.0
 	if val := os.Getenv("SENTRY_SAMPLE_RATE"); val != "" {
@@ -102,13 +281,42 @@ func LoadFromEnv() (*Config, error) {
 		Email:                 os.Getenv("EMAIL"),
 		InsecureMode:          os.Getenv("INSECURE_HTTP") == "true",
 		DBPath:                getEnvOrDefault("DB_PATH", "gopublic.db"),
+		HTTPPort:              os.Getenv("INGRESS_PORT"),
 		ControlPlanePort:      getEnvOrDefault("CONTROL_PLANE_PORT", ":4443"),
 		MaxConnections:        1000,
+		MinClientVersion:      os.Getenv("MIN_CLIENT_VERSION"),
+		QUICEnabled:           os.Getenv("QUIC_ENABLED") == "true",
+		DeviceCADir:           os.Getenv("DEVICE_CA_DIR"),
+		AuthMaxFailures:       authMaxFailures,
+		AuthBanSecs:           authBanSecs,
+		AuthGlobalMaxFailures: authGlobalMaxFailures,
+		SessionMaxMinutes:     sessionMaxMinutes,
+		SessionIdleMinutes:    sessionIdleMinutes,
+		SessionMaxStreams:     sessionMaxStreams,
+		ResumeGraceSecs:       resumeGraceSecs,
+		DrainReconnectSecs:    drainReconnectSecs,
+		TunnelBalance:         tunnelBalance,
+		TunnelHoldSecs:        tunnelHoldSecs,
+		TunnelHoldMaxRequests: tunnelHoldMaxRequests,
+		TunnelHoldPerDomain:   tunnelHoldMaxPerDomain,
+		ClusterNodeID:         clusterNodeID,
+		ClusterSecret:         os.Getenv("CLUSTER_SECRET"),
+		ClusterListen:         clusterListen,
+		ClusterAdvertise:      clusterAdvertise,
+		ClusterRegistryURL:    os.Getenv("CLUSTER_REGISTRY_URL"),
+		ClusterNodeTTLSecs:    clusterNodeTTLSecs,
+		PublicPortMin:         publicPortMin,
+		PublicPortMax:         publicPortMax,
+		PublicPortsPerUser:    publicPortsPerUser,
+		UDPMaxFlows:           udpMaxFlows,
 		TelegramBotToken:      os.Getenv("TELEGRAM_BOT_TOKEN"),
 		TelegramBotName:       os.Getenv("TELEGRAM_BOT_NAME"),
 		TelegramWidgetEnabled: os.Getenv("TELEGRAM_OAUTH_WIDGET_ENABLED") == "true",
 		YandexClientID:        os.Getenv("YANDEX_CLIENT_ID"),
 		YandexClientSecret:    os.Getenv("YANDEX_CLIENT_SECRET"),
+		OIDCIssuer:            strings.TrimSuffix(os.Getenv("OIDC_ISSUER"), "/"),
+		OIDCClientID:          os.Getenv("OIDC_CLIENT_ID"),
+		OIDCClientSecret:      os.Getenv("OIDC_CLIENT_SECRET"),
 		AdminTelegramID:       adminTelegramID,
 		SentryDSN:             os.Getenv("SENTRY_DSN"),
 		SentryEnvironment:     getEnvOrDefault("SENTRY_ENVIRONMENT", "development"),
@@ -117,6 +325,7 @@ func LoadFromEnv() (*Config, error) {
 		MetricsToken:          os.Getenv("METRICS_TOKEN"),
 		DomainsPerUser:        domainsPerUser,
 		DailyBandwidthLimit:   dailyBandwidthLimit,
+		MaxRequestBody:        maxRequestBody,
 	}
 
 	// Parse session keys
@@ -169,6 +378,9 @@ func (c *Config) IsSecure() bool {
 
 // IngressPort returns the appropriate ingress port based on mode
 func (c *Config) IngressPort() string {
+	if c.HTTPPort != "" {
+		return c.HTTPPort
+	}
 	if c.InsecureMode {
 		return ":80"
 	}
@@ -185,6 +397,11 @@ func (c *Config) HasYandexOAuth() bool {
 	return c.YandexClientID != "" && c.YandexClientSecret != ""
 }
 
+// HasOIDC returns true if the OIDC provider for tunnel login walls is configured
+func (c *Config) HasOIDC() bool {
+	return c.OIDCIssuer != "" && c.OIDCClientID != "" && c.OIDCClientSecret != ""
+}
+
 // HasTelegramOAuth returns true if Telegram OAuth is configured
 func (c *Config) HasTelegramOAuth() bool {
 	return c.TelegramBotToken != "" && c.TelegramBotName != ""
@@ -195,11 +412,44 @@ func (c *Config) HasAdminNotifications() bool {
 	return c.AdminTelegramID != 0 && c.TelegramBotToken != ""
 }
 
+// HasPublicPorts returns true if a public port range for TCP and UDP tunnels is configured
+func (c *Config) HasPublicPorts() bool {
+	return c.PublicPortMin > 0 && c.PublicPortMax >= c.PublicPortMin
+}
+
+// IsCluster returns true if this node shares its tunnels with other nodes
+func (c *Config) IsCluster() bool {
+	return c.ClusterSecret != ""
+}
+
 // HasSentry returns true if Sentry is configured
 func (c *Config) HasSentry() bool {
 	return c.SentryDSN != ""
 }
 
+// parsePortRange parses "min-max". An empty string yields a zero range.
+func parsePortRange(val string) (int, int, error) {
+	if val == "" {
+		return 0, 0, nil
+	}
+	lo, hi, ok := strings.Cut(val, "-")
+	if !ok {
+		return 0, 0, ErrInvalidPortRange
+	}
+	min, err := strconv.Atoi(strings.TrimSpace(lo))
+	if err != nil {
+		return 0, 0, ErrInvalidPortRange
+	}
+	max, err := strconv.Atoi(strings.TrimSpace(hi))
+	if err != nil {
+		return 0, 0, ErrInvalidPortRange
+	}
+	if min < 1 || max > 65535 || min > max {
+		return 0, 0, ErrInvalidPortRange
+	}
+	return min, max, nil
+}
+
 func getEnvOrDefault(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
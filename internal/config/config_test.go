@@ -163,3 +163,33 @@ func TestConfig_Validate(t *testing.T) {
 		}
 	})
 }
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		input   string
+		min     int
+		max     int
+		wantErr bool
+	}{
+		{"", 0, 0, false},
+		{"20000-20999", 20000, 20999, false},
+		{" 3000 - 3000 ", 3000, 3000, false},
+		{"20000", 0, 0, true},
+		{"b-a", 0, 0, true},
+		{"200-100", 0, 0, true},
+		{"0-100", 0, 0, true},
+		{"100-70000", 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			min, max, err := parsePortRange(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePortRange(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			}
+			if min != tt.min || max != tt.max {
+				t.Errorf("parsePortRange(%q) = %d-%d, want %d-%d", tt.input, min, max, tt.min, tt.max)
+			}
+		})
+	}
+}
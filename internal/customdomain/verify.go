@@ -0,0 +1,109 @@
+// Package customdomain checks that a user controls a domain outside the
+// server's root domain before tunnels may be bound to it.
+package customdomain
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	// recordPrefix is prepended to a hostname to form the TXT record name.
+	recordPrefix = "_gopublic."
+	// valuePrefix is prepended to the token in the TXT record value.
+	valuePrefix = "gopublic-verify="
+)
+
+var (
+	// ErrInvalidHostname is returned for names that can't be custom domains.
+	ErrInvalidHostname = errors.New("invalid custom domain")
+	// ErrNotVerified is returned when no TXT record carries the expected token.
+	ErrNotVerified = errors.New("verification record not found")
+)
+
+// Resolver looks up TXT records. *net.Resolver implements it; tests use a fake.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// Verifier checks the TXT record proving ownership of a custom domain.
+type Verifier struct {
+	Resolver Resolver
+}
+
+// NewVerifier creates a verifier backed by the system resolver.
+func NewVerifier() *Verifier {
+	return &Verifier{Resolver: net.DefaultResolver}
+}
+
+// Verify succeeds if the TXT record of hostname carries token.
+func (v *Verifier) Verify(ctx context.Context, hostname, token string) error {
+	records, err := v.Resolver.LookupTXT(ctx, RecordName(hostname))
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return ErrNotVerified
+		}
+		return fmt.Errorf("TXT lookup for %s: %w", hostname, err)
+	}
+	want := RecordValue(token)
+	for _, record := range records {
+		if strings.TrimSpace(record) == want {
+			return nil
+		}
+	}
+	return ErrNotVerified
+}
+
+// RecordName returns the name of the TXT record for hostname.
+func RecordName(hostname string) string {
+	return recordPrefix + hostname
+}
+
+// RecordValue returns the TXT record value expected for token.
+func RecordValue(token string) string {
+	return valuePrefix + token
+}
+
+// NewToken generates a random verification token.
+func NewToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Normalize lowercases hostname and checks that it is a plain DNS name with
+// at least two labels outside rootDomain, whose names are handed out by the
+// server itself.
+func Normalize(hostname, rootDomain string) (string, error) {
+	hostname = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(hostname)), ".")
+	if len(hostname) > 253 || !strings.Contains(hostname, ".") {
+		return "", ErrInvalidHostname
+	}
+	for _, label := range strings.Split(hostname, ".") {
+		if !validLabel(label) {
+			return "", ErrInvalidHostname
+		}
+	}
+	if rootDomain != "" && (hostname == rootDomain || strings.HasSuffix(hostname, "."+rootDomain)) {
+		return "", ErrInvalidHostname
+	}
+	return hostname, nil
+}
+
+func validLabel(label string) bool {
+	if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+		return false
+	}
+	for _, c := range label {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,59 @@
+package customdomain
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+type fakeResolver map[string][]string
+
+func (f fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	records, ok := f[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return records, nil
+}
+
+func TestVerify(t *testing.T) {
+	v := &Verifier{Resolver: fakeResolver{
+		"_gopublic.dev.example.org":   {"v=spf1 -all", "gopublic-verify=abc123"},
+		"_gopublic.stale.example.org": {"gopublic-verify=old"},
+	}}
+	ctx := context.Background()
+
+	if err := v.Verify(ctx, "dev.example.org", "abc123"); err != nil {
+		t.Errorf("Verify() with matching record: %v", err)
+	}
+	if err := v.Verify(ctx, "stale.example.org", "abc123"); !errors.Is(err, ErrNotVerified) {
+		t.Errorf("Verify() with other token = %v, want ErrNotVerified", err)
+	}
+	if err := v.Verify(ctx, "missing.example.org", "abc123"); !errors.Is(err, ErrNotVerified) {
+		t.Errorf("Verify() without record = %v, want ErrNotVerified", err)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"Dev.OurCompany.com.", "dev.ourcompany.com", true},
+		{"example.org", "example.org", true},
+		{"localhost", "", false},
+		{"gopublic.su", "", false},
+		{"app.gopublic.su", "", false},
+		{"bad_name.example.org", "", false},
+		{"-dash.example.org", "", false},
+		{"a..example.org", "", false},
+	}
+	for _, tt := range tests {
+		got, err := Normalize(tt.in, "gopublic.su")
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("Normalize(%q) = %q, %v", tt.in, got, err)
+		}
+	}
+}
@@ -0,0 +1,511 @@
+package dashboard
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"gopublic/internal/auth"
+	"gopublic/internal/models"
+	"gopublic/internal/sentry"
+	"gopublic/internal/storage"
+	"gopublic/pkg/protocol"
+)
+
+// OIDCUserInfo represents the identity claims of an OIDC user, taken from the
+// ID token or the userinfo endpoint
+type OIDCUserInfo struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+// oidcEndpoints is the part of the OIDC discovery document used for login walls
+type oidcEndpoints struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcDiscoveryTTL is how long a fetched discovery document and key set are reused
+const oidcDiscoveryTTL = time.Hour
+
+// oidcClient talks to the OIDC provider; a stuck provider must not hold
+// logins open forever
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+// oidcDiscovery caches the provider's discovery document and signing keys
+type oidcDiscovery struct {
+	mu            sync.Mutex
+	endpoints     *oidcEndpoints
+	fetchedAt     time.Time
+	keys          auth.JWKS
+	keysFetchedAt time.Time
+}
+
+// EdgeLogin signs in a visitor of a tunnel behind a login wall. Only hosts
+// whose login wall is live are served, with the provider of that wall.
+// Dashboard logins reuse the dashboard session; visitors without one log in
+// first and come back through Index. Either way the visitor confirms before
+// the host learns who they are.
+func (h *Handler) EdgeLogin(c *gin.Context) {
+	host := strings.ToLower(c.Query("host"))
+	if !h.isTunnelHost(host) {
+		c.String(http.StatusBadRequest, "Invalid tunnel host")
+		return
+	}
+	next := auth.SafeRedirectPath(c.Query("next"))
+
+	switch h.loginProvider(host) {
+	case protocol.LoginProviderOIDC:
+		h.startOIDCLogin(c, host, next)
+		return
+	case protocol.LoginProviderDashboard:
+	default:
+		c.String(http.StatusNotFound, "%s has no login wall", host)
+		return
+	}
+
+	if err := h.Session.SetEdgeLogin(c.Writer, auth.EdgeLogin{Host: host, Next: next}); err != nil {
+		sentry.CaptureErrorWithContext(c, err, "Failed to store edge login")
+		c.String(http.StatusInternalServerError, "Failed to start login")
+		return
+	}
+	user, err := h.getUserFromSession(c)
+	if err != nil {
+		c.Redirect(http.StatusTemporaryRedirect, "/login")
+		return
+	}
+	h.showEdgeConsent(c, host, dashboardIdentity(user).User)
+}
+
+// startOIDCLogin sends the visitor to the OIDC provider. The nonce ties the
+// ID token to this login and the PKCE verifier the authorization code.
+func (h *Handler) startOIDCLogin(c *gin.Context, host, next string) {
+	if !h.oidcEnabled() {
+		c.String(http.StatusNotFound, "OIDC login not configured")
+		return
+	}
+	endpoints, err := h.oidcEndpoints()
+	if err != nil {
+		sentry.CaptureErrorWithContext(c, err, "Failed to discover OIDC endpoints")
+		c.String(http.StatusBadGateway, "OIDC provider unavailable")
+		return
+	}
+
+	login := auth.EdgeLogin{
+		Host:     host,
+		Next:     next,
+		State:    generateState(),
+		Nonce:    generateState(),
+		Verifier: pkceVerifier(),
+	}
+	if err := h.Session.SetEdgeLogin(c.Writer, login); err != nil {
+		sentry.CaptureErrorWithContext(c, err, "Failed to store edge login")
+		c.String(http.StatusInternalServerError, "Failed to start login")
+		return
+	}
+
+	challenge := sha256.Sum256([]byte(login.Verifier))
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", h.OIDCClientID)
+	params.Set("redirect_uri", h.dashboardURL("/edge/oidc/callback"))
+	params.Set("state", login.State)
+	params.Set("nonce", login.Nonce)
+	params.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	params.Set("code_challenge_method", "S256")
+	params.Set("scope", "openid email")
+
+	c.Redirect(http.StatusTemporaryRedirect, endpoints.AuthorizationEndpoint+"?"+params.Encode())
+}
+
+// EdgeOIDCCallback handles the OIDC provider's redirect for login walls. The
+// visitor is identified by the ID token, which must be signed by the
+// provider, issued to this client and carry the nonce of this login.
+func (h *Handler) EdgeOIDCCallback(c *gin.Context) {
+	login, err := h.Session.GetEdgeLogin(c.Request)
+	if err != nil || login.State == "" || login.Nonce == "" || login.Verifier == "" || c.Query("state") != login.State {
+		c.String(http.StatusBadRequest, "Invalid state parameter")
+		return
+	}
+	h.Session.ClearEdgeLogin(c.Writer)
+
+	if errMsg := c.Query("error"); errMsg != "" {
+		log.Printf("OIDC login error: %s - %s", errMsg, c.Query("error_description"))
+		c.String(http.StatusForbidden, "Login failed")
+		return
+	}
+	code := c.Query("code")
+	if code == "" {
+		c.String(http.StatusBadRequest, "Missing authorization code")
+		return
+	}
+
+	endpoints, err := h.oidcEndpoints()
+	if err != nil {
+		sentry.CaptureErrorWithContext(c, err, "Failed to discover OIDC endpoints")
+		c.String(http.StatusBadGateway, "OIDC provider unavailable")
+		return
+	}
+
+	// Exchange code for token
+	tokenData := url.Values{}
+	tokenData.Set("grant_type", "authorization_code")
+	tokenData.Set("code", code)
+	tokenData.Set("redirect_uri", h.dashboardURL("/edge/oidc/callback"))
+	tokenData.Set("client_id", h.OIDCClientID)
+	tokenData.Set("client_secret", h.OIDCClientSecret)
+	tokenData.Set("code_verifier", login.Verifier)
+
+	tokenResp, err := oidcClient.PostForm(endpoints.TokenEndpoint, tokenData)
+	if err != nil {
+		sentry.CaptureErrorWithContext(c, err, "Failed to exchange OIDC code for token")
+		c.String(http.StatusBadGateway, "Failed to authenticate with the OIDC provider")
+		return
+	}
+	defer tokenResp.Body.Close()
+
+	if tokenResp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(tokenResp.Body)
+		sentry.CaptureErrorWithContext(c, fmt.Errorf("token exchange failed: %s", string(body)), "OIDC token exchange failed")
+		c.String(http.StatusBadGateway, "Failed to authenticate with the OIDC provider")
+		return
+	}
+
+	var tokenResult struct {
+		AccessToken string `json:"access_token"`
+		IDToken     string `json:"id_token"`
+	}
+	if err := json.NewDecoder(tokenResp.Body).Decode(&tokenResult); err != nil || tokenResult.IDToken == "" {
+		sentry.CaptureErrorWithContext(c, fmt.Errorf("no ID token: %v", err), "Failed to decode OIDC token response")
+		c.String(http.StatusBadGateway, "Failed to authenticate with the OIDC provider")
+		return
+	}
+
+	claims, err := h.verifyIDToken(tokenResult.IDToken, login.Nonce)
+	if err != nil {
+		sentry.CaptureErrorWithContext(c, err, "OIDC ID token rejected")
+		c.String(http.StatusForbidden, "Login failed")
+		return
+	}
+	info := OIDCUserInfo{Subject: claims.Subject, Email: claims.Email, EmailVerified: bool(claims.EmailVerified)}
+
+	// Providers may leave the email out of the ID token; ask for it, but only
+	// for the subject the ID token names
+	if info.Email == "" && endpoints.UserinfoEndpoint != "" && tokenResult.AccessToken != "" {
+		fetched, err := fetchOIDCUserInfo(endpoints.UserinfoEndpoint, tokenResult.AccessToken)
+		if err != nil {
+			sentry.CaptureErrorWithContext(c, err, "Failed to get user info from the OIDC provider")
+			c.String(http.StatusBadGateway, "Failed to get user info from the OIDC provider")
+			return
+		}
+		if fetched.Subject == info.Subject {
+			info.Email, info.EmailVerified = fetched.Email, fetched.EmailVerified
+		}
+	}
+
+	id := oidcIdentity(&info)
+	if err := h.Session.SetEdgeLogin(c.Writer, auth.EdgeLogin{Host: login.Host, Next: login.Next, Identity: &id}); err != nil {
+		sentry.CaptureErrorWithContext(c, err, "Failed to store edge login")
+		c.String(http.StatusInternalServerError, "Failed to finish login")
+		return
+	}
+	h.showEdgeConsent(c, login.Host, id.User)
+}
+
+// fetchOIDCUserInfo reads the claims of the userinfo endpoint
+func fetchOIDCUserInfo(endpoint, accessToken string) (*OIDCUserInfo, error) {
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("userinfo returned %s", resp.Status)
+	}
+
+	var info OIDCUserInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// resumeEdgeLogin asks a visitor who just logged in on the dashboard to
+// confirm the sign-in at the tunnel that sent them. It reports whether there
+// was such a tunnel.
+func (h *Handler) resumeEdgeLogin(c *gin.Context, user *models.User) bool {
+	login, err := h.Session.GetEdgeLogin(c.Request)
+	if err != nil || login.State != "" || login.Identity != nil {
+		return false
+	}
+	h.showEdgeConsent(c, login.Host, dashboardIdentity(user).User)
+	return true
+}
+
+// showEdgeConsent asks the visitor whether host may learn that they are
+// user. The page can't be framed, so a tunnel can't trick them into
+// confirming.
+func (h *Handler) showEdgeConsent(c *gin.Context, host, user string) {
+	c.Header("X-Frame-Options", "DENY")
+	c.Header("Content-Security-Policy", "frame-ancestors 'none'")
+	c.Header("Cache-Control", "no-store")
+	c.HTML(http.StatusOK, "edge_consent.html", gin.H{
+		"Host":      host,
+		"User":      user,
+		"CSRFToken": c.GetString("csrf_token"),
+	})
+}
+
+// EdgeLoginConfirm handles POST /edge/login/confirm - the visitor's answer
+// on the consent page. The ticket is only issued if the host still has a
+// login wall of the provider the visitor signed in with.
+func (h *Handler) EdgeLoginConfirm(c *gin.Context) {
+	// Validate CSRF token (double-submit cookie pattern)
+	cookieToken, err := c.Cookie("csrf_token")
+	if err != nil || c.PostForm("csrf_token") == "" || c.PostForm("csrf_token") != cookieToken {
+		c.String(http.StatusForbidden, "CSRF token invalid")
+		return
+	}
+
+	login, err := h.Session.GetEdgeLogin(c.Request)
+	if err != nil || login.State != "" {
+		c.String(http.StatusBadRequest, "Login expired, open the site again")
+		return
+	}
+	if c.PostForm("decision") != "allow" {
+		h.Session.ClearEdgeLogin(c.Writer)
+		c.Redirect(http.StatusSeeOther, "/")
+		return
+	}
+
+	id := login.Identity
+	if id == nil {
+		user, err := h.getUserFromSession(c)
+		if err != nil {
+			c.Redirect(http.StatusSeeOther, "/login")
+			return
+		}
+		dashboard := dashboardIdentity(user)
+		id = &dashboard
+	}
+	h.Session.ClearEdgeLogin(c.Writer)
+
+	if h.loginProvider(login.Host) != id.Provider {
+		c.String(http.StatusForbidden, "%s no longer has a login wall for this login", login.Host)
+		return
+	}
+	h.redirectToTunnel(c, login.Host, login.Next, *id)
+}
+
+// redirectToTunnel hands a ticket for id to host, which sets its own cookie
+// and continues to next.
+func (h *Handler) redirectToTunnel(c *gin.Context, host, next string, id auth.EdgeIdentity) {
+	id.Host = host
+	ticket, err := h.Session.IssueEdgeTicket(id)
+	if err != nil {
+		sentry.CaptureErrorWithContext(c, err, "Failed to issue edge ticket")
+		c.String(http.StatusInternalServerError, "Failed to create session")
+		return
+	}
+
+	target := url.URL{
+		Scheme:   h.scheme(),
+		Host:     host,
+		Path:     auth.EdgeAuthPath,
+		RawQuery: url.Values{"ticket": {ticket}, "next": {next}}.Encode(),
+	}
+	c.Redirect(http.StatusSeeOther, target.String())
+}
+
+// dashboardIdentity lists the identities of a dashboard user: the Telegram
+// ID and the email verified by Yandex.
+func dashboardIdentity(user *models.User) auth.EdgeIdentity {
+	id := auth.EdgeIdentity{Provider: protocol.LoginProviderDashboard}
+	if user.Email != "" {
+		id.Identities = append(id.Identities, strings.ToLower(user.Email))
+	}
+	if user.TelegramID != nil {
+		id.Identities = append(id.Identities, fmt.Sprintf("tg:%d", *user.TelegramID))
+	}
+	if len(id.Identities) > 0 {
+		id.User = id.Identities[0]
+	} else {
+		id.User = fmt.Sprintf("user:%d", user.ID)
+	}
+	return id
+}
+
+// oidcIdentity lists the identities of an OIDC user: the subject and the
+// email if the provider verified it.
+func oidcIdentity(info *OIDCUserInfo) auth.EdgeIdentity {
+	id := auth.EdgeIdentity{Provider: protocol.LoginProviderOIDC, User: "oidc:" + info.Subject}
+	if info.Email != "" && info.EmailVerified {
+		id.User = strings.ToLower(info.Email)
+		id.Identities = append(id.Identities, id.User)
+	}
+	id.Identities = append(id.Identities, "oidc:"+info.Subject)
+	return id
+}
+
+// isTunnelHost reports whether host can be a tunnel of this server, so
+// tickets are only handed to its own hosts.
+func (h *Handler) isTunnelHost(host string) bool {
+	if u, err := url.Parse("//" + host); err != nil || u.Host != host || u.Hostname() != host || u.User != nil {
+		return false
+	}
+	if h.Domain != "" && strings.HasSuffix(host, "."+h.Domain) && host != "app."+h.Domain {
+		return true
+	}
+	verified, err := storage.IsVerifiedCustomDomain(host)
+	return err == nil && verified
+}
+
+// oidcEnabled reports whether the OIDC provider for login walls is configured
+func (h *Handler) oidcEnabled() bool {
+	return h.OIDCIssuer != "" && h.OIDCClientID != "" && h.OIDCClientSecret != ""
+}
+
+// loginProvider returns the provider of the login wall in front of host,
+// or "" if it has none
+func (h *Handler) loginProvider(host string) string {
+	if h.LoginWalls == nil {
+		return ""
+	}
+	return h.LoginWalls.LoginProvider(host)
+}
+
+// oidcEndpoints returns the provider's endpoints from the cached discovery
+// document, fetching it again once it is older than oidcDiscoveryTTL
+func (h *Handler) oidcEndpoints() (*oidcEndpoints, error) {
+	h.oidc.mu.Lock()
+	defer h.oidc.mu.Unlock()
+	if h.oidc.endpoints != nil && time.Since(h.oidc.fetchedAt) < oidcDiscoveryTTL {
+		return h.oidc.endpoints, nil
+	}
+
+	endpoints, err := h.fetchOIDCEndpoints()
+	if err != nil {
+		return nil, err
+	}
+	h.oidc.endpoints = endpoints
+	h.oidc.fetchedAt = time.Now()
+	return endpoints, nil
+}
+
+// fetchOIDCEndpoints fetches the provider's discovery document
+func (h *Handler) fetchOIDCEndpoints() (*oidcEndpoints, error) {
+	resp, err := oidcClient.Get(h.OIDCIssuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery returned %s", resp.Status)
+	}
+
+	var endpoints oidcEndpoints
+	if err := json.NewDecoder(resp.Body).Decode(&endpoints); err != nil {
+		return nil, err
+	}
+	if endpoints.AuthorizationEndpoint == "" || endpoints.TokenEndpoint == "" || endpoints.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery document of %s lacks endpoints", h.OIDCIssuer)
+	}
+	return &endpoints, nil
+}
+
+// verifyIDToken checks an ID token against the provider's keys. A token
+// signed with a key the cached set lacks makes it fetch the keys again, in
+// case the provider rotated them.
+func (h *Handler) verifyIDToken(raw, nonce string) (*auth.IDTokenClaims, error) {
+	keys, err := h.oidcKeys(false)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := auth.VerifyIDToken(raw, keys, h.OIDCIssuer, h.OIDCClientID, nonce)
+	if !errors.Is(err, auth.ErrIDTokenKeyUnknown) {
+		return claims, err
+	}
+	if keys, err = h.oidcKeys(true); err != nil {
+		return nil, err
+	}
+	return auth.VerifyIDToken(raw, keys, h.OIDCIssuer, h.OIDCClientID, nonce)
+}
+
+// oidcKeys returns the provider's signing keys, fetching them again once
+// they are older than oidcDiscoveryTTL or if refresh is set
+func (h *Handler) oidcKeys(refresh bool) (auth.JWKS, error) {
+	endpoints, err := h.oidcEndpoints()
+	if err != nil {
+		return nil, err
+	}
+
+	h.oidc.mu.Lock()
+	defer h.oidc.mu.Unlock()
+	if h.oidc.keys != nil && !refresh && time.Since(h.oidc.keysFetchedAt) < oidcDiscoveryTTL {
+		return h.oidc.keys, nil
+	}
+
+	resp, err := oidcClient.Get(endpoints.JWKSURI)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("key set returned %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	keys, err := auth.ParseJWKS(data)
+	if err != nil {
+		return nil, fmt.Errorf("key set of %s: %w", h.OIDCIssuer, err)
+	}
+	h.oidc.keys = keys
+	h.oidc.keysFetchedAt = time.Now()
+	return keys, nil
+}
+
+// pkceVerifier returns a random PKCE code verifier (RFC 7636)
+func pkceVerifier() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// scheme returns the URL scheme of the dashboard and tunnel hosts
+func (h *Handler) scheme() string {
+	if h.Domain == "localhost" || h.Domain == "127.0.0.1" {
+		return "http"
+	}
+	return "https"
+}
+
+// dashboardURL returns the absolute URL of a dashboard path
+func (h *Handler) dashboardURL(path string) string {
+	if h.Domain == "localhost" || h.Domain == "127.0.0.1" {
+		return fmt.Sprintf("http://%s%s", h.Domain, path)
+	}
+	return fmt.Sprintf("https://app.%s%s", h.Domain, path)
+}
@@ -19,12 +19,15 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
 	"gopublic/internal/auth"
 	"gopublic/internal/avatar"
 	"gopublic/internal/config"
+	"gopublic/internal/customdomain"
+	"gopublic/internal/devicecert"
 	"gopublic/internal/metrics"
 	"gopublic/internal/models"
 	"gopublic/internal/sentry"
@@ -37,10 +40,33 @@ import (
 var templateFS embed.FS
 
 // UserSessionProvider provides information about active user sessions.
-// This interface is implemented by server.UserSessionRegistry.
+// main adapts server.UserSessionRegistry to it.
 type UserSessionProvider interface {
 	IsConnected(userID uint) bool
-	GetActiveDomains(userID uint) []string
+	GetSessions(userID uint) []AgentSession
+}
+
+// DomainReleaser takes a custom domain away from the agents whose user no
+// longer owns it. This interface is implemented by server.Server.
+type DomainReleaser interface {
+	ReleaseUnownedDomain(hostname string)
+}
+
+// LoginWallLookup tells which provider the login wall in front of a tunnel
+// host uses ("" = no login wall). This interface is implemented by
+// server.Server.
+type LoginWallLookup interface {
+	LoginProvider(hostname string) string
+}
+
+// AgentSession is a connected agent as listed on the dashboard.
+type AgentSession struct {
+	Session     io.Closer // Closing it disconnects the agent
+	RemoteAddr  string
+	ConnectedAt time.Time
+	Domains     []string
+	DeviceID    uint   // Device certificate the agent authenticated with (0 = token)
+	Device      string // Name of that device
 }
 
 type Handler struct {
@@ -53,12 +79,21 @@ type Handler struct {
 	AdminTelegramID       int64
 	YandexClientID        string
 	YandexClientSecret    string
+	OIDCIssuer            string // OIDC provider for tunnel login walls (empty = disabled)
+	OIDCClientID          string
+	OIDCClientSecret      string
 	Session               *auth.SessionManager
 	UserSessions          UserSessionProvider // Optional: provides active session info
+	DomainReleaser        DomainReleaser      // Optional: unbinds custom domains that changed hands
+	LoginWalls            LoginWallLookup     // Login walls of tunnel hosts (nil = no edge logins)
 	TelegramBot           *telegram.Bot       // Telegram bot for auth
 	TelegramWidgetEnabled bool                // If true, use legacy Telegram Login Widget
 	AppMetrics            *metrics.AppMetrics // Optional: Prometheus metrics
 	MetricsToken          string              // Optional: Bearer token for /metrics endpoint
+	DomainVerifier        *customdomain.Verifier
+	DeviceCA              *devicecert.CA // Optional: issues device client certificates
+
+	oidc oidcDiscovery // Cached discovery document of OIDCIssuer
 }
 
 // SetUserSessions sets the user session provider for displaying connection status.
@@ -88,7 +123,11 @@ func NewHandlerWithConfig(cfg *config.Config) (*Handler, error) {
 		AdminTelegramID:     cfg.AdminTelegramID,
 		YandexClientID:      cfg.YandexClientID,
 		YandexClientSecret:  cfg.YandexClientSecret,
+		OIDCIssuer:          cfg.OIDCIssuer,
+		OIDCClientID:        cfg.OIDCClientID,
+		OIDCClientSecret:    cfg.OIDCClientSecret,
 		Session:             sessionMgr,
+		DomainVerifier:      customdomain.NewVerifier(),
 	}, nil
 }
 
@@ -109,10 +148,11 @@ func NewHandler() (*Handler, error) {
 	}
 
 	return &Handler{
-		BotToken: os.Getenv("TELEGRAM_BOT_TOKEN"),
-		BotName:  os.Getenv("TELEGRAM_BOT_NAME"),
-		Domain:   domain,
-		Session:  sessionMgr,
+		BotToken:       os.Getenv("TELEGRAM_BOT_TOKEN"),
+		BotName:        os.Getenv("TELEGRAM_BOT_NAME"),
+		Domain:         domain,
+		Session:        sessionMgr,
+		DomainVerifier: customdomain.NewVerifier(),
 	}, nil
 }
 
@@ -202,6 +242,11 @@ func (h *Handler) Index(c *gin.Context) {
 		return
 	}
 
+	// Every login method lands here; finish a login wall sign-in if one is pending
+	if h.resumeEdgeLogin(c, user) {
+		return
+	}
+
 	// Fetch token
 	token, err := storage.GetUserToken(user.ID)
 	if err != nil {
@@ -218,6 +263,23 @@ func (h *Handler) Index(c *gin.Context) {
 		return
 	}
 
+	customDomains, err := storage.GetUserCustomDomains(user.ID)
+	if err != nil {
+		sentry.CaptureErrorWithContextf(c, err, "Failed to fetch custom domains for user %d", user.ID)
+		c.String(http.StatusInternalServerError, "Failed to load user data")
+		return
+	}
+
+	var deviceCerts []models.DeviceCert
+	if h.DeviceCA != nil {
+		deviceCerts, err = storage.GetUserDeviceCerts(user.ID)
+		if err != nil {
+			sentry.CaptureErrorWithContextf(c, err, "Failed to fetch device certificates for user %d", user.ID)
+			c.String(http.StatusInternalServerError, "Failed to load user data")
+			return
+		}
+	}
+
 	// Fetch bandwidth statistics
 	bandwidthToday, _ := storage.GetUserBandwidthToday(user.ID)
 	bandwidthTotal, _ := storage.GetUserTotalBandwidth(user.ID)
@@ -228,16 +290,19 @@ func (h *Handler) Index(c *gin.Context) {
 
 	// Check connection status
 	var isConnected bool
-	var activeDomains []string
+	var agents []AgentSession
 	if h.UserSessions != nil {
 		isConnected = h.UserSessions.IsConnected(user.ID)
-		activeDomains = h.UserSessions.GetActiveDomains(user.ID)
+		agents = h.UserSessions.GetSessions(user.ID)
 	}
 
 	c.HTML(http.StatusOK, "index.html", gin.H{
 		"User":            user,
 		"Token":           token.TokenString,
 		"Domains":         domains,
+		"CustomDomains":   customDomains,
+		"DevicesEnabled":  h.DeviceCA != nil,
+		"DeviceCerts":     deviceCerts,
 		"RootDomain":      h.Domain,
 		"GitHubRepo":      h.GitHubRepo,
 		"Version":         version.Version,
@@ -248,7 +313,7 @@ func (h *Handler) Index(c *gin.Context) {
 		"BandwidthTotal":  bandwidthTotal,
 		"BandwidthLimit":  bandwidthLimit,
 		"IsConnected":     isConnected,
-		"ActiveDomains":   activeDomains,
+		"Agents":          agents,
 	})
 }
 
@@ -287,7 +352,7 @@ func (h *Handler) TelegramCallback(c *gin.Context) {
 		suffixes := []string{"river", "star", "eagle", "bear", "fox"}
 		var domains []string
 		for i := 0; i < h.DomainsPerUser; i++ {
-			name := generateDomainName(prefixes[i%len(prefixes)], suffixes[i%len(suffixes)])
+			name := storage.GenerateDomainName(prefixes[i%len(prefixes)], suffixes[i%len(suffixes)])
 			domains = append(domains, name)
 		}
 
@@ -387,6 +452,294 @@ func (h *Handler) RegenerateToken(c *gin.Context) {
 	})
 }
 
+// AddCustomDomain handles POST /api/custom-domains - registers a custom domain
+// and returns the TXT record that proves the user controls it
+func (h *Handler) AddCustomDomain(c *gin.Context) {
+	// Validate CSRF token (double-submit cookie pattern)
+	cookieToken, err := c.Cookie("csrf_token")
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "CSRF token missing"})
+		return
+	}
+
+	requestToken := c.GetHeader("X-CSRF-Token")
+	if requestToken == "" || requestToken != cookieToken {
+		c.JSON(http.StatusForbidden, gin.H{"error": "CSRF token invalid"})
+		return
+	}
+
+	// Validate session
+	user, err := h.getUserFromSession(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req struct {
+		Hostname string `json:"hostname"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	hostname, err := customdomain.Normalize(req.Hostname, h.Domain)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid domain name"})
+		return
+	}
+
+	domain := &models.CustomDomain{
+		Hostname:          hostname,
+		UserID:            user.ID,
+		VerificationToken: customdomain.NewToken(),
+	}
+	if err := storage.CreateCustomDomain(domain); err != nil {
+		if err == storage.ErrDuplicateKey {
+			c.JSON(http.StatusConflict, gin.H{"error": "Domain is already added"})
+			return
+		}
+		sentry.CaptureErrorWithContextf(c, err, "Failed to add custom domain for user %d", user.ID)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add domain"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"hostname":     domain.Hostname,
+		"record_name":  customdomain.RecordName(domain.Hostname),
+		"record_value": customdomain.RecordValue(domain.VerificationToken),
+	})
+}
+
+// VerifyCustomDomain handles POST /api/custom-domains/verify - looks up the
+// TXT record of a custom domain and marks it verified when the token matches
+func (h *Handler) VerifyCustomDomain(c *gin.Context) {
+	// Validate CSRF token (double-submit cookie pattern)
+	cookieToken, err := c.Cookie("csrf_token")
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "CSRF token missing"})
+		return
+	}
+
+	requestToken := c.GetHeader("X-CSRF-Token")
+	if requestToken == "" || requestToken != cookieToken {
+		c.JSON(http.StatusForbidden, gin.H{"error": "CSRF token invalid"})
+		return
+	}
+
+	// Validate session
+	user, err := h.getUserFromSession(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req struct {
+		Hostname string `json:"hostname"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	domain, err := storage.GetCustomDomain(strings.ToLower(req.Hostname), user.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Domain not found"})
+		return
+	}
+
+	if err := h.DomainVerifier.Verify(c.Request.Context(), domain.Hostname, domain.VerificationToken); err != nil {
+		if err != customdomain.ErrNotVerified {
+			log.Printf("Custom domain verification of %s failed: %v", domain.Hostname, err)
+		}
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error":        "Verification record not found",
+			"record_name":  customdomain.RecordName(domain.Hostname),
+			"record_value": customdomain.RecordValue(domain.VerificationToken),
+		})
+		return
+	}
+
+	if err := storage.MarkCustomDomainVerified(domain.ID); err != nil {
+		sentry.CaptureErrorWithContextf(c, err, "Failed to mark custom domain %s verified", domain.Hostname)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify domain"})
+		return
+	}
+	if h.DomainReleaser != nil {
+		// A previous holder's agents must stop serving it
+		h.DomainReleaser.ReleaseUnownedDomain(domain.Hostname)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "hostname": domain.Hostname})
+}
+
+// DeleteCustomDomain handles POST /api/custom-domains/delete - removes a
+// custom domain of the user
+func (h *Handler) DeleteCustomDomain(c *gin.Context) {
+	// Validate CSRF token (double-submit cookie pattern)
+	cookieToken, err := c.Cookie("csrf_token")
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "CSRF token missing"})
+		return
+	}
+
+	requestToken := c.GetHeader("X-CSRF-Token")
+	if requestToken == "" || requestToken != cookieToken {
+		c.JSON(http.StatusForbidden, gin.H{"error": "CSRF token invalid"})
+		return
+	}
+
+	// Validate session
+	user, err := h.getUserFromSession(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req struct {
+		Hostname string `json:"hostname"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	if err := storage.DeleteCustomDomain(strings.ToLower(req.Hostname), user.ID); err != nil {
+		if err == storage.ErrNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Domain not found"})
+			return
+		}
+		sentry.CaptureErrorWithContextf(c, err, "Failed to delete custom domain %s", req.Hostname)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete domain"})
+		return
+	}
+	if h.DomainReleaser != nil {
+		h.DomainReleaser.ReleaseUnownedDomain(strings.ToLower(req.Hostname))
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// IssueDeviceCert handles POST /api/devices - issues a client certificate for
+// a new device and returns it with its private key for download
+func (h *Handler) IssueDeviceCert(c *gin.Context) {
+	// Validate CSRF token (double-submit cookie pattern)
+	cookieToken, err := c.Cookie("csrf_token")
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "CSRF token missing"})
+		return
+	}
+
+	requestToken := c.GetHeader("X-CSRF-Token")
+	if requestToken == "" || requestToken != cookieToken {
+		c.JSON(http.StatusForbidden, gin.H{"error": "CSRF token invalid"})
+		return
+	}
+
+	// Validate session
+	user, err := h.getUserFromSession(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	if h.DeviceCA == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device certificates are disabled"})
+		return
+	}
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	cert, bundle, err := h.DeviceCA.Issue(req.Name)
+	if err != nil {
+		if err == devicecert.ErrInvalidName {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid device name"})
+			return
+		}
+		sentry.CaptureErrorWithContextf(c, err, "Failed to issue device certificate for user %d", user.ID)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue certificate"})
+		return
+	}
+
+	device := &models.DeviceCert{
+		UserID:      user.ID,
+		Name:        cert.Subject.CommonName,
+		Fingerprint: devicecert.Fingerprint(cert),
+		ExpiresAt:   cert.NotAfter,
+	}
+	if err := storage.CreateDeviceCert(device); err != nil {
+		sentry.CaptureErrorWithContextf(c, err, "Failed to store device certificate for user %d", user.ID)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue certificate"})
+		return
+	}
+
+	// The private key is not stored; this response is the only copy
+	c.JSON(http.StatusOK, gin.H{
+		"id":          device.ID,
+		"name":        device.Name,
+		"fingerprint": device.Fingerprint,
+		"pem":         string(bundle),
+	})
+}
+
+// RevokeDeviceCert handles POST /api/devices/revoke - revokes a device
+// certificate and disconnects the agents that authenticated with it
+func (h *Handler) RevokeDeviceCert(c *gin.Context) {
+	// Validate CSRF token (double-submit cookie pattern)
+	cookieToken, err := c.Cookie("csrf_token")
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "CSRF token missing"})
+		return
+	}
+
+	requestToken := c.GetHeader("X-CSRF-Token")
+	if requestToken == "" || requestToken != cookieToken {
+		c.JSON(http.StatusForbidden, gin.H{"error": "CSRF token invalid"})
+		return
+	}
+
+	// Validate session
+	user, err := h.getUserFromSession(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req struct {
+		ID uint `json:"id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	if err := storage.RevokeDeviceCert(req.ID, user.ID); err != nil {
+		if err == storage.ErrNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Certificate not found"})
+			return
+		}
+		sentry.CaptureErrorWithContextf(c, err, "Failed to revoke device certificate %d", req.ID)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke certificate"})
+		return
+	}
+
+	if h.UserSessions != nil {
+		for _, sess := range h.UserSessions.GetSessions(user.ID) {
+			if sess.DeviceID == req.ID {
+				sess.Session.Close()
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
 func (h *Handler) getUserFromSession(c *gin.Context) (*models.User, error) {
 	session, err := h.Session.GetSession(c.Request)
 	if err != nil {
@@ -626,15 +979,6 @@ func generateState() string {
 	return base64.URLEncoding.EncodeToString(b)
 }
 
-// generateDomainName generates a unique domain slug using a cryptographically random suffix.
-// Format: <prefix>-<suffix>-<6-hex-chars>, e.g. "misty-river-3f7a2c".
-// This avoids collisions that occurred when using time.Unix()%1000.
-func generateDomainName(prefix, suffix string) string {
-	b := make([]byte, 3)
-	rand.Read(b)
-	return fmt.Sprintf("%s-%s-%s", prefix, suffix, hex.EncodeToString(b))
-}
-
 // YandexAuth initiates Yandex OAuth flow
 func (h *Handler) YandexAuth(c *gin.Context) {
 	if h.YandexClientID == "" {
@@ -792,7 +1136,7 @@ func (h *Handler) YandexCallback(c *gin.Context) {
 		suffixes := []string{"river", "star", "eagle", "bear", "fox"}
 		var domains []string
 		for i := 0; i < h.DomainsPerUser; i++ {
-			name := generateDomainName(prefixes[i%len(prefixes)], suffixes[i%len(suffixes)])
+			name := storage.GenerateDomainName(prefixes[i%len(prefixes)], suffixes[i%len(suffixes)])
 			domains = append(domains, name)
 		}
 
@@ -936,7 +1280,7 @@ func (h *Handler) YandexTokenAuth(c *gin.Context) {
 		suffixes := []string{"river", "star", "eagle", "bear", "fox"}
 		var domains []string
 		for i := 0; i < h.DomainsPerUser; i++ {
-			name := generateDomainName(prefixes[i%len(prefixes)], suffixes[i%len(suffixes)])
+			name := storage.GenerateDomainName(prefixes[i%len(prefixes)], suffixes[i%len(suffixes)])
 			domains = append(domains, name)
 		}
 
@@ -1198,7 +1542,7 @@ func (h *Handler) handleTelegramLoginFromBot(c *gin.Context, login *telegram.Pen
 		suffixes := []string{"river", "star", "eagle", "bear", "fox"}
 		var domains []string
 		for i := 0; i < h.DomainsPerUser; i++ {
-			name := generateDomainName(prefixes[i%len(prefixes)], suffixes[i%len(suffixes)])
+			name := storage.GenerateDomainName(prefixes[i%len(prefixes)], suffixes[i%len(suffixes)])
 			domains = append(domains, name)
 		}
 
@@ -0,0 +1,67 @@
+package devicecert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"testing"
+)
+
+func TestIssue(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := LoadOrCreate(dir)
+	if err != nil {
+		t.Fatalf("LoadOrCreate: %v", err)
+	}
+
+	cert, bundle, err := ca.Issue("laptop")
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	if cert.Subject.CommonName != "laptop" {
+		t.Errorf("CommonName = %q, want laptop", cert.Subject.CommonName)
+	}
+
+	// The agent loads the bundle as both certificate and key file
+	pair, err := tls.X509KeyPair(bundle, bundle)
+	if err != nil {
+		t.Fatalf("X509KeyPair: %v", err)
+	}
+	if pair.Leaf == nil || Fingerprint(pair.Leaf) != Fingerprint(cert) {
+		t.Error("bundle holds a different certificate")
+	}
+
+	// A reloaded CA verifies what the first one issued
+	reloaded, err := LoadOrCreate(dir)
+	if err != nil {
+		t.Fatalf("LoadOrCreate (existing): %v", err)
+	}
+	opts := x509.VerifyOptions{
+		Roots:     reloaded.Pool(),
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if _, err := cert.Verify(opts); err != nil {
+		t.Errorf("Verify with reloaded CA: %v", err)
+	}
+
+	other, err := LoadOrCreate(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Roots = other.Pool()
+	if _, err := cert.Verify(opts); err == nil {
+		t.Error("certificate verified against an unrelated CA")
+	}
+}
+
+func TestIssue_InvalidName(t *testing.T) {
+	ca, err := LoadOrCreate(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"", "   ", string(make([]byte, 65))} {
+		if _, _, err := ca.Issue(name); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("Issue(%q) error = %v, want ErrInvalidName", name, err)
+		}
+	}
+}
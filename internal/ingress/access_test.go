@@ -0,0 +1,169 @@
+package ingress
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"gopublic/internal/auth"
+	"gopublic/internal/server"
+	"gopublic/pkg/protocol"
+)
+
+func TestProxyToTunnel_AccessPolicy(t *testing.T) {
+	access, err := server.NewTunnelAccess(&protocol.AccessPolicy{
+		BasicAuth:  []string{"alice:wonderland"},
+		AllowCIDRs: []string{"192.0.2.0/24"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, agent := tunnelIngress(t, 0, access)
+
+	authorization := make(chan string, 3)
+	go func() {
+		for {
+			stream, err := agent.Accept()
+			if err != nil {
+				return
+			}
+			if req, err := http.ReadRequest(bufio.NewReader(stream)); err == nil {
+				authorization <- req.Header.Get("Authorization")
+				io.WriteString(stream, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+			}
+			stream.Close()
+		}
+	}()
+
+	// Refused requests never reach the client
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://myapp.example.com/", nil))
+	if w.Code != http.StatusUnauthorized || !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Basic") {
+		t.Errorf("no credentials: %d %q, want 401 with a basic auth challenge", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+	outside := httptest.NewRequest(http.MethodGet, "http://myapp.example.com/", nil)
+	outside.RemoteAddr = "198.51.100.1:1234"
+	outside.SetBasicAuth("alice", "wonderland")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, outside)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("outside the allowed network: status = %d, want 403", w.Code)
+	}
+	select {
+	case <-authorization:
+		t.Fatal("a refused request reached the client")
+	default:
+	}
+
+	// The edge credentials are not passed on to the local service
+	allowed := httptest.NewRequest(http.MethodGet, "http://myapp.example.com/", nil)
+	allowed.SetBasicAuth("alice", "wonderland")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, allowed)
+	if w.Code != http.StatusOK {
+		t.Fatalf("with credentials: status = %d, want 200", w.Code)
+	}
+	if got := <-authorization; got != "" {
+		t.Errorf("client got Authorization %q, want none", got)
+	}
+}
+
+func TestProxyToTunnel_LoginWall(t *testing.T) {
+	t.Setenv("SESSION_HASH_KEY", strings.Repeat("ab", 32))
+	t.Setenv("SESSION_BLOCK_KEY", strings.Repeat("cd", 32))
+	sessions, err := auth.NewSessionManager(auth.SessionConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	access, err := server.NewTunnelAccess(&protocol.AccessPolicy{Login: &protocol.LoginPolicy{Allow: []string{"*@example.com"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, agent := tunnelIngress(t, 0, access)
+
+	type forwarded struct{ user, cookie string }
+	requests := make(chan forwarded, 3)
+	go func() {
+		for {
+			stream, err := agent.Accept()
+			if err != nil {
+				return
+			}
+			if req, err := http.ReadRequest(bufio.NewReader(stream)); err == nil {
+				requests <- forwarded{req.Header.Get(auth.EdgeUserHeader), req.Header.Get("Cookie")}
+				io.WriteString(stream, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+			}
+			stream.Close()
+		}
+	}()
+
+	// Browsers are sent to the dashboard, with a way back
+	page := httptest.NewRequest(http.MethodGet, "http://myapp.example.com/docs?page=2", nil)
+	page.Header.Set("Accept", "text/html")
+	page.Header.Set(auth.EdgeUserHeader, "admin@example.com")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, page)
+	location, _ := url.Parse(w.Header().Get("Location"))
+	if w.Code != http.StatusTemporaryRedirect || location == nil || location.Host != "app.example.com" || location.Path != "/edge/login" {
+		t.Fatalf("no login: %d to %q, want a redirect to the dashboard", w.Code, w.Header().Get("Location"))
+	}
+	if q := location.Query(); q.Get("host") != "myapp.example.com" || q.Get("next") != "/docs?page=2" || q.Get("provider") != protocol.LoginProviderDashboard {
+		t.Errorf("login URL query = %v", q)
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "http://myapp.example.com/api", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("API call without login: status = %d, want 401", w.Code)
+	}
+
+	redeem := func(id auth.EdgeIdentity) *httptest.ResponseRecorder {
+		t.Helper()
+		ticket, err := sessions.IssueEdgeTicket(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://myapp.example.com"+auth.EdgeAuthPath+"?"+url.Values{"ticket": {ticket}, "next": {"/docs"}}.Encode(), nil))
+		return w
+	}
+
+	// Tickets for other hosts, other providers or other people are refused
+	if w := redeem(auth.EdgeIdentity{Host: "other.example.com", Provider: protocol.LoginProviderDashboard, Identities: []string{"alice@example.com"}}); w.Code != http.StatusUnauthorized {
+		t.Errorf("ticket for another host: status = %d, want 401", w.Code)
+	}
+	if w := redeem(auth.EdgeIdentity{Host: "myapp.example.com", Provider: protocol.LoginProviderOIDC, Identities: []string{"alice@example.com"}}); w.Code != http.StatusForbidden {
+		t.Errorf("ticket from another provider: status = %d, want 403", w.Code)
+	}
+	if w := redeem(auth.EdgeIdentity{Host: "myapp.example.com", Provider: protocol.LoginProviderDashboard, User: "tg:7", Identities: []string{"tg:7"}}); w.Code != http.StatusForbidden {
+		t.Errorf("identity not allowed: status = %d, want 403", w.Code)
+	}
+	select {
+	case <-requests:
+		t.Fatal("a visitor reached the client without signing in")
+	default:
+	}
+
+	// An allowed visitor gets a cookie and the client learns who they are
+	w = redeem(auth.EdgeIdentity{Host: "myapp.example.com", Provider: protocol.LoginProviderDashboard, User: "alice@example.com", Identities: []string{"alice@example.com", "tg:42"}})
+	if w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != "/docs" {
+		t.Fatalf("redeeming a ticket: %d to %q, want a redirect to /docs", w.Code, w.Header().Get("Location"))
+	}
+	signedIn := httptest.NewRequest(http.MethodGet, "http://myapp.example.com/docs", nil)
+	signedIn.Header.Set(auth.EdgeUserHeader, "admin@example.com")
+	signedIn.AddCookie(&http.Cookie{Name: "theme", Value: "dark"})
+	for _, c := range w.Result().Cookies() {
+		signedIn.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, signedIn)
+	if w.Code != http.StatusOK {
+		t.Fatalf("signed in: status = %d, want 200", w.Code)
+	}
+	if got := <-requests; got.user != "alice@example.com" || got.cookie != "theme=dark" {
+		t.Errorf("client got user %q and cookies %q, want alice@example.com and only theme=dark", got.user, got.cookie)
+	}
+}
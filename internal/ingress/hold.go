@@ -0,0 +1,110 @@
+package ingress
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"gopublic/internal/metrics"
+)
+
+// holdPollInterval is how often held requests check whether their client is back.
+const holdPollInterval = 100 * time.Millisecond
+
+// recentlyLostWindow is how long after losing its client a domain still has
+// its requests held; domains gone for longer answer right away.
+const recentlyLostWindow = 2 * time.Minute
+
+// HoldQueue keeps requests for a tunnel whose client is reconnecting until
+// it is back, so webhooks arriving in between are not lost. It bounds how
+// many requests wait at once, in total and per domain. Held requests keep
+// their bodies unread on the visitor's connection, so waiting costs no
+// buffering.
+type HoldQueue struct {
+	Timeout    time.Duration // Longest a request waits
+	MaxHeld    int           // Requests waiting at once on this server
+	MaxPerHost int           // Requests waiting at once for one domain
+
+	// Metrics counts held and dropped requests (nil = off)
+	Metrics *metrics.AppMetrics
+
+	mu      sync.Mutex
+	held    int
+	perHost map[string]int
+}
+
+// NewHoldQueue creates a hold queue with the given limits.
+func NewHoldQueue(timeout time.Duration, maxHeld, maxPerHost int) *HoldQueue {
+	return &HoldQueue{
+		Timeout:    timeout,
+		MaxHeld:    maxHeld,
+		MaxPerHost: maxPerHost,
+		perHost:    make(map[string]int),
+	}
+}
+
+// Wait holds a request for host until ready reports its client is back, the
+// timeout passes or ctx is done. It reports whether the client came back;
+// requests beyond the limits don't wait at all.
+func (q *HoldQueue) Wait(ctx context.Context, host string, ready func() bool) bool {
+	if !q.acquire(host) {
+		q.dropped(metrics.HoldDroppedFull)
+		return false
+	}
+	defer q.release(host)
+	if q.Metrics != nil {
+		q.Metrics.RequestHeld()
+		defer q.Metrics.HoldEnded()
+	}
+
+	timer := time.NewTimer(q.Timeout)
+	defer timer.Stop()
+	ticker := time.NewTicker(holdPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if ready() {
+				return true
+			}
+		case <-timer.C:
+			if ready() {
+				return true
+			}
+			q.dropped(metrics.HoldDroppedTimeout)
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// acquire reserves a place in the queue for a request to host.
+func (q *HoldQueue) acquire(host string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.held >= q.MaxHeld || q.perHost[host] >= q.MaxPerHost {
+		return false
+	}
+	q.held++
+	q.perHost[host]++
+	return true
+}
+
+// release frees the place taken by acquire.
+func (q *HoldQueue) release(host string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.held--
+	q.perHost[host]--
+	if q.perHost[host] <= 0 {
+		delete(q.perHost, host)
+	}
+}
+
+func (q *HoldQueue) dropped(reason string) {
+	if q.Metrics != nil {
+		q.Metrics.HeldRequestDropped(reason)
+	}
+}
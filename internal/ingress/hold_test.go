@@ -0,0 +1,166 @@
+package ingress
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hashicorp/yamux"
+
+	"gopublic/internal/metrics"
+	"gopublic/internal/server"
+)
+
+func TestHoldQueue_Limits(t *testing.T) {
+	q := NewHoldQueue(5*time.Second, 2, 1)
+	q.Metrics = metrics.NewAppMetrics()
+
+	var back atomic.Bool
+	ready := func() bool { return back.Load() }
+	results := make(chan bool, 2)
+	go func() { results <- q.Wait(context.Background(), "a.example.com", ready) }()
+	go func() { results <- q.Wait(context.Background(), "b.example.com", ready) }()
+	waitFor(t, func() bool { return q.Metrics.HeldRequests.Value() == 2 })
+
+	// Over the per-domain and the total limit, requests don't wait
+	if q.Wait(context.Background(), "a.example.com", ready) {
+		t.Error("Wait() over the per-domain limit = true")
+	}
+	if q.Wait(context.Background(), "c.example.com", ready) {
+		t.Error("Wait() over the total limit = true")
+	}
+	if got := q.Metrics.HeldRequestsDropped[metrics.HoldDroppedFull].Value(); got != 2 {
+		t.Errorf("dropped as full = %d, want 2", got)
+	}
+
+	back.Store(true)
+	for i := 0; i < 2; i++ {
+		if !<-results {
+			t.Error("held request not released when its client came back")
+		}
+	}
+	if q.Metrics.HeldRequests.Value() != 0 || q.Metrics.HeldRequestsTotal.Value() != 2 {
+		t.Errorf("held now = %v, total = %d; want 0 and 2", q.Metrics.HeldRequests.Value(), q.Metrics.HeldRequestsTotal.Value())
+	}
+	if !q.Wait(context.Background(), "a.example.com", ready) {
+		t.Error("places were not freed")
+	}
+}
+
+func TestHoldQueue_Timeout(t *testing.T) {
+	q := NewHoldQueue(150*time.Millisecond, 10, 10)
+	q.Metrics = metrics.NewAppMetrics()
+
+	start := time.Now()
+	if q.Wait(context.Background(), "a.example.com", func() bool { return false }) {
+		t.Fatal("Wait() = true for a client that never came back")
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("gave up after %v, before the timeout", elapsed)
+	}
+	if got := q.Metrics.HeldRequestsDropped[metrics.HoldDroppedTimeout].Value(); got != 1 {
+		t.Errorf("dropped after timeout = %d, want 1", got)
+	}
+
+	// A visitor that goes away stops waiting
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if q.Wait(ctx, "a.example.com", func() bool { return false }) {
+		t.Error("Wait() = true for a canceled request")
+	}
+}
+
+func TestProxyToTunnel_HoldsUntilClientReconnects(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	registry := server.NewTunnelRegistry()
+	ingress := &Ingress{Registry: registry, RootDomain: "example.com", Hold: NewHoldQueue(5*time.Second, 10, 10)}
+	r := gin.New()
+	r.NoRoute(ingress.handleRequest)
+
+	// The client drops its connection
+	lost, _ := yamuxSessions(t)
+	registry.Register("myapp.example.com", lost, 1, false)
+	lost.Close()
+	registry.LoseSession("myapp.example.com", lost)
+
+	w := httptest.NewRecorder()
+	served := make(chan struct{})
+	go func() {
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "http://myapp.example.com/webhook", nil))
+		close(served)
+	}()
+
+	// ...and reconnects while the webhook waits
+	time.Sleep(300 * time.Millisecond)
+	select {
+	case <-served:
+		t.Fatalf("request answered %d before the client came back", w.Code)
+	default:
+	}
+	session, agent := yamuxSessions(t)
+	go func() {
+		stream, err := agent.Accept()
+		if err != nil {
+			return
+		}
+		defer stream.Close()
+		if _, err := http.ReadRequest(bufio.NewReader(stream)); err == nil {
+			io.WriteString(stream, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+		}
+	}()
+	registry.Register("myapp.example.com", session, 1, false)
+
+	select {
+	case <-served:
+	case <-time.After(3 * time.Second):
+		t.Fatal("held request not dispatched after the client came back")
+	}
+	if w.Code != http.StatusOK || w.Body.String() != "ok" {
+		t.Errorf("response = %d %q, want 200 ok", w.Code, w.Body.String())
+	}
+
+	// Domains that were never served answer right away
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://unknown.example.com/", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown domain: status = %d, want 404", w.Code)
+	}
+}
+
+// yamuxSessions returns the server's end of a yamux session and the agent's end.
+func yamuxSessions(t *testing.T) (*yamux.Session, *yamux.Session) {
+	t.Helper()
+	serverConn, agentConn := net.Pipe()
+	serverSession, err := yamux.Server(serverConn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agentSession, err := yamux.Client(agentConn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		serverSession.Close()
+		agentSession.Close()
+	})
+	return serverSession, agentSession
+}
+
+// waitFor polls cond for up to two seconds.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -2,13 +2,15 @@ package ingress
 
 import (
 	"bufio"
-	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"regexp"
 	"strings"
@@ -19,13 +21,17 @@ import (
 	sentrygin "github.com/getsentry/sentry-go/gin"
 	"github.com/gin-gonic/gin"
 
+	"gopublic/internal/auth"
+	"gopublic/internal/cluster"
 	"gopublic/internal/config"
 	"gopublic/internal/dashboard"
 	"gopublic/internal/middleware"
 	"gopublic/internal/sentry"
 	"gopublic/internal/server"
 	"gopublic/internal/storage"
+	"gopublic/internal/transport"
 	"gopublic/internal/version"
+	"gopublic/pkg/protocol"
 )
 
 // hostPattern validates hostnames (RFC 1123 compliant + localhost).
@@ -43,8 +49,19 @@ type Ingress struct {
 	IsSecure            bool   // Whether running in secure mode
 	GitHubRepo          string // GitHub repo for client downloads (e.g., "username/gopublic")
 	DailyBandwidthLimit int64  // Daily bandwidth limit per user in bytes (0 = unlimited)
+	MaxRequestBody      int64  // Largest request body forwarded to a tunnel in bytes (0 = unlimited)
 	SentryEnabled       bool   // Whether Sentry is configured
 
+	// Cluster forwards requests for tunnels held by other server nodes (nil = single node)
+	Cluster *cluster.Node
+
+	// Hold keeps requests for reconnecting clients until they are back (nil = off)
+	Hold *HoldQueue
+
+	// ControlPlane serves clients that reach the control plane as a WebSocket
+	// on transport.WebSocketPath, e.g. behind firewalls allowing only 443 (nil = off)
+	ControlPlane *server.Server
+
 	quotaNotifyMu   sync.Mutex
 	quotaNotifiedAt map[uint]time.Time
 }
@@ -60,11 +77,22 @@ func NewIngressWithConfig(cfg *config.Config, registry *server.TunnelRegistry, d
 		IsSecure:            cfg.IsSecure(),
 		GitHubRepo:          cfg.GitHubRepo,
 		DailyBandwidthLimit: cfg.DailyBandwidthLimit,
+		MaxRequestBody:      cfg.MaxRequestBody,
 		SentryEnabled:       cfg.HasSentry(),
+		Hold:                newHoldQueueWithConfig(cfg),
 		quotaNotifiedAt:     make(map[uint]time.Time),
 	}
 }
 
+// newHoldQueueWithConfig returns the hold queue configured in cfg, or nil
+// when holding is off.
+func newHoldQueueWithConfig(cfg *config.Config) *HoldQueue {
+	if cfg.TunnelHoldSecs <= 0 {
+		return nil
+	}
+	return NewHoldQueue(time.Duration(cfg.TunnelHoldSecs)*time.Second, cfg.TunnelHoldMaxRequests, cfg.TunnelHoldPerDomain)
+}
+
 // NewIngress creates a new ingress (deprecated, use NewIngressWithConfig).
 func NewIngress(port string, registry *server.TunnelRegistry, dash *dashboard.Handler) *Ingress {
 	projectName := os.Getenv("PROJECT_NAME")
@@ -106,6 +134,16 @@ func (i *Ingress) maybeNotifyBandwidthExceeded(entry *server.TunnelEntry) {
 		return
 	}
 
+	if ctrl, ok := i.Registry.Control(entry.Session); ok {
+		used, err := storage.GetUserBandwidthToday(entry.UserID)
+		if err != nil {
+			used = i.DailyBandwidthLimit
+		}
+		_ = ctrl.SendQuotaWarning(used, i.DailyBandwidthLimit)
+		return
+	}
+
+	// Clients without a control stream only understand this fake HTTP request
 	stream, err := entry.Session.Open()
 	if err != nil {
 		return
@@ -213,6 +251,8 @@ func (i *Ingress) handleRequest(c *gin.Context) {
 
 	// Route based on host
 	switch {
+	case i.isControlPlaneRequest(host, c.Request):
+		transport.WebSocketHandler(i.ControlPlane.ServeConn).ServeHTTP(c.Writer, c.Request)
 	case i.isLandingPage(host):
 		i.serveLandingPage(c)
 	case i.isDashboardHost(host):
@@ -266,6 +306,13 @@ func (i *Ingress) isLandingPage(host string) bool {
 	return !i.isLocalDev() && i.RootDomain != "" && host == i.RootDomain
 }
 
+// isControlPlaneRequest returns true if the request tunnels the control plane.
+// Only the server's own hosts serve it; tunnel domains keep every path.
+func (i *Ingress) isControlPlaneRequest(host string, r *http.Request) bool {
+	return i.ControlPlane != nil && r.URL.Path == transport.WebSocketPath &&
+		(i.isLandingPage(host) || i.isDashboardHost(host))
+}
+
 // isDashboardHost returns true if the host should serve the dashboard.
 func (i *Ingress) isDashboardHost(host string) bool {
 	if i.RootDomain == "" {
@@ -436,6 +483,36 @@ func (i *Ingress) serveDashboard(c *gin.Context) {
 		} else {
 			c.String(http.StatusMethodNotAllowed, "Method Not Allowed")
 		}
+	case "/api/custom-domains":
+		if c.Request.Method == http.MethodPost {
+			i.DashHandler.AddCustomDomain(c)
+		} else {
+			c.String(http.StatusMethodNotAllowed, "Method Not Allowed")
+		}
+	case "/api/custom-domains/verify":
+		if c.Request.Method == http.MethodPost {
+			i.DashHandler.VerifyCustomDomain(c)
+		} else {
+			c.String(http.StatusMethodNotAllowed, "Method Not Allowed")
+		}
+	case "/api/custom-domains/delete":
+		if c.Request.Method == http.MethodPost {
+			i.DashHandler.DeleteCustomDomain(c)
+		} else {
+			c.String(http.StatusMethodNotAllowed, "Method Not Allowed")
+		}
+	case "/api/devices":
+		if c.Request.Method == http.MethodPost {
+			i.DashHandler.IssueDeviceCert(c)
+		} else {
+			c.String(http.StatusMethodNotAllowed, "Method Not Allowed")
+		}
+	case "/api/devices/revoke":
+		if c.Request.Method == http.MethodPost {
+			i.DashHandler.RevokeDeviceCert(c)
+		} else {
+			c.String(http.StatusMethodNotAllowed, "Method Not Allowed")
+		}
 	case "/api/accept-terms":
 		if c.Request.Method == http.MethodPost {
 			i.DashHandler.AcceptTerms(c)
@@ -454,6 +531,16 @@ func (i *Ingress) serveDashboard(c *gin.Context) {
 		} else {
 			c.String(http.StatusMethodNotAllowed, "Method Not Allowed")
 		}
+	case "/edge/login":
+		i.DashHandler.EdgeLogin(c)
+	case "/edge/login/confirm":
+		if c.Request.Method == http.MethodPost {
+			i.DashHandler.EdgeLoginConfirm(c)
+		} else {
+			c.String(http.StatusMethodNotAllowed, "Method Not Allowed")
+		}
+	case "/edge/oidc/callback":
+		i.DashHandler.EdgeOIDCCallback(c)
 	case "/link/telegram":
 		i.DashHandler.LinkTelegram(c)
 	case "/auth/telegram/link":
@@ -482,53 +569,134 @@ func (i *Ingress) serveDashboard(c *gin.Context) {
 	}
 }
 
+// openTunnelStream opens a stream on the first session of entries that accepts
+// one and returns the entry it used. Entries come from TunnelRegistry.Entries,
+// balanced pick first.
+func openTunnelStream(entries []*server.TunnelEntry) (net.Conn, *server.TunnelEntry, error) {
+	lastErr := errors.New("no tunnel session available")
+	for _, e := range entries {
+		stream, err := e.Session.Open()
+		if err == nil {
+			return stream, e, nil
+		}
+		lastErr = err
+	}
+	return nil, nil, lastErr
+}
+
+// httpStreamHeader describes the visitor of an HTTP request for the client.
+func httpStreamHeader(r *http.Request, host string) *protocol.StreamHeader {
+	visitor := cluster.VisitorOf(r)
+	return &protocol.StreamHeader{
+		Proto:      protocol.StreamProtoHTTP,
+		Domain:     host,
+		RemoteAddr: visitor.RemoteAddr,
+		TLSVersion: visitor.TLSVersion,
+		SNI:        visitor.SNI,
+		RequestID:  newRequestID(),
+	}
+}
+
+// newRequestID returns a random ID that ties the client's log of a request to the server.
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// forwardToNode hands the request to the cluster node whose client serves
+// host. It reports whether the request was handled.
+func (i *Ingress) forwardToNode(c *gin.Context, host string) bool {
+	if i.Cluster == nil || cluster.Forwarded(c.Request) {
+		return false
+	}
+	owner, ok, err := i.Cluster.Owner(host)
+	if err != nil {
+		sentry.CaptureErrorWithContextf(c, err, "Cluster lookup failed for host %s", host)
+		c.String(http.StatusBadGateway, "Failed to locate tunnel client")
+		return true
+	}
+	if !ok {
+		return false
+	}
+	i.Cluster.Forward(c.Writer, c.Request, owner)
+	return true
+}
+
 // proxyToTunnel forwards the request to a tunnel client.
 func (i *Ingress) proxyToTunnel(c *gin.Context, host string) {
-	// Look up tunnel entry (includes user ID)
-	entry, ok := i.Registry.GetEntry(host)
-	if !ok {
+	// Look up tunnel entries (include user ID); shared domains have several
+	entries := i.Registry.Entries(host)
+	if len(entries) == 0 && i.forwardToNode(c, host) {
+		return
+	}
+
+	// Requests for a client that is reconnecting wait for it to come back
+	if i.clientReconnecting(host, entries) {
+		ready := func() bool { return i.Registry.HasLiveSession(host) }
+		if i.Hold.Wait(c.Request.Context(), host, ready) {
+			entries = i.Registry.Entries(host)
+		} else if len(entries) == 0 && i.forwardToNode(c, host) {
+			// It came back on another node
+			return
+		}
+	}
+	if len(entries) == 0 {
 		c.String(http.StatusNotFound, "Tunnel not found for host: %s", host)
 		return
 	}
+	entry := entries[0]
 
-	// Capture request size (we need this before opening the stream so we can enforce the limit).
-	var reqBuf bytes.Buffer
-	if err := c.Request.Write(&reqBuf); err != nil {
-		sentry.CaptureErrorWithContext(c, err, "Failed to serialize request")
-		c.Status(http.StatusBadGateway)
+	// Passthrough tunnels terminate TLS on the client; plain HTTP can't reach them
+	if entry.Passthrough {
+		c.String(http.StatusMisdirectedRequest, "Tunnel %s only accepts TLS connections", host)
+		return
+	}
+
+	// Access policies are enforced before anything reaches the client or is charged
+	if !i.checkAccess(c, entries, host) || !i.checkLogin(c, entries, host) {
+		return
+	}
+
+	// The domain is reserved while its client reconnects or its server drains
+	if !i.Registry.IsAvailable(entry) {
+		c.Header("Retry-After", "5")
+		c.String(http.StatusServiceUnavailable, "Tunnel client for %s is reconnecting, please retry shortly", host)
+		return
+	}
+
+	// Bodies that announce their size are refused before reaching the client
+	if i.MaxRequestBody > 0 && c.Request.ContentLength > i.MaxRequestBody {
+		c.String(http.StatusRequestEntityTooLarge, "Request body exceeds %d bytes", i.MaxRequestBody)
 		return
 	}
-	requestBytes := int64(reqBuf.Len())
+	// The request is used from a goroutine that may outlive the handler
+	req := c.Request.Clone(c.Request.Context())
+	if i.MaxRequestBody > 0 && req.Body != nil {
+		// Chunked bodies are cut off once they grow past the limit
+		req.Body = http.MaxBytesReader(c.Writer, req.Body, i.MaxRequestBody)
+	}
 
 	consume := func(bytes int64) (bool, error) {
-		if entry.BandwidthExempt {
-			return true, nil
-		}
-		if i.DailyBandwidthLimit <= 0 || bytes <= 0 {
-			return true, nil
-		}
-		allowed, _, err := storage.ConsumeUserBandwidthWithinLimit(entry.UserID, bytes, i.DailyBandwidthLimit)
-		if err != nil {
-			log.Printf("Failed to consume bandwidth for user %d: %v", entry.UserID, err)
-			// Fail-open on DB errors
-			return true, nil
-		}
-		return allowed, nil
+		return i.consumeBandwidth(entry, bytes)
 	}
 
-	// Reserve quota for request bytes before opening the tunnel stream.
-	if !entry.BandwidthExempt && i.DailyBandwidthLimit > 0 && requestBytes > 0 {
-		allowed, _ := consume(requestBytes)
-		if !allowed {
-			i.maybeNotifyBandwidthExceeded(entry)
-			c.Header("Retry-After", "86400") // 24 hours
-			c.String(http.StatusTooManyRequests, "Daily bandwidth limit exceeded. Please try again tomorrow.")
-			return
-		}
+	// Request bytes are charged as they stream; only refuse up front when
+	// today's quota is already used up
+	if i.quotaExhausted(entry) {
+		i.maybeNotifyBandwidthExceeded(entry)
+		c.Header("Retry-After", "86400") // 24 hours
+		c.String(http.StatusTooManyRequests, "Daily bandwidth limit exceeded. Please try again tomorrow.")
+		return
 	}
 
-	// Open stream to tunnel client
-	stream, err := entry.Session.Open()
+	// Open stream to tunnel client, failing over to the other sessions of a shared domain
+	stream, opened, err := openTunnelStream(entries)
+	if errors.Is(err, server.ErrTooManyStreams) {
+		c.Header("Retry-After", "1")
+		c.String(http.StatusServiceUnavailable, "Tunnel client for %s is busy, please retry shortly", host)
+		return
+	}
 	if err != nil {
 		sentry.CaptureErrorWithContextf(c, err, "Failed to open stream for host %s", host)
 		c.String(http.StatusBadGateway, "Failed to connect to tunnel client")
@@ -536,11 +704,13 @@ func (i *Ingress) proxyToTunnel(c *gin.Context, host string) {
 	}
 	defer stream.Close()
 
-	// Forward request to tunnel
-	if _, err := stream.Write(reqBuf.Bytes()); err != nil {
-		sentry.CaptureErrorWithContext(c, err, "Failed to write request to stream")
-		c.Status(http.StatusBadGateway)
-		return
+	// Clients that read typed streams learn the visitor without parsing the request
+	if i.Registry.StreamHeaders(opened.Session) {
+		if err := protocol.WriteStreamHeader(stream, httpStreamHeader(c.Request, host)); err != nil {
+			sentry.CaptureErrorWithContext(c, err, "Failed to write stream header")
+			c.Status(http.StatusBadGateway)
+			return
+		}
 	}
 
 	// Check if this is an upgrade request (WebSocket, h2c, etc.)
@@ -549,6 +719,12 @@ func (i *Ingress) proxyToTunnel(c *gin.Context, host string) {
 	// Note: bandwidth is consumed during streaming; we don't need to count response bytes here.
 
 	if isUpgrade {
+		// The upgrade handshake carries no body; send it before the raw bytes follow
+		if err := i.writeRequest(req, stream, consume, entry); err != nil {
+			i.requestFailed(c, err)
+			return
+		}
+
 		// For Upgrade requests (WebSocket, h2c, etc.) we must not parse or rewrite the
 		// upstream response/body because that can corrupt framing. Instead, we hijack
 		// the client connection and tunnel raw bytes bidirectionally.
@@ -617,9 +793,33 @@ func (i *Ingress) proxyToTunnel(c *gin.Context, host string) {
 		wg.Wait()
 		return
 	} else {
-		// Normal HTTP request/response - existing behavior
-		resp, err := http.ReadResponse(bufio.NewReader(stream), c.Request)
+		// Normal HTTP request/response. The body streams to the client while
+		// the response is awaited, so the local service may answer early
+		var writeErr error
+		writeDone := make(chan struct{})
+		go func() {
+			defer close(writeDone)
+			if writeErr = i.writeRequest(req, stream, consume, entry); writeErr != nil {
+				// Stop waiting for a response to a request that was cut off
+				stream.SetReadDeadline(time.Now())
+			}
+		}()
+
+		resp, err := http.ReadResponse(bufio.NewReader(stream), req)
 		if err != nil {
+			// The writer's deadline ends the read only after the write failed
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				<-writeDone
+			}
+			select {
+			case <-writeDone:
+				if writeErr != nil {
+					i.requestFailed(c, writeErr)
+					return
+				}
+			default:
+			}
 			sentry.CaptureErrorWithContext(c, err, "Failed to read response from stream")
 			c.Status(http.StatusBadGateway)
 			return
@@ -642,15 +842,277 @@ func (i *Ingress) proxyToTunnel(c *gin.Context, host string) {
 				_ = stream.Close()
 			})
 		}
-		cw := &bandwidthChargingWriter{w: c.Writer, consume: func(b int64) (bool, error) {
+		// Bodies of unknown length (gRPC, server-sent events) reach the
+		// visitor chunk by chunk instead of when the buffer fills
+		var out io.Writer = c.Writer
+		if resp.ContentLength < 0 {
+			out = flushWriter{c.Writer}
+		}
+		cw := &bandwidthChargingWriter{w: out, consume: func(b int64) (bool, error) {
 			allowed, err := consume(b)
 			if !allowed {
 				i.maybeNotifyBandwidthExceeded(entry)
 			}
 			return allowed, err
 		}, onLimit: closeUpstream}
-		_, _ = io.Copy(cw, resp.Body)
+		if _, err := io.Copy(cw, resp.Body); err != nil {
+			return
+		}
+
+		// Trailers (gRPC status) are only known once the body ended
+		for k, vv := range resp.Trailer {
+			c.Writer.Header()[http.TrailerPrefix+k] = vv
+		}
+	}
+}
+
+// flushWriter flushes the response after every write.
+type flushWriter struct {
+	w gin.ResponseWriter
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	fw.w.Flush()
+	return n, err
+}
+
+// requestWriteBuffer coalesces the request headers and chunk framing, so
+// bandwidth is charged per body chunk rather than per small write.
+const requestWriteBuffer = 32 * 1024
+
+// writeRequest streams req to the tunnel client, headers first, charging
+// bandwidth as it goes.
+func (i *Ingress) writeRequest(req *http.Request, stream net.Conn, consume func(int64) (bool, error), entry *server.TunnelEntry) error {
+	cw := &bandwidthChargingWriter{w: stream, consume: func(b int64) (bool, error) {
+		allowed, err := consume(b)
+		if !allowed {
+			i.maybeNotifyBandwidthExceeded(entry)
+		}
+		return allowed, err
+	}}
+	bw := bufio.NewWriterSize(cw, requestWriteBuffer)
+	out := *req
+	var body *flushingBody
+	if out.Body != nil && out.Body != http.NoBody {
+		body = &flushingBody{ReadCloser: out.Body, w: bw}
+		out.Body = body
+	}
+	if err := out.Write(requestWriter{bw}); err != nil {
+		// Request.Write hides why the body failed; report the cause
+		if body != nil && body.err != nil {
+			return body.err
+		}
+		return err
+	}
+	return bw.Flush()
+}
+
+// requestWriter hides bufio.Writer's ReadFrom from Request.Write, which would
+// otherwise read the body straight into the buffer that flushingBody flushes.
+// Being an io.ByteWriter, it keeps Request.Write from adding its own buffer.
+type requestWriter struct {
+	w *bufio.Writer
+}
+
+func (rw requestWriter) Write(p []byte) (int, error) { return rw.w.Write(p) }
+func (rw requestWriter) WriteByte(c byte) error      { return rw.w.WriteByte(c) }
+
+// flushingBody sends what was buffered before each read of the request body,
+// so the client gets the headers and every chunk without waiting for the
+// upload to fill the buffer.
+type flushingBody struct {
+	io.ReadCloser
+	w   *bufio.Writer
+	err error // First failure of a flush or read, other than EOF
+}
+
+func (b *flushingBody) Read(p []byte) (int, error) {
+	if err := b.w.Flush(); err != nil {
+		b.err = err
+		return 0, err
+	}
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && b.err == nil {
+		b.err = err
+	}
+	return n, err
+}
+
+// requestFailed answers a request whose forwarding to the client failed.
+func (i *Ingress) requestFailed(c *gin.Context, err error) {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		c.String(http.StatusRequestEntityTooLarge, "Request body exceeds %d bytes", tooLarge.Limit)
+	case errors.Is(err, errBandwidthLimitExceeded):
+		c.Header("Retry-After", "86400") // 24 hours
+		c.String(http.StatusTooManyRequests, "Daily bandwidth limit exceeded. Please try again tomorrow.")
+	default:
+		sentry.CaptureErrorWithContext(c, err, "Failed to write request to stream")
+		c.Status(http.StatusBadGateway)
+	}
+}
+
+// clientReconnecting reports whether requests for host should be held: its
+// client lost the connection recently, or its domains are reserved while
+// it resumes. entries are the sessions serving host, live ones first.
+func (i *Ingress) clientReconnecting(host string, entries []*server.TunnelEntry) bool {
+	if i.Hold == nil {
+		return false
+	}
+	if len(entries) == 0 {
+		return i.Registry.LostWithin(host, recentlyLostWindow)
+	}
+	return !entries[0].Passthrough && !i.Registry.IsAvailable(entries[0])
+}
+
+// checkAccess enforces the access policies of the sessions serving host and
+// answers the visitor when one refuses the request; the sessions of a shared
+// domain must all let it in. Credentials that passed are not forwarded.
+func (i *Ingress) checkAccess(c *gin.Context, entries []*server.TunnelEntry, host string) bool {
+	remoteAddr := cluster.VisitorOf(c.Request).RemoteAddr
+	credentials := false
+	for _, e := range entries {
+		switch e.Access.Check(c.Request, remoteAddr) {
+		case server.AccessForbidden:
+			c.String(http.StatusForbidden, "Access to %s is not allowed from your network", host)
+			return false
+		case server.AccessUnauthorized:
+			if e.Access.BasicAuth() {
+				c.Header("WWW-Authenticate", fmt.Sprintf(`Basic realm=%q, charset="UTF-8"`, host))
+			} else {
+				c.Header("WWW-Authenticate", "Bearer")
+			}
+			c.String(http.StatusUnauthorized, "Authentication required for %s", host)
+			return false
+		}
+		credentials = credentials || e.Access.HasCredentials()
+	}
+	if credentials {
+		c.Request.Header.Del("Authorization")
+	}
+	return true
+}
+
+// checkLogin keeps visitors of a host behind a login wall out until they
+// signed in as an allowed identity, and passes that identity to the client.
+// The identity header is never taken from visitors.
+func (i *Ingress) checkLogin(c *gin.Context, entries []*server.TunnelEntry, host string) bool {
+	c.Request.Header.Del(auth.EdgeUserHeader)
+	var walls []*server.LoginWall
+	for _, e := range entries {
+		if w := e.Access.Login(); w != nil {
+			walls = append(walls, w)
+		}
+	}
+	if len(walls) == 0 {
+		return true
+	}
+	sm := i.DashHandler.Session
+
+	if c.Request.URL.Path == auth.EdgeAuthPath {
+		id, err := sm.RedeemEdgeTicket(host, c.Query("ticket"))
+		if err != nil {
+			c.String(http.StatusUnauthorized, "Login link for %s expired, please reload the page", host)
+			return false
+		}
+		if !allowedByWalls(walls, id) {
+			c.String(http.StatusForbidden, "%s is not allowed to access %s", id.User, host)
+			return false
+		}
+		if err := sm.SetEdgeSession(c.Writer, id); err != nil {
+			sentry.CaptureErrorWithContext(c, err, "Failed to set edge session")
+			c.String(http.StatusInternalServerError, "Failed to create session")
+			return false
+		}
+		c.Redirect(http.StatusTemporaryRedirect, auth.SafeRedirectPath(c.Query("next")))
+		return false
+	}
+
+	id, err := sm.GetEdgeSession(c.Request, host)
+	if err != nil {
+		i.requireLogin(c, walls[0].Provider, host)
+		return false
+	}
+	if !allowedByWalls(walls, id) {
+		c.String(http.StatusForbidden, "%s is not allowed to access %s", id.User, host)
+		return false
+	}
+	c.Request.Header.Set(auth.EdgeUserHeader, id.User)
+	removeCookie(c.Request, auth.EdgeCookieName)
+	return true
+}
+
+// requireLogin sends browsers to the dashboard to sign in; other clients
+// only learn where to do it.
+func (i *Ingress) requireLogin(c *gin.Context, provider, host string) {
+	dashboard := "https://app." + i.RootDomain
+	if i.isLocalDev() {
+		dashboard = "http://" + i.RootDomain
+	}
+	loginURL := dashboard + "/edge/login?" + url.Values{
+		"host":     {host},
+		"next":     {c.Request.URL.RequestURI()},
+		"provider": {provider},
+	}.Encode()
+
+	if (c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead) && strings.Contains(c.GetHeader("Accept"), "text/html") {
+		c.Redirect(http.StatusTemporaryRedirect, loginURL)
+		return
+	}
+	c.String(http.StatusUnauthorized, "Sign in at %s to access %s", loginURL, host)
+}
+
+// allowedByWalls reports whether id signed in with the provider of every
+// wall and is on all their allowlists.
+func allowedByWalls(walls []*server.LoginWall, id *auth.EdgeIdentity) bool {
+	for _, w := range walls {
+		if id.Provider != w.Provider || !w.Allows(id.Identities) {
+			return false
+		}
+	}
+	return true
+}
+
+// removeCookie drops the cookie called name from r.
+func removeCookie(r *http.Request, name string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if cookie.Name != name {
+			r.AddCookie(cookie)
+		}
+	}
+}
+
+// quotaExhausted reports whether the tunnel owner has used up today's bandwidth.
+func (i *Ingress) quotaExhausted(entry *server.TunnelEntry) bool {
+	if entry.BandwidthExempt || i.DailyBandwidthLimit <= 0 {
+		return false
+	}
+	used, err := storage.GetUserBandwidthToday(entry.UserID)
+	if err != nil {
+		return false // Fail-open on DB errors, like consumeBandwidth
+	}
+	return used >= i.DailyBandwidthLimit
+}
+
+// consumeBandwidth charges bytes against the tunnel owner's daily limit.
+func (i *Ingress) consumeBandwidth(entry *server.TunnelEntry, bytes int64) (bool, error) {
+	if entry.BandwidthExempt {
+		return true, nil
+	}
+	if i.DailyBandwidthLimit <= 0 || bytes <= 0 {
+		return true, nil
+	}
+	allowed, _, err := storage.ConsumeUserBandwidthWithinLimit(entry.UserID, bytes, i.DailyBandwidthLimit)
+	if err != nil {
+		log.Printf("Failed to consume bandwidth for user %d: %v", entry.UserID, err)
+		// Fail-open on DB errors
+		return true, nil
 	}
+	return allowed, nil
 }
 
 // isUpgradeRequest checks if the HTTP request is attempting a protocol upgrade
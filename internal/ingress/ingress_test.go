@@ -1,6 +1,7 @@
 package ingress
 
 import (
+	"crypto/tls"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -8,6 +9,8 @@ import (
 	"github.com/gin-gonic/gin"
 
 	"gopublic/internal/server"
+	"gopublic/internal/transport"
+	"gopublic/pkg/protocol"
 )
 
 func TestParseAndValidateHost(t *testing.T) {
@@ -125,6 +128,36 @@ func TestIsDashboardHost(t *testing.T) {
 	}
 }
 
+func TestIsControlPlaneRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		host     string
+		path     string
+		expected bool
+	}{
+		{"root domain", "example.com", transport.WebSocketPath, true},
+		{"dashboard host", "app.example.com", transport.WebSocketPath, true},
+		{"tunnel domain keeps the path", "misty-river.example.com", transport.WebSocketPath, false},
+		{"other path", "example.com", "/", false},
+	}
+
+	ingress := &Ingress{RootDomain: "example.com", ControlPlane: &server.Server{}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://"+tt.host+tt.path, nil)
+			if got := ingress.isControlPlaneRequest(tt.host, req); got != tt.expected {
+				t.Errorf("isControlPlaneRequest(%q, %q) = %v, want %v", tt.host, tt.path, got, tt.expected)
+			}
+		})
+	}
+
+	ingress.ControlPlane = nil
+	req := httptest.NewRequest(http.MethodGet, "http://example.com"+transport.WebSocketPath, nil)
+	if ingress.isControlPlaneRequest("example.com", req) {
+		t.Error("control plane served without a server")
+	}
+}
+
 func TestHandleRequest_InvalidHost(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
@@ -170,3 +203,20 @@ func TestHandleRequest_TunnelNotFound(t *testing.T) {
 		t.Errorf("Expected status 404, got %d", w.Code)
 	}
 }
+
+func TestHTTPStreamHeader(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "https://myapp.example.com/", nil)
+	req.RemoteAddr = "203.0.113.7:51000"
+	req.TLS = &tls.ConnectionState{Version: tls.VersionTLS13, ServerName: "myapp.example.com"}
+
+	h := httpStreamHeader(req, "myapp.example.com")
+	if h.Proto != protocol.StreamProtoHTTP || h.Domain != "myapp.example.com" || h.RemoteAddr != "203.0.113.7:51000" {
+		t.Errorf("unexpected header: %+v", h)
+	}
+	if h.TLSVersion != "TLS 1.3" || h.SNI != "myapp.example.com" {
+		t.Errorf("TLS details = %q, %q", h.TLSVersion, h.SNI)
+	}
+	if h.RequestID == "" || h.RequestID == httpStreamHeader(req, "myapp.example.com").RequestID {
+		t.Errorf("request IDs not unique: %q", h.RequestID)
+	}
+}
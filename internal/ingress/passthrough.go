@@ -0,0 +1,218 @@
+package ingress
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"gopublic/internal/server"
+	"gopublic/pkg/protocol"
+)
+
+// clientHelloTimeout bounds how long a visitor may take to send its ClientHello.
+const clientHelloTimeout = 10 * time.Second
+
+// errHelloPeeked aborts the fake handshake once the ClientHello has been parsed.
+var errHelloPeeked = errors.New("client hello peeked")
+
+// readClientHello reads the TLS ClientHello from r and returns the SNI server
+// name together with every byte consumed, so the caller can replay them.
+// An empty name means the visitor did not send SNI.
+func readClientHello(r io.Reader) (string, []byte, error) {
+	var consumed bytes.Buffer
+	var serverName string
+	err := tls.Server(readOnlyConn{r: io.TeeReader(r, &consumed)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errHelloPeeked
+		},
+	}).Handshake()
+	if !errors.Is(err, errHelloPeeked) {
+		return "", consumed.Bytes(), err
+	}
+	return strings.ToLower(serverName), consumed.Bytes(), nil
+}
+
+// readOnlyConn feeds a reader into crypto/tls and discards anything it writes.
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// replayConn returns already consumed bytes before reading from the connection.
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// PassthroughListener wraps the public TLS listener. Connections whose SNI
+// matches a passthrough tunnel are forwarded as raw TLS bytes to the client;
+// all other connections are returned by Accept for regular TLS termination.
+type PassthroughListener struct {
+	net.Listener
+	ingress *Ingress
+
+	conns     chan net.Conn
+	errs      chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewPassthroughListener starts routing connections accepted on ln.
+func (i *Ingress) NewPassthroughListener(ln net.Listener) *PassthroughListener {
+	pl := &PassthroughListener{
+		Listener: ln,
+		ingress:  i,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error, 1),
+		done:     make(chan struct{}),
+	}
+	go pl.acceptLoop()
+	return pl
+}
+
+// Accept returns the next connection that should be served by the HTTPS server.
+func (pl *PassthroughListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-pl.conns:
+		return conn, nil
+	case err := <-pl.errs:
+		return nil, err
+	case <-pl.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting connections.
+func (pl *PassthroughListener) Close() error {
+	pl.closeOnce.Do(func() { close(pl.done) })
+	return pl.Listener.Close()
+}
+
+func (pl *PassthroughListener) acceptLoop() {
+	for {
+		conn, err := pl.Listener.Accept()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			select {
+			case pl.errs <- err:
+			case <-pl.done:
+			}
+			return
+		}
+		go pl.route(conn)
+	}
+}
+
+// route peeks at the ClientHello and dispatches the connection.
+func (pl *PassthroughListener) route(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	serverName, hello, err := readClientHello(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		// Not a TLS handshake; the HTTPS server would reject it anyway
+		conn.Close()
+		return
+	}
+
+	if serverName != "" {
+		if entry, ok := pl.ingress.Registry.GetEntry(serverName); ok && entry.Passthrough {
+			pl.ingress.proxyPassthrough(conn, hello, serverName, entry)
+			return
+		}
+		if pl.ingress.remotePassthrough(serverName) {
+			// Raw TLS isn't forwarded between nodes, and terminating it here
+			// would answer with this server's certificate instead
+			log.Printf("TLS passthrough: host %s is served by another cluster node", serverName)
+			conn.Close()
+			return
+		}
+	}
+
+	select {
+	case pl.conns <- &replayConn{Conn: conn, r: io.MultiReader(bytes.NewReader(hello), conn)}:
+	case <-pl.done:
+		conn.Close()
+	}
+}
+
+// remotePassthrough reports whether another cluster node holds host as a TLS
+// passthrough domain.
+func (i *Ingress) remotePassthrough(host string) bool {
+	if i.Cluster == nil {
+		return false
+	}
+	owner, ok, err := i.Cluster.Owner(host)
+	if err != nil {
+		log.Printf("Cluster: lookup of %s failed: %v", host, err)
+		return false
+	}
+	return ok && owner.Passthrough
+}
+
+// proxyPassthrough forwards a raw TLS connection to the client session.
+func (i *Ingress) proxyPassthrough(conn net.Conn, hello []byte, host string, entry *server.TunnelEntry) {
+	defer conn.Close()
+
+	consume := func(b int64) (bool, error) {
+		allowed, err := i.consumeBandwidth(entry, b)
+		if !allowed {
+			i.maybeNotifyBandwidthExceeded(entry)
+		}
+		return allowed, err
+	}
+
+	if allowed, _ := consume(int64(len(hello))); !allowed {
+		return
+	}
+
+	entries := i.Registry.Entries(host)
+	if len(entries) == 0 || !i.Registry.IsAvailable(entries[0]) {
+		log.Printf("TLS passthrough: no available session for host %s", host)
+		return
+	}
+	stream, _, err := openTunnelStream(entries)
+	if err != nil {
+		log.Printf("TLS passthrough: failed to open stream for host %s: %v", host, err)
+		return
+	}
+	defer stream.Close()
+
+	header := &protocol.StreamHeader{
+		Proto:      protocol.StreamProtoTLS,
+		Domain:     host,
+		RemoteAddr: conn.RemoteAddr().String(),
+		SNI:        host,
+	}
+	if err := protocol.WriteStreamHeader(stream, header); err != nil {
+		log.Printf("TLS passthrough: failed to write stream header for host %s: %v", host, err)
+		return
+	}
+	if _, err := stream.Write(hello); err != nil {
+		log.Printf("TLS passthrough: failed to forward ClientHello for host %s: %v", host, err)
+		return
+	}
+
+	copyBidirectionalWithReaderCharging(conn, stream, bufio.NewReader(stream), consume)
+}
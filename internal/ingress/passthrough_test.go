@@ -0,0 +1,81 @@
+package ingress
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"gopublic/internal/cluster"
+	"gopublic/internal/server"
+)
+
+func TestReadClientHello(t *testing.T) {
+	tests := []struct {
+		name       string
+		serverName string
+		want       string
+	}{
+		{"with SNI", "App.Example.com", "app.example.com"},
+		{"without SNI", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+			_ = serverConn.SetDeadline(time.Now().Add(2 * time.Second))
+
+			go func() {
+				cfg := &tls.Config{ServerName: tt.serverName, InsecureSkipVerify: true}
+				_ = tls.Client(clientConn, cfg).Handshake()
+			}()
+
+			got, hello, err := readClientHello(serverConn)
+			if err != nil {
+				t.Fatalf("readClientHello() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("readClientHello() server name = %q, want %q", got, tt.want)
+			}
+			// 0x16 is the TLS handshake record type
+			if len(hello) == 0 || hello[0] != 0x16 {
+				t.Errorf("readClientHello() consumed bytes do not start with a handshake record")
+			}
+		})
+	}
+}
+
+func TestReadClientHello_NotTLS(t *testing.T) {
+	_, consumed, err := readClientHello(bytes.NewReader([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")))
+	if err == nil {
+		t.Fatal("readClientHello() expected error for plain HTTP")
+	}
+	if len(consumed) == 0 {
+		t.Error("readClientHello() should report the bytes it consumed")
+	}
+}
+
+func TestPassthroughListener_ClosesRemotePassthrough(t *testing.T) {
+	registry := cluster.NewMemoryRegistry(0)
+	registry.Claim(cluster.Claim{Domain: "db.example.com", NodeID: "b", UserID: 1, Passthrough: true})
+	ing := &Ingress{Registry: server.NewTunnelRegistry(), Cluster: cluster.NewNode("a", "", "secret", registry)}
+	pl := &PassthroughListener{ingress: ing, conns: make(chan net.Conn, 1), done: make(chan struct{})}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	_ = clientConn.SetDeadline(time.Now().Add(2 * time.Second))
+	go pl.route(serverConn)
+
+	err := tls.Client(clientConn, &tls.Config{ServerName: "db.example.com", InsecureSkipVerify: true}).Handshake()
+	if err == nil {
+		t.Fatal("handshake succeeded, want the connection closed")
+	}
+	select {
+	case <-pl.conns:
+		t.Error("connection for a remote passthrough domain was handed to local TLS termination")
+	default:
+	}
+}
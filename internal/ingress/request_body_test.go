@@ -0,0 +1,193 @@
+package ingress
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hashicorp/yamux"
+
+	"gopublic/internal/auth"
+	"gopublic/internal/dashboard"
+	"gopublic/internal/server"
+)
+
+// tunnelIngress returns an ingress serving myapp.example.com through a yamux
+// session, and the agent's end of that session. Its dashboard signs cookies
+// with SESSION_HASH_KEY and SESSION_BLOCK_KEY when they are set.
+func tunnelIngress(t *testing.T, maxBody int64, access *server.TunnelAccess) (*gin.Engine, *yamux.Session) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	serverSession, agentSession := yamuxSessions(t)
+	sessions, err := auth.NewSessionManager(auth.SessionConfig{AllowInsecureKeys: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registry := server.NewTunnelRegistry()
+	registry.JoinPool("myapp.example.com", &server.TunnelEntry{Session: serverSession, UserID: 1, Access: access})
+	ingress := &Ingress{Registry: registry, DashHandler: &dashboard.Handler{Session: sessions}, RootDomain: "example.com", MaxRequestBody: maxBody}
+
+	r := gin.New()
+	r.NoRoute(ingress.handleRequest)
+	return r, agentSession
+}
+
+func TestProxyToTunnel_StreamsRequestBody(t *testing.T) {
+	r, agent := tunnelIngress(t, 0, nil)
+
+	headers := make(chan *http.Request, 1)
+	agentDone := make(chan string, 1)
+	go func() {
+		stream, err := agent.Accept()
+		if err != nil {
+			return
+		}
+		defer stream.Close()
+		req, err := http.ReadRequest(bufio.NewReader(stream))
+		if err != nil {
+			agentDone <- "read request: " + err.Error()
+			return
+		}
+		headers <- req
+		body, _ := io.ReadAll(req.Body)
+		io.WriteString(stream, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+		agentDone <- string(body)
+	}()
+
+	bodyReader, bodyWriter := io.Pipe()
+	req := httptest.NewRequest(http.MethodPost, "http://myapp.example.com/upload", bodyReader)
+	w := httptest.NewRecorder()
+	served := make(chan struct{})
+	go func() {
+		r.ServeHTTP(w, req)
+		close(served)
+	}()
+
+	// The agent sees the request while the upload is still going
+	bodyWriter.Write([]byte("first,"))
+	select {
+	case got := <-headers:
+		if got.URL.Path != "/upload" {
+			t.Errorf("agent got path %q, want /upload", got.URL.Path)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("agent got nothing before the upload finished")
+	}
+	bodyWriter.Write([]byte("second"))
+	bodyWriter.Close()
+
+	select {
+	case body := <-agentDone:
+		if body != "first,second" {
+			t.Errorf("agent got body %q", body)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("agent did not get the whole body")
+	}
+	<-served
+	if w.Code != http.StatusOK || w.Body.String() != "ok" {
+		t.Errorf("response = %d %q, want 200 ok", w.Code, w.Body.String())
+	}
+}
+
+func TestProxyToTunnel_MaxRequestBody(t *testing.T) {
+	r, agent := tunnelIngress(t, 10, nil)
+
+	opened := make(chan struct{}, 2)
+	go func() {
+		for {
+			stream, err := agent.Accept()
+			if err != nil {
+				return
+			}
+			opened <- struct{}{}
+			// Wait for a request that never completes
+			go io.Copy(io.Discard, stream)
+		}
+	}()
+
+	// A declared size over the limit never reaches the agent
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "http://myapp.example.com/", strings.NewReader(strings.Repeat("x", 11))))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("declared size: status = %d, want 413", w.Code)
+	}
+	select {
+	case <-opened:
+		t.Error("stream opened for a body over the limit")
+	default:
+	}
+
+	// A chunked body is cut off once it grows past the limit
+	req := httptest.NewRequest(http.MethodPost, "http://myapp.example.com/", io.MultiReader(strings.NewReader(strings.Repeat("x", 8)), strings.NewReader(strings.Repeat("y", 8))))
+	req.ContentLength = -1
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("chunked: status = %d, want 413", w.Code)
+	}
+}
+
+func TestProxyToTunnel_HTTP2StreamingWithTrailers(t *testing.T) {
+	r, agent := tunnelIngress(t, 0, nil)
+	srv := httptest.NewUnstartedServer(r)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	// The agent answers a gRPC call with HTTP/1.1 chunks and trailers,
+	// echoing the first message before the request body ends
+	go func() {
+		stream, err := agent.Accept()
+		if err != nil {
+			return
+		}
+		defer stream.Close()
+		reader := bufio.NewReader(stream)
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		msg := make([]byte, 4)
+		if _, err := io.ReadFull(req.Body, msg); err != nil {
+			return
+		}
+		io.WriteString(stream, "HTTP/1.1 200 OK\r\nContent-Type: application/grpc\r\nTransfer-Encoding: chunked\r\n\r\n4\r\n"+string(msg)+"\r\n")
+		io.Copy(io.Discard, req.Body)
+		io.WriteString(stream, "0\r\nGrpc-Status: 0\r\n\r\n")
+	}()
+
+	bodyReader, bodyWriter := io.Pipe()
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/echo.Echo/Stream", bodyReader)
+	req.Host = "myapp.example.com"
+	req.Header.Set("Content-Type", "application/grpc")
+	go bodyWriter.Write([]byte("ping"))
+
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("visitor got %s, want HTTP/2", resp.Proto)
+	}
+	msg := make([]byte, 4)
+	if _, err := io.ReadFull(resp.Body, msg); err != nil || string(msg) != "ping" {
+		t.Fatalf("echoed message = %q, %v", msg, err)
+	}
+	bodyWriter.Close()
+
+	if _, err := io.ReadAll(resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+		t.Errorf("Grpc-Status trailer = %q, want 0", got)
+	}
+}
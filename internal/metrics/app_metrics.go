@@ -13,6 +13,16 @@ type AppMetrics struct {
 	TunnelConnections *Counter
 	TunnelErrors      *Counter
 
+	// Control plane authentication metrics
+	AuthFailures *Counter
+	AuthRejects  *Counter
+	AuthBans     *Counter
+
+	// Requests held while their tunnel client reconnects
+	HeldRequests        *Gauge
+	HeldRequestsTotal   *Counter
+	HeldRequestsDropped map[string]*Counter // By reason: "full" or "timeout"
+
 	// User metrics
 	UsersTotal *Gauge
 
@@ -50,6 +60,38 @@ func NewAppMetrics() *AppMetrics {
 			nil,
 		),
 
+		AuthFailures: m.NewCounter(
+			"gopublic_auth_failures_total",
+			"Total number of control plane connections with an invalid token",
+			nil,
+		),
+
+		AuthRejects: m.NewCounter(
+			"gopublic_auth_rejected_total",
+			"Total number of token attempts refused by the brute-force limits",
+			nil,
+		),
+
+		AuthBans: m.NewCounter(
+			"gopublic_auth_bans_total",
+			"Total number of IPs banned for failed token attempts",
+			nil,
+		),
+
+		HeldRequests: m.NewGauge(
+			"gopublic_held_requests",
+			"Number of requests waiting for their tunnel client to reconnect",
+			nil,
+		),
+
+		HeldRequestsTotal: m.NewCounter(
+			"gopublic_held_requests_total",
+			"Total number of requests held while their tunnel client reconnected",
+			nil,
+		),
+
+		HeldRequestsDropped: make(map[string]*Counter),
+
 		UsersTotal: m.NewGauge(
 			"gopublic_users_total",
 			"Total number of registered users",
@@ -81,6 +123,14 @@ func NewAppMetrics() *AppMetrics {
 		)
 	}
 
+	for _, reason := range []string{HoldDroppedFull, HoldDroppedTimeout} {
+		am.HeldRequestsDropped[reason] = m.NewCounter(
+			"gopublic_held_requests_dropped_total",
+			"Total number of requests for a reconnecting tunnel client that were not dispatched",
+			map[string]string{"reason": reason},
+		)
+	}
+
 	return am
 }
 
@@ -126,6 +176,46 @@ func (am *AppMetrics) TunnelError() {
 	am.TunnelErrors.Inc()
 }
 
+// AuthFailed should be called when a client sends an invalid token.
+func (am *AppMetrics) AuthFailed() {
+	am.AuthFailures.Inc()
+}
+
+// AuthRejected should be called when the brute-force limits refuse a token attempt.
+func (am *AppMetrics) AuthRejected() {
+	am.AuthRejects.Inc()
+}
+
+// AuthBanned should be called when an IP is banned for failed token attempts.
+func (am *AppMetrics) AuthBanned() {
+	am.AuthBans.Inc()
+}
+
+// Reasons for dropping a request for a reconnecting tunnel client
+const (
+	HoldDroppedFull    = "full"    // The hold queue had no room
+	HoldDroppedTimeout = "timeout" // The client did not come back in time
+)
+
+// RequestHeld should be called when a request starts waiting for its tunnel client.
+func (am *AppMetrics) RequestHeld() {
+	am.HeldRequests.Inc()
+	am.HeldRequestsTotal.Inc()
+}
+
+// HoldEnded should be called when a held request stops waiting.
+func (am *AppMetrics) HoldEnded() {
+	am.HeldRequests.Dec()
+}
+
+// HeldRequestDropped should be called when a request for a reconnecting
+// tunnel client is not dispatched, with one of the HoldDropped reasons.
+func (am *AppMetrics) HeldRequestDropped(reason string) {
+	if counter, ok := am.HeldRequestsDropped[reason]; ok {
+		counter.Inc()
+	}
+}
+
 // SetUsersTotal sets the total users gauge to an absolute value.
 func (am *AppMetrics) SetUsersTotal(n float64) {
 	am.UsersTotal.Set(n)
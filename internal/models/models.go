@@ -16,6 +16,15 @@ type User struct {
 	Username        string
 	PhotoURL        string
 	TermsAcceptedAt *time.Time // nil if terms not yet accepted
+	SessionLimits
+}
+
+// SessionLimits overrides the server's session policy for one user. A nil
+// field uses the server default; 0 means unlimited.
+type SessionLimits struct {
+	MaxSessionMinutes  *int // Tunnel sessions are closed after this long
+	IdleTimeoutMinutes *int // Tunnel sessions without streams are closed after this long
+	MaxStreams         *int // Concurrent streams per tunnel session
 }
 
 type Token struct {
@@ -33,6 +42,32 @@ type Domain struct {
 	User   User
 }
 
+// CustomDomain is a domain outside the root domain that a user points at the
+// server with a CNAME. It can be bound once a TXT record with
+// VerificationToken proves the user controls it. Several users may claim the
+// same hostname; the one who verifies it last holds it.
+type CustomDomain struct {
+	gorm.Model
+	Hostname          string `gorm:"uniqueIndex:idx_custom_domain_claim"` // Full name, e.g. dev.example.org
+	UserID            uint   `gorm:"uniqueIndex:idx_custom_domain_claim"`
+	User              User
+	VerificationToken string
+	VerifiedAt        *time.Time // nil until the TXT record was found
+}
+
+// DeviceCert is a client certificate issued to one of a user's devices. An
+// agent presenting it on the control plane authenticates as the user.
+type DeviceCert struct {
+	gorm.Model
+	UserID      uint
+	User        User
+	Name        string     // Shown in the dashboard, e.g. "laptop"
+	Fingerprint string     `gorm:"uniqueIndex"` // Hex SHA-256 of the certificate
+	ExpiresAt   time.Time  // NotAfter of the certificate
+	RevokedAt   *time.Time // nil while the certificate is accepted
+	LastSeenAt  *time.Time // Last successful authentication
+}
+
 // AbuseReport stores user reports about malicious tunnels
 type AbuseReport struct {
 	gorm.Model
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"gopublic/pkg/protocol"
+)
+
+// AccessResult is the outcome of checking a request against a TunnelAccess.
+type AccessResult int
+
+const (
+	AccessAllowed      AccessResult = iota
+	AccessForbidden                 // The visitor's network is not allowed
+	AccessUnauthorized              // Credentials are missing or wrong
+)
+
+// TunnelAccess is the parsed access policy of an HTTP domain.
+type TunnelAccess struct {
+	basicAuth []string // "user:password"
+	bearer    string
+	allow     []netip.Prefix
+	deny      []netip.Prefix
+	login     *LoginWall
+}
+
+// LoginWall makes visitors of a domain sign in with Provider; only the
+// identities it allows get through.
+type LoginWall struct {
+	Provider string
+	allow    []string // Lowercased; "*@domain" matches any address at domain
+}
+
+// NewTunnelAccess validates p. It returns nil for a policy that lets everyone in.
+func NewTunnelAccess(p *protocol.AccessPolicy) (*TunnelAccess, error) {
+	if p == nil {
+		return nil, nil
+	}
+	a := &TunnelAccess{bearer: p.BearerToken}
+	for _, cred := range p.BasicAuth {
+		if user, _, ok := strings.Cut(cred, ":"); !ok || user == "" {
+			return nil, errors.New("basic auth credentials must be user:password")
+		}
+		a.basicAuth = append(a.basicAuth, cred)
+	}
+	var err error
+	if a.allow, err = parsePrefixes(p.AllowCIDRs); err != nil {
+		return nil, err
+	}
+	if a.deny, err = parsePrefixes(p.DenyCIDRs); err != nil {
+		return nil, err
+	}
+	if a.login, err = newLoginWall(p.Login); err != nil {
+		return nil, err
+	}
+	if len(a.basicAuth) == 0 && a.bearer == "" && len(a.allow) == 0 && len(a.deny) == 0 && a.login == nil {
+		return nil, nil
+	}
+	return a, nil
+}
+
+// newLoginWall validates p. A nil policy needs no login.
+func newLoginWall(p *protocol.LoginPolicy) (*LoginWall, error) {
+	if p == nil {
+		return nil, nil
+	}
+	w := &LoginWall{Provider: p.Provider}
+	if w.Provider == "" {
+		w.Provider = protocol.LoginProviderDashboard
+	}
+	if w.Provider != protocol.LoginProviderDashboard && w.Provider != protocol.LoginProviderOIDC {
+		return nil, fmt.Errorf("unknown login provider %q", p.Provider)
+	}
+	for _, id := range p.Allow {
+		if id = strings.ToLower(strings.TrimSpace(id)); id != "" {
+			w.allow = append(w.allow, id)
+		}
+	}
+	if len(w.allow) == 0 {
+		return nil, errors.New("login needs at least one allowed identity")
+	}
+	return w, nil
+}
+
+// Allows reports whether a visitor signed in with one of identities may pass.
+func (w *LoginWall) Allows(identities []string) bool {
+	for _, id := range identities {
+		id = strings.ToLower(id)
+		for _, allowed := range w.allow {
+			if id == allowed {
+				return true
+			}
+			if domain, ok := strings.CutPrefix(allowed, "*@"); ok && strings.Contains(id, "@") && strings.HasSuffix(id, "@"+domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parsePrefixes parses CIDRs; a bare IP stands for that single address.
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			addr, err := netip.ParseAddr(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid IP or CIDR %q", cidr)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP or CIDR %q", cidr)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// HasCredentials reports whether requests must authenticate.
+func (a *TunnelAccess) HasCredentials() bool {
+	return a != nil && (len(a.basicAuth) > 0 || a.bearer != "")
+}
+
+// BasicAuth reports whether basic auth credentials are accepted, so browsers
+// can be asked for them.
+func (a *TunnelAccess) BasicAuth() bool {
+	return a != nil && len(a.basicAuth) > 0
+}
+
+// Login returns the login wall of the domain, or nil when visitors need not sign in.
+func (a *TunnelAccess) Login() *LoginWall {
+	if a == nil {
+		return nil
+	}
+	return a.login
+}
+
+// Check decides whether r, sent from remoteAddr, may reach the domain.
+// The login wall is left to the ingress. A nil TunnelAccess allows everything.
+func (a *TunnelAccess) Check(r *http.Request, remoteAddr string) AccessResult {
+	if a == nil {
+		return AccessAllowed
+	}
+	if len(a.allow) > 0 || len(a.deny) > 0 {
+		addr, err := netip.ParseAddr(remoteIP(remoteAddr))
+		if err != nil {
+			return AccessForbidden
+		}
+		addr = addr.Unmap()
+		if containsAddr(a.deny, addr) || (len(a.allow) > 0 && !containsAddr(a.allow, addr)) {
+			return AccessForbidden
+		}
+	}
+	if a.HasCredentials() && !a.authenticated(r) {
+		return AccessUnauthorized
+	}
+	return AccessAllowed
+}
+
+// authenticated reports whether the Authorization header carries one of the credentials.
+func (a *TunnelAccess) authenticated(r *http.Request) bool {
+	if user, pass, ok := r.BasicAuth(); ok {
+		given := []byte(user + ":" + pass)
+		for _, cred := range a.basicAuth {
+			if subtle.ConstantTimeCompare(given, []byte(cred)) == 1 {
+				return true
+			}
+		}
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && a.bearer != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.bearer)) == 1
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
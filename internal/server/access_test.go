@@ -0,0 +1,136 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"gopublic/pkg/protocol"
+)
+
+func TestNewTunnelAccess(t *testing.T) {
+	if a, err := NewTunnelAccess(&protocol.AccessPolicy{}); a != nil || err != nil {
+		t.Errorf("empty policy = %v, %v; want nil", a, err)
+	}
+	invalid := []*protocol.AccessPolicy{
+		{BasicAuth: []string{"nopassword"}},
+		{BasicAuth: []string{":secret"}},
+		{AllowCIDRs: []string{"10.0.0.0/33"}},
+		{DenyCIDRs: []string{"example.com"}},
+		{Login: &protocol.LoginPolicy{Allow: []string{" "}}},
+		{Login: &protocol.LoginPolicy{Provider: "github", Allow: []string{"tg:1"}}},
+	}
+	for _, p := range invalid {
+		if _, err := NewTunnelAccess(p); err == nil {
+			t.Errorf("NewTunnelAccess(%+v) accepted an invalid policy", p)
+		}
+	}
+}
+
+func TestTunnelAccess_Check(t *testing.T) {
+	a, err := NewTunnelAccess(&protocol.AccessPolicy{
+		BasicAuth:   []string{"alice:wonderland"},
+		BearerToken: "s3cret",
+		AllowCIDRs:  []string{"10.0.0.0/8", "203.0.113.7"},
+		DenyCIDRs:   []string{"10.6.6.0/24"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(auth string) *http.Request {
+		r, _ := http.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		return r
+	}
+	basic := request("")
+	basic.SetBasicAuth("alice", "wonderland")
+	wrongBasic := request("")
+	wrongBasic.SetBasicAuth("alice", "oz")
+
+	tests := []struct {
+		name       string
+		req        *http.Request
+		remoteAddr string
+		want       AccessResult
+	}{
+		{"basic auth", basic, "10.1.2.3:5000", AccessAllowed},
+		{"bearer token", request("Bearer s3cret"), "203.0.113.7:5000", AccessAllowed},
+		{"IPv4-mapped address", request("Bearer s3cret"), "[::ffff:10.1.2.3]:5000", AccessAllowed},
+		{"no credentials", request(""), "10.1.2.3:5000", AccessUnauthorized},
+		{"wrong password", wrongBasic, "10.1.2.3:5000", AccessUnauthorized},
+		{"wrong token", request("Bearer guess"), "10.1.2.3:5000", AccessUnauthorized},
+		{"not allowed", basic, "198.51.100.1:5000", AccessForbidden},
+		{"denied inside allowed", basic, "10.6.6.6:5000", AccessForbidden},
+	}
+	for _, tt := range tests {
+		if got := a.Check(tt.req, tt.remoteAddr); got != tt.want {
+			t.Errorf("%s: Check() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	var public *TunnelAccess
+	if got := public.Check(request(""), "198.51.100.1:5000"); got != AccessAllowed {
+		t.Errorf("nil policy: Check() = %v, want allowed", got)
+	}
+}
+
+func TestLoginWall_Allows(t *testing.T) {
+	a, err := NewTunnelAccess(&protocol.AccessPolicy{Login: &protocol.LoginPolicy{Allow: []string{"tg:42", "*@Example.com", "bob@partner.org"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := a.Login()
+	if w == nil || w.Provider != protocol.LoginProviderDashboard {
+		t.Fatalf("Login() = %+v, want a dashboard login wall", w)
+	}
+	if a.Check(&http.Request{Header: http.Header{}}, "198.51.100.1:5000") != AccessAllowed {
+		t.Error("Check() refused a request the login wall is left to handle")
+	}
+
+	tests := []struct {
+		identities []string
+		want       bool
+	}{
+		{[]string{"tg:42"}, true},
+		{[]string{"alice@example.com"}, true},
+		{[]string{"tg:7", "Bob@Partner.org"}, true},
+		{[]string{"alice@sub.example.com"}, false},
+		{[]string{"alice@notexample.com"}, false},
+		{[]string{"tg:7", "carol@partner.org"}, false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := w.Allows(tt.identities); got != tt.want {
+			t.Errorf("Allows(%v) = %v, want %v", tt.identities, got, tt.want)
+		}
+	}
+}
+
+func TestAccessPolicies_KeyedByHostname(t *testing.T) {
+	s := &Server{RootDomain: "example.com"}
+	access, err := s.accessPolicies(map[string]*protocol.AccessPolicy{
+		"app":    {BearerToken: "s3cret"},
+		"public": {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if access["app.example.com"] == nil || len(access) != 1 {
+		t.Errorf("accessPolicies() = %v, want only app.example.com", access)
+	}
+
+	if _, err := s.accessPolicies(map[string]*protocol.AccessPolicy{"app": {AllowCIDRs: []string{"nope"}}}); err == nil {
+		t.Error("accessPolicies() accepted an invalid policy")
+	}
+
+	oidc := map[string]*protocol.AccessPolicy{"app": {Login: &protocol.LoginPolicy{Provider: protocol.LoginProviderOIDC, Allow: []string{"*@example.com"}}}}
+	if _, err := s.accessPolicies(oidc); err == nil {
+		t.Error("accessPolicies() accepted an OIDC login without a configured provider")
+	}
+	s.OIDCLogin = true
+	if _, err := s.accessPolicies(oidc); err != nil {
+		t.Errorf("accessPolicies() with OIDC configured = %v", err)
+	}
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"gopublic/internal/middleware"
+)
+
+// AuthLimits configures brute-force protection of token authentication.
+type AuthLimits struct {
+	MaxFailures       int           // Failed attempts from one IP before it is banned (0 = no bans)
+	BanDuration       time.Duration // First ban of an IP; each further ban doubles it up to maxAuthBan
+	GlobalMaxFailures int           // Failed attempts per minute from all IPs before throttling (0 = unlimited)
+}
+
+const (
+	// authBaseDelay is the wait before checking the token of an IP with one
+	// failed attempt; it doubles with every further failure up to authMaxDelay.
+	authBaseDelay = 250 * time.Millisecond
+	authMaxDelay  = 5 * time.Second
+	// maxAuthBan caps the doubling of repeated bans.
+	maxAuthBan = 24 * time.Hour
+	// authMemory is how long failures and past bans of a quiet IP are kept.
+	authMemory = time.Hour
+	// authInFlight limits concurrent token checks per IP, so the delays
+	// can't be sidestepped by opening many connections at once.
+	authInFlight = 4
+)
+
+var (
+	errAuthBanned    = errors.New("too many failed token attempts, IP is banned")
+	errAuthThrottled = errors.New("too many token attempts, throttled")
+)
+
+// authGuard throttles token authentication per IP and server-wide. It is
+// consulted before the token lookup, so banned clients never reach storage.
+// A nil guard allows everything.
+type authGuard struct {
+	limits   AuthLimits
+	attempts *middleware.IPRateLimiter     // Token attempts per second per IP, failed or not
+	inFlight *middleware.ConnectionLimiter // Concurrent token checks per IP
+
+	mu             sync.Mutex
+	clients        map[string]*authClient
+	window         time.Time // Start of the current minute of global failures
+	windowFailures int
+	lastPrune      time.Time
+	now            func() time.Time
+}
+
+// authClient is the failure history of one IP.
+type authClient struct {
+	failures    int // Since the last success or ban
+	lastFailure time.Time
+	bans        int // Bans so far; each one doubles the next
+	bannedUntil time.Time
+}
+
+func newAuthGuard(limits AuthLimits) *authGuard {
+	return &authGuard{
+		limits: limits,
+		attempts: middleware.NewIPRateLimiter(middleware.RateLimiterConfig{
+			RequestsPerSecond: 1,
+			BurstSize:         10,
+			CleanupInterval:   time.Minute,
+			MaxAge:            5 * time.Minute,
+		}),
+		inFlight: middleware.NewConnectionLimiter(authInFlight),
+		clients:  make(map[string]*authClient),
+		now:      time.Now,
+	}
+}
+
+// admit decides whether ip may try a token now and how long to make it wait
+// first. Each admitted attempt must be followed by release.
+func (g *authGuard) admit(ip string) (time.Duration, error) {
+	if g == nil {
+		return 0, nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	c := g.clients[ip]
+	if c != nil && now.Before(c.bannedUntil) {
+		return 0, errAuthBanned
+	}
+	if !g.attempts.Allow(ip) {
+		return 0, errAuthThrottled
+	}
+
+	delay := time.Duration(0)
+	if c != nil && c.failures > 0 {
+		delay = min(authBaseDelay<<(c.failures-1), authMaxDelay)
+	}
+	if g.globalExceeded(now) {
+		// Under a distributed attack, IPs that already failed get no more
+		// tries and everyone else checks slowly
+		if c != nil && c.failures > 0 {
+			return 0, errAuthThrottled
+		}
+		delay = authMaxDelay
+	}
+
+	if !g.inFlight.Acquire(ip) {
+		return 0, errAuthThrottled
+	}
+	return delay, nil
+}
+
+// release ends an attempt admitted by admit.
+func (g *authGuard) release(ip string) {
+	if g == nil {
+		return
+	}
+	g.inFlight.Release(ip)
+}
+
+// failed records a wrong token from ip. It returns the length of the ban
+// when this failure got the IP banned, otherwise 0.
+func (g *authGuard) failed(ip string) time.Duration {
+	if g == nil {
+		return 0
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	g.globalExceeded(now) // Roll the window before counting
+	g.windowFailures++
+	g.prune(now)
+
+	c := g.clients[ip]
+	if c == nil {
+		c = &authClient{}
+		g.clients[ip] = c
+	}
+	c.failures++
+	c.lastFailure = now
+
+	if g.limits.MaxFailures <= 0 || c.failures < g.limits.MaxFailures {
+		return 0
+	}
+	ban := maxAuthBan
+	if c.bans < 16 {
+		ban = min(g.limits.BanDuration<<c.bans, maxAuthBan)
+	}
+	c.bans++
+	c.failures = 0
+	c.bannedUntil = now.Add(ban)
+	return ban
+}
+
+// succeeded clears the failures of ip; earlier bans still count.
+func (g *authGuard) succeeded(ip string) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if c := g.clients[ip]; c != nil {
+		c.failures = 0
+	}
+}
+
+// stop releases the rate limiter's cleanup goroutine.
+func (g *authGuard) stop() {
+	if g != nil {
+		g.attempts.Stop()
+	}
+}
+
+// globalExceeded reports whether this minute's failures from all IPs
+// reached the limit. Callers hold g.mu.
+func (g *authGuard) globalExceeded(now time.Time) bool {
+	if now.Sub(g.window) >= time.Minute {
+		g.window = now
+		g.windowFailures = 0
+	}
+	return g.limits.GlobalMaxFailures > 0 && g.windowFailures >= g.limits.GlobalMaxFailures
+}
+
+// prune forgets IPs that have been quiet for authMemory, at most once a
+// minute. Callers hold g.mu.
+func (g *authGuard) prune(now time.Time) {
+	if now.Sub(g.lastPrune) < time.Minute {
+		return
+	}
+	g.lastPrune = now
+	for ip, c := range g.clients {
+		if now.Sub(c.lastFailure) > authMemory && now.After(c.bannedUntil) {
+			delete(g.clients, ip)
+		}
+	}
+}
+
+// remoteIP strips the port from a client address.
+func remoteIP(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// testAuthGuard returns a guard on a clock the test moves with the returned func.
+func testAuthGuard(t *testing.T, limits AuthLimits) (*authGuard, func(time.Duration)) {
+	t.Helper()
+	g := newAuthGuard(limits)
+	t.Cleanup(g.stop)
+	now := time.Now()
+	g.now = func() time.Time { return now }
+	return g, func(d time.Duration) { now = now.Add(d) }
+}
+
+// attempt runs one admitted attempt from ip that fails, like authenticate.
+func attempt(t *testing.T, g *authGuard, ip string) (time.Duration, time.Duration) {
+	t.Helper()
+	delay, err := g.admit(ip)
+	if err != nil {
+		t.Fatalf("admit(%s): %v", ip, err)
+	}
+	defer g.release(ip)
+	return delay, g.failed(ip)
+}
+
+func TestAuthGuard_ProgressiveDelayAndBan(t *testing.T) {
+	g, advance := testAuthGuard(t, AuthLimits{MaxFailures: 3, BanDuration: time.Minute})
+
+	wantDelays := []time.Duration{0, authBaseDelay, 2 * authBaseDelay}
+	for i, want := range wantDelays {
+		delay, ban := attempt(t, g, "10.0.0.1")
+		if delay != want {
+			t.Errorf("attempt %d: delay = %v, want %v", i+1, delay, want)
+		}
+		if (ban != 0) != (i == len(wantDelays)-1) {
+			t.Errorf("attempt %d: ban = %v", i+1, ban)
+		}
+	}
+
+	if _, err := g.admit("10.0.0.1"); !errors.Is(err, errAuthBanned) {
+		t.Fatalf("admit() while banned = %v, want errAuthBanned", err)
+	}
+	if delay, err := g.admit("10.0.0.2"); err != nil || delay != 0 {
+		t.Errorf("other IP: admit() = %v, %v; want no delay", delay, err)
+	}
+	g.release("10.0.0.2")
+
+	// The next ban of the same IP lasts twice as long
+	advance(time.Minute + time.Second)
+	var ban time.Duration
+	for i := 0; i < 3; i++ {
+		_, ban = attempt(t, g, "10.0.0.1")
+	}
+	if ban != 2*time.Minute {
+		t.Errorf("second ban = %v, want %v", ban, 2*time.Minute)
+	}
+}
+
+func TestAuthGuard_SuccessResetsFailures(t *testing.T) {
+	g, _ := testAuthGuard(t, AuthLimits{MaxFailures: 3, BanDuration: time.Minute})
+
+	attempt(t, g, "10.0.0.1")
+	attempt(t, g, "10.0.0.1")
+	g.succeeded("10.0.0.1")
+
+	if delay, ban := attempt(t, g, "10.0.0.1"); delay != 0 || ban != 0 {
+		t.Errorf("after success: delay = %v, ban = %v; want fresh start", delay, ban)
+	}
+}
+
+func TestAuthGuard_GlobalLimit(t *testing.T) {
+	g, advance := testAuthGuard(t, AuthLimits{GlobalMaxFailures: 2})
+
+	attempt(t, g, "10.0.0.1")
+	attempt(t, g, "10.0.0.2")
+
+	// IPs that failed are refused, new ones wait the longest delay
+	if _, err := g.admit("10.0.0.1"); !errors.Is(err, errAuthThrottled) {
+		t.Errorf("admit(failed IP) = %v, want errAuthThrottled", err)
+	}
+	delay, err := g.admit("10.0.0.3")
+	if err != nil || delay != authMaxDelay {
+		t.Errorf("admit(new IP) = %v, %v; want %v", delay, err, authMaxDelay)
+	}
+	g.release("10.0.0.3")
+
+	advance(time.Minute)
+	if _, err := g.admit("10.0.0.1"); err != nil {
+		t.Errorf("admit() in the next minute = %v", err)
+	}
+}
+
+func TestAuthGuard_InFlightLimit(t *testing.T) {
+	g, _ := testAuthGuard(t, AuthLimits{})
+
+	for i := 0; i < authInFlight; i++ {
+		if _, err := g.admit("10.0.0.1"); err != nil {
+			t.Fatalf("admit %d: %v", i+1, err)
+		}
+	}
+	if _, err := g.admit("10.0.0.1"); !errors.Is(err, errAuthThrottled) {
+		t.Errorf("admit() beyond %d concurrent checks = %v, want errAuthThrottled", authInFlight, err)
+	}
+	g.release("10.0.0.1")
+	if _, err := g.admit("10.0.0.1"); err != nil {
+		t.Errorf("admit() after release = %v", err)
+	}
+}
+
+func TestAuthGuard_Nil(t *testing.T) {
+	var g *authGuard
+	if delay, err := g.admit("10.0.0.1"); delay != 0 || err != nil {
+		t.Errorf("nil guard admit() = %v, %v", delay, err)
+	}
+	if ban := g.failed("10.0.0.1"); ban != 0 {
+		t.Errorf("nil guard failed() = %v", ban)
+	}
+	g.release("10.0.0.1")
+	g.succeeded("10.0.0.1")
+	g.stop()
+}
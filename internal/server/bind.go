@@ -0,0 +1,256 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"gopublic/internal/cluster"
+	"gopublic/internal/transport"
+	"gopublic/pkg/protocol"
+)
+
+var (
+	errDomainNotOwned   = errors.New("domain not found or not owned by you")
+	errDomainNotBound   = errors.New("domain is not bound to this session")
+	errSessionNotActive = errors.New("session is no longer active")
+	errDomainInUse      = errors.New("domain is already served by another session")
+)
+
+// domainHolder returns the registry entry of hostname if a session other than
+// session serves it or keeps it reserved for resumption. A shared session does
+// not conflict with other shared sessions of the same user.
+func (s *Server) domainHolder(hostname string, session transport.Session, userID uint, shared bool) *TunnelEntry {
+	for _, entry := range s.Registry.Entries(hostname) {
+		if entry.Session == session || entry.Session == nil {
+			continue
+		}
+		if entry.Session.IsClosed() && !s.resumes.reserved(entry.Session) {
+			continue
+		}
+		if shared && entry.Shared && entry.UserID == userID {
+			continue
+		}
+		return entry
+	}
+	return nil
+}
+
+// resolveDomainConflicts checks that no other agent of the user serves one of
+// the requested domains. With force the agents holding them are disconnected;
+// otherwise the client is told which domain is taken. The caller holds bindMu.
+func (s *Server) resolveDomainConflicts(stream net.Conn, userID uint, session transport.Session, names []string, shared, force bool) error {
+	holders := make(map[transport.Session]bool)
+	for _, name := range names {
+		hostname := s.hostname(name)
+		if owner, ok := s.remoteOwner(hostname); ok && owner.UserID == userID {
+			// A client on another node can't be disconnected from here, even with --force
+			s.sendErrorWithCode(stream, fmt.Sprintf("%s is already served by a client connected to another server node.", hostname), protocol.ErrorCodeAlreadyConnected)
+			return fmt.Errorf("%w: %s on node %s", errDomainInUse, hostname, owner.NodeID)
+		}
+		entry := s.domainHolder(hostname, session, userID, shared)
+		if entry == nil || entry.UserID != userID {
+			// Domains of other users are rejected by the ownership check
+			continue
+		}
+		if entry.Session.IsClosed() {
+			// Even --force must wait: the lost client may still come back
+			s.sendErrorWithCode(stream, fmt.Sprintf("%s is reserved for a client that lost its connection. Try again in %v.", hostname, s.ResumeGrace), protocol.ErrorCodeDomainReserved)
+			return fmt.Errorf("%w: %s is reserved", errDomainInUse, hostname)
+		}
+		if !force {
+			s.sendErrorWithCode(stream, fmt.Sprintf("%s is already served by another client session. Use --force to take it over.", hostname), protocol.ErrorCodeAlreadyConnected)
+			return fmt.Errorf("%w: %s", errDomainInUse, hostname)
+		}
+		holders[entry.Session] = true
+	}
+
+	for holder := range holders {
+		log.Printf("Force disconnect: closing session of user %d that serves requested domains", userID)
+		if ctrl, ok := s.Registry.Control(holder); ok {
+			ctrl.SendDisconnect(protocol.DisconnectReplaced, "Another client connected with --force and took over your domains.")
+		}
+		holder.Close()
+	}
+	return nil
+}
+
+// bindAtRuntime binds one more HTTP domain to a live session and returns its hostname.
+func (s *Server) bindAtRuntime(session transport.Session, userID uint, bandwidthExempt bool, bindings *sessionBindings, name string) (string, error) {
+	s.bindMu.Lock()
+	defer s.bindMu.Unlock()
+
+	if session.IsClosed() {
+		return "", errSessionNotActive
+	}
+	if s.domainHolder(s.hostname(name), session, userID, bindings.shared) != nil {
+		return "", errDomainInUse
+	}
+	if _, ok := s.remoteOwner(s.hostname(name)); ok {
+		return "", errDomainInUse
+	}
+
+	bound := s.bindDomains(session, userID, []string{name}, bandwidthExempt, false, bindings.shared, bindings.access)
+	if len(bound) == 0 {
+		return "", errDomainNotOwned
+	}
+	hostname := bound[0]
+
+	bindings.mu.Lock()
+	if !containsString(bindings.domains, hostname) {
+		bindings.domains = append(bindings.domains, hostname)
+	}
+	bindings.mu.Unlock()
+
+	s.UserSessions.SetDomains(userID, session, bindings.allDomains())
+	log.Printf("Runtime bind of %s for user %d", hostname, userID)
+	return hostname, nil
+}
+
+// releaseAtRuntime removes an HTTP domain from a live session.
+func (s *Server) releaseAtRuntime(session transport.Session, userID uint, bindings *sessionBindings, name string) error {
+	s.bindMu.Lock()
+	defer s.bindMu.Unlock()
+
+	hostname := s.hostname(name)
+
+	bindings.mu.Lock()
+	idx := -1
+	for i, d := range bindings.domains {
+		if d == hostname {
+			idx = i
+			break
+		}
+	}
+	if idx == -1 {
+		bindings.mu.Unlock()
+		return errDomainNotBound
+	}
+	bindings.domains = append(bindings.domains[:idx], bindings.domains[idx+1:]...)
+	bindings.mu.Unlock()
+
+	s.unregisterDomain(hostname, session, false)
+	s.UserSessions.SetDomains(userID, session, bindings.allDomains())
+	log.Printf("Runtime release of %s for user %d", hostname, userID)
+	return nil
+}
+
+// ReleaseUnownedDomain takes hostname away from every session of this node
+// whose user no longer owns it, e.g. after another user verified the custom
+// domain or its owner deleted it. Sessions kept for resuming lose it from
+// their reservation too; live clients are told with an announcement.
+func (s *Server) ReleaseUnownedDomain(hostname string) {
+	hostname = strings.ToLower(hostname)
+	s.bindMu.Lock()
+	defer s.bindMu.Unlock()
+
+	for _, entry := range s.Registry.Entries(hostname) {
+		bindings := s.bound[entry.Session]
+		if bindings != nil && bindings.ephemeral == hostname {
+			continue
+		}
+		if s.stillOwns(hostname, entry.UserID) {
+			continue
+		}
+		if bindings != nil && bindings.remove(hostname) {
+			s.UserSessions.SetDomains(entry.UserID, entry.Session, bindings.allDomains())
+		}
+		s.unregisterDomain(hostname, entry.Session, false)
+		if ctrl, ok := s.Registry.Control(entry.Session); ok {
+			ctrl.Send(&protocol.ControlMessage{
+				Type:         protocol.ControlAnnouncement,
+				Announcement: &protocol.Announcement{Level: "warn", Message: fmt.Sprintf("%s is no longer yours and was released from this session.", hostname)},
+			})
+		}
+		log.Printf("Released %s from a session of user %d that no longer owns it", hostname, entry.UserID)
+	}
+}
+
+// stillOwns reports whether userID may keep serving the bound hostname.
+// Storage errors count as owned, so a database hiccup doesn't unbind tunnels.
+func (s *Server) stillOwns(hostname string, userID uint) bool {
+	name := hostname
+	if label, ok := strings.CutSuffix(hostname, "."+s.RootDomain); ok && s.RootDomain != "" && !isCustomDomain(label) {
+		name = label
+	}
+	owned, err := s.ownsDomain(name, userID)
+	if err != nil {
+		log.Printf("Domain ownership check error for %s: %v", hostname, err)
+		return true
+	}
+	return owned
+}
+
+// remoteOwner returns the claim on hostname if a client connected to another
+// cluster node serves it.
+func (s *Server) remoteOwner(hostname string) (cluster.Claim, bool) {
+	if s.Cluster == nil {
+		return cluster.Claim{}, false
+	}
+	owner, ok, err := s.Cluster.Owner(hostname)
+	if err != nil {
+		log.Printf("Cluster: lookup of %s failed: %v", hostname, err)
+	}
+	return owner, ok
+}
+
+// LoginProvider returns the provider of the login wall in front of hostname,
+// or "" if visitors need not sign in. Hostnames served by another cluster
+// node are looked up in its claim.
+func (s *Server) LoginProvider(hostname string) string {
+	entries := s.Registry.Entries(hostname)
+	for _, e := range entries {
+		if wall := e.Access.Login(); wall != nil {
+			return wall.Provider
+		}
+	}
+	if len(entries) > 0 {
+		return ""
+	}
+	owner, _ := s.remoteOwner(hostname)
+	return owner.LoginProvider
+}
+
+// claimDomain claims c.Domain for this node so no client on another node can
+// bind it. The caller holds bindMu.
+func (s *Server) claimDomain(c cluster.Claim) error {
+	if s.Cluster == nil {
+		return nil
+	}
+	if err := s.Cluster.Claim(c); err != nil {
+		if errors.Is(err, cluster.ErrClaimed) {
+			return fmt.Errorf("%w: %v", errDomainInUse, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// unregisterDomain removes session from the sessions serving hostname and
+// gives the domain back to the cluster once no session of this node serves
+// it. lost is set when the session ended without its client asking for it,
+// so the ingress expects the client back. The caller holds bindMu.
+func (s *Server) unregisterDomain(hostname string, session transport.Session, lost bool) {
+	if lost {
+		s.Registry.LoseSession(hostname, session)
+	} else {
+		s.Registry.UnregisterSession(hostname, session)
+	}
+	if s.Cluster == nil || len(s.Registry.Entries(hostname)) > 0 {
+		return
+	}
+	if err := s.Cluster.Release(hostname); err != nil {
+		log.Printf("Cluster: release of %s failed: %v", hostname, err)
+	}
+}
+
+func containsString(list []string, v string) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
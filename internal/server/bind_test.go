@@ -0,0 +1,120 @@
+package server
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopublic/internal/cluster"
+	"gopublic/internal/models"
+	"gopublic/internal/storage"
+	"gopublic/internal/transport"
+	"gopublic/pkg/protocol"
+)
+
+func TestBindDomains_CustomDomain(t *testing.T) {
+	if err := storage.InitDB(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatalf("InitDB: %v", err)
+	}
+	domain := &models.CustomDomain{Hostname: "dev.example.org", UserID: 1, VerificationToken: "abc123"}
+	if err := storage.CreateCustomDomain(domain); err != nil {
+		t.Fatalf("CreateCustomDomain: %v", err)
+	}
+	session, _ := yamuxPair(t)
+	s := &Server{Registry: NewTunnelRegistry(), RootDomain: "example.com"}
+
+	// Unverified custom domains are not bound
+	if bound := s.bindDomains(session, 1, []string{"dev.example.org"}, false, false, false, nil); len(bound) != 0 {
+		t.Fatalf("bound unverified custom domain: %v", bound)
+	}
+
+	if err := storage.MarkCustomDomainVerified(domain.ID); err != nil {
+		t.Fatalf("MarkCustomDomainVerified: %v", err)
+	}
+	if bound := s.bindDomains(session, 2, []string{"dev.example.org"}, false, false, false, nil); len(bound) != 0 {
+		t.Fatalf("bound custom domain of another user: %v", bound)
+	}
+	bound := s.bindDomains(session, 1, []string{"Dev.Example.org"}, false, false, false, nil)
+	if len(bound) != 1 || bound[0] != "dev.example.org" {
+		t.Fatalf("bindDomains() = %v, want [dev.example.org]", bound)
+	}
+	if entry, ok := s.Registry.GetEntry("dev.example.org"); !ok || entry.Session != session {
+		t.Errorf("custom domain not registered under its full name: %+v", entry)
+	}
+}
+
+func TestReleaseUnownedDomain(t *testing.T) {
+	if err := storage.InitDB(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatalf("InitDB: %v", err)
+	}
+	first := &models.CustomDomain{Hostname: "dev.example.org", UserID: 1, VerificationToken: "abc"}
+	if err := storage.CreateCustomDomain(first); err != nil {
+		t.Fatalf("CreateCustomDomain: %v", err)
+	}
+	if err := storage.MarkCustomDomainVerified(first.ID); err != nil {
+		t.Fatalf("MarkCustomDomainVerified: %v", err)
+	}
+
+	live, _ := yamuxPair(t)
+	lost, _ := yamuxPair(t)
+	s := &Server{Registry: NewTunnelRegistry(), UserSessions: NewUserSessionRegistry(), RootDomain: "example.com", ResumeGrace: time.Minute}
+	s.bound = make(map[transport.Session]*sessionBindings)
+	for _, session := range []transport.Session{live, lost} {
+		bound := s.bindDomains(session, 1, []string{"dev.example.org"}, false, false, true, nil)
+		if len(bound) != 1 {
+			t.Fatalf("bindDomains() = %v", bound)
+		}
+		s.bound[session] = &sessionBindings{shared: true, domains: bound}
+	}
+	token := s.resumes.issue(1, lost, s.bound[lost])
+	lost.Close()
+	s.resumes.hold(lost, time.Minute, func() {})
+
+	// Still verified for user 1: nothing changes
+	s.ReleaseUnownedDomain("dev.example.org")
+	if entries := s.Registry.Entries("dev.example.org"); len(entries) != 2 {
+		t.Fatalf("owner lost the domain: %+v", entries)
+	}
+
+	// User 2 takes it over
+	second := &models.CustomDomain{Hostname: "dev.example.org", UserID: 2, VerificationToken: "def"}
+	if err := storage.CreateCustomDomain(second); err != nil {
+		t.Fatalf("CreateCustomDomain: %v", err)
+	}
+	if err := storage.MarkCustomDomainVerified(second.ID); err != nil {
+		t.Fatalf("MarkCustomDomainVerified: %v", err)
+	}
+	s.ReleaseUnownedDomain("Dev.Example.org")
+	if entries := s.Registry.Entries("dev.example.org"); len(entries) != 0 {
+		t.Errorf("previous owner still serves the domain: %+v", entries)
+	}
+	if domains := s.bound[live].allDomains(); len(domains) != 0 {
+		t.Errorf("live bindings still hold %v", domains)
+	}
+	if res := s.resumes.take(token, 1); res == nil || len(res.bindings.allDomains()) != 0 {
+		t.Error("resume reservation still holds the domain")
+	}
+}
+
+func TestLoginProvider(t *testing.T) {
+	wall, err := NewTunnelAccess(&protocol.AccessPolicy{Login: &protocol.LoginPolicy{Provider: protocol.LoginProviderOIDC, Allow: []string{"*@example.com"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := cluster.NewMemoryRegistry(0)
+	s := &Server{Registry: NewTunnelRegistry(), RootDomain: "example.com", Cluster: cluster.NewNode("a", "", "secret", registry)}
+	s.Registry.RegisterEntry("app.example.com", &TunnelEntry{UserID: 1, Access: wall})
+	s.Registry.Register("open.example.com", nil, 1, false)
+	registry.Claim(cluster.Claim{Domain: "remote.example.com", NodeID: "b", UserID: 2, LoginProvider: protocol.LoginProviderDashboard})
+
+	for host, want := range map[string]string{
+		"app.example.com":     protocol.LoginProviderOIDC,
+		"open.example.com":    "",
+		"remote.example.com":  protocol.LoginProviderDashboard,
+		"unknown.example.com": "",
+	} {
+		if got := s.LoginProvider(host); got != want {
+			t.Errorf("LoginProvider(%q) = %q, want %q", host, got, want)
+		}
+	}
+}
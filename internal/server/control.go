@@ -0,0 +1,211 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"gopublic/internal/storage"
+	"gopublic/internal/transport"
+	"gopublic/pkg/protocol"
+)
+
+const (
+	// controlUsageInterval is how often usage updates are pushed to clients.
+	controlUsageInterval = time.Minute
+	// controlWriteTimeout bounds a single control message write.
+	controlWriteTimeout = 10 * time.Second
+	// quotaWarningRatio is the share of the daily limit that triggers an early warning.
+	quotaWarningRatio = 0.8
+)
+
+// ControlChannel is the server side of a client's control stream: the
+// handshake stream kept open for typed messages after InitResponse.
+type ControlChannel struct {
+	stream net.Conn
+
+	mu  sync.Mutex // Serializes writes
+	enc *json.Encoder
+
+	// quotaWarnedDay is the UTC day an early quota warning was last sent.
+	quotaWarnedDay string
+}
+
+func newControlChannel(stream net.Conn) *ControlChannel {
+	return &ControlChannel{
+		stream: stream,
+		enc:    json.NewEncoder(stream),
+	}
+}
+
+// Send writes a control message to the client.
+func (c *ControlChannel) Send(msg *protocol.ControlMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stream.SetWriteDeadline(time.Now().Add(controlWriteTimeout))
+	defer c.stream.SetWriteDeadline(time.Time{})
+	return c.enc.Encode(msg)
+}
+
+// SendQuotaWarning tells the client how much of its daily limit it has used.
+func (c *ControlChannel) SendQuotaWarning(used, limit int64) error {
+	return c.Send(&protocol.ControlMessage{
+		Type: protocol.ControlQuotaWarning,
+		Quota: &protocol.QuotaWarning{
+			Used:     used,
+			Limit:    limit,
+			Exceeded: used >= limit,
+		},
+	})
+}
+
+// SendDisconnect tells the client why its session is about to be closed.
+func (c *ControlChannel) SendDisconnect(reason, message string) error {
+	return c.Send(&protocol.ControlMessage{
+		Type:       protocol.ControlDisconnect,
+		Disconnect: &protocol.Disconnect{Reason: reason, Message: message},
+	})
+}
+
+// SendPolicyDisconnect tells the client which session policy is closing its session.
+func (c *ControlChannel) SendPolicyDisconnect(code protocol.ErrorCode, message string) error {
+	return c.Send(&protocol.ControlMessage{
+		Type:       protocol.ControlDisconnect,
+		Disconnect: &protocol.Disconnect{Reason: protocol.DisconnectPolicy, Message: message, Code: code},
+	})
+}
+
+// SendGoingAway tells the client the server is shutting down and when to reconnect.
+func (c *ControlChannel) SendGoingAway(message string, reconnectIn time.Duration) error {
+	return c.Send(&protocol.ControlMessage{
+		Type: protocol.ControlDisconnect,
+		Disconnect: &protocol.Disconnect{
+			Reason:      protocol.DisconnectShutdown,
+			Message:     message,
+			ReconnectIn: int(reconnectIn / time.Second),
+		},
+	})
+}
+
+// markQuotaWarned records an early warning for today and reports whether one
+// was already sent.
+func (c *ControlChannel) markQuotaWarned(now time.Time) bool {
+	day := now.UTC().Format("2006-01-02")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.quotaWarnedDay == day {
+		return true
+	}
+	c.quotaWarnedDay = day
+	return false
+}
+
+// serveControl answers client messages and pushes usage updates until the
+// session closes. The decoder is the one used for the handshake, so any
+// bytes it already buffered are not lost.
+func (s *Server) serveControl(session transport.Session, ctrl *ControlChannel, decoder *json.Decoder, userID uint, bandwidthExempt bool, bindings *sessionBindings) {
+	if !bandwidthExempt && s.DailyBandwidthLimit > 0 {
+		go s.pushUsage(session, ctrl, userID)
+	}
+
+	for {
+		var msg protocol.ControlMessage
+		if err := decoder.Decode(&msg); err != nil {
+			if !errors.Is(err, io.EOF) && !session.IsClosed() {
+				log.Printf("Control stream for user %d closed: %v", userID, err)
+			}
+			return
+		}
+
+		switch msg.Type {
+		case protocol.ControlPing:
+			pong := &protocol.ControlMessage{Type: protocol.ControlPong, Seq: msg.Seq, SentAt: msg.SentAt}
+			if err := ctrl.Send(pong); err != nil {
+				return
+			}
+		case protocol.ControlBind:
+			result := &protocol.ControlMessage{Type: protocol.ControlResult, Seq: msg.Seq}
+			if hostname, err := s.bindAtRuntime(session, userID, bandwidthExempt, bindings, msg.Domain); err != nil {
+				result.Error = err.Error()
+			} else {
+				result.Domain = hostname
+			}
+			if err := ctrl.Send(result); err != nil {
+				return
+			}
+		case protocol.ControlRelease:
+			result := &protocol.ControlMessage{Type: protocol.ControlResult, Seq: msg.Seq, Domain: s.hostname(msg.Domain)}
+			if err := s.releaseAtRuntime(session, userID, bindings, msg.Domain); err != nil {
+				result.Error = err.Error()
+			}
+			if err := ctrl.Send(result); err != nil {
+				return
+			}
+		case protocol.ControlClose:
+			// The client is shutting down: release its domains as soon as
+			// the session closes instead of holding them for a reconnect
+			bindings.markClosing()
+			s.resumes.forget(session)
+			if err := ctrl.Send(&protocol.ControlMessage{Type: protocol.ControlResult, Seq: msg.Seq}); err != nil {
+				return
+			}
+		default:
+			// Unknown types come from newer clients; ignore them
+		}
+	}
+}
+
+// pushUsage periodically sends bandwidth usage and an early quota warning.
+func (s *Server) pushUsage(session transport.Session, ctrl *ControlChannel, userID uint) {
+	ticker := time.NewTicker(controlUsageInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-session.CloseChan():
+			return
+		case now := <-ticker.C:
+			today, err := storage.GetUserBandwidthToday(userID)
+			if err != nil {
+				continue
+			}
+			total, _ := storage.GetUserTotalBandwidth(userID)
+
+			err = ctrl.Send(&protocol.ControlMessage{
+				Type: protocol.ControlUsage,
+				Usage: &protocol.ServerStats{
+					BandwidthToday: today,
+					BandwidthTotal: total,
+					BandwidthLimit: s.DailyBandwidthLimit,
+				},
+			})
+			if err != nil {
+				return
+			}
+
+			if float64(today) >= quotaWarningRatio*float64(s.DailyBandwidthLimit) && !ctrl.markQuotaWarned(now) {
+				ctrl.SendQuotaWarning(today, s.DailyBandwidthLimit)
+			}
+		}
+	}
+}
+
+// Announce sends an operator message to every client with a control stream
+// and returns how many clients it reached.
+func (s *Server) Announce(level, message string) int {
+	msg := &protocol.ControlMessage{
+		Type:         protocol.ControlAnnouncement,
+		Announcement: &protocol.Announcement{Level: level, Message: message},
+	}
+	sent := 0
+	for _, ctrl := range s.Registry.Controls() {
+		if err := ctrl.Send(msg); err == nil {
+			sent++
+		}
+	}
+	return sent
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"gopublic/pkg/protocol"
+)
+
+func TestServeControl_AnswersPing(t *testing.T) {
+	serverSession, clientSession := yamuxPair(t)
+
+	clientStream, err := clientSession.Open()
+	if err != nil {
+		t.Fatalf("open stream: %v", err)
+	}
+	defer clientStream.Close()
+	clientStream.SetDeadline(time.Now().Add(2 * time.Second))
+
+	// yamux only announces a stream once data is written
+	enc := json.NewEncoder(clientStream)
+	if err := enc.Encode(&protocol.ControlMessage{Type: protocol.ControlPing, Seq: 7, SentAt: 42}); err != nil {
+		t.Fatalf("send ping: %v", err)
+	}
+
+	serverStream, err := serverSession.Accept()
+	if err != nil {
+		t.Fatalf("accept stream: %v", err)
+	}
+
+	s := &Server{Registry: NewTunnelRegistry()}
+	ctrl := newControlChannel(serverStream)
+	go s.serveControl(serverSession, ctrl, json.NewDecoder(serverStream), 1, true, &sessionBindings{})
+
+	var pong protocol.ControlMessage
+	if err := json.NewDecoder(clientStream).Decode(&pong); err != nil {
+		t.Fatalf("read pong: %v", err)
+	}
+	if pong.Type != protocol.ControlPong || pong.Seq != 7 || pong.SentAt != 42 {
+		t.Errorf("unexpected pong: %+v", pong)
+	}
+}
+
+func TestReleaseAtRuntime_KeepsOtherDomains(t *testing.T) {
+	serverSession, _ := yamuxPair(t)
+
+	s := &Server{Registry: NewTunnelRegistry(), UserSessions: NewUserSessionRegistry(), RootDomain: "example.com"}
+	s.Registry.Register("app.example.com", serverSession, 1, false)
+	s.Registry.Register("api.example.com", serverSession, 1, false)
+	bindings := &sessionBindings{domains: []string{"app.example.com", "api.example.com"}}
+	s.UserSessions.Register(1, serverSession, "127.0.0.1:5000", bindings.allDomains())
+
+	if err := s.releaseAtRuntime(serverSession, 1, bindings, "app"); err != nil {
+		t.Fatalf("releaseAtRuntime: %v", err)
+	}
+	if _, ok := s.Registry.GetEntry("app.example.com"); ok {
+		t.Error("released domain still registered")
+	}
+	if s.Registry.LostWithin("app.example.com", time.Minute) {
+		t.Error("released domain counts as lost")
+	}
+	if _, ok := s.Registry.GetEntry("api.example.com"); !ok {
+		t.Error("other domain was unregistered")
+	}
+	if domains := s.UserSessions.GetActiveDomains(1); len(domains) != 1 || domains[0] != "api.example.com" {
+		t.Errorf("user session domains = %v, want [api.example.com]", domains)
+	}
+
+	if err := s.releaseAtRuntime(serverSession, 1, bindings, "app"); err != errDomainNotBound {
+		t.Errorf("second release error = %v, want %v", err, errDomainNotBound)
+	}
+}
+
+func TestMonitorSession_CloseNoticeIsNotALoss(t *testing.T) {
+	for _, notice := range []bool{false, true} {
+		serverSession, clientSession := yamuxPair(t)
+		clientStream, err := clientSession.Open()
+		if err != nil {
+			t.Fatalf("open stream: %v", err)
+		}
+		clientStream.SetDeadline(time.Now().Add(2 * time.Second))
+		enc := json.NewEncoder(clientStream)
+		enc.Encode(&protocol.ControlMessage{Type: protocol.ControlPing, Seq: 1})
+		serverStream, err := serverSession.Accept()
+		if err != nil {
+			t.Fatalf("accept stream: %v", err)
+		}
+
+		s := &Server{Registry: NewTunnelRegistry(), UserSessions: NewUserSessionRegistry()}
+		s.Registry.Register("app.example.com", serverSession, 1, false)
+		bindings := &sessionBindings{domains: []string{"app.example.com"}}
+		s.UserSessions.Register(1, serverSession, "127.0.0.1:5000", bindings.allDomains())
+		s.monitorSession(serverSession, 1, bindings)
+		go s.serveControl(serverSession, newControlChannel(serverStream), json.NewDecoder(serverStream), 1, true, bindings)
+
+		dec := json.NewDecoder(clientStream)
+		var pong protocol.ControlMessage
+		if err := dec.Decode(&pong); err != nil {
+			t.Fatalf("read pong: %v", err)
+		}
+		if notice {
+			enc.Encode(&protocol.ControlMessage{Type: protocol.ControlClose, Seq: 2})
+			var result protocol.ControlMessage
+			if err := dec.Decode(&result); err != nil || result.Type != protocol.ControlResult || result.Seq != 2 {
+				t.Fatalf("close notice answered with %+v, %v", result, err)
+			}
+		}
+		clientSession.Close()
+
+		deadline := time.Now().Add(2 * time.Second)
+		for s.Registry.HasLiveSession("app.example.com") || len(s.Registry.Entries("app.example.com")) > 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("domain not released after the session closed")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if lost := s.Registry.LostWithin("app.example.com", time.Minute); lost == notice {
+			t.Errorf("close notice %v: LostWithin() = %v", notice, lost)
+		}
+	}
+}
+
+func TestAnnounce_ReachesRegisteredControls(t *testing.T) {
+	serverSession, clientSession := yamuxPair(t)
+
+	serverStream, err := serverSession.Open()
+	if err != nil {
+		t.Fatalf("open stream: %v", err)
+	}
+
+	s := &Server{Registry: NewTunnelRegistry()}
+	s.Registry.SetControl(serverSession, newControlChannel(serverStream))
+
+	if sent := s.Announce("info", "maintenance at 22:00"); sent != 1 {
+		t.Fatalf("Announce() reached %d clients, want 1", sent)
+	}
+
+	clientStream, err := clientSession.Accept()
+	if err != nil {
+		t.Fatalf("accept stream: %v", err)
+	}
+	clientStream.SetDeadline(time.Now().Add(2 * time.Second))
+
+	var msg protocol.ControlMessage
+	if err := json.NewDecoder(clientStream).Decode(&msg); err != nil {
+		t.Fatalf("read announcement: %v", err)
+	}
+	if msg.Type != protocol.ControlAnnouncement || msg.Announcement == nil || msg.Announcement.Message != "maintenance at 22:00" {
+		t.Errorf("unexpected message: %+v", msg)
+	}
+
+	s.Registry.RemoveControl(serverSession)
+	if sent := s.Announce("info", "again"); sent != 0 {
+		t.Errorf("Announce() after RemoveControl reached %d clients, want 0", sent)
+	}
+}
+
+func TestControlChannel_QuotaWarnedOncePerDay(t *testing.T) {
+	ctrl := &ControlChannel{}
+	day := time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	if ctrl.markQuotaWarned(day) {
+		t.Error("first warning of the day reported as already sent")
+	}
+	if !ctrl.markQuotaWarned(day.Add(time.Hour)) {
+		t.Error("second warning on the same day not suppressed")
+	}
+	if ctrl.markQuotaWarned(day.Add(24 * time.Hour)) {
+		t.Error("warning on the next day suppressed")
+	}
+}
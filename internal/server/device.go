@@ -0,0 +1,43 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+
+	"gopublic/internal/devicecert"
+	"gopublic/internal/models"
+	"gopublic/internal/storage"
+)
+
+// peerCertificate completes the TLS handshake of conn and returns the client
+// certificate, which crypto/tls already verified against the device CA. It
+// returns nil for plain connections and clients without a certificate.
+func peerCertificate(conn net.Conn) (*x509.Certificate, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+		return certs[0], nil
+	}
+	return nil, nil
+}
+
+// validateDeviceCert looks up the device a verified certificate was issued
+// to. Revoked certificates and ones missing from storage are rejected.
+func validateDeviceCert(cert *x509.Certificate) (*models.DeviceCert, error) {
+	fingerprint := devicecert.Fingerprint(cert)
+	device, err := storage.ValidateDeviceCert(fingerprint)
+	if err != nil {
+		return nil, fmt.Errorf("device certificate %s (%q): %w", fingerprint, cert.Subject.CommonName, err)
+	}
+	return device, nil
+}
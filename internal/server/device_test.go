@@ -0,0 +1,147 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopublic/internal/devicecert"
+	"gopublic/internal/models"
+	"gopublic/internal/storage"
+)
+
+// deviceTLSPair runs a TLS handshake like the control plane's, with clientCert
+// presented by the client (nil for none), and returns the server end.
+func deviceTLSPair(t *testing.T, ca *devicecert.CA, clientCert *tls.Certificate) net.Conn {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConf := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    ca.Pool(),
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", serverConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	clientConf := &tls.Config{InsecureSkipVerify: true}
+	if clientCert != nil {
+		clientConf.Certificates = []tls.Certificate{*clientCert}
+	}
+	clientConns := make(chan net.Conn, 1)
+	go func() {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), clientConf)
+		if err != nil {
+			clientConns <- nil
+			return
+		}
+		clientConns <- conn
+	}()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		if client := <-clientConns; client != nil {
+			client.Close()
+		}
+	})
+	return conn
+}
+
+func TestDeviceCertificateAuthentication(t *testing.T) {
+	if err := storage.InitDB(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatalf("InitDB: %v", err)
+	}
+	user := &models.User{Username: "alice"}
+	if err := storage.DB.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	ca, err := devicecert.LoadOrCreate(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, bundle, err := ca.Issue("laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair, err := tls.X509KeyPair(bundle, bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	device := &models.DeviceCert{UserID: user.ID, Name: "laptop", Fingerprint: devicecert.Fingerprint(cert), ExpiresAt: cert.NotAfter}
+	if err := storage.CreateDeviceCert(device); err != nil {
+		t.Fatal(err)
+	}
+
+	// Clients without a certificate fall through to the token
+	if got, err := peerCertificate(deviceTLSPair(t, ca, nil)); err != nil || got != nil {
+		t.Errorf("peerCertificate(no cert) = %v, %v; want nil, nil", got, err)
+	}
+
+	got, err := peerCertificate(deviceTLSPair(t, ca, &pair))
+	if err != nil || got == nil {
+		t.Fatalf("peerCertificate() = %v, %v", got, err)
+	}
+	authed, err := validateDeviceCert(got)
+	if err != nil {
+		t.Fatalf("validateDeviceCert: %v", err)
+	}
+	if authed.User.ID != user.ID || authed.Name != "laptop" {
+		t.Errorf("validateDeviceCert() = device %q of user %d, want laptop of user %d", authed.Name, authed.User.ID, user.ID)
+	}
+
+	if err := storage.RevokeDeviceCert(device.ID, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := validateDeviceCert(got); err == nil {
+		t.Error("revoked certificate accepted")
+	}
+}
+
+func TestPeerCertificate_UnknownCA(t *testing.T) {
+	ca, err := devicecert.LoadOrCreate(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := devicecert.LoadOrCreate(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, bundle, err := other.Issue("stranger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair, err := tls.X509KeyPair(bundle, bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peerCertificate(deviceTLSPair(t, ca, &pair)); err == nil {
+		t.Error("handshake with a certificate from another CA succeeded")
+	}
+}
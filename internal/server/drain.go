@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"gopublic/internal/transport"
+)
+
+// drainPollInterval is how often a draining server checks for in-flight streams.
+const drainPollInterval = 100 * time.Millisecond
+
+// drainSessions tells every client the server is going away, stops new
+// streams on their sessions and waits for in-flight ones to finish before
+// closing the sessions. Whatever is still running when ctx ends is cut off.
+func (s *Server) drainSessions(ctx context.Context) {
+	sessions := s.UserSessions.AllSessions()
+	if len(sessions) == 0 {
+		return
+	}
+
+	reconnectIn := int(s.DrainReconnect / time.Second)
+	message := "Server is restarting, the client will reconnect automatically."
+	if reconnectIn > 0 {
+		message = fmt.Sprintf("Server is restarting, the client will reconnect in %d seconds.", reconnectIn)
+	}
+	for _, session := range sessions {
+		s.Registry.Drain(session)
+		session.GoAway()
+		if ctrl, ok := s.Registry.Control(session); ok {
+			ctrl.SendGoingAway(message, s.DrainReconnect)
+		}
+	}
+	log.Printf("Control Plane: draining %d sessions...", len(sessions))
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for !s.sessionsIdle(sessions) {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			log.Println("Control Plane: drain timeout, closing sessions with streams in flight")
+			closeSessions(sessions)
+			return
+		}
+	}
+	closeSessions(sessions)
+}
+
+// sessionsIdle reports whether no session has streams open besides its
+// control stream.
+func (s *Server) sessionsIdle(sessions []transport.Session) bool {
+	for _, session := range sessions {
+		if session.IsClosed() {
+			continue
+		}
+		idle := 0
+		if _, ok := s.Registry.Control(session); ok {
+			idle = 1
+		}
+		if session.NumStreams() > idle {
+			return false
+		}
+	}
+	return true
+}
+
+func closeSessions(sessions []transport.Session) {
+	for _, session := range sessions {
+		session.Close()
+	}
+}
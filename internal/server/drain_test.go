@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDrainSessions_WaitsForInFlightStreams(t *testing.T) {
+	draining, drainingClient := yamuxPair(t)
+	other, _ := yamuxPair(t)
+
+	s := &Server{Registry: NewTunnelRegistry(), UserSessions: NewUserSessionRegistry()}
+	s.Registry.JoinPool("app.example.com", &TunnelEntry{Session: draining, UserID: 1})
+	s.Registry.JoinPool("app.example.com", &TunnelEntry{Session: other, UserID: 1})
+	s.UserSessions.Register(1, draining, "10.0.0.1:5000", []string{"app.example.com"})
+
+	// An HTTP exchange is in flight when the shutdown starts
+	accepted := make(chan struct{})
+	go func() {
+		stream, err := drainingClient.Accept()
+		if err == nil {
+			defer stream.Close()
+			close(accepted)
+			buf := make([]byte, 1)
+			stream.Read(buf)
+		}
+	}()
+	inFlight, err := draining.Open()
+	if err != nil {
+		t.Fatalf("open stream: %v", err)
+	}
+	inFlight.Write([]byte("x"))
+	<-accepted
+
+	done := make(chan struct{})
+	go func() {
+		s.drainSessions(context.Background())
+		close(done)
+	}()
+
+	time.Sleep(2 * drainPollInterval)
+	if draining.IsClosed() {
+		t.Fatal("session closed with a stream in flight")
+	}
+	entries := s.Registry.Entries("app.example.com")
+	if entries[0].Session != other || s.Registry.IsAvailable(entries[1]) {
+		t.Errorf("draining session still picked for new requests: %+v", entries)
+	}
+	if _, err := drainingClient.Open(); err == nil {
+		t.Error("client opened a stream on a draining session")
+	}
+
+	inFlight.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("drain did not finish after the last stream closed")
+	}
+	if !draining.IsClosed() {
+		t.Error("drained session left open")
+	}
+}
+
+func TestDrainSessions_StopsAtDeadline(t *testing.T) {
+	session, client := yamuxPair(t)
+	s := &Server{Registry: NewTunnelRegistry(), UserSessions: NewUserSessionRegistry()}
+	s.UserSessions.Register(1, session, "10.0.0.1:5000", nil)
+
+	go client.Accept()
+	if _, err := session.Open(); err != nil {
+		t.Fatalf("open stream: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*drainPollInterval)
+	defer cancel()
+	s.drainSessions(ctx)
+	if !session.IsClosed() {
+		t.Error("session left open after the drain deadline")
+	}
+}
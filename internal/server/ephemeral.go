@@ -0,0 +1,54 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+
+	"gopublic/internal/cluster"
+	"gopublic/internal/storage"
+	"gopublic/internal/transport"
+)
+
+// ephemeralAttempts bounds the search for an unused random domain.
+const ephemeralAttempts = 5
+
+var (
+	ephemeralPrefixes = []string{"misty", "silent", "bold", "rapid", "cool"}
+	ephemeralSuffixes = []string{"river", "star", "eagle", "bear", "fox"}
+)
+
+var errNoEphemeralDomain = errors.New("no free ephemeral domain found")
+
+// bindEphemeral registers a random domain for the life of session. It is
+// never stored as a models.Domain, so it disappears with the session (or
+// with its resume reservation). The caller holds bindMu.
+func (s *Server) bindEphemeral(session transport.Session, userID uint, bandwidthExempt bool) (string, error) {
+	for i := 0; i < ephemeralAttempts; i++ {
+		name := storage.GenerateDomainName(
+			ephemeralPrefixes[rand.Intn(len(ephemeralPrefixes))],
+			ephemeralSuffixes[rand.Intn(len(ephemeralSuffixes))],
+		)
+		hostname := s.hostname(name)
+		if len(s.Registry.Entries(hostname)) > 0 {
+			continue
+		}
+		exists, err := storage.DomainExists(name)
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			continue
+		}
+		if err := s.claimDomain(cluster.Claim{Domain: hostname, UserID: userID}); err != nil {
+			continue
+		}
+
+		if err := s.registerDomain(hostname, session, userID, bandwidthExempt, false, false, nil); err != nil {
+			return "", err
+		}
+		log.Printf("Bound ephemeral domain %s for user %d", hostname, userID)
+		return hostname, nil
+	}
+	return "", errNoEphemeralDomain
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopublic/internal/storage"
+)
+
+func TestBindEphemeral(t *testing.T) {
+	if err := storage.InitDB(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatalf("InitDB: %v", err)
+	}
+	session, _ := yamuxPair(t)
+	s := &Server{Registry: NewTunnelRegistry(), RootDomain: "example.com"}
+
+	hostname, err := s.bindEphemeral(session, 1, false)
+	if err != nil {
+		t.Fatalf("bindEphemeral: %v", err)
+	}
+	if !strings.HasSuffix(hostname, ".example.com") {
+		t.Errorf("hostname = %q, want a subdomain of example.com", hostname)
+	}
+	if entry, ok := s.Registry.GetEntry(hostname); !ok || entry.Session != session || entry.UserID != 1 {
+		t.Errorf("ephemeral domain not registered to the session: %+v", entry)
+	}
+
+	// The domain is never persisted
+	name := strings.TrimSuffix(hostname, ".example.com")
+	if exists, err := storage.DomainExists(name); err != nil || exists {
+		t.Errorf("DomainExists(%q) = %v, %v; ephemeral domains must not be stored", name, exists, err)
+	}
+
+	other, err := s.bindEphemeral(session, 1, false)
+	if err != nil || other == hostname {
+		t.Errorf("second ephemeral domain = %q, %v; want a new name", other, err)
+	}
+}
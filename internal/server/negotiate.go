@@ -0,0 +1,55 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+
+	"gopublic/internal/version"
+	"gopublic/pkg/protocol"
+)
+
+// errIncompatibleClient is returned when a client is older than MinClientVersion.
+var errIncompatibleClient = errors.New("incompatible client")
+
+// checkClientVersion enforces MinClientVersion. Development builds are always
+// accepted; clients that predate negotiation send no version and are rejected
+// once a minimum is configured.
+func (s *Server) checkClientVersion(clientVersion string) error {
+	if s.MinClientVersion == "" {
+		return nil
+	}
+	if clientVersion != "" && version.IsDev(clientVersion) {
+		return nil
+	}
+	if clientVersion == "" || version.Compare(clientVersion, s.MinClientVersion) < 0 {
+		return fmt.Errorf("%w: version %q is older than %s", errIncompatibleClient, clientVersion, s.MinClientVersion)
+	}
+	return nil
+}
+
+// sendIncompatibleClient tells the client to update before reconnecting.
+func (s *Server) sendIncompatibleClient(stream net.Conn) {
+	resp := protocol.InitResponse{
+		Success:          false,
+		Error:            fmt.Sprintf("Client is too old, version %s or newer is required. Run 'gopublic update' to upgrade.", s.MinClientVersion),
+		ErrorCode:        protocol.ErrorCodeIncompatibleClient,
+		ServerVersion:    version.Version,
+		ProtocolVersion:  protocol.ProtocolVersion,
+		MinClientVersion: s.MinClientVersion,
+	}
+	json.NewEncoder(stream).Encode(resp)
+}
+
+// capabilities lists the features this server has enabled.
+func (s *Server) capabilities() []string {
+	caps := []string{protocol.CapabilityStreamHeader, protocol.CapabilityTLSPassthrough, protocol.CapabilityControlStream, protocol.CapabilityRuntimeBind, protocol.CapabilitySharedDomains, protocol.CapabilityEphemeralDomains, protocol.CapabilityAccessPolicy, protocol.CapabilityLoginWall, protocol.CapabilityCloseNotice}
+	if s.ResumeGrace > 0 {
+		caps = append(caps, protocol.CapabilityResume)
+	}
+	if s.PublicPorts != nil {
+		caps = append(caps, protocol.CapabilityTCPTunnels, protocol.CapabilityUDPTunnels)
+	}
+	return caps
+}
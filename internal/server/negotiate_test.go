@@ -0,0 +1,89 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"gopublic/pkg/protocol"
+)
+
+func TestCheckClientVersion(t *testing.T) {
+	tests := []struct {
+		name          string
+		minVersion    string
+		clientVersion string
+		wantErr       bool
+	}{
+		{"no minimum", "", "", false},
+		{"legacy client without version", "v1.4.0", "", true},
+		{"older client", "v1.4.0", "v1.3.9", true},
+		{"same version", "v1.4.0", "v1.4.0", false},
+		{"newer client", "v1.4.0", "1.10.0", false},
+		{"dev build", "v1.4.0", "dev", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{MinClientVersion: tt.minVersion}
+			err := s.checkClientVersion(tt.clientVersion)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkClientVersion(%q) error = %v, wantErr %v", tt.clientVersion, err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, errIncompatibleClient) {
+				t.Errorf("checkClientVersion(%q) error = %v, want errIncompatibleClient", tt.clientVersion, err)
+			}
+		})
+	}
+}
+
+func TestAuthenticate_RejectsIncompatibleClient(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	clientConn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	s := &Server{MinClientVersion: "v2.0.0"}
+	errCh := make(chan error, 1)
+	go func() {
+		_, _, _, err := s.authenticate(json.NewDecoder(serverConn), serverConn, "test", nil)
+		errCh <- err
+	}()
+
+	authReq := protocol.AuthRequest{Token: "tok", ClientVersion: "v1.0.0", ProtocolVersion: protocol.ProtocolVersion}
+	if err := json.NewEncoder(clientConn).Encode(authReq); err != nil {
+		t.Fatalf("encode auth request: %v", err)
+	}
+
+	var resp protocol.InitResponse
+	if err := json.NewDecoder(clientConn).Decode(&resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if resp.Success || resp.ErrorCode != protocol.ErrorCodeIncompatibleClient {
+		t.Errorf("response = %+v, want incompatible_client error", resp)
+	}
+	if resp.MinClientVersion != "v2.0.0" {
+		t.Errorf("MinClientVersion = %q, want %q", resp.MinClientVersion, "v2.0.0")
+	}
+
+	if err := <-errCh; !errors.Is(err, errIncompatibleClient) {
+		t.Errorf("authenticate() error = %v, want errIncompatibleClient", err)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	s := &Server{}
+	if protocol.HasCapability(s.capabilities(), protocol.CapabilityTCPTunnels) {
+		t.Error("tcp_tunnels advertised without a port range")
+	}
+
+	s.PublicPorts = NewPortPool(20000, 20001, 0)
+	caps := s.capabilities()
+	for _, c := range []string{protocol.CapabilityStreamHeader, protocol.CapabilityTCPTunnels, protocol.CapabilityUDPTunnels} {
+		if !protocol.HasCapability(caps, c) {
+			t.Errorf("capabilities() = %v, missing %q", caps, c)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"gopublic/internal/models"
+	"gopublic/internal/transport"
+	"gopublic/pkg/protocol"
+)
+
+// SessionPolicy limits how long a client session may live and how many
+// streams it may carry at once. Zero values mean no limit.
+type SessionPolicy struct {
+	MaxDuration time.Duration // Session is closed this long after the handshake
+	IdleTimeout time.Duration // Session is closed after carrying no streams this long
+	MaxStreams  int           // Concurrent streams opened to the client
+}
+
+// ErrTooManyStreams is returned when opening a stream would exceed the
+// session's MaxStreams.
+var ErrTooManyStreams = errors.New("too many concurrent streams on the tunnel session")
+
+// policyFor applies the user's overrides to the server's default policy.
+func (s *Server) policyFor(user *models.User) SessionPolicy {
+	policy := s.SessionPolicy
+	if v := user.MaxSessionMinutes; v != nil {
+		policy.MaxDuration = time.Duration(*v) * time.Minute
+	}
+	if v := user.IdleTimeoutMinutes; v != nil {
+		policy.IdleTimeout = time.Duration(*v) * time.Minute
+	}
+	if v := user.MaxStreams; v != nil {
+		policy.MaxStreams = *v
+	}
+	return policy
+}
+
+// policySession counts the streams the server opens on a client session, so
+// the stream limit can refuse new ones and the idle timeout can tell when
+// the last one ended. The handshake and control stream are not counted.
+type policySession struct {
+	transport.Session
+
+	mu         sync.Mutex
+	maxStreams int // 0 = unlimited; set once the user is known
+	active     int
+	idleSince  time.Time // When active last dropped to 0
+	now        func() time.Time
+}
+
+func newPolicySession(session transport.Session) *policySession {
+	return &policySession{Session: session, idleSince: time.Now(), now: time.Now}
+}
+
+// Open opens a stream to the client unless MaxStreams are already open.
+func (p *policySession) Open() (net.Conn, error) {
+	p.mu.Lock()
+	if p.maxStreams > 0 && p.active >= p.maxStreams {
+		p.mu.Unlock()
+		return nil, ErrTooManyStreams
+	}
+	p.active++
+	p.mu.Unlock()
+
+	stream, err := p.Session.Open()
+	if err != nil {
+		p.streamDone()
+		return nil, err
+	}
+	return &policyStream{Conn: stream, session: p}, nil
+}
+
+func (p *policySession) setMaxStreams(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.maxStreams = n
+}
+
+func (p *policySession) streamDone() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.active--
+	if p.active == 0 {
+		p.idleSince = p.now()
+	}
+}
+
+// idleFor returns how long the session has had no streams, 0 while it has some.
+func (p *policySession) idleFor() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.active > 0 {
+		return 0
+	}
+	return p.now().Sub(p.idleSince)
+}
+
+// policyStream releases its slot in the session on the first Close.
+type policyStream struct {
+	net.Conn
+	session *policySession
+	once    sync.Once
+}
+
+func (s *policyStream) Close() error {
+	s.once.Do(s.session.streamDone)
+	return s.Conn.Close()
+}
+
+// enforcePolicy closes the session once it reaches MaxDuration or has been
+// idle for IdleTimeout. It returns when the session closes.
+func (s *Server) enforcePolicy(session *policySession, userID uint, policy SessionPolicy, bindings *sessionBindings) {
+	if policy.MaxDuration <= 0 && policy.IdleTimeout <= 0 {
+		return
+	}
+
+	var expired <-chan time.Time
+	if policy.MaxDuration > 0 {
+		timer := time.NewTimer(policy.MaxDuration)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	var idleCheck <-chan time.Time
+	var idleTimer *time.Timer
+	if policy.IdleTimeout > 0 {
+		idleTimer = time.NewTimer(policy.IdleTimeout)
+		defer idleTimer.Stop()
+		idleCheck = idleTimer.C
+	}
+
+	for {
+		select {
+		case <-session.CloseChan():
+			return
+		case <-expired:
+			log.Printf("Closing session of user %d: maximum duration of %v reached", userID, policy.MaxDuration)
+			s.closeByPolicy(session, protocol.ErrorCodeSessionExpired, "The session reached its maximum duration, the client will reconnect.")
+			return
+		case <-idleCheck:
+			idle := session.idleFor()
+			if idle >= policy.IdleTimeout {
+				log.Printf("Closing session of user %d: no streams for %v", userID, idle.Round(time.Second))
+				// Release the domains right away instead of holding them for
+				// a resume; the client exits, so they are not lost either
+				bindings.markClosing()
+				s.resumes.forget(session)
+				s.closeByPolicy(session, protocol.ErrorCodeIdleTimeout, "The tunnel carried no traffic for too long and was closed. Start the client again to reopen it.")
+				return
+			}
+			idleTimer.Reset(policy.IdleTimeout - idle)
+		}
+	}
+}
+
+// closeByPolicy tells the client which policy ended its session and closes it.
+func (s *Server) closeByPolicy(session transport.Session, code protocol.ErrorCode, message string) {
+	if ctrl, ok := s.Registry.Control(session); ok {
+		ctrl.SendPolicyDisconnect(code, message)
+	}
+	session.Close()
+}
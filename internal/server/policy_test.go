@@ -0,0 +1,139 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"gopublic/internal/models"
+	"gopublic/pkg/protocol"
+)
+
+func TestPolicySession_MaxStreams(t *testing.T) {
+	session, client := yamuxPair(t)
+	go func() {
+		for {
+			if _, err := client.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	p := newPolicySession(session)
+	p.setMaxStreams(2)
+	first, err := p.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Open(); !errors.Is(err, ErrTooManyStreams) {
+		t.Fatalf("third Open() = %v, want ErrTooManyStreams", err)
+	}
+
+	// Closing twice frees a single slot
+	first.Close()
+	first.Close()
+	if _, err := p.Open(); err != nil {
+		t.Errorf("Open() after a stream closed = %v", err)
+	}
+	if _, err := p.Open(); !errors.Is(err, ErrTooManyStreams) {
+		t.Errorf("Open() over the limit = %v, want ErrTooManyStreams", err)
+	}
+}
+
+func TestPolicySession_IdleFor(t *testing.T) {
+	session, client := yamuxPair(t)
+	go client.Accept()
+
+	now := time.Now()
+	p := newPolicySession(session)
+	p.now = func() time.Time { return now }
+	p.idleSince = now
+
+	stream, err := p.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Hour)
+	if idle := p.idleFor(); idle != 0 {
+		t.Errorf("idleFor() with an open stream = %v, want 0", idle)
+	}
+	stream.Close()
+	now = now.Add(time.Minute)
+	if idle := p.idleFor(); idle != time.Minute {
+		t.Errorf("idleFor() = %v, want 1m", idle)
+	}
+}
+
+func TestEnforcePolicy_IdleTimeout(t *testing.T) {
+	session, _ := yamuxPair(t)
+	p := newPolicySession(session)
+
+	serverConn, clientConn := net.Pipe()
+	t.Cleanup(func() { serverConn.Close(); clientConn.Close() })
+	s := &Server{Registry: NewTunnelRegistry()}
+	s.Registry.SetControl(p, newControlChannel(serverConn))
+
+	msgs := make(chan protocol.ControlMessage, 1)
+	go func() {
+		var msg protocol.ControlMessage
+		if json.NewDecoder(clientConn).Decode(&msg) == nil {
+			msgs <- msg
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		s.enforcePolicy(p, 1, SessionPolicy{IdleTimeout: 50 * time.Millisecond, MaxDuration: time.Hour}, &sessionBindings{})
+		close(done)
+	}()
+
+	select {
+	case msg := <-msgs:
+		if msg.Type != protocol.ControlDisconnect || msg.Disconnect == nil || msg.Disconnect.Code != protocol.ErrorCodeIdleTimeout {
+			t.Errorf("control message = %+v, want idle_timeout disconnect", msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no disconnect sent to the idle session")
+	}
+	<-done
+	if !p.IsClosed() {
+		t.Error("idle session left open")
+	}
+}
+
+func TestEnforcePolicy_MaxDuration(t *testing.T) {
+	session, client := yamuxPair(t)
+	go client.Accept()
+	p := newPolicySession(session)
+	s := &Server{Registry: NewTunnelRegistry()}
+
+	// A busy session is not idle, but still expires
+	if _, err := p.Open(); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	s.enforcePolicy(p, 1, SessionPolicy{MaxDuration: 50 * time.Millisecond, IdleTimeout: 20 * time.Millisecond}, &sessionBindings{})
+	if !p.IsClosed() {
+		t.Fatal("expired session left open")
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("session closed after %v, before its maximum duration", elapsed)
+	}
+}
+
+func TestPolicyFor(t *testing.T) {
+	s := &Server{SessionPolicy: SessionPolicy{MaxDuration: time.Hour, IdleTimeout: 10 * time.Minute, MaxStreams: 50}}
+	idle, unlimited := 30, 0
+	user := &models.User{SessionLimits: models.SessionLimits{IdleTimeoutMinutes: &idle, MaxStreams: &unlimited}}
+
+	got := s.policyFor(user)
+	want := SessionPolicy{MaxDuration: time.Hour, IdleTimeout: 30 * time.Minute, MaxStreams: 0}
+	if got != want {
+		t.Errorf("policyFor() = %+v, want %+v", got, want)
+	}
+}
@@ -1,64 +1,335 @@
 package server
 
 import (
+	"errors"
 	"sync"
+	"time"
 
-	"github.com/hashicorp/yamux"
+	"gopublic/internal/transport"
 )
 
+// ErrPassthroughConflict is returned by JoinPool when the live sessions of a
+// shared hostname serve it in the other TLS passthrough mode.
+var ErrPassthroughConflict = errors.New("shared domain is served with a different TLS passthrough mode")
+
+// lostRetention is how long the registry remembers that a hostname lost its
+// last session.
+const lostRetention = 10 * time.Minute
+
 // TunnelEntry contains session and user info for a registered tunnel
 type TunnelEntry struct {
-	Session *yamux.Session
+	Session transport.Session
 	UserID  uint
 	// BandwidthExempt disables bandwidth limits for this tunnel's user.
 	BandwidthExempt bool
+	// Passthrough means TLS is terminated by the client; the ingress forwards
+	// raw TLS bytes selected by SNI instead of proxying HTTP.
+	Passthrough bool
+	// Shared means the session opted in to serve the hostname together with
+	// other sessions of the same user, load balanced by the ingress.
+	Shared bool
+	// Access is checked by the ingress before a stream is opened (nil = public).
+	Access *TunnelAccess
+}
+
+// BalanceStrategy selects which session of a shared hostname gets a request.
+type BalanceStrategy string
+
+const (
+	BalanceRoundRobin   BalanceStrategy = "round_robin"   // Take turns
+	BalanceLeastStreams BalanceStrategy = "least_streams" // Fewest open yamux streams
+)
+
+// tunnelPool holds the sessions serving one hostname. Only shared entries
+// ever share a pool; everything else is a pool of one.
+type tunnelPool struct {
+	entries []*TunnelEntry
+	next    int // Round-robin cursor
 }
 
 // TunnelRegistry manages the mapping between hostnames and active Yamux sessions.
+// It also tracks the control channel of each session that negotiated one and
+// which sessions are draining before a server shutdown.
 type TunnelRegistry struct {
+	// Balance picks among the sessions of a shared hostname (default round robin)
+	Balance BalanceStrategy
+
 	mu       sync.RWMutex
-	sessions map[string]*TunnelEntry
+	pools    map[string]*tunnelPool
+	controls map[transport.Session]*ControlChannel
+	draining map[transport.Session]bool
+	headers  map[transport.Session]bool // Sessions that accept a StreamHeader on HTTP streams
+	lost     map[string]time.Time       // When hostnames lost their last session
 }
 
 func NewTunnelRegistry() *TunnelRegistry {
 	return &TunnelRegistry{
-		sessions: make(map[string]*TunnelEntry),
+		pools:    make(map[string]*tunnelPool),
+		controls: make(map[transport.Session]*ControlChannel),
+		draining: make(map[transport.Session]bool),
+		headers:  make(map[transport.Session]bool),
+		lost:     make(map[string]time.Time),
 	}
 }
 
 // Register maps a hostname to a session with user ID.
-func (r *TunnelRegistry) Register(hostname string, session *yamux.Session, userID uint, bandwidthExempt bool) {
+func (r *TunnelRegistry) Register(hostname string, session transport.Session, userID uint, bandwidthExempt bool) {
+	r.RegisterEntry(hostname, &TunnelEntry{
+		Session:         session,
+		UserID:          userID,
+		BandwidthExempt: bandwidthExempt,
+	})
+}
+
+// RegisterEntry maps a hostname to entry alone, replacing the sessions serving it.
+func (r *TunnelRegistry) RegisterEntry(hostname string, entry *TunnelEntry) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	r.sessions[hostname] = &TunnelEntry{
-		Session: session,
-		UserID:  userID,
-		BandwidthExempt: bandwidthExempt,
+	r.pools[hostname] = &tunnelPool{entries: []*TunnelEntry{entry}}
+	delete(r.lost, hostname)
+}
+
+// JoinPool adds a shared session to the sessions serving hostname. Entries
+// that are not shared are replaced, as Register would do. A hostname whose
+// live shared sessions use the other passthrough mode is left alone and
+// ErrPassthroughConflict returned.
+func (r *TunnelRegistry) JoinPool(hostname string, entry *TunnelEntry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	pool, ok := r.pools[hostname]
+	if !ok {
+		entry.Shared = true
+		delete(r.lost, hostname)
+		r.pools[hostname] = &tunnelPool{entries: []*TunnelEntry{entry}}
+		return nil
+	}
+	for _, e := range pool.entries {
+		if e.Shared && e.Passthrough != entry.Passthrough && e.Session != entry.Session && r.live(e) {
+			return ErrPassthroughConflict
+		}
 	}
+	entry.Shared = true
+	delete(r.lost, hostname)
+	entries := []*TunnelEntry{}
+	for _, e := range pool.entries {
+		if e.Shared && e.Passthrough == entry.Passthrough && e.Session != entry.Session {
+			entries = append(entries, e)
+		}
+	}
+	pool.entries = append(entries, entry)
+	return nil
 }
 
 // Unregister removes a mapping.
 func (r *TunnelRegistry) Unregister(hostname string) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	delete(r.sessions, hostname)
+	delete(r.pools, hostname)
 }
 
-// GetSession returns the session for a given hostname (for backward compatibility).
-func (r *TunnelRegistry) GetSession(hostname string) (*yamux.Session, bool) {
+// UnregisterSession removes session from the sessions serving hostname, so a
+// closing session never drops a hostname another session has taken over.
+func (r *TunnelRegistry) UnregisterSession(hostname string, session transport.Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.removeSession(hostname, session)
+}
+
+// LoseSession is UnregisterSession for a session that ended unexpectedly:
+// if it was the last one serving hostname, the hostname counts as lost, so
+// the ingress holds its requests while the client reconnects.
+func (r *TunnelRegistry) LoseSession(hostname string, session transport.Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.removeSession(hostname, session) {
+		r.markLost(hostname)
+	}
+}
+
+// removeSession drops session from the pool of hostname and reports whether
+// that left the hostname without sessions. Callers hold r.mu.
+func (r *TunnelRegistry) removeSession(hostname string, session transport.Session) bool {
+	pool, ok := r.pools[hostname]
+	if !ok {
+		return false
+	}
+	for i, e := range pool.entries {
+		if e.Session == session {
+			pool.entries = append(pool.entries[:i:i], pool.entries[i+1:]...)
+			break
+		}
+	}
+	if len(pool.entries) > 0 {
+		return false
+	}
+	delete(r.pools, hostname)
+	return true
+}
+
+// markLost remembers that hostname just lost its last session and forgets
+// hostnames lost long ago. Callers hold r.mu.
+func (r *TunnelRegistry) markLost(hostname string) {
+	now := time.Now()
+	for h, at := range r.lost {
+		if now.Sub(at) > lostRetention {
+			delete(r.lost, h)
+		}
+	}
+	r.lost[hostname] = now
+}
+
+// LostWithin reports whether hostname has no sessions because its last one
+// went away less than d ago, e.g. while its client reconnects.
+func (r *TunnelRegistry) LostWithin(hostname string, d time.Duration) bool {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
-	entry, ok := r.sessions[hostname]
+	at, ok := r.lost[hostname]
+	return ok && time.Since(at) <= d
+}
+
+// HasLiveSession reports whether a session serving hostname accepts new
+// streams. Unlike Entries it leaves the balancing untouched.
+func (r *TunnelRegistry) HasLiveSession(hostname string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	pool, ok := r.pools[hostname]
+	if !ok {
+		return false
+	}
+	for _, e := range pool.entries {
+		if r.live(e) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetSession returns the session for a given hostname (for backward compatibility).
+func (r *TunnelRegistry) GetSession(hostname string) (transport.Session, bool) {
+	entry, ok := r.GetEntry(hostname)
 	if !ok {
 		return nil, false
 	}
 	return entry.Session, true
 }
 
-// GetEntry returns the full tunnel entry for a given hostname.
+// GetEntry returns the tunnel entry that should serve the next request for
+// hostname. Shared hostnames are balanced across their live sessions.
 func (r *TunnelRegistry) GetEntry(hostname string) (*TunnelEntry, bool) {
+	entries := r.Entries(hostname)
+	if len(entries) == 0 {
+		return nil, false
+	}
+	return entries[0], true
+}
+
+// Entries returns every session serving hostname in the order they should be
+// tried: the balanced pick first, then the other live sessions as failover,
+// then draining and closed ones (e.g. reserved for resumption).
+func (r *TunnelRegistry) Entries(hostname string) []*TunnelEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	pool, ok := r.pools[hostname]
+	if !ok {
+		return nil
+	}
+
+	var live, closed []*TunnelEntry
+	for _, e := range pool.entries {
+		if r.live(e) {
+			live = append(live, e)
+		} else {
+			closed = append(closed, e)
+		}
+	}
+	if len(live) > 1 {
+		first := 0
+		if r.Balance == BalanceLeastStreams {
+			for i, e := range live {
+				if e.Session.NumStreams() < live[first].Session.NumStreams() {
+					first = i
+				}
+			}
+		} else {
+			first = pool.next % len(live)
+			pool.next++
+		}
+		rotated := make([]*TunnelEntry, 0, len(live))
+		rotated = append(rotated, live[first:]...)
+		live = append(rotated, live[:first]...)
+	}
+	return append(live, closed...)
+}
+
+// SetControl associates a control channel with a session.
+func (r *TunnelRegistry) SetControl(session transport.Session, ctrl *ControlChannel) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.controls[session] = ctrl
+}
+
+// RemoveControl forgets the control channel, drain mark and stream header
+// support of a closed session.
+func (r *TunnelRegistry) RemoveControl(session transport.Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.controls, session)
+	delete(r.draining, session)
+	delete(r.headers, session)
+}
+
+// SetStreamHeaders records that the client of session reads a StreamHeader
+// at the start of HTTP streams.
+func (r *TunnelRegistry) SetStreamHeaders(session transport.Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.headers[session] = true
+}
+
+// StreamHeaders reports whether HTTP streams to session start with a StreamHeader.
+func (r *TunnelRegistry) StreamHeaders(session transport.Session) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.headers[session]
+}
+
+// Drain marks a session as going away: it keeps its hostnames and in-flight
+// streams, but new requests go to other sessions or get 503.
+func (r *TunnelRegistry) Drain(session transport.Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.draining[session] = true
+}
+
+// IsAvailable reports whether new streams may be opened to the session of entry.
+func (r *TunnelRegistry) IsAvailable(entry *TunnelEntry) bool {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
-	entry, ok := r.sessions[hostname]
-	return entry, ok
+	return r.live(entry)
+}
+
+// live reports whether entry has a session that accepts new streams. The
+// caller holds r.mu.
+func (r *TunnelRegistry) live(entry *TunnelEntry) bool {
+	return entry.Session != nil && !entry.Session.IsClosed() && !r.draining[entry.Session]
+}
+
+// Control returns the control channel of a session. Clients that predate
+// the control stream have none.
+func (r *TunnelRegistry) Control(session transport.Session) (*ControlChannel, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ctrl, ok := r.controls[session]
+	return ctrl, ok
+}
+
+// Controls returns all registered control channels.
+func (r *TunnelRegistry) Controls() []*ControlChannel {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	controls := make([]*ControlChannel, 0, len(r.controls))
+	for _, ctrl := range r.controls {
+		controls = append(controls, ctrl)
+	}
+	return controls
 }
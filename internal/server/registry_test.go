@@ -1,17 +1,19 @@
 package server
 
 import (
+	"errors"
 	"sync"
 	"testing"
+	"time"
 
-	"github.com/hashicorp/yamux"
+	"gopublic/internal/transport"
 )
 
 func TestTunnelRegistry_RegisterUnregister(t *testing.T) {
 	registry := NewTunnelRegistry()
 
 	// Use nil session for basic registry operations
-	var session *yamux.Session = nil
+	var session transport.Session
 
 	// Register with userID
 	registry.Register("test.example.com", session, 1, false)
@@ -116,3 +118,166 @@ func TestTunnelRegistry_MultipleHosts(t *testing.T) {
 		t.Error("Expected a.example.com to still be registered")
 	}
 }
+
+func TestTunnelRegistry_Passthrough(t *testing.T) {
+	registry := NewTunnelRegistry()
+
+	registry.Register("http.example.com", nil, 1, false)
+	registry.RegisterEntry("tls.example.com", &TunnelEntry{UserID: 1, Passthrough: true})
+
+	if entry, ok := registry.GetEntry("http.example.com"); !ok || entry.Passthrough {
+		t.Errorf("Expected http.example.com not to be passthrough: %+v", entry)
+	}
+
+	entry, ok := registry.GetEntry("tls.example.com")
+	if !ok || !entry.Passthrough || entry.UserID != 1 {
+		t.Errorf("Unexpected entry: %+v", entry)
+	}
+}
+
+func TestTunnelRegistry_SharedPool(t *testing.T) {
+	first, _ := yamuxPair(t)
+	second, _ := yamuxPair(t)
+	registry := NewTunnelRegistry()
+
+	registry.JoinPool("app.example.com", &TunnelEntry{Session: first, UserID: 1})
+	registry.JoinPool("app.example.com", &TunnelEntry{Session: second, UserID: 1})
+
+	// Round robin alternates between the live sessions
+	picks := map[transport.Session]int{}
+	for i := 0; i < 4; i++ {
+		entry, ok := registry.GetEntry("app.example.com")
+		if !ok {
+			t.Fatal("shared host not found")
+		}
+		picks[entry.Session]++
+	}
+	if picks[first] != 2 || picks[second] != 2 {
+		t.Errorf("round robin picks = %v, want 2 each", picks)
+	}
+
+	// A closed session is only tried after the live ones
+	first.Close()
+	entries := registry.Entries("app.example.com")
+	if len(entries) != 2 || entries[0].Session != second {
+		t.Errorf("closed session not moved to the end: %+v", entries)
+	}
+
+	registry.UnregisterSession("app.example.com", second)
+	if entry, ok := registry.GetEntry("app.example.com"); !ok || entry.Session != first {
+		t.Error("UnregisterSession removed the whole pool")
+	}
+
+	// Register replaces the pool with a single session
+	registry.Register("app.example.com", second, 1, false)
+	if entries := registry.Entries("app.example.com"); len(entries) != 1 || entries[0].Shared {
+		t.Errorf("Register did not replace the pool: %+v", entries)
+	}
+}
+
+func TestTunnelRegistry_LeastStreams(t *testing.T) {
+	busy, busyClient := yamuxPair(t)
+	idle, _ := yamuxPair(t)
+	registry := NewTunnelRegistry()
+	registry.Balance = BalanceLeastStreams
+
+	registry.JoinPool("app.example.com", &TunnelEntry{Session: busy, UserID: 1})
+	registry.JoinPool("app.example.com", &TunnelEntry{Session: idle, UserID: 1})
+
+	stream, err := busyClient.Open()
+	if err != nil {
+		t.Fatalf("open stream: %v", err)
+	}
+	defer stream.Close()
+
+	for i := 0; i < 3; i++ {
+		if entry, _ := registry.GetEntry("app.example.com"); entry.Session != idle {
+			t.Fatal("least_streams picked the busy session")
+		}
+	}
+}
+
+func TestTunnelRegistry_NilSessionNotLive(t *testing.T) {
+	live, _ := yamuxPair(t)
+	registry := NewTunnelRegistry()
+	registry.Balance = BalanceLeastStreams
+
+	registry.JoinPool("app.example.com", &TunnelEntry{UserID: 1})
+	if registry.HasLiveSession("app.example.com") {
+		t.Error("entry without a session reported as live")
+	}
+
+	registry.JoinPool("app.example.com", &TunnelEntry{Session: live, UserID: 1})
+	entries := registry.Entries("app.example.com")
+	if len(entries) != 2 || entries[0].Session != live {
+		t.Errorf("Entries() = %+v, want the live session first", entries)
+	}
+	if registry.IsAvailable(entries[1]) {
+		t.Error("entry without a session reported as available")
+	}
+}
+
+func TestTunnelRegistry_LostWithin(t *testing.T) {
+	session, _ := yamuxPair(t)
+	registry := NewTunnelRegistry()
+	if registry.LostWithin("app.example.com", time.Minute) {
+		t.Error("a hostname never served counts as lost")
+	}
+
+	registry.Register("app.example.com", session, 1, false)
+	if !registry.HasLiveSession("app.example.com") {
+		t.Error("HasLiveSession() = false for a live session")
+	}
+	session.Close()
+	if registry.HasLiveSession("app.example.com") {
+		t.Error("HasLiveSession() = true for a closed session")
+	}
+
+	// A session that is let go on purpose is not expected back
+	registry.UnregisterSession("app.example.com", session)
+	if registry.LostWithin("app.example.com", time.Minute) {
+		t.Error("LostWithin() = true after the session was unregistered on purpose")
+	}
+
+	registry.Register("app.example.com", session, 1, false)
+	registry.LoseSession("app.example.com", session)
+	if !registry.LostWithin("app.example.com", time.Minute) {
+		t.Error("LostWithin() = false right after the last session went away")
+	}
+	if registry.LostWithin("app.example.com", 0) {
+		t.Error("LostWithin(0) = true")
+	}
+
+	// Coming back clears it
+	second, _ := yamuxPair(t)
+	registry.JoinPool("app.example.com", &TunnelEntry{Session: second, UserID: 1})
+	if registry.LostWithin("app.example.com", time.Minute) {
+		t.Error("LostWithin() = true once a session serves the hostname again")
+	}
+}
+
+func TestTunnelRegistry_JoinPoolPassthroughConflict(t *testing.T) {
+	httpSession, _ := yamuxPair(t)
+	tlsSession, _ := yamuxPair(t)
+	registry := NewTunnelRegistry()
+
+	if err := registry.JoinPool("app.example.com", &TunnelEntry{Session: httpSession, UserID: 1}); err != nil {
+		t.Fatalf("JoinPool() error = %v", err)
+	}
+	err := registry.JoinPool("app.example.com", &TunnelEntry{Session: tlsSession, UserID: 1, Passthrough: true})
+	if !errors.Is(err, ErrPassthroughConflict) {
+		t.Fatalf("JoinPool() error = %v, want ErrPassthroughConflict", err)
+	}
+	if entries := registry.Entries("app.example.com"); len(entries) != 1 || entries[0].Session != httpSession {
+		t.Errorf("conflicting JoinPool changed the pool: %+v", entries)
+	}
+
+	// Once the other mode has no live session the hostname can switch
+	httpSession.Close()
+	if err := registry.JoinPool("app.example.com", &TunnelEntry{Session: tlsSession, UserID: 1, Passthrough: true}); err != nil {
+		t.Fatalf("JoinPool() after the session closed: %v", err)
+	}
+	if entries := registry.Entries("app.example.com"); len(entries) != 1 || !entries[0].Passthrough {
+		t.Errorf("Entries() = %+v, want only the passthrough session", entries)
+	}
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+
+	"gopublic/internal/transport"
+)
+
+// reservation keeps the domains of a session that negotiated resume. Once the
+// session is lost they stay registered to it until the grace period expires
+// or a new session presents the token.
+type reservation struct {
+	token    string
+	userID   uint
+	session  transport.Session
+	bindings *sessionBindings
+	timer    *time.Timer // Set once the session is lost
+}
+
+// resumeStore tracks the reservations of all sessions. The zero value is ready to use.
+type resumeStore struct {
+	mu        sync.Mutex
+	byToken   map[string]*reservation
+	bySession map[transport.Session]*reservation
+}
+
+// issue creates a reservation for a live session and returns its token.
+func (rs *resumeStore) issue(userID uint, session transport.Session, bindings *sessionBindings) string {
+	buf := make([]byte, 32)
+	rand.Read(buf)
+	res := &reservation{
+		token:    hex.EncodeToString(buf),
+		userID:   userID,
+		session:  session,
+		bindings: bindings,
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.byToken == nil {
+		rs.byToken = make(map[string]*reservation)
+		rs.bySession = make(map[transport.Session]*reservation)
+	}
+	rs.byToken[res.token] = res
+	rs.bySession[session] = res
+	return res.token
+}
+
+// hold starts the grace period of a lost session and calls expire if nobody
+// resumes it in time. It reports whether the session had a reservation.
+func (rs *resumeStore) hold(session transport.Session, grace time.Duration, expire func()) bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	res, ok := rs.bySession[session]
+	if !ok {
+		return false
+	}
+	res.timer = time.AfterFunc(grace, func() {
+		rs.mu.Lock()
+		current := rs.byToken[res.token] == res
+		if current {
+			rs.remove(res)
+		}
+		rs.mu.Unlock()
+		if current {
+			expire()
+		}
+	})
+	return true
+}
+
+// forget drops the reservation of a live session, so its domains are
+// released as soon as it closes.
+func (rs *resumeStore) forget(session transport.Session) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if res, ok := rs.bySession[session]; ok {
+		rs.remove(res)
+	}
+}
+
+// peek returns the reservation for token if it belongs to userID, leaving it
+// in place.
+func (rs *resumeStore) peek(token string, userID uint) *reservation {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	res, ok := rs.byToken[token]
+	if !ok || res.userID != userID {
+		return nil
+	}
+	return res
+}
+
+// take claims the reservation for token if it belongs to userID.
+func (rs *resumeStore) take(token string, userID uint) *reservation {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	res, ok := rs.byToken[token]
+	if !ok || res.userID != userID {
+		return nil
+	}
+	if res.timer != nil {
+		res.timer.Stop()
+	}
+	rs.remove(res)
+	return res
+}
+
+// reserved reports whether a lost session still holds its domains.
+func (rs *resumeStore) reserved(session transport.Session) bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	_, ok := rs.bySession[session]
+	return ok
+}
+
+// remove deletes res from both indexes. The caller holds rs.mu.
+func (rs *resumeStore) remove(res *reservation) {
+	delete(rs.byToken, res.token)
+	delete(rs.bySession, res.session)
+}
+
+// hostnames returns the HTTP and TLS passthrough domains res keeps reserved.
+func (res *reservation) hostnames() (domains, tlsDomains []string) {
+	res.bindings.mu.Lock()
+	defer res.bindings.mu.Unlock()
+	domains = append(domains, res.bindings.domains...)
+	tlsDomains = append(tlsDomains, res.bindings.tlsDomains...)
+	return domains, tlsDomains
+}
+
+// resumeBindings moves the domains reserved by res to session. Domains the
+// user no longer owns, e.g. a custom domain another user verified while the
+// client was away, are released instead. The caller holds bindMu.
+func (s *Server) resumeBindings(res *reservation, session transport.Session, bandwidthExempt bool, access map[string]*TunnelAccess) (domains, tlsDomains []string) {
+	reservedDomains, reservedTLS := res.hostnames()
+	delete(s.bound, res.session)
+
+	move := func(d string, passthrough bool, access *TunnelAccess) bool {
+		if d != res.bindings.ephemeral && !s.stillOwns(d, res.userID) {
+			log.Printf("Domain %s is no longer owned by user %d, not resuming it", d, res.userID)
+			s.unregisterDomain(d, res.session, false)
+			return false
+		}
+		s.Registry.UnregisterSession(d, res.session)
+		if err := s.registerDomain(d, session, res.userID, bandwidthExempt, passthrough, res.bindings.shared, access); err != nil {
+			log.Printf("Domain %s could not be resumed: %v", d, err)
+			return false
+		}
+		return true
+	}
+	for _, d := range reservedDomains {
+		if move(d, false, access[d]) {
+			domains = append(domains, d)
+		}
+	}
+	for _, d := range reservedTLS {
+		if move(d, true, nil) {
+			tlsDomains = append(tlsDomains, d)
+		}
+	}
+
+	// The old session may not have noticed the network loss yet
+	if !res.session.IsClosed() {
+		res.session.Close()
+	}
+	log.Printf("Resumed session for user %d: %d domains, %d TLS domains", res.userID, len(domains), len(tlsDomains))
+	return domains, tlsDomains
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopublic/internal/models"
+	"gopublic/internal/storage"
+	"gopublic/pkg/protocol"
+)
+
+func TestResumeStore_TakeStopsExpiry(t *testing.T) {
+	session, _ := yamuxPair(t)
+	var rs resumeStore
+	bindings := &sessionBindings{domains: []string{"app.example.com"}}
+
+	token := rs.issue(1, session, bindings)
+	expired := make(chan struct{}, 1)
+	if !rs.hold(session, 50*time.Millisecond, func() { expired <- struct{}{} }) {
+		t.Fatal("hold() found no reservation for the session")
+	}
+	if !rs.reserved(session) {
+		t.Error("session not reserved during grace period")
+	}
+
+	if res := rs.take(token, 2); res != nil {
+		t.Error("another user took the reservation")
+	}
+	res := rs.take(token, 1)
+	if res == nil || res.bindings != bindings {
+		t.Fatalf("take() = %+v, want the reservation", res)
+	}
+	if rs.take(token, 1) != nil {
+		t.Error("token accepted twice")
+	}
+
+	select {
+	case <-expired:
+		t.Error("grace period expired after the session was resumed")
+	case <-time.After(150 * time.Millisecond):
+	}
+}
+
+func TestResumeStore_ExpiresAfterGrace(t *testing.T) {
+	session, _ := yamuxPair(t)
+	var rs resumeStore
+
+	token := rs.issue(1, session, &sessionBindings{})
+	expired := make(chan struct{})
+	rs.hold(session, 10*time.Millisecond, func() { close(expired) })
+
+	select {
+	case <-expired:
+	case <-time.After(time.Second):
+		t.Fatal("grace period never expired")
+	}
+	if rs.reserved(session) || rs.take(token, 1) != nil {
+		t.Error("reservation still present after expiry")
+	}
+}
+
+func TestResumeBindings_MovesDomainsToNewSession(t *testing.T) {
+	if err := storage.InitDB(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatalf("InitDB: %v", err)
+	}
+	for _, name := range []string{"app", "db"} {
+		if err := storage.DB.Create(&models.Domain{Name: name, UserID: 1}).Error; err != nil {
+			t.Fatalf("create domain %s: %v", name, err)
+		}
+	}
+	oldSession, _ := yamuxPair(t)
+	newSession, _ := yamuxPair(t)
+
+	s := &Server{Registry: NewTunnelRegistry(), RootDomain: "example.com", ResumeGrace: time.Minute}
+	bindings := &sessionBindings{domains: []string{"app.example.com", "dev.example.org"}, tlsDomains: []string{"db.example.com"}}
+	s.Registry.Register("app.example.com", oldSession, 1, false)
+	s.Registry.Register("dev.example.org", oldSession, 1, false)
+	s.Registry.RegisterEntry("db.example.com", &TunnelEntry{Session: oldSession, UserID: 1, Passthrough: true})
+	token := s.resumes.issue(1, oldSession, bindings)
+
+	oldSession.Close()
+	s.resumes.hold(oldSession, time.Minute, func() {})
+	if s.domainHolder("app.example.com", newSession, 1, false) == nil {
+		t.Fatal("reserved domain reported as free")
+	}
+
+	domains, tlsDomains := s.resumeBindings(s.resumes.take(token, 1), newSession, false, nil)
+	if len(domains) != 1 || len(tlsDomains) != 1 {
+		t.Fatalf("resumed %v and %v, want one of each", domains, tlsDomains)
+	}
+	// The custom domain isn't verified for the user (any more)
+	if _, ok := s.Registry.GetEntry("dev.example.org"); ok {
+		t.Error("custom domain the user doesn't own was kept")
+	}
+	entry, ok := s.Registry.GetEntry("db.example.com")
+	if !ok || entry.Session != newSession || !entry.Passthrough {
+		t.Errorf("passthrough domain not moved: %+v", entry)
+	}
+	if got := s.notResumed([]string{"app", "api"}, domains); len(got) != 1 || got[0] != "api" {
+		t.Errorf("notResumed() = %v, want [api]", got)
+	}
+}
+
+func TestProcessTunnelRequest_ConflictKeepsReservation(t *testing.T) {
+	oldSession, _ := yamuxPair(t)
+	otherSession, _ := yamuxPair(t)
+	newSession, _ := yamuxPair(t)
+
+	s := &Server{Registry: NewTunnelRegistry(), UserSessions: NewUserSessionRegistry(), RootDomain: "example.com", ResumeGrace: time.Minute}
+	s.Registry.Register("app.example.com", oldSession, 1, false)
+	token := s.resumes.issue(1, oldSession, &sessionBindings{domains: []string{"app.example.com"}})
+	oldSession.Close()
+	s.resumes.hold(oldSession, time.Minute, func() {})
+	s.Registry.Register("api.example.com", otherSession, 1, false)
+
+	// The client resumes app but also asks for api, which another agent serves
+	stream, server := net.Pipe()
+	defer stream.Close()
+	go io.Copy(io.Discard, server)
+	req, _ := json.Marshal(protocol.TunnelRequest{RequestedDomains: []string{"app", "api"}})
+	decoder := json.NewDecoder(bytes.NewReader(req))
+
+	user := &models.User{}
+	user.ID = 1
+	_, err := s.processTunnelRequest(decoder, stream, newSession, user, "test", false, &protocol.AuthRequest{ResumeToken: token})
+	if !errors.Is(err, errDomainInUse) {
+		t.Fatalf("processTunnelRequest() error = %v, want errDomainInUse", err)
+	}
+	if !s.resumes.reserved(oldSession) {
+		t.Error("rejected client used up the reservation")
+	}
+	if entry, ok := s.Registry.GetEntry("app.example.com"); !ok || entry.Session != oldSession {
+		t.Errorf("reserved domain moved to the rejected session: %+v", entry)
+	}
+}
@@ -3,8 +3,10 @@ package server
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net"
 	"os"
@@ -14,11 +16,14 @@ import (
 
 	"github.com/hashicorp/yamux"
 
+	"gopublic/internal/cluster"
 	"gopublic/internal/config"
 	"gopublic/internal/metrics"
 	"gopublic/internal/models"
 	"gopublic/internal/sentry"
 	"gopublic/internal/storage"
+	"gopublic/internal/transport"
+	"gopublic/internal/version"
 	"gopublic/pkg/protocol"
 )
 
@@ -31,10 +36,14 @@ type Server struct {
 	TLSConfig    *tls.Config
 	RootDomain   string // Root domain for FQDN generation
 
-	listener net.Listener
-	wg       sync.WaitGroup
-	ctx      context.Context
-	cancel   context.CancelFunc
+	// QUIC also accepts clients over QUIC on the UDP port of Port (needs TLSConfig)
+	QUIC bool
+
+	listener     net.Listener
+	quicListener *transport.QUICListener
+	wg           sync.WaitGroup
+	ctx          context.Context
+	cancel       context.CancelFunc
 
 	// MaxConnections limits concurrent connections (0 = unlimited)
 	MaxConnections int
@@ -43,27 +52,91 @@ type Server struct {
 	// DailyBandwidthLimit is the daily bandwidth limit per user in bytes
 	DailyBandwidthLimit int64
 
+	// PublicPorts hands out public ports for TCP and UDP tunnels and
+	// enforces the per-user port limit (nil = disabled)
+	PublicPorts *PortPool
+	// UDPMaxFlows limits the remote addresses one UDP tunnel serves at once (0 = unlimited)
+	UDPMaxFlows int
+
+	// bindMu serializes runtime bind/release so TunnelRegistry and
+	// UserSessions always agree on a session's domains.
+	bindMu sync.Mutex
+	// bound holds the bindings of every session whose domains are
+	// registered, live or reserved for resuming. Guarded by bindMu.
+	bound map[transport.Session]*sessionBindings
+
+	// MinClientVersion rejects older CLI releases during the handshake (empty = any)
+	MinClientVersion string
+
+	// DrainReconnect is how long clients of a shutting down server wait before reconnecting
+	DrainReconnect time.Duration
+
+	// SessionPolicy limits every client session unless its user has overrides
+	SessionPolicy SessionPolicy
+
+	// ResumeGrace keeps a lost session's domains reserved for its resume token (0 = off)
+	ResumeGrace time.Duration
+	resumes     resumeStore
+
+	// OIDCLogin allows login walls that sign visitors in with the OIDC provider
+	OIDCLogin bool
+
+	// Cluster shares domain ownership with other server nodes (nil = single node)
+	Cluster *cluster.Node
+
 	// AdminTelegramID identifies admin user (no bandwidth limits).
 	AdminTelegramID int64
 
 	// AppMetrics tracks tunnel connection metrics.
 	AppMetrics *metrics.AppMetrics
+
+	// Alerts tells the operator when an IP is banned for guessing tokens (nil = log only)
+	Alerts AdminNotifier
+
+	// authGuard limits failed token attempts (nil = unlimited)
+	authGuard *authGuard
+}
+
+// AdminNotifier sends security alerts to the operator.
+type AdminNotifier interface {
+	NotifyAdmin(text string)
 }
 
 // NewServerWithConfig creates a new server with the given configuration.
 func NewServerWithConfig(cfg *config.Config, registry *TunnelRegistry, tlsConfig *tls.Config) *Server {
 	ctx, cancel := context.WithCancel(context.Background())
+	var publicPorts *PortPool
+	if cfg.HasPublicPorts() {
+		publicPorts = NewPortPool(cfg.PublicPortMin, cfg.PublicPortMax, cfg.PublicPortsPerUser)
+	}
 	return &Server{
 		Registry:            registry,
 		UserSessions:        NewUserSessionRegistry(),
 		Port:                cfg.ControlPlanePort,
 		TLSConfig:           tlsConfig,
 		RootDomain:          cfg.Domain,
+		QUIC:                cfg.QUICEnabled,
+		OIDCLogin:           cfg.HasOIDC(),
 		ctx:                 ctx,
 		cancel:              cancel,
 		MaxConnections:      cfg.MaxConnections,
 		DailyBandwidthLimit: cfg.DailyBandwidthLimit,
+		PublicPorts:         publicPorts,
+		UDPMaxFlows:         cfg.UDPMaxFlows,
+		MinClientVersion:    cfg.MinClientVersion,
+		ResumeGrace:         time.Duration(cfg.ResumeGraceSecs) * time.Second,
+		DrainReconnect:      time.Duration(cfg.DrainReconnectSecs) * time.Second,
 		AdminTelegramID:     cfg.AdminTelegramID,
+		SessionPolicy: SessionPolicy{
+			MaxDuration: time.Duration(cfg.SessionMaxMinutes) * time.Minute,
+			IdleTimeout: time.Duration(cfg.SessionIdleMinutes) * time.Minute,
+			MaxStreams:  cfg.SessionMaxStreams,
+		},
+		authGuard: newAuthGuard(AuthLimits{
+			MaxFailures:       cfg.AuthMaxFailures,
+			BanDuration:       time.Duration(cfg.AuthBanSecs) * time.Second,
+			GlobalMaxFailures: cfg.AuthGlobalMaxFailures,
+		}),
 	}
 }
 
@@ -100,7 +173,20 @@ func (s *Server) Start() error {
 		s.connSem = make(chan struct{}, s.MaxConnections)
 	}
 
-	log.Printf("Control Plane listening on %s (TLS=%v, MaxConn=%d)", s.Port, s.TLSConfig != nil, s.MaxConnections)
+	if s.QUIC {
+		if s.TLSConfig == nil {
+			log.Println("Control Plane: QUIC needs TLS, accepting TCP clients only")
+		} else {
+			s.quicListener, err = transport.ListenQUIC(s.Port, s.TLSConfig)
+			if err != nil {
+				s.listener.Close()
+				return err
+			}
+			go s.serveQUIC()
+		}
+	}
+
+	log.Printf("Control Plane listening on %s (TLS=%v, QUIC=%v, MaxConn=%d)", s.Port, s.TLSConfig != nil, s.quicListener != nil, s.MaxConnections)
 
 	for {
 		// Check if we're shutting down
@@ -132,33 +218,73 @@ func (s *Server) Start() error {
 			return err
 		}
 
-		// Acquire semaphore slot (rate limiting)
-		if s.connSem != nil {
-			select {
-			case s.connSem <- struct{}{}:
-				// Got slot, proceed
-			case <-s.ctx.Done():
-				conn.Close()
-				return nil
+		if !s.runConnection(func() { s.handleTCPConn(conn) }) {
+			conn.Close()
+			return nil
+		}
+	}
+}
+
+// serveQUIC accepts QUIC sessions until the QUIC listener is closed.
+func (s *Server) serveQUIC() {
+	for {
+		session, err := s.quicListener.Accept(s.ctx)
+		if err != nil {
+			if s.ctx.Err() == nil {
+				log.Printf("Control Plane: QUIC accept failed: %v", err)
 			}
+			return
+		}
+		if !s.runConnection(func() { s.handleConnection(session, transport.PeerCertificate(session)) }) {
+			session.Close()
+			return
 		}
+	}
+}
 
-		s.wg.Add(1)
-		go func(c net.Conn) {
-			defer s.wg.Done()
-			defer func() {
-				if s.connSem != nil {
-					<-s.connSem // Release semaphore slot
-				}
-			}()
-			defer func() {
-				if r := recover(); r != nil {
-					log.Printf("Panic recovered in handleConnection: %v", r)
-				}
-			}()
-			s.handleConnection(c)
-		}(conn)
+// ServeConn runs the control plane on a connection accepted elsewhere, such
+// as a WebSocket on the public ingress. It blocks until the session ends.
+func (s *Server) ServeConn(conn net.Conn) {
+	done := make(chan struct{})
+	if !s.runConnection(func() {
+		defer close(done)
+		s.handleTCPConn(conn)
+	}) {
+		conn.Close()
+		return
 	}
+	<-done
+}
+
+// runConnection handles a client connection in its own goroutine once a
+// connection slot is free. It returns false if the server shut down first.
+func (s *Server) runConnection(handle func()) bool {
+	// Acquire semaphore slot (rate limiting)
+	if s.connSem != nil {
+		select {
+		case s.connSem <- struct{}{}:
+			// Got slot, proceed
+		case <-s.ctx.Done():
+			return false
+		}
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer func() {
+			if s.connSem != nil {
+				<-s.connSem // Release semaphore slot
+			}
+		}()
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("Panic recovered in handleConnection: %v", r)
+			}
+		}()
+		handle()
+	}()
+	return true
 }
 
 // Shutdown gracefully stops the server.
@@ -169,13 +295,22 @@ func (s *Server) Shutdown(ctx context.Context) error {
 
 	// Signal all goroutines to stop
 	s.cancel()
+	s.authGuard.stop()
 
-	// Close listener to stop accepting new connections
+	// Close listeners to stop accepting new connections
 	if s.listener != nil {
 		if err := s.listener.Close(); err != nil {
 			log.Printf("Error closing listener: %v", err)
 		}
 	}
+	if s.quicListener != nil {
+		if err := s.quicListener.Close(); err != nil {
+			log.Printf("Error closing QUIC listener: %v", err)
+		}
+	}
+
+	// Tell connected clients when to come back and let in-flight streams finish
+	s.drainSessions(ctx)
 
 	// Wait for active connections with timeout
 	done := make(chan struct{})
@@ -194,21 +329,47 @@ func (s *Server) Shutdown(ctx context.Context) error {
 	}
 }
 
-// handleConnection processes a new client connection through the handshake protocol.
-func (s *Server) handleConnection(conn net.Conn) {
-	log.Printf("New connection from %s", conn.RemoteAddr())
+// handleTCPConn runs a client connection over TCP (or TLS) as a yamux session.
+func (s *Server) handleTCPConn(conn net.Conn) {
+	clientCert, err := peerCertificate(conn)
+	if err != nil {
+		// Scanners and clients that don't trust the certificate end up here
+		conn.Close()
+		log.Printf("WARN: TLS handshake with %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+	session, err := yamux.Server(conn, nil)
+	if err != nil {
+		conn.Close()
+		sentry.CaptureErrorf(err, "Session setup failed for %s", conn.RemoteAddr())
+		return
+	}
+	log.Printf("Yamux session established for %s", conn.RemoteAddr())
+	s.handleConnection(session, clientCert)
+}
 
-	// 1. Setup yamux session
-	session, stream, err := s.setupYamuxSession(conn)
+// handleConnection processes a new client session of either transport
+// through the handshake protocol. clientCert is the device certificate the
+// client presented during the TLS handshake, if any.
+func (s *Server) handleConnection(conn transport.Session, clientCert *x509.Certificate) {
+	// Everything below sees the session through the policy wrapper, so
+	// streams opened by the ingress and tunnels count toward its limits
+	policySession := newPolicySession(conn)
+	var session transport.Session = policySession
+	remoteAddr := session.RemoteAddr()
+	log.Printf("New connection from %s", remoteAddr)
+
+	// 1. Accept the handshake stream
+	stream, err := s.acceptHandshake(session)
 	if err != nil {
 		// "invalid protocol version" means the peer did not speak the yamux protocol at all.
 		// This is expected noise from port scanners and outdated CLI clients (built before
 		// yamux was introduced). Log as a warning and skip Sentry to avoid alert fatigue.
 		if strings.Contains(err.Error(), "invalid protocol version") {
-			log.Printf("WARN: rejected connection from %s: incompatible protocol (scanner or outdated client)", conn.RemoteAddr())
+			log.Printf("WARN: rejected connection from %s: incompatible protocol (scanner or outdated client)", remoteAddr)
 			return
 		}
-		sentry.CaptureErrorf(err, "Session setup failed for %s", conn.RemoteAddr())
+		sentry.CaptureErrorf(err, "Session setup failed for %s", remoteAddr)
 		return
 	}
 
@@ -216,9 +377,15 @@ func (s *Server) handleConnection(conn net.Conn) {
 	decoder := json.NewDecoder(stream)
 
 	// 2. Authenticate client
-	user, force, err := s.authenticate(decoder, stream, conn.RemoteAddr().String())
+	user, device, authReq, err := s.authenticate(decoder, stream, remoteAddr.String(), clientCert)
+	if errors.Is(err, errIncompatibleClient) || errors.Is(err, errAuthBanned) || errors.Is(err, errAuthThrottled) {
+		// Outdated CLIs and throttled guessers are expected; no need for Sentry
+		log.Printf("WARN: rejected connection from %s: %v", remoteAddr, err)
+		session.Close()
+		return
+	}
 	if err != nil {
-		sentry.CaptureErrorf(err, "Authentication failed for %s", conn.RemoteAddr())
+		sentry.CaptureErrorf(err, "Authentication failed for %s", remoteAddr)
 		if s.AppMetrics != nil {
 			s.AppMetrics.TunnelError()
 		}
@@ -226,35 +393,33 @@ func (s *Server) handleConnection(conn net.Conn) {
 		return
 	}
 
-	// 3. Check for existing session
-	if existingSession, exists := s.UserSessions.GetSession(user.ID); exists {
-		if !force {
-			// Reject connection - user already has active session
-			log.Printf("User %d already connected, rejecting new connection (use force=true to override)", user.ID)
-			s.sendErrorWithCode(stream, "You already have an active tunnel session. Use --force to disconnect the existing session.", protocol.ErrorCodeAlreadyConnected)
-			session.Close()
-			return
-		}
-
-		// Force mode: disconnect old session
-		log.Printf("Force disconnect: closing existing session for user %d", user.ID)
-		// Unregister old domains first
-		for _, domain := range existingSession.Domains {
-			s.Registry.Unregister(domain)
-		}
-		existingSession.Session.Close()
-		s.UserSessions.Unregister(user.ID)
-	}
-
 	isAdmin := false
 	if s.AdminTelegramID != 0 && user.TelegramID != nil && *user.TelegramID == s.AdminTelegramID {
 		isAdmin = true
 	}
 
-	// 4. Process tunnel request and bind domains
-	boundDomains, err := s.processTunnelRequest(decoder, stream, session, user, conn.RemoteAddr().String(), isAdmin)
+	// Clients that read typed streams learn the visitor of HTTP requests too;
+	// set before binding so the first routed request already carries it
+	if protocol.HasCapability(authReq.Capabilities, protocol.CapabilityStreamHeader) {
+		s.Registry.SetStreamHeaders(session)
+	}
+
+	policy := s.policyFor(user)
+	policySession.setMaxStreams(policy.MaxStreams)
+
+	// 3. Process tunnel request and bind domains
+	bindings, err := s.processTunnelRequest(decoder, stream, session, user, remoteAddr.String(), isAdmin, authReq)
 	if err != nil {
-		sentry.CaptureErrorf(err, "Tunnel request failed for %s", conn.RemoteAddr())
+		s.Registry.RemoveControl(session)
+	}
+	if errors.Is(err, errDomainInUse) {
+		// Another agent of the same user serves the domain; the client was told which one
+		log.Printf("WARN: rejected connection from %s: %v", remoteAddr, err)
+		session.Close()
+		return
+	}
+	if err != nil {
+		sentry.CaptureErrorf(err, "Tunnel request failed for %s", remoteAddr)
 		if s.AppMetrics != nil {
 			s.AppMetrics.TunnelError()
 		}
@@ -262,76 +427,198 @@ func (s *Server) handleConnection(conn net.Conn) {
 		return
 	}
 
-	// 5. Register user session
-	s.UserSessions.Register(user.ID, session, boundDomains)
+	// 4. Register user session next to the user's other agents
+	s.UserSessions.Register(user.ID, session, remoteAddr.String(), bindings.allDomains())
+	if device != nil {
+		s.UserSessions.SetDevice(user.ID, session, device.ID, device.Name)
+	}
 
 	// Track tunnel connection in metrics
 	if s.AppMetrics != nil {
 		s.AppMetrics.TunnelConnected()
 	}
 
-	// 6. Send success response
-	if err := s.sendSuccessResponse(stream, boundDomains, user.ID, isAdmin); err != nil {
-		sentry.CaptureErrorf(err, "Failed to send success response to %s", conn.RemoteAddr())
+	// 5. Send success response with a resume token for clients that can use it
+	var resumeToken string
+	if s.ResumeGrace > 0 && protocol.HasCapability(authReq.Capabilities, protocol.CapabilityResume) {
+		resumeToken = s.resumes.issue(user.ID, session, bindings)
+	}
+	if err := s.sendSuccessResponse(stream, bindings, user.ID, isAdmin, resumeToken); err != nil {
+		sentry.CaptureErrorf(err, "Failed to send success response to %s", remoteAddr)
+	}
+	log.Printf("Handshake complete for %s. Bound domains: %v, TLS passthrough: %v, TCP tunnels: %d, UDP tunnels: %d", remoteAddr, bindings.domains, bindings.tlsDomains, len(bindings.tcp), len(bindings.udp))
+
+	// 6. Keep the handshake stream open as the control channel
+	if protocol.HasCapability(authReq.Capabilities, protocol.CapabilityControlStream) {
+		ctrl := newControlChannel(stream)
+		s.Registry.SetControl(session, ctrl)
+		go s.serveControl(session, ctrl, decoder, user.ID, isAdmin, bindings)
 	}
-	log.Printf("Handshake complete for %s. Bound domains: %v", conn.RemoteAddr(), boundDomains)
 
-	// 7. Monitor session for cleanup
-	s.monitorSession(session, user.ID, boundDomains)
+	// 7. Monitor session for cleanup and enforce the session policy
+	s.monitorSession(session, user.ID, bindings)
+	go s.enforcePolicy(policySession, user.ID, policy, bindings)
 }
 
-// Handshake timeout for server-side operations
-const handshakeTimeout = 10 * time.Second
+// sessionBindings holds everything bound to a client session. HTTP domains
+// can change at runtime through bind/release control messages.
+type sessionBindings struct {
+	mu         sync.Mutex
+	shared     bool         // Domains are load balanced with other shared sessions of the user
+	domains    []string     // HTTP domains
+	tlsDomains []string     // TLS passthrough domains
+	tcp        []*tcpTunnel // Raw TCP tunnels on public ports
+	udp        []*udpTunnel // UDP tunnels on public ports
+	// access holds the policies the client declared for HTTP domains, by hostname
+	access map[string]*TunnelAccess
+	// closing is set once the client announced with ControlClose that it is
+	// shutting down
+	closing bool
+	// ephemeral is the hostname of the ephemeral domain among domains, which
+	// no user owns in storage
+	ephemeral string
+}
 
-// setupYamuxSession creates a yamux session and accepts the handshake stream.
-func (s *Server) setupYamuxSession(conn net.Conn) (*yamux.Session, net.Conn, error) {
-	// Set initial deadline for yamux setup
-	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+// markClosing records that the client is shutting down on purpose.
+func (b *sessionBindings) markClosing() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closing = true
+}
 
-	session, err := yamux.Server(conn, nil)
-	if err != nil {
-		conn.Close()
-		return nil, nil, err
+// isClosing reports whether the client announced its shutdown.
+func (b *sessionBindings) isClosing() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.closing
+}
+
+// remove drops hostname from the HTTP and passthrough domains and reports
+// whether it was bound.
+func (b *sessionBindings) remove(hostname string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	found := false
+	for _, list := range []*[]string{&b.domains, &b.tlsDomains} {
+		kept := (*list)[:0]
+		for _, d := range *list {
+			if d == hostname {
+				found = true
+				continue
+			}
+			kept = append(kept, d)
+		}
+		*list = kept
 	}
-	log.Printf("Yamux session established for %s", conn.RemoteAddr())
+	return found
+}
 
+// allDomains returns HTTP and passthrough domains together.
+func (b *sessionBindings) allDomains() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	all := make([]string, 0, len(b.domains)+len(b.tlsDomains))
+	all = append(all, b.domains...)
+	return append(all, b.tlsDomains...)
+}
+
+// Handshake timeout for server-side operations
+const handshakeTimeout = 10 * time.Second
+
+// acceptHandshake waits for the client to open the handshake stream. Sessions
+// that open none within handshakeTimeout (e.g. port scanners) are closed.
+func (s *Server) acceptHandshake(session transport.Session) (net.Conn, error) {
+	timer := time.AfterFunc(handshakeTimeout, func() { session.Close() })
 	stream, err := session.Accept()
+	if !timer.Stop() && err == nil {
+		stream.Close()
+		err = errors.New("handshake timeout")
+	}
 	if err != nil {
 		session.Close()
-		return nil, nil, err
+		return nil, err
 	}
-	log.Printf("Handshake stream accepted from %s", conn.RemoteAddr())
-
-	// Clear deadline on the underlying connection after yamux is established
-	conn.SetDeadline(time.Time{})
-
-	return session, stream, nil
+	log.Printf("Handshake stream accepted from %s", session.RemoteAddr())
+	return stream, nil
 }
 
-// authenticate validates the client's token and returns the user and force flag.
-func (s *Server) authenticate(decoder *json.Decoder, stream net.Conn, remoteAddr string) (*models.User, bool, error) {
+// authenticate checks the client version, validates the client's device
+// certificate or else its token, and returns the user together with the
+// auth request. The device is nil for token authentication.
+func (s *Server) authenticate(decoder *json.Decoder, stream net.Conn, remoteAddr string, clientCert *x509.Certificate) (*models.User, *models.DeviceCert, *protocol.AuthRequest, error) {
 	// Set read deadline for auth request
 	stream.SetReadDeadline(time.Now().Add(handshakeTimeout))
 	defer stream.SetReadDeadline(time.Time{}) // Clear deadline after auth
 
 	var authReq protocol.AuthRequest
 	if err := decoder.Decode(&authReq); err != nil {
-		return nil, false, err
+		return nil, nil, nil, err
+	}
+	log.Printf("Auth request received from %s (force=%v, client=%q, protocol=%d, capabilities=%v)",
+		remoteAddr, authReq.Force, authReq.ClientVersion, authReq.ProtocolVersion, authReq.Capabilities)
+
+	if err := s.checkClientVersion(authReq.ClientVersion); err != nil {
+		s.sendIncompatibleClient(stream)
+		return nil, nil, nil, err
+	}
+
+	// A certificate is never ignored: a revoked one fails even with a valid token
+	if clientCert != nil {
+		device, err := validateDeviceCert(clientCert)
+		if err != nil {
+			s.sendErrorWithCode(stream, "Invalid client certificate", protocol.ErrorCodeInvalidToken)
+			return nil, nil, nil, err
+		}
+		log.Printf("User %s authenticated with device %q (ID: %d)", device.User.Username, device.Name, device.User.ID)
+		return &device.User, device, &authReq, nil
+	}
+
+	// Throttle before the lookup so guessing never reaches storage
+	ip := remoteIP(remoteAddr)
+	delay, err := s.authGuard.admit(ip)
+	if err != nil {
+		if s.AppMetrics != nil {
+			s.AppMetrics.AuthRejected()
+		}
+		s.sendErrorWithCode(stream, "Too many failed attempts, try again later", protocol.ErrorCodeRateLimited)
+		return nil, nil, nil, err
 	}
-	log.Printf("Auth request received from %s (force=%v)", remoteAddr, authReq.Force)
+	defer s.authGuard.release(ip)
+	time.Sleep(delay)
 
 	user, err := storage.ValidateToken(authReq.Token)
 	if err != nil {
+		s.tokenFailed(ip)
 		s.sendErrorWithCode(stream, "Invalid Token", protocol.ErrorCodeInvalidToken)
-		return nil, false, err
+		return nil, nil, nil, err
 	}
+	s.authGuard.succeeded(ip)
 	log.Printf("User %s authenticated (ID: %d)", user.Username, user.ID)
 
-	return user, authReq.Force, nil
+	return user, nil, &authReq, nil
 }
 
-// processTunnelRequest handles the tunnel request and binds domains.
-func (s *Server) processTunnelRequest(decoder *json.Decoder, stream net.Conn, session *yamux.Session, user *models.User, remoteAddr string, bandwidthExempt bool) ([]string, error) {
+// tokenFailed counts a wrong token from ip and raises the alarm when it
+// gets the IP banned.
+func (s *Server) tokenFailed(ip string) {
+	if s.AppMetrics != nil {
+		s.AppMetrics.AuthFailed()
+	}
+	ban := s.authGuard.failed(ip)
+	if ban == 0 {
+		return
+	}
+	log.Printf("WARN: banned %s for %s after %d failed token attempts", ip, ban, s.authGuard.limits.MaxFailures)
+	if s.AppMetrics != nil {
+		s.AppMetrics.AuthBanned()
+	}
+	if s.Alerts != nil {
+		s.Alerts.NotifyAdmin(fmt.Sprintf("🚫 IP %s заблокирован на %s: %d неверных токенов подряд", ip, ban, s.authGuard.limits.MaxFailures))
+	}
+}
+
+// processTunnelRequest handles the tunnel request and binds domains and public ports.
+func (s *Server) processTunnelRequest(decoder *json.Decoder, stream net.Conn, session transport.Session, user *models.User, remoteAddr string, bandwidthExempt bool, authReq *protocol.AuthRequest) (*sessionBindings, error) {
 	// Set read deadline for tunnel request
 	stream.SetReadDeadline(time.Now().Add(handshakeTimeout))
 
@@ -339,14 +626,42 @@ func (s *Server) processTunnelRequest(decoder *json.Decoder, stream net.Conn, se
 	if err := decoder.Decode(&tunnelReq); err != nil {
 		return nil, err
 	}
-	log.Printf("Tunnel request received from %s for %d domains", remoteAddr, len(tunnelReq.RequestedDomains))
+	log.Printf("Tunnel request received from %s for %d domains, %d TLS domains, %d TCP tunnels, %d UDP tunnels", remoteAddr, len(tunnelReq.RequestedDomains), len(tunnelReq.TLSDomains), len(tunnelReq.TCPTunnels), len(tunnelReq.UDPTunnels))
 
 	// Clear read deadline before database operations
 	stream.SetReadDeadline(time.Time{})
 
-	// If no domains requested, get all user domains
+	access, err := s.accessPolicies(tunnelReq.Access)
+	if err != nil {
+		s.sendError(stream, fmt.Sprintf("Invalid access policy for %v", err))
+		return nil, err
+	}
+
+	s.bindMu.Lock()
+	defer s.bindMu.Unlock()
+
+	// A resume token brings back the domains reserved for the lost session
+	// that the user still owns; their policies come from this request.
+	// The reservation is only taken once the other domains passed the
+	// conflict check, so a rejected client can still resume later.
+	var res *reservation
+	var resumedDomains, resumedTLS []string
+	if authReq.ResumeToken != "" && s.ResumeGrace > 0 {
+		if res = s.resumes.peek(authReq.ResumeToken, user.ID); res != nil {
+			resumedDomains, resumedTLS = res.hostnames()
+		} else {
+			log.Printf("Unknown or expired resume token from %s, binding domains from scratch", remoteAddr)
+		}
+	}
+
+	// A resumed session keeps the ephemeral domain it already has
+	needEphemeral := tunnelReq.Ephemeral && len(resumedDomains) == 0
+
+	// If nothing specific was requested, get all user domains that no other
+	// agent of the user is serving
 	requestedDomains := tunnelReq.RequestedDomains
-	if len(requestedDomains) == 0 {
+	tlsDomains := tunnelReq.TLSDomains
+	if len(requestedDomains) == 0 && len(tlsDomains) == 0 && len(tunnelReq.TCPTunnels) == 0 && len(tunnelReq.UDPTunnels) == 0 && !tunnelReq.Ephemeral {
 		userDomains, err := storage.GetUserDomains(user.ID)
 		if err != nil {
 			s.sendError(stream, "Failed to retrieve user domains")
@@ -356,27 +671,87 @@ func (s *Server) processTunnelRequest(decoder *json.Decoder, stream net.Conn, se
 		for _, d := range userDomains {
 			requestedDomains = append(requestedDomains, d.Name)
 		}
+		requestedDomains = s.notResumed(requestedDomains, resumedDomains)
+	} else {
+		requestedDomains = s.notResumed(requestedDomains, resumedDomains)
+		tlsDomains = s.notResumed(tlsDomains, resumedTLS)
+		explicit := append(append([]string{}, requestedDomains...), tlsDomains...)
+		if err := s.resolveDomainConflicts(stream, user.ID, session, explicit, tunnelReq.Shared, authReq.Force); err != nil {
+			return nil, err
+		}
+	}
+
+	bindings := &sessionBindings{shared: tunnelReq.Shared, access: access}
+	if res != nil {
+		if s.resumes.take(authReq.ResumeToken, user.ID) != nil {
+			bindings.domains, bindings.tlsDomains = s.resumeBindings(res, session, bandwidthExempt, access)
+			if containsString(bindings.domains, res.bindings.ephemeral) {
+				bindings.ephemeral = res.bindings.ephemeral
+			}
+		} else {
+			// The grace period ran out in the meantime; bind the domains again
+			requestedDomains = append(requestedDomains, resumedDomains...)
+			tlsDomains = append(tlsDomains, resumedTLS...)
+			needEphemeral = tunnelReq.Ephemeral
+		}
 	}
 
-	// Bind domains
-	boundDomains := s.bindDomains(session, user.ID, requestedDomains, bandwidthExempt)
+	// Bind domains and public ports
+	bindings.domains = append(bindings.domains, s.bindDomains(session, user.ID, requestedDomains, bandwidthExempt, false, tunnelReq.Shared, access)...)
+	bindings.tlsDomains = append(bindings.tlsDomains, s.bindDomains(session, user.ID, tlsDomains, bandwidthExempt, true, tunnelReq.Shared, nil)...)
+	bindings.tcp = s.bindTCPTunnels(session, user.ID, tunnelReq.TCPTunnels, bandwidthExempt)
+	bindings.udp = s.bindUDPTunnels(session, user.ID, tunnelReq.UDPTunnels, bandwidthExempt)
+	if needEphemeral {
+		if hostname, err := s.bindEphemeral(session, user.ID, bandwidthExempt); err != nil {
+			log.Printf("Ephemeral domain for user %d: %v", user.ID, err)
+		} else {
+			bindings.domains = append(bindings.domains, hostname)
+			bindings.ephemeral = hostname
+		}
+	}
 
-	if len(boundDomains) == 0 {
+	if len(bindings.domains) == 0 && len(bindings.tlsDomains) == 0 && len(bindings.tcp) == 0 && len(bindings.udp) == 0 {
 		s.sendError(stream, "No valid domains requested or authorized")
 		return nil, errors.New("no domains bound")
 	}
 
-	return boundDomains, nil
+	if s.bound == nil {
+		s.bound = make(map[transport.Session]*sessionBindings)
+	}
+	s.bound[session] = bindings
+	return bindings, nil
+}
+
+// accessPolicies validates the access policies of a tunnel request and keys
+// them by hostname.
+func (s *Server) accessPolicies(policies map[string]*protocol.AccessPolicy) (map[string]*TunnelAccess, error) {
+	access := make(map[string]*TunnelAccess)
+	for name, p := range policies {
+		a, err := NewTunnelAccess(p)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if a.Login() != nil && a.Login().Provider == protocol.LoginProviderOIDC && !s.OIDCLogin {
+			return nil, fmt.Errorf("%s: OIDC login is not configured on this server", name)
+		}
+		if a != nil {
+			access[s.hostname(name)] = a
+		}
+	}
+	return access, nil
 }
 
 // bindDomains validates ownership and registers domains with the session.
-func (s *Server) bindDomains(session *yamux.Session, userID uint, requestedDomains []string, bandwidthExempt bool) []string {
+// Passthrough domains are registered for raw TLS forwarding by SNI; shared
+// domains join the sessions of the user already serving them. access holds
+// the policies of the domains by hostname.
+func (s *Server) bindDomains(session transport.Session, userID uint, requestedDomains []string, bandwidthExempt bool, passthrough bool, shared bool, access map[string]*TunnelAccess) []string {
 	var boundDomains []string
 
 	for _, name := range requestedDomains {
-		log.Printf("Processing domain bind: %s (User: %d)", name, userID)
+		log.Printf("Processing domain bind: %s (User: %d, TLS passthrough: %v)", name, userID, passthrough)
 
-		isOwner, err := storage.ValidateDomainOwnership(name, userID)
+		isOwner, err := s.ownsDomain(name, userID)
 		if err != nil {
 			log.Printf("Domain ownership check error for %s: %v", name, err)
 			continue
@@ -387,13 +762,25 @@ func (s *Server) bindDomains(session *yamux.Session, userID uint, requestedDomai
 			continue
 		}
 
-		// Register FQDN if rootDomain is set, otherwise just name (local dev)
-		regName := name
-		if s.RootDomain != "" {
-			regName = name + "." + s.RootDomain
+		regName := s.hostname(name)
+		if entry := s.domainHolder(regName, session, userID, shared); entry != nil {
+			log.Printf("Domain %s is already served by another session of user %d, skipping", regName, entry.UserID)
+			continue
 		}
 
-		s.Registry.Register(regName, session, userID, bandwidthExempt)
+		claim := cluster.Claim{Domain: regName, UserID: userID, Passthrough: passthrough}
+		if wall := access[regName].Login(); wall != nil {
+			claim.LoginProvider = wall.Provider
+		}
+		if err := s.claimDomain(claim); err != nil {
+			log.Printf("Domain %s could not be claimed in the cluster, skipping: %v", regName, err)
+			continue
+		}
+
+		if err := s.registerDomain(regName, session, userID, bandwidthExempt, passthrough, shared, access[regName]); err != nil {
+			log.Printf("Domain %s could not join the sessions serving it, skipping: %v", regName, err)
+			continue
+		}
 		boundDomains = append(boundDomains, regName)
 		log.Printf("Successfully bound domain %s for user %d", regName, userID)
 	}
@@ -401,15 +788,81 @@ func (s *Server) bindDomains(session *yamux.Session, userID uint, requestedDomai
 	return boundDomains
 }
 
+// registerDomain maps hostname to session in the registry.
+func (s *Server) registerDomain(hostname string, session transport.Session, userID uint, bandwidthExempt, passthrough, shared bool, access *TunnelAccess) error {
+	entry := &TunnelEntry{
+		Session:         session,
+		UserID:          userID,
+		BandwidthExempt: bandwidthExempt,
+		Passthrough:     passthrough,
+		Access:          access,
+	}
+	if shared {
+		return s.Registry.JoinPool(hostname, entry)
+	}
+	s.Registry.RegisterEntry(hostname, entry)
+	return nil
+}
+
+// notResumed drops the names whose hostname is already in resumed.
+func (s *Server) notResumed(names []string, resumed []string) []string {
+	if len(resumed) == 0 {
+		return names
+	}
+	var rest []string
+	for _, name := range names {
+		if !containsString(resumed, s.hostname(name)) {
+			rest = append(rest, name)
+		}
+	}
+	return rest
+}
+
+// ownsDomain checks that userID may bind name: a subdomain the user owns or,
+// for a full hostname, a custom domain the user has verified.
+func (s *Server) ownsDomain(name string, userID uint) (bool, error) {
+	if isCustomDomain(name) {
+		return storage.ValidateCustomDomainOwnership(strings.ToLower(name), userID)
+	}
+	return storage.ValidateDomainOwnership(name, userID)
+}
+
+// isCustomDomain reports whether name is a full hostname rather than a
+// subdomain label of the root domain.
+func isCustomDomain(name string) bool {
+	return strings.Contains(name, ".")
+}
+
+// hostname returns the FQDN for a domain name if rootDomain is set, otherwise
+// just the name (local dev). Custom domains are already full hostnames.
+func (s *Server) hostname(name string) string {
+	if isCustomDomain(name) {
+		return strings.ToLower(name)
+	}
+	if s.RootDomain != "" {
+		return name + "." + s.RootDomain
+	}
+	return name
+}
+
 // sendSuccessResponse sends the handshake success response to the client.
-func (s *Server) sendSuccessResponse(stream net.Conn, boundDomains []string, userID uint, bandwidthExempt bool) error {
+func (s *Server) sendSuccessResponse(stream net.Conn, bindings *sessionBindings, userID uint, bandwidthExempt bool, resumeToken string) error {
 	// Fetch bandwidth statistics for the user
 	bandwidthToday, _ := storage.GetUserBandwidthToday(userID)
 	bandwidthTotal, _ := storage.GetUserTotalBandwidth(userID)
 
 	resp := protocol.InitResponse{
 		Success:      true,
-		BoundDomains: boundDomains,
+		BoundDomains: bindings.domains,
+		TCPBindings:  s.tcpBindings(bindings.tcp),
+		UDPBindings:  s.udpBindings(bindings.udp),
+		TLSDomains:   bindings.tlsDomains,
+		// Negotiation
+		ServerVersion:    version.Version,
+		ProtocolVersion:  protocol.ProtocolVersion,
+		Capabilities:     s.capabilities(),
+		MinClientVersion: s.MinClientVersion,
+		ResumeToken:      resumeToken,
 		ServerStats: &protocol.ServerStats{
 			BandwidthToday: bandwidthToday,
 			BandwidthTotal: bandwidthTotal,
@@ -421,18 +874,39 @@ func (s *Server) sendSuccessResponse(stream net.Conn, boundDomains []string, use
 			}(),
 		},
 	}
+	if resumeToken != "" {
+		resp.ResumeGraceSeconds = int(s.ResumeGrace / time.Second)
+	}
 	return json.NewEncoder(stream).Encode(resp)
 }
 
 // monitorSession watches for session close and cleans up domain registrations.
-func (s *Server) monitorSession(session *yamux.Session, userID uint, boundDomains []string) {
+// Domains of a session with a resume token stay reserved for ResumeGrace.
+// Unless the client announced its shutdown, the domains count as lost, so
+// the ingress holds their requests while the client reconnects.
+func (s *Server) monitorSession(session transport.Session, userID uint, bindings *sessionBindings) {
 	go func() {
 		<-session.CloseChan()
-		log.Printf("Session closed for user %d. Cleaning up domains.", userID)
-		for _, d := range boundDomains {
-			s.Registry.Unregister(d)
+		lost := !bindings.isClosing()
+		releaseDomains := func() {
+			log.Printf("Releasing domains of closed session for user %d.", userID)
+			s.bindMu.Lock()
+			for _, d := range bindings.allDomains() {
+				s.unregisterDomain(d, session, lost)
+			}
+			delete(s.bound, session)
+			s.bindMu.Unlock()
+		}
+		if s.resumes.hold(session, s.ResumeGrace, releaseDomains) {
+			log.Printf("Session closed for user %d. Keeping domains reserved for %v.", userID, s.ResumeGrace)
+		} else {
+			log.Printf("Session closed for user %d. Cleaning up domains.", userID)
+			releaseDomains()
 		}
-		s.UserSessions.Unregister(userID)
+		s.closeTCPTunnels(bindings.tcp)
+		s.closeUDPTunnels(bindings.udp)
+		s.Registry.RemoveControl(session)
+		s.UserSessions.Unregister(userID, session)
 		if s.AppMetrics != nil {
 			s.AppMetrics.TunnelDisconnected()
 		}
@@ -0,0 +1,306 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+
+	"gopublic/internal/storage"
+	"gopublic/internal/transport"
+	"gopublic/pkg/protocol"
+)
+
+var (
+	errNoFreePorts       = errors.New("no free public ports available")
+	errPortLimit         = errors.New("per-user port limit reached")
+	errBandwidthExceeded = errors.New("daily bandwidth limit exceeded")
+)
+
+// PortPool hands out public ports for TCP and UDP tunnels from a fixed range.
+// It remembers which user holds each port, so the per-user limit covers all
+// of a user's sessions.
+type PortPool struct {
+	mu      sync.Mutex
+	min     int
+	max     int
+	next    int
+	perUser int          // Max ports one user may hold (0 = unlimited)
+	used    map[int]uint // Port -> user holding it
+	held    map[uint]int // User -> ports held
+}
+
+// NewPortPool creates a pool for the inclusive range [min, max] that lets
+// each user hold at most perUser ports (0 = unlimited).
+func NewPortPool(min, max, perUser int) *PortPool {
+	return &PortPool{
+		min:     min,
+		max:     max,
+		next:    min,
+		perUser: perUser,
+		used:    make(map[int]uint),
+		held:    make(map[uint]int),
+	}
+}
+
+// Listen reserves a free port for userID and opens a TCP listener on it.
+// Ports that are already taken at the OS level are skipped.
+func (p *PortPool) Listen(userID uint) (net.Listener, int, error) {
+	var ln net.Listener
+	port, err := p.reserve(userID, func(port int) (err error) {
+		ln, err = net.Listen("tcp", ":"+strconv.Itoa(port))
+		return err
+	})
+	return ln, port, err
+}
+
+// ListenPacket reserves a free port for userID and opens a UDP socket on it.
+func (p *PortPool) ListenPacket(userID uint) (*net.UDPConn, int, error) {
+	var conn *net.UDPConn
+	port, err := p.reserve(userID, func(port int) (err error) {
+		conn, err = net.ListenUDP("udp", &net.UDPAddr{Port: port})
+		return err
+	})
+	return conn, port, err
+}
+
+// reserve walks the range from the last handed out port and returns the first
+// port that is free in the pool and for which open succeeds.
+func (p *PortPool) reserve(userID uint, open func(port int) error) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.perUser > 0 && p.held[userID] >= p.perUser {
+		return 0, errPortLimit
+	}
+
+	size := p.max - p.min + 1
+	for i := 0; i < size; i++ {
+		port := p.next
+		p.next++
+		if p.next > p.max {
+			p.next = p.min
+		}
+		if _, taken := p.used[port]; taken {
+			continue
+		}
+		if err := open(port); err != nil {
+			continue
+		}
+		p.used[port] = userID
+		p.held[userID]++
+		return port, nil
+	}
+	return 0, errNoFreePorts
+}
+
+// Release returns a port to the pool.
+func (p *PortPool) Release(port int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	userID, ok := p.used[port]
+	if !ok {
+		return
+	}
+	delete(p.used, port)
+	if p.held[userID]--; p.held[userID] <= 0 {
+		delete(p.held, userID)
+	}
+}
+
+// InUse returns the number of ports currently handed out.
+func (p *PortPool) InUse() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.used)
+}
+
+// tcpTunnel forwards connections accepted on a public port to a client session.
+type tcpTunnel struct {
+	name            string
+	port            int
+	listener        net.Listener
+	session         transport.Session
+	userID          uint
+	bandwidthExempt bool
+}
+
+// bindTCPTunnels allocates a public port for each requested TCP tunnel name.
+func (s *Server) bindTCPTunnels(session transport.Session, userID uint, names []string, bandwidthExempt bool) []*tcpTunnel {
+	if len(names) == 0 {
+		return nil
+	}
+	if s.PublicPorts == nil {
+		log.Printf("TCP tunnels requested by user %d, but PUBLIC_PORT_RANGE is not configured", userID)
+		return nil
+	}
+
+	var tunnels []*tcpTunnel
+	seen := make(map[string]struct{})
+	for _, name := range names {
+		if _, dup := seen[name]; dup {
+			continue
+		}
+		seen[name] = struct{}{}
+
+		ln, port, err := s.PublicPorts.Listen(userID)
+		if errors.Is(err, errPortLimit) {
+			log.Printf("Port limit reached for user %d, skipping TCP tunnel %q", userID, name)
+			break
+		}
+		if err != nil {
+			log.Printf("Failed to allocate TCP port for %q (User: %d): %v", name, userID, err)
+			break
+		}
+
+		t := &tcpTunnel{
+			name:            name,
+			port:            port,
+			listener:        ln,
+			session:         session,
+			userID:          userID,
+			bandwidthExempt: bandwidthExempt,
+		}
+		tunnels = append(tunnels, t)
+		go s.serveTCPTunnel(t)
+		log.Printf("Successfully bound TCP tunnel %q on port %d for user %d", name, port, userID)
+	}
+	return tunnels
+}
+
+// tcpBindings describes bound TCP tunnels for the handshake response.
+func (s *Server) tcpBindings(tunnels []*tcpTunnel) []protocol.PortBinding {
+	bindings := make([]protocol.PortBinding, 0, len(tunnels))
+	for _, t := range tunnels {
+		bindings = append(bindings, s.portBinding(t.name, t.port))
+	}
+	return bindings
+}
+
+// portBinding describes a public port on the server's root domain.
+func (s *Server) portBinding(name string, port int) protocol.PortBinding {
+	host := s.RootDomain
+	if host == "" {
+		host = "localhost"
+	}
+	return protocol.PortBinding{
+		Name: name,
+		Port: port,
+		Addr: net.JoinHostPort(host, strconv.Itoa(port)),
+	}
+}
+
+// closeTCPTunnels stops the public listeners and returns their ports to the pool.
+func (s *Server) closeTCPTunnels(tunnels []*tcpTunnel) {
+	for _, t := range tunnels {
+		t.listener.Close()
+		if s.PublicPorts != nil {
+			s.PublicPorts.Release(t.port)
+		}
+	}
+}
+
+// serveTCPTunnel accepts public connections until the listener is closed.
+func (s *Server) serveTCPTunnel(t *tcpTunnel) {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("TCP tunnel %q accept error: %v", t.name, err)
+			}
+			return
+		}
+		go s.proxyTCPConn(t, conn)
+	}
+}
+
+// proxyTCPConn opens a stream to the client and pipes the public connection through it.
+func (s *Server) proxyTCPConn(t *tcpTunnel, conn net.Conn) {
+	defer conn.Close()
+
+	stream, err := t.session.Open()
+	if err != nil {
+		log.Printf("TCP tunnel %q: failed to open stream: %v", t.name, err)
+		return
+	}
+	defer stream.Close()
+
+	header := &protocol.StreamHeader{
+		Proto:      protocol.StreamProtoTCP,
+		Name:       t.name,
+		RemoteAddr: conn.RemoteAddr().String(),
+	}
+	if err := protocol.WriteStreamHeader(stream, header); err != nil {
+		log.Printf("TCP tunnel %q: failed to write stream header: %v", t.name, err)
+		return
+	}
+
+	consume := func(n int64) bool {
+		return s.consumeBandwidth(t.userID, t.bandwidthExempt, n)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	// Public -> Client
+	go func() {
+		defer wg.Done()
+		_, err := io.Copy(&meteredWriter{w: stream, consume: consume}, conn)
+		if errors.Is(err, errBandwidthExceeded) {
+			log.Printf("TCP tunnel %q: bandwidth limit exceeded for user %d", t.name, t.userID)
+			conn.Close()
+		}
+		// Half-close: yamux delivers EOF to the client but keeps the read side open
+		stream.Close()
+	}()
+
+	// Client -> Public
+	go func() {
+		defer wg.Done()
+		_, err := io.Copy(&meteredWriter{w: conn, consume: consume}, stream)
+		if errors.Is(err, errBandwidthExceeded) {
+			log.Printf("TCP tunnel %q: bandwidth limit exceeded for user %d", t.name, t.userID)
+			stream.Close()
+		}
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			tcpConn.CloseWrite()
+		} else {
+			conn.Close()
+		}
+	}()
+
+	wg.Wait()
+}
+
+// consumeBandwidth charges bytes against the user's daily limit.
+// It fails open on storage errors, the same way the HTTP ingress does.
+func (s *Server) consumeBandwidth(userID uint, bandwidthExempt bool, n int64) bool {
+	if bandwidthExempt || s.DailyBandwidthLimit <= 0 || n <= 0 {
+		return true
+	}
+	allowed, _, err := storage.ConsumeUserBandwidthWithinLimit(userID, n, s.DailyBandwidthLimit)
+	if err != nil {
+		log.Printf("Failed to consume bandwidth for user %d: %v", userID, err)
+		return true
+	}
+	return allowed
+}
+
+// meteredWriter charges bandwidth for each chunk before it is written.
+type meteredWriter struct {
+	w       io.Writer
+	consume func(n int64) bool
+}
+
+func (mw *meteredWriter) Write(p []byte) (int, error) {
+	if !mw.consume(int64(len(p))) {
+		return 0, errBandwidthExceeded
+	}
+	n, err := mw.w.Write(p)
+	if err == nil && n < len(p) {
+		err = io.ErrShortWrite
+	}
+	return n, err
+}
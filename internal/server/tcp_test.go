@@ -0,0 +1,205 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+
+	"gopublic/pkg/protocol"
+)
+
+// freePort returns a port that was free at the time of the call.
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// yamuxPair returns connected server and client sessions over an in-memory pipe.
+func yamuxPair(t *testing.T) (*yamux.Session, *yamux.Session) {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	serverSession, err := yamux.Server(serverConn, nil)
+	if err != nil {
+		t.Fatalf("yamux server: %v", err)
+	}
+	clientSession, err := yamux.Client(clientConn, nil)
+	if err != nil {
+		t.Fatalf("yamux client: %v", err)
+	}
+	t.Cleanup(func() {
+		clientSession.Close()
+		serverSession.Close()
+	})
+	return serverSession, clientSession
+}
+
+func TestPortPool_ListenAndRelease(t *testing.T) {
+	port := freePort(t)
+	pool := NewPortPool(port, port, 0)
+
+	ln, got, err := pool.Listen(1)
+	if err != nil {
+		t.Fatalf("Listen() error: %v", err)
+	}
+	if got != port {
+		t.Errorf("Listen() port = %d, want %d", got, port)
+	}
+	if pool.InUse() != 1 {
+		t.Errorf("InUse() = %d, want 1", pool.InUse())
+	}
+
+	// Pool is exhausted while the only port is held
+	if _, _, err := pool.Listen(1); err != errNoFreePorts {
+		t.Errorf("Listen() on exhausted pool error = %v, want %v", err, errNoFreePorts)
+	}
+
+	ln.Close()
+	pool.Release(got)
+	if pool.InUse() != 0 {
+		t.Errorf("InUse() after release = %d, want 0", pool.InUse())
+	}
+
+	ln, _, err = pool.Listen(1)
+	if err != nil {
+		t.Fatalf("Listen() after release error: %v", err)
+	}
+	ln.Close()
+}
+
+func TestBindTCPTunnels_Disabled(t *testing.T) {
+	s := &Server{}
+	if tunnels := s.bindTCPTunnels(nil, 1, []string{"db"}, false); tunnels != nil {
+		t.Errorf("expected no tunnels without a port pool, got %d", len(tunnels))
+	}
+}
+
+func TestBindTCPTunnels_PerUserLimit(t *testing.T) {
+	first := freePort(t)
+	s := &Server{PublicPorts: NewPortPool(first, first+10, 2)}
+
+	tunnels := s.bindTCPTunnels(nil, 1, []string{"db", "ssh", "redis"}, true)
+	defer func() { s.closeTCPTunnels(tunnels) }()
+
+	if len(tunnels) != 2 {
+		t.Fatalf("expected 2 tunnels, got %d", len(tunnels))
+	}
+	if tunnels[0].name != "db" {
+		t.Errorf("expected tunnel 'db', got %q", tunnels[0].name)
+	}
+
+	// The limit covers all of a user's sessions, not each one
+	if other := s.bindTCPTunnels(nil, 1, []string{"web"}, true); len(other) != 0 {
+		s.closeTCPTunnels(other)
+		t.Errorf("second session of the user got %d tunnels, want 0", len(other))
+	}
+	other := s.bindTCPTunnels(nil, 2, []string{"web"}, true)
+	defer s.closeTCPTunnels(other)
+	if len(other) != 1 {
+		t.Errorf("another user got %d tunnels, want 1", len(other))
+	}
+
+	// Released ports no longer count
+	s.closeTCPTunnels(tunnels[:1])
+	tunnels = tunnels[1:]
+	again := s.bindTCPTunnels(nil, 1, []string{"web"}, true)
+	defer s.closeTCPTunnels(again)
+	if len(again) != 1 {
+		t.Errorf("after release got %d tunnels, want 1", len(again))
+	}
+}
+
+func TestProxyTCPConn_EndToEnd(t *testing.T) {
+	serverSession, clientSession := yamuxPair(t)
+
+	port := freePort(t)
+	s := &Server{PublicPorts: NewPortPool(port, port, 0), RootDomain: "example.com"}
+	tunnels := s.bindTCPTunnels(serverSession, 1, []string{"db"}, true)
+	defer s.closeTCPTunnels(tunnels)
+	if len(tunnels) != 1 {
+		t.Fatalf("expected 1 tunnel, got %d", len(tunnels))
+	}
+
+	bindings := s.tcpBindings(tunnels)
+	if bindings[0].Addr != "example.com:"+strconv.Itoa(port) {
+		t.Errorf("binding addr = %q", bindings[0].Addr)
+	}
+
+	// Fake client: read header, then echo everything back
+	headerCh := make(chan *protocol.StreamHeader, 1)
+	go func() {
+		stream, err := clientSession.Accept()
+		if err != nil {
+			return
+		}
+		defer stream.Close()
+		reader := bufio.NewReader(stream)
+		header, err := protocol.ReadStreamHeader(reader)
+		if err != nil {
+			return
+		}
+		headerCh <- header
+		io.Copy(stream, reader)
+	}()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatalf("dial public port: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("read echo: %v", err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("echo = %q, want %q", buf, "ping")
+	}
+
+	select {
+	case header := <-headerCh:
+		if header.Proto != protocol.StreamProtoTCP || header.Name != "db" {
+			t.Errorf("unexpected header: %+v", header)
+		}
+		if header.RemoteAddr == "" {
+			t.Error("expected remote address in header")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("client did not receive stream header")
+	}
+}
+
+func TestMeteredWriter_StopsWhenDenied(t *testing.T) {
+	var out []byte
+	w := &meteredWriter{
+		w:       writerFunc(func(p []byte) (int, error) { out = append(out, p...); return len(p), nil }),
+		consume: func(n int64) bool { return len(out)+int(n) <= 4 },
+	}
+
+	if _, err := w.Write([]byte("abcd")); err != nil {
+		t.Fatalf("first write error: %v", err)
+	}
+	if _, err := w.Write([]byte("e")); err != errBandwidthExceeded {
+		t.Errorf("second write error = %v, want %v", err, errBandwidthExceeded)
+	}
+	if string(out) != "abcd" {
+		t.Errorf("written = %q, want %q", out, "abcd")
+	}
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
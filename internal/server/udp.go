@@ -0,0 +1,358 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopublic/internal/storage"
+	"gopublic/internal/transport"
+	"gopublic/pkg/protocol"
+)
+
+// udpFlowIdleTimeout closes a flow after no datagrams were seen in either direction.
+const udpFlowIdleTimeout = 60 * time.Second
+
+// udpFlowQueueSize is how many datagrams may wait for a flow's stream; more
+// are dropped so that one slow flow cannot hold up the others.
+const udpFlowQueueSize = 64
+
+// Forwarded UDP bytes are charged against the daily limit in batches: once a
+// flow has forwarded udpChargeBytes, and every udpChargeInterval.
+const (
+	udpChargeBytes    = 64 << 10
+	udpChargeInterval = 5 * time.Second
+)
+
+// udpTunnel forwards datagrams received on a public port to a client session.
+// Each remote address gets its own yamux stream (a "flow").
+type udpTunnel struct {
+	name            string
+	port            int
+	conn            *net.UDPConn
+	session         transport.Session
+	userID          uint
+	bandwidthExempt bool
+	maxFlows        int // 0 = unlimited
+
+	mu        sync.Mutex
+	flows     map[string]*udpFlow
+	done      chan struct{} // Closed when the tunnel is torn down
+	unbilled  atomic.Int64  // Bytes of closed flows not charged yet
+	overLimit atomic.Bool   // Set while the user has no bandwidth left today
+}
+
+// udpFlow is the stream carrying datagrams for one remote address.
+type udpFlow struct {
+	addr       *net.UDPAddr
+	queue      chan []byte   // Datagrams waiting to be written to the stream
+	done       chan struct{} // Closed when the flow is closed
+	closeOnce  sync.Once
+	lastActive atomic.Int64 // Unix nanoseconds
+	unbilled   atomic.Int64 // Bytes forwarded since the flow was last charged
+}
+
+func (f *udpFlow) touch() {
+	f.lastActive.Store(time.Now().UnixNano())
+}
+
+func (f *udpFlow) idleSince(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, f.lastActive.Load()))
+}
+
+func (f *udpFlow) close() {
+	f.closeOnce.Do(func() { close(f.done) })
+}
+
+// bindUDPTunnels allocates a public UDP port for each requested tunnel name.
+// UDP tunnels share the TCP port range and count towards the same per-user
+// limit.
+func (s *Server) bindUDPTunnels(session transport.Session, userID uint, names []string, bandwidthExempt bool) []*udpTunnel {
+	if len(names) == 0 {
+		return nil
+	}
+	if s.PublicPorts == nil {
+		log.Printf("UDP tunnels requested by user %d, but PUBLIC_PORT_RANGE is not configured", userID)
+		return nil
+	}
+
+	var tunnels []*udpTunnel
+	seen := make(map[string]struct{})
+	for _, name := range names {
+		if _, dup := seen[name]; dup {
+			continue
+		}
+		seen[name] = struct{}{}
+
+		conn, port, err := s.PublicPorts.ListenPacket(userID)
+		if errors.Is(err, errPortLimit) {
+			log.Printf("Port limit reached for user %d, skipping UDP tunnel %q", userID, name)
+			break
+		}
+		if err != nil {
+			log.Printf("Failed to allocate UDP port for %q (User: %d): %v", name, userID, err)
+			break
+		}
+
+		t := &udpTunnel{
+			name:            name,
+			port:            port,
+			conn:            conn,
+			session:         session,
+			userID:          userID,
+			bandwidthExempt: bandwidthExempt,
+			maxFlows:        s.UDPMaxFlows,
+			flows:           make(map[string]*udpFlow),
+			done:            make(chan struct{}),
+		}
+		tunnels = append(tunnels, t)
+		go s.serveUDPTunnel(t)
+		go t.expireFlows()
+		go s.chargeUDPTunnel(t)
+		log.Printf("Successfully bound UDP tunnel %q on port %d for user %d", name, port, userID)
+	}
+	return tunnels
+}
+
+// udpBindings describes bound UDP tunnels for the handshake response.
+func (s *Server) udpBindings(tunnels []*udpTunnel) []protocol.PortBinding {
+	bindings := make([]protocol.PortBinding, 0, len(tunnels))
+	for _, t := range tunnels {
+		bindings = append(bindings, s.portBinding(t.name, t.port))
+	}
+	return bindings
+}
+
+// closeUDPTunnels closes the public sockets, their flows, and releases the ports.
+func (s *Server) closeUDPTunnels(tunnels []*udpTunnel) {
+	for _, t := range tunnels {
+		close(t.done)
+		t.conn.Close()
+		t.mu.Lock()
+		for key, f := range t.flows {
+			f.close()
+			delete(t.flows, key)
+			t.unbilled.Add(f.unbilled.Swap(0))
+		}
+		t.mu.Unlock()
+		s.chargeUDP(t, t.unbilled.Swap(0))
+		if s.PublicPorts != nil {
+			s.PublicPorts.Release(t.port)
+		}
+	}
+}
+
+// serveUDPTunnel reads datagrams from the public socket until it is closed
+// and queues each one on the flow of its remote address. Datagrams from new
+// addresses beyond the flow limit, those a busy flow has no room for, and
+// all of them while the user is over the daily limit are dropped; UDP
+// senders are expected to cope with loss.
+func (s *Server) serveUDPTunnel(t *udpTunnel) {
+	buf := make([]byte, protocol.MaxDatagramSize)
+	for {
+		n, addr, err := t.conn.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("UDP tunnel %q read error: %v", t.name, err)
+			}
+			return
+		}
+
+		if t.overLimit.Load() {
+			continue
+		}
+		f := s.udpFlow(t, addr)
+		if f == nil {
+			continue
+		}
+		select {
+		case f.queue <- append([]byte(nil), buf[:n]...):
+			f.touch()
+		default:
+		}
+	}
+}
+
+// udpFlow returns the flow for addr, starting a new one if the tunnel has
+// room for it, and nil otherwise.
+func (s *Server) udpFlow(t *udpTunnel, addr *net.UDPAddr) *udpFlow {
+	key := addr.String()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if f, ok := t.flows[key]; ok {
+		return f
+	}
+	if t.maxFlows > 0 && len(t.flows) >= t.maxFlows {
+		return nil
+	}
+
+	f := &udpFlow{
+		addr:  addr,
+		queue: make(chan []byte, udpFlowQueueSize),
+		done:  make(chan struct{}),
+	}
+	f.touch()
+	t.flows[key] = f
+	go s.runUDPFlow(t, f)
+	return f
+}
+
+// runUDPFlow opens the flow's stream to the client and writes the queued
+// datagrams to it until the flow is closed.
+func (s *Server) runUDPFlow(t *udpTunnel, f *udpFlow) {
+	defer t.closeFlow(f)
+
+	stream, err := t.session.Open()
+	if err != nil {
+		log.Printf("UDP tunnel %q: failed to open flow for %s: %v", t.name, f.addr, err)
+		return
+	}
+	defer stream.Close()
+
+	header := &protocol.StreamHeader{
+		Proto:      protocol.StreamProtoUDP,
+		Name:       t.name,
+		RemoteAddr: f.addr.String(),
+	}
+	if err := protocol.WriteStreamHeader(stream, header); err != nil {
+		log.Printf("UDP tunnel %q: failed to open flow for %s: %v", t.name, f.addr, err)
+		return
+	}
+
+	go s.serveUDPFlow(t, f, stream)
+	for {
+		select {
+		case <-f.done:
+			return
+		case p := <-f.queue:
+			if err := protocol.WriteDatagram(stream, p); err != nil {
+				return
+			}
+			s.forwardedUDP(t, f, len(p))
+		}
+	}
+}
+
+// serveUDPFlow writes datagrams coming back from the client to the remote address.
+func (s *Server) serveUDPFlow(t *udpTunnel, f *udpFlow, stream net.Conn) {
+	defer t.closeFlow(f)
+
+	buf := make([]byte, protocol.MaxDatagramSize)
+	for {
+		n, err := protocol.ReadDatagram(stream, buf)
+		if err != nil {
+			return
+		}
+		if t.overLimit.Load() {
+			continue
+		}
+		f.touch()
+		if _, err := t.conn.WriteToUDP(buf[:n], f.addr); err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("UDP tunnel %q: failed to write to %s: %v", t.name, f.addr, err)
+			continue
+		}
+		s.forwardedUDP(t, f, n)
+	}
+}
+
+// closeFlow removes the flow if it is still registered and closes it, which
+// closes its stream.
+func (t *udpTunnel) closeFlow(f *udpFlow) {
+	t.mu.Lock()
+	if key := f.addr.String(); t.flows[key] == f {
+		delete(t.flows, key)
+	}
+	t.mu.Unlock()
+	f.close()
+	t.unbilled.Add(f.unbilled.Swap(0))
+}
+
+// expireFlows closes idle flows until the tunnel is torn down.
+func (t *udpTunnel) expireFlows() {
+	ticker := time.NewTicker(udpFlowIdleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.done:
+			return
+		case now := <-ticker.C:
+			t.mu.Lock()
+			var idle []*udpFlow
+			for _, f := range t.flows {
+				if f.idleSince(now) >= udpFlowIdleTimeout {
+					idle = append(idle, f)
+				}
+			}
+			t.mu.Unlock()
+			for _, f := range idle {
+				t.closeFlow(f)
+			}
+		}
+	}
+}
+
+// forwardedUDP adds n forwarded bytes to the flow and charges them once
+// udpChargeBytes have collected.
+func (s *Server) forwardedUDP(t *udpTunnel, f *udpFlow, n int) {
+	if f.unbilled.Add(int64(n)) >= udpChargeBytes {
+		s.chargeUDP(t, f.unbilled.Swap(0))
+	}
+}
+
+// chargeUDPTunnel charges the bytes the tunnel's flows forwarded every
+// udpChargeInterval until the tunnel is torn down. A tunnel over the limit
+// is checked again each time, so it resumes when a new day starts.
+func (s *Server) chargeUDPTunnel(t *udpTunnel) {
+	ticker := time.NewTicker(udpChargeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+			n := t.unbilled.Swap(0)
+			t.mu.Lock()
+			for _, f := range t.flows {
+				n += f.unbilled.Swap(0)
+			}
+			t.mu.Unlock()
+			if n > 0 || t.overLimit.Load() {
+				s.chargeUDP(t, n)
+			}
+		}
+	}
+}
+
+// chargeUDP records n bytes the tunnel already forwarded and stops it from
+// forwarding more once the user's daily limit is used up. Like
+// consumeBandwidth it fails open on storage errors.
+func (s *Server) chargeUDP(t *udpTunnel, n int64) {
+	if t.bandwidthExempt || s.DailyBandwidthLimit <= 0 {
+		return
+	}
+	if n > 0 {
+		if err := storage.AddUserBandwidth(t.userID, n); err != nil {
+			log.Printf("Failed to consume bandwidth for user %d: %v", t.userID, err)
+			return
+		}
+	}
+	used, err := storage.GetUserBandwidthToday(t.userID)
+	if err != nil {
+		log.Printf("Failed to read bandwidth of user %d: %v", t.userID, err)
+		return
+	}
+	over := used >= s.DailyBandwidthLimit
+	if over && !t.overLimit.Load() {
+		log.Printf("UDP tunnel %q: bandwidth limit exceeded for user %d", t.name, t.userID)
+	}
+	t.overLimit.Store(over)
+}
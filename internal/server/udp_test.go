@@ -0,0 +1,217 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopublic/internal/storage"
+	"gopublic/pkg/protocol"
+)
+
+// freeUDPPort returns a UDP port that was free at the time of the call.
+func freeUDPPort(t *testing.T) int {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestDatagramFraming(t *testing.T) {
+	var buf bytes.Buffer
+	for _, p := range [][]byte{[]byte("hello"), {}, bytes.Repeat([]byte{'x'}, 1500)} {
+		if err := protocol.WriteDatagram(&buf, p); err != nil {
+			t.Fatalf("WriteDatagram() error: %v", err)
+		}
+	}
+
+	out := make([]byte, protocol.MaxDatagramSize)
+	for _, want := range []int{5, 0, 1500} {
+		n, err := protocol.ReadDatagram(&buf, out)
+		if err != nil {
+			t.Fatalf("ReadDatagram() error: %v", err)
+		}
+		if n != want {
+			t.Errorf("ReadDatagram() = %d bytes, want %d", n, want)
+		}
+	}
+}
+
+func TestBindUDPTunnels_SharesPortLimit(t *testing.T) {
+	first := freeUDPPort(t)
+	s := &Server{PublicPorts: NewPortPool(first, first+10, 2)}
+
+	tcp := s.bindTCPTunnels(nil, 1, []string{"db"}, true)
+	defer s.closeTCPTunnels(tcp)
+	tunnels := s.bindUDPTunnels(nil, 1, []string{"dns", "wg"}, true)
+	defer s.closeUDPTunnels(tunnels)
+
+	if len(tunnels) != 1 {
+		t.Fatalf("expected 1 tunnel with one port already held, got %d", len(tunnels))
+	}
+	if s.PublicPorts.InUse() != 2 {
+		t.Errorf("InUse() = %d, want 2", s.PublicPorts.InUse())
+	}
+}
+
+func TestProxyUDP_EndToEnd(t *testing.T) {
+	serverSession, clientSession := yamuxPair(t)
+
+	port := freeUDPPort(t)
+	s := &Server{PublicPorts: NewPortPool(port, port, 0)}
+	tunnels := s.bindUDPTunnels(serverSession, 1, []string{"dns"}, true)
+	defer s.closeUDPTunnels(tunnels)
+	if len(tunnels) != 1 {
+		t.Fatalf("expected 1 tunnel, got %d", len(tunnels))
+	}
+
+	// Fake client: read header, then echo every datagram back
+	headerCh := make(chan *protocol.StreamHeader, 1)
+	go func() {
+		stream, err := clientSession.Accept()
+		if err != nil {
+			return
+		}
+		defer stream.Close()
+		reader := bufio.NewReader(stream)
+		header, err := protocol.ReadStreamHeader(reader)
+		if err != nil {
+			return
+		}
+		headerCh <- header
+		buf := make([]byte, protocol.MaxDatagramSize)
+		for {
+			n, err := protocol.ReadDatagram(reader, buf)
+			if err != nil {
+				return
+			}
+			if err := protocol.WriteDatagram(stream, buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err != nil {
+		t.Fatalf("dial public port: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	for _, msg := range []string{"ping", "pong"} {
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		buf := make([]byte, 64)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("read echo: %v", err)
+		}
+		if string(buf[:n]) != msg {
+			t.Errorf("echo = %q, want %q", buf[:n], msg)
+		}
+	}
+
+	select {
+	case header := <-headerCh:
+		if header.Proto != protocol.StreamProtoUDP || header.Name != "dns" {
+			t.Errorf("unexpected header: %+v", header)
+		}
+		if header.RemoteAddr != conn.LocalAddr().String() {
+			t.Errorf("header remote addr = %q, want %q", header.RemoteAddr, conn.LocalAddr())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("client did not receive stream header")
+	}
+
+	// Both datagrams used the same flow
+	tunnels[0].mu.Lock()
+	flows := len(tunnels[0].flows)
+	tunnels[0].mu.Unlock()
+	if flows != 1 {
+		t.Errorf("flows = %d, want 1", flows)
+	}
+}
+
+func TestProxyUDP_FlowLimit(t *testing.T) {
+	serverSession, clientSession := yamuxPair(t)
+
+	port := freeUDPPort(t)
+	s := &Server{PublicPorts: NewPortPool(port, port, 0), UDPMaxFlows: 1}
+	tunnels := s.bindUDPTunnels(serverSession, 1, []string{"dns"}, true)
+	defer s.closeUDPTunnels(tunnels)
+	if len(tunnels) != 1 {
+		t.Fatalf("expected 1 tunnel, got %d", len(tunnels))
+	}
+
+	streams := make(chan struct{}, 2)
+	go func() {
+		for {
+			stream, err := clientSession.Accept()
+			if err != nil {
+				return
+			}
+			streams <- struct{}{}
+			go io.Copy(io.Discard, stream)
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+		if err != nil {
+			t.Fatalf("dial public port: %v", err)
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	select {
+	case <-streams:
+	case <-time.After(time.Second):
+		t.Fatal("first source got no flow")
+	}
+	select {
+	case <-streams:
+		t.Error("second source got a flow beyond the limit")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestChargeUDP_Batches(t *testing.T) {
+	if err := storage.InitDB(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatalf("InitDB: %v", err)
+	}
+	s := &Server{DailyBandwidthLimit: udpChargeBytes}
+	tunnel := &udpTunnel{name: "dns", userID: 1}
+	f := &udpFlow{}
+
+	// Small datagrams are only counted
+	s.forwardedUDP(tunnel, f, 60)
+	if used, _ := storage.GetUserBandwidthToday(1); used != 0 {
+		t.Errorf("charged %d bytes before a batch was full", used)
+	}
+
+	// The periodic charge bills what has collected
+	s.chargeUDP(tunnel, f.unbilled.Swap(0))
+	if used, _ := storage.GetUserBandwidthToday(1); used != 60 || tunnel.overLimit.Load() {
+		t.Errorf("used = %d, over limit = %v after the first batch", used, tunnel.overLimit.Load())
+	}
+
+	// A full batch is charged right away and uses up the limit
+	s.forwardedUDP(tunnel, f, udpChargeBytes)
+	if used, _ := storage.GetUserBandwidthToday(1); used != 60+udpChargeBytes {
+		t.Errorf("used = %d, want %d", used, 60+udpChargeBytes)
+	}
+	if !tunnel.overLimit.Load() {
+		t.Error("tunnel still forwards after the limit was used up")
+	}
+}
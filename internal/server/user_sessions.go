@@ -2,76 +2,142 @@ package server
 
 import (
 	"sync"
+	"time"
 
-	"github.com/hashicorp/yamux"
+	"gopublic/internal/transport"
 )
 
-// UserSession represents an active user connection.
+// UserSession represents an active agent connection of a user.
 type UserSession struct {
-	UserID  uint
-	Session *yamux.Session
-	Domains []string
+	UserID      uint
+	Session     transport.Session
+	RemoteAddr  string
+	ConnectedAt time.Time
+	Domains     []string
+	DeviceID    uint   // Device certificate the agent authenticated with (0 = token)
+	Device      string // Name of that device
 }
 
 // UserSessionRegistry tracks active sessions per user.
-// Only one active session per user is allowed.
+// A user may run several agents at once as long as their domains do not overlap.
+// It only knows the sessions of this node: in cluster mode domains are claimed
+// cluster-wide through cluster.Registry, but sessions on other nodes are not
+// listed here and can't be replaced with --force.
 type UserSessionRegistry struct {
 	mu       sync.RWMutex
-	sessions map[uint]*UserSession // userID -> session
+	sessions map[uint][]*UserSession // userID -> sessions in connect order
 }
 
 // NewUserSessionRegistry creates a new registry.
 func NewUserSessionRegistry() *UserSessionRegistry {
 	return &UserSessionRegistry{
-		sessions: make(map[uint]*UserSession),
+		sessions: make(map[uint][]*UserSession),
 	}
 }
 
-// GetSession returns the active session for a user, if any.
-func (r *UserSessionRegistry) GetSession(userID uint) (*UserSession, bool) {
+// GetSessions returns a snapshot of the active sessions of a user, oldest first.
+func (r *UserSessionRegistry) GetSessions(userID uint) []UserSession {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
-	sess, ok := r.sessions[userID]
-	return sess, ok
+	sessions := make([]UserSession, 0, len(r.sessions[userID]))
+	for _, sess := range r.sessions[userID] {
+		snapshot := *sess
+		snapshot.Domains = append([]string(nil), sess.Domains...)
+		sessions = append(sessions, snapshot)
+	}
+	return sessions
 }
 
-// IsConnected checks if a user has an active session.
+// AllSessions returns the sessions of every user.
+func (r *UserSessionRegistry) AllSessions() []transport.Session {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var sessions []transport.Session
+	for _, userSessions := range r.sessions {
+		for _, sess := range userSessions {
+			sessions = append(sessions, sess.Session)
+		}
+	}
+	return sessions
+}
+
+// IsConnected checks if a user has at least one active session.
 func (r *UserSessionRegistry) IsConnected(userID uint) bool {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
-	_, ok := r.sessions[userID]
-	return ok
+	return len(r.sessions[userID]) > 0
 }
 
-// GetActiveDomains returns the list of active domains for a user.
+// GetActiveDomains returns the active domains of all sessions of a user.
 // Returns nil if the user has no active session.
 func (r *UserSessionRegistry) GetActiveDomains(userID uint) []string {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
-	if sess, ok := r.sessions[userID]; ok {
-		return sess.Domains
+	var domains []string
+	for _, sess := range r.sessions[userID] {
+		domains = append(domains, sess.Domains...)
 	}
-	return nil
+	return domains
+}
+
+// Register adds a session for a user next to any sessions already active.
+func (r *UserSessionRegistry) Register(userID uint, session transport.Session, remoteAddr string, domains []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sessions[userID] = append(r.sessions[userID], &UserSession{
+		UserID:      userID,
+		Session:     session,
+		RemoteAddr:  remoteAddr,
+		ConnectedAt: time.Now(),
+		Domains:     domains,
+	})
 }
 
-// Register registers a new session for a user.
-// Returns the old session if one existed (caller should close it).
-func (r *UserSessionRegistry) Register(userID uint, session *yamux.Session, domains []string) *UserSession {
+// SetDomains replaces the domain list of one of a user's sessions.
+// It reports whether the session was found.
+func (r *UserSessionRegistry) SetDomains(userID uint, session transport.Session, domains []string) bool {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	for _, sess := range r.sessions[userID] {
+		if sess.Session == session {
+			sess.Domains = domains
+			return true
+		}
+	}
+	return false
+}
 
-	old := r.sessions[userID]
-	r.sessions[userID] = &UserSession{
-		UserID:  userID,
-		Session: session,
-		Domains: domains,
+// SetDevice records the device certificate a session authenticated with.
+// It reports whether the session was found.
+func (r *UserSessionRegistry) SetDevice(userID uint, session transport.Session, deviceID uint, name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, sess := range r.sessions[userID] {
+		if sess.Session == session {
+			sess.DeviceID = deviceID
+			sess.Device = name
+			return true
+		}
 	}
-	return old
+	return false
 }
 
-// Unregister removes a user's session.
-func (r *UserSessionRegistry) Unregister(userID uint) {
+// Unregister removes one session of a user; the user's other sessions stay.
+func (r *UserSessionRegistry) Unregister(userID uint, session transport.Session) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	delete(r.sessions, userID)
+
+	sessions := r.sessions[userID]
+	for i, sess := range sessions {
+		if sess.Session == session {
+			sessions = append(sessions[:i:i], sessions[i+1:]...)
+			break
+		}
+	}
+	if len(sessions) == 0 {
+		delete(r.sessions, userID)
+		return
+	}
+	r.sessions[userID] = sessions
 }
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+
+	"gopublic/internal/cluster"
+	"gopublic/pkg/protocol"
+)
+
+func TestUserSessionRegistry_MultipleSessions(t *testing.T) {
+	first, _ := yamuxPair(t)
+	second, _ := yamuxPair(t)
+
+	r := NewUserSessionRegistry()
+	r.Register(1, first, "10.0.0.1:5000", []string{"app.example.com"})
+	r.Register(1, second, "10.0.0.2:6000", []string{"api.example.com"})
+
+	sessions := r.GetSessions(1)
+	if len(sessions) != 2 {
+		t.Fatalf("GetSessions() returned %d sessions, want 2", len(sessions))
+	}
+	if sessions[0].RemoteAddr != "10.0.0.1:5000" || sessions[1].RemoteAddr != "10.0.0.2:6000" {
+		t.Errorf("sessions not in connect order: %+v", sessions)
+	}
+	if domains := r.GetActiveDomains(1); len(domains) != 2 {
+		t.Errorf("GetActiveDomains() = %v, want domains of both sessions", domains)
+	}
+
+	r.SetDomains(1, second, []string{"api.example.com", "docs.example.com"})
+	r.Unregister(1, first)
+	if !r.IsConnected(1) {
+		t.Fatal("user disconnected after closing only one session")
+	}
+	sessions = r.GetSessions(1)
+	if len(sessions) != 1 || sessions[0].Session != second || len(sessions[0].Domains) != 2 {
+		t.Errorf("unexpected sessions after Unregister: %+v", sessions)
+	}
+
+	r.Unregister(1, second)
+	if r.IsConnected(1) {
+		t.Error("user still connected after closing all sessions")
+	}
+}
+
+func TestResolveDomainConflicts(t *testing.T) {
+	holder, _ := yamuxPair(t)
+	newcomer, _ := yamuxPair(t)
+
+	s := &Server{Registry: NewTunnelRegistry(), RootDomain: "example.com"}
+	s.Registry.Register("app.example.com", holder, 1, false)
+
+	// Disjoint domains never conflict
+	if err := s.resolveDomainConflicts(nil, 1, newcomer, []string{"api"}, false, false); err != nil {
+		t.Fatalf("disjoint domains: %v", err)
+	}
+
+	// The same domain without force is rejected with already_connected
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	clientConn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	errc := make(chan error, 1)
+	go func() { errc <- s.resolveDomainConflicts(serverConn, 1, newcomer, []string{"app"}, false, false) }()
+
+	var resp protocol.InitResponse
+	if err := json.NewDecoder(clientConn).Decode(&resp); err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if resp.ErrorCode != protocol.ErrorCodeAlreadyConnected {
+		t.Errorf("error code = %q, want %q", resp.ErrorCode, protocol.ErrorCodeAlreadyConnected)
+	}
+	if err := <-errc; !errors.Is(err, errDomainInUse) {
+		t.Errorf("error = %v, want errDomainInUse", err)
+	}
+	if holder.IsClosed() {
+		t.Error("holder closed without force")
+	}
+
+	// With force the holder is disconnected and the domain becomes free
+	if err := s.resolveDomainConflicts(nil, 1, newcomer, []string{"app"}, false, true); err != nil {
+		t.Fatalf("force: %v", err)
+	}
+	if !holder.IsClosed() {
+		t.Error("holder still open after force")
+	}
+	if s.domainHolder("app.example.com", newcomer, 1, false) != nil {
+		t.Error("domain still held by the closed session")
+	}
+}
+
+func TestDomainHolder_SharedSessions(t *testing.T) {
+	first, _ := yamuxPair(t)
+	second, _ := yamuxPair(t)
+
+	s := &Server{Registry: NewTunnelRegistry()}
+	s.Registry.JoinPool("app.example.com", &TunnelEntry{Session: first, UserID: 1})
+
+	if s.domainHolder("app.example.com", second, 1, true) != nil {
+		t.Error("shared session of the same user reported as a conflict")
+	}
+	if s.domainHolder("app.example.com", second, 1, false) == nil {
+		t.Error("session without the shared flag joined a pool")
+	}
+	if s.domainHolder("app.example.com", second, 2, true) == nil {
+		t.Error("shared session of another user joined the pool")
+	}
+}
+
+func TestResolveDomainConflicts_OtherNode(t *testing.T) {
+	session, _ := yamuxPair(t)
+	registry := cluster.NewMemoryRegistry(0)
+	registry.Claim(cluster.Claim{Domain: "app.example.com", NodeID: "b", UserID: 1})
+
+	s := &Server{Registry: NewTunnelRegistry(), RootDomain: "example.com", Cluster: cluster.NewNode("a", "", "secret", registry)}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	clientConn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	// Even --force can't take a domain from a client on another node
+	errc := make(chan error, 1)
+	go func() { errc <- s.resolveDomainConflicts(serverConn, 1, session, []string{"app"}, false, true) }()
+
+	var resp protocol.InitResponse
+	if err := json.NewDecoder(clientConn).Decode(&resp); err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if resp.ErrorCode != protocol.ErrorCodeAlreadyConnected {
+		t.Errorf("error code = %q, want %q", resp.ErrorCode, protocol.ErrorCodeAlreadyConnected)
+	}
+	if err := <-errc; !errors.Is(err, errDomainInUse) {
+		t.Errorf("error = %v, want errDomainInUse", err)
+	}
+}
+
+func TestUnregisterDomain_ReleasesClusterClaim(t *testing.T) {
+	first, _ := yamuxPair(t)
+	second, _ := yamuxPair(t)
+	registry := cluster.NewMemoryRegistry(0)
+	s := &Server{Registry: NewTunnelRegistry(), Cluster: cluster.NewNode("a", "", "secret", registry)}
+
+	for _, session := range []*yamux.Session{first, second} {
+		if err := s.claimDomain(cluster.Claim{Domain: "app.example.com", UserID: 1}); err != nil {
+			t.Fatalf("claimDomain: %v", err)
+		}
+		s.registerDomain("app.example.com", session, 1, false, false, true, nil)
+	}
+
+	// The claim stays while another local session serves the domain
+	s.unregisterDomain("app.example.com", first, false)
+	if _, ok, _ := registry.Lookup("app.example.com"); !ok {
+		t.Fatal("claim released while a session still serves the domain")
+	}
+	s.unregisterDomain("app.example.com", second, false)
+	if _, ok, _ := registry.Lookup("app.example.com"); ok {
+		t.Error("claim kept after the last session left")
+	}
+}
@@ -56,6 +56,8 @@ func NewSQLiteStore(path string) (*SQLiteStore, error) {
 		&models.User{},
 		&models.Token{},
 		&models.Domain{},
+		&models.CustomDomain{},
+		&models.DeviceCert{},
 		&models.AbuseReport{},
 		&models.UserBandwidth{},
 	); err != nil {
@@ -143,6 +145,21 @@ func (s *SQLiteStore) LinkTelegramAccount(userID uint, telegramID int64) error {
 	return s.db.Model(&models.User{}).Where("id = ?", userID).Update("telegram_id", telegramID).Error
 }
 
+// SetUserSessionLimits replaces the session policy overrides of a user; nil
+// fields go back to the server default. It returns ErrNotFound for unknown users.
+func (s *SQLiteStore) SetUserSessionLimits(userID uint, limits models.SessionLimits) error {
+	result := s.db.Model(&models.User{}).Where("id = ?", userID).
+		Select("max_session_minutes", "idle_timeout_minutes", "max_streams").
+		Updates(&models.User{SessionLimits: limits})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
 // --- Token Operations ---
 
 func (s *SQLiteStore) ValidateToken(tokenStr string) (*models.User, error) {
@@ -238,6 +255,15 @@ func (s *SQLiteStore) ValidateDomainOwnership(domainName string, userID uint) (b
 	return true, nil
 }
 
+// DomainExists reports whether any user owns a domain with this name.
+func (s *SQLiteStore) DomainExists(domainName string) (bool, error) {
+	var count int64
+	if err := s.db.Model(&models.Domain{}).Where("name = ?", domainName).Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
 func (s *SQLiteStore) CreateDomain(domain *models.Domain) error {
 	err := s.db.Create(domain).Error
 	if err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed") {
@@ -246,6 +272,140 @@ func (s *SQLiteStore) CreateDomain(domain *models.Domain) error {
 	return err
 }
 
+// --- Custom Domain Operations ---
+
+func (s *SQLiteStore) CreateCustomDomain(domain *models.CustomDomain) error {
+	err := s.db.Create(domain).Error
+	if err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed") {
+		return ErrDuplicateKey
+	}
+	return err
+}
+
+func (s *SQLiteStore) GetUserCustomDomains(userID uint) ([]models.CustomDomain, error) {
+	var domains []models.CustomDomain
+	if err := s.db.Where("user_id = ?", userID).Order("hostname").Find(&domains).Error; err != nil {
+		return nil, err
+	}
+	return domains, nil
+}
+
+// GetCustomDomain returns the claim of userID on hostname.
+func (s *SQLiteStore) GetCustomDomain(hostname string, userID uint) (*models.CustomDomain, error) {
+	var domain models.CustomDomain
+	result := s.db.Where("hostname = ? AND user_id = ?", hostname, userID).First(&domain)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, result.Error
+	}
+	return &domain, nil
+}
+
+// MarkCustomDomainVerified records a successful verification of the claim id
+// and drops the claims of other users on the same hostname: the TXT record
+// shows who controls the domain now.
+func (s *SQLiteStore) MarkCustomDomainVerified(id uint) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var domain models.CustomDomain
+		if err := tx.First(&domain, id).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNotFound
+			}
+			return err
+		}
+		if err := tx.Unscoped().Where("hostname = ? AND id <> ?", domain.Hostname, id).Delete(&models.CustomDomain{}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&domain).Update("verified_at", time.Now()).Error
+	})
+}
+
+// DeleteCustomDomain removes the claim of userID on hostname.
+func (s *SQLiteStore) DeleteCustomDomain(hostname string, userID uint) error {
+	result := s.db.Unscoped().Where("hostname = ? AND user_id = ?", hostname, userID).Delete(&models.CustomDomain{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ValidateCustomDomainOwnership reports whether userID owns hostname and has verified it.
+func (s *SQLiteStore) ValidateCustomDomainOwnership(hostname string, userID uint) (bool, error) {
+	var count int64
+	err := s.db.Model(&models.CustomDomain{}).
+		Where("hostname = ? AND user_id = ? AND verified_at IS NOT NULL", hostname, userID).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// IsVerifiedCustomDomain reports whether some user has verified hostname.
+func (s *SQLiteStore) IsVerifiedCustomDomain(hostname string) (bool, error) {
+	var count int64
+	err := s.db.Model(&models.CustomDomain{}).
+		Where("hostname = ? AND verified_at IS NOT NULL", hostname).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// --- Device Certificate Operations ---
+
+func (s *SQLiteStore) CreateDeviceCert(cert *models.DeviceCert) error {
+	err := s.db.Create(cert).Error
+	if err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed") {
+		return ErrDuplicateKey
+	}
+	return err
+}
+
+func (s *SQLiteStore) GetUserDeviceCerts(userID uint) ([]models.DeviceCert, error) {
+	var certs []models.DeviceCert
+	if err := s.db.Where("user_id = ?", userID).Order("created_at").Find(&certs).Error; err != nil {
+		return nil, err
+	}
+	return certs, nil
+}
+
+// RevokeDeviceCert revokes a certificate of userID. It returns ErrNotFound if
+// the user has no such certificate or it is already revoked.
+func (s *SQLiteStore) RevokeDeviceCert(id, userID uint) error {
+	result := s.db.Model(&models.DeviceCert{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", id, userID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ValidateDeviceCert returns the unexpired, unrevoked certificate with
+// fingerprint together with its user, and records that it was seen.
+func (s *SQLiteStore) ValidateDeviceCert(fingerprint string) (*models.DeviceCert, error) {
+	var cert models.DeviceCert
+	result := s.db.Preload("User").
+		Where("fingerprint = ? AND revoked_at IS NULL AND expires_at > ?", fingerprint, time.Now()).
+		First(&cert)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, result.Error
+	}
+	now := time.Now()
+	if err := s.db.Model(&cert).Update("last_seen_at", now).Error; err != nil {
+		return nil, err
+	}
+	cert.LastSeenAt = &now
+	return &cert, nil
+}
+
 // --- Abuse Report Operations ---
 
 func (s *SQLiteStore) CreateAbuseReport(report *models.AbuseReport) error {
@@ -537,6 +697,123 @@ func ValidateDomainOwnership(domainName string, userID uint) (bool, error) {
 	return (&SQLiteStore{db: DB}).ValidateDomainOwnership(domainName, userID)
 }
 
+// DomainExists checks whether a domain name is taken using the global DB.
+// Deprecated: Use SQLiteStore.DomainExists instead.
+func DomainExists(domainName string) (bool, error) {
+	if DB == nil {
+		return false, ErrDBError
+	}
+	return (&SQLiteStore{db: DB}).DomainExists(domainName)
+}
+
+// CreateCustomDomain creates a custom domain using the global DB.
+// Deprecated: Use SQLiteStore.CreateCustomDomain instead.
+func CreateCustomDomain(domain *models.CustomDomain) error {
+	if DB == nil {
+		return ErrDBError
+	}
+	return (&SQLiteStore{db: DB}).CreateCustomDomain(domain)
+}
+
+// GetUserCustomDomains gets user custom domains using the global DB.
+// Deprecated: Use SQLiteStore.GetUserCustomDomains instead.
+func GetUserCustomDomains(userID uint) ([]models.CustomDomain, error) {
+	if DB == nil {
+		return nil, ErrDBError
+	}
+	return (&SQLiteStore{db: DB}).GetUserCustomDomains(userID)
+}
+
+// GetCustomDomain gets a user's custom domain by hostname using the global DB.
+// Deprecated: Use SQLiteStore.GetCustomDomain instead.
+func GetCustomDomain(hostname string, userID uint) (*models.CustomDomain, error) {
+	if DB == nil {
+		return nil, ErrDBError
+	}
+	return (&SQLiteStore{db: DB}).GetCustomDomain(hostname, userID)
+}
+
+// MarkCustomDomainVerified records a successful verification using the global DB.
+// Deprecated: Use SQLiteStore.MarkCustomDomainVerified instead.
+func MarkCustomDomainVerified(id uint) error {
+	if DB == nil {
+		return ErrDBError
+	}
+	return (&SQLiteStore{db: DB}).MarkCustomDomainVerified(id)
+}
+
+// DeleteCustomDomain removes a user's custom domain using the global DB.
+// Deprecated: Use SQLiteStore.DeleteCustomDomain instead.
+func DeleteCustomDomain(hostname string, userID uint) error {
+	if DB == nil {
+		return ErrDBError
+	}
+	return (&SQLiteStore{db: DB}).DeleteCustomDomain(hostname, userID)
+}
+
+// ValidateCustomDomainOwnership checks custom domain ownership using the global DB.
+// Deprecated: Use SQLiteStore.ValidateCustomDomainOwnership instead.
+func ValidateCustomDomainOwnership(hostname string, userID uint) (bool, error) {
+	if DB == nil {
+		return false, ErrDBError
+	}
+	return (&SQLiteStore{db: DB}).ValidateCustomDomainOwnership(hostname, userID)
+}
+
+// IsVerifiedCustomDomain checks for a verified custom domain using the global DB.
+// Deprecated: Use SQLiteStore.IsVerifiedCustomDomain instead.
+func IsVerifiedCustomDomain(hostname string) (bool, error) {
+	if DB == nil {
+		return false, ErrDBError
+	}
+	return (&SQLiteStore{db: DB}).IsVerifiedCustomDomain(hostname)
+}
+
+// CreateDeviceCert records an issued device certificate using the global DB.
+// Deprecated: Use SQLiteStore.CreateDeviceCert instead.
+func CreateDeviceCert(cert *models.DeviceCert) error {
+	if DB == nil {
+		return ErrDBError
+	}
+	return (&SQLiteStore{db: DB}).CreateDeviceCert(cert)
+}
+
+// GetUserDeviceCerts gets user device certificates using the global DB.
+// Deprecated: Use SQLiteStore.GetUserDeviceCerts instead.
+func GetUserDeviceCerts(userID uint) ([]models.DeviceCert, error) {
+	if DB == nil {
+		return nil, ErrDBError
+	}
+	return (&SQLiteStore{db: DB}).GetUserDeviceCerts(userID)
+}
+
+// RevokeDeviceCert revokes a device certificate using the global DB.
+// Deprecated: Use SQLiteStore.RevokeDeviceCert instead.
+func RevokeDeviceCert(id, userID uint) error {
+	if DB == nil {
+		return ErrDBError
+	}
+	return (&SQLiteStore{db: DB}).RevokeDeviceCert(id, userID)
+}
+
+// ValidateDeviceCert validates a device certificate using the global DB.
+// Deprecated: Use SQLiteStore.ValidateDeviceCert instead.
+func ValidateDeviceCert(fingerprint string) (*models.DeviceCert, error) {
+	if DB == nil {
+		return nil, ErrDBError
+	}
+	return (&SQLiteStore{db: DB}).ValidateDeviceCert(fingerprint)
+}
+
+// SetUserSessionLimits sets session policy overrides using the global DB.
+// Deprecated: Use SQLiteStore.SetUserSessionLimits instead.
+func SetUserSessionLimits(userID uint, limits models.SessionLimits) error {
+	if DB == nil {
+		return ErrDBError
+	}
+	return (&SQLiteStore{db: DB}).SetUserSessionLimits(userID, limits)
+}
+
 // GetUserDomains gets user domains using the global DB.
 // Deprecated: Use SQLiteStore.GetUserDomains instead.
 func GetUserDomains(userID uint) ([]models.Domain, error) {
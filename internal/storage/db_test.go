@@ -4,6 +4,7 @@ import (
 	"errors"
 	"os"
 	"testing"
+	"time"
 
 	apperrors "gopublic/internal/errors"
 	"gopublic/internal/models"
@@ -104,3 +105,178 @@ func TestCreateUserWithTokenAndDomains_DuplicateDomain(t *testing.T) {
 		t.Errorf("expected ErrDuplicateKey, got: %v", err)
 	}
 }
+
+func TestDomainExists(t *testing.T) {
+	store := setupTestStore(t)
+	userID := createTestUser(t, store)
+	if err := store.CreateDomain(&models.Domain{Name: "misty-river-3f7a2c", UserID: userID}); err != nil {
+		t.Fatalf("CreateDomain: %v", err)
+	}
+
+	if exists, err := store.DomainExists("misty-river-3f7a2c"); err != nil || !exists {
+		t.Errorf("DomainExists(owned) = %v, %v", exists, err)
+	}
+	if exists, err := store.DomainExists("bold-fox-000000"); err != nil || exists {
+		t.Errorf("DomainExists(free) = %v, %v", exists, err)
+	}
+}
+
+func TestCustomDomainVerification(t *testing.T) {
+	store := setupTestStore(t)
+	userID := createTestUser(t, store)
+	domain := &models.CustomDomain{Hostname: "dev.example.org", UserID: userID, VerificationToken: "abc123"}
+	if err := store.CreateCustomDomain(domain); err != nil {
+		t.Fatalf("CreateCustomDomain: %v", err)
+	}
+	if err := store.CreateCustomDomain(&models.CustomDomain{Hostname: "dev.example.org", UserID: userID}); err != ErrDuplicateKey {
+		t.Errorf("duplicate CreateCustomDomain = %v, want ErrDuplicateKey", err)
+	}
+
+	// Unverified domains can't be bound or get certificates
+	if ok, err := store.ValidateCustomDomainOwnership("dev.example.org", userID); err != nil || ok {
+		t.Errorf("ValidateCustomDomainOwnership(unverified) = %v, %v", ok, err)
+	}
+	if ok, err := store.IsVerifiedCustomDomain("dev.example.org"); err != nil || ok {
+		t.Errorf("IsVerifiedCustomDomain(unverified) = %v, %v", ok, err)
+	}
+
+	if err := store.MarkCustomDomainVerified(domain.ID); err != nil {
+		t.Fatalf("MarkCustomDomainVerified: %v", err)
+	}
+	if ok, err := store.ValidateCustomDomainOwnership("dev.example.org", userID); err != nil || !ok {
+		t.Errorf("ValidateCustomDomainOwnership(verified) = %v, %v", ok, err)
+	}
+	if ok, _ := store.ValidateCustomDomainOwnership("dev.example.org", userID+1); ok {
+		t.Error("another user owns the verified domain")
+	}
+	if ok, err := store.IsVerifiedCustomDomain("dev.example.org"); err != nil || !ok {
+		t.Errorf("IsVerifiedCustomDomain(verified) = %v, %v", ok, err)
+	}
+}
+
+func TestCustomDomainTakeoverAndDelete(t *testing.T) {
+	store := setupTestStore(t)
+	first := createTestUser(t, store)
+	other := &models.User{Email: "other@example.com"}
+	if err := store.CreateUser(other); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+
+	// Adding a hostname doesn't keep other users from adding it too
+	held := &models.CustomDomain{Hostname: "dev.example.org", UserID: first, VerificationToken: "first"}
+	if err := store.CreateCustomDomain(held); err != nil {
+		t.Fatalf("CreateCustomDomain: %v", err)
+	}
+	if err := store.MarkCustomDomainVerified(held.ID); err != nil {
+		t.Fatalf("MarkCustomDomainVerified: %v", err)
+	}
+	claim := &models.CustomDomain{Hostname: "dev.example.org", UserID: other.ID, VerificationToken: "other"}
+	if err := store.CreateCustomDomain(claim); err != nil {
+		t.Fatalf("CreateCustomDomain by another user: %v", err)
+	}
+	if got, err := store.GetCustomDomain("dev.example.org", other.ID); err != nil || got.VerificationToken != "other" {
+		t.Errorf("GetCustomDomain() = %+v, %v, want the other user's claim", got, err)
+	}
+
+	// Verifying it takes the hostname over
+	if err := store.MarkCustomDomainVerified(claim.ID); err != nil {
+		t.Fatalf("MarkCustomDomainVerified: %v", err)
+	}
+	if ok, _ := store.ValidateCustomDomainOwnership("dev.example.org", other.ID); !ok {
+		t.Error("verifying user does not own the domain")
+	}
+	if _, err := store.GetCustomDomain("dev.example.org", first); err != ErrNotFound {
+		t.Errorf("previous holder's claim: GetCustomDomain() error = %v, want ErrNotFound", err)
+	}
+
+	if err := store.DeleteCustomDomain("dev.example.org", first); err != ErrNotFound {
+		t.Errorf("DeleteCustomDomain() of a missing claim = %v, want ErrNotFound", err)
+	}
+	if err := store.DeleteCustomDomain("dev.example.org", other.ID); err != nil {
+		t.Fatalf("DeleteCustomDomain: %v", err)
+	}
+	if ok, _ := store.IsVerifiedCustomDomain("dev.example.org"); ok {
+		t.Error("deleted domain still verified")
+	}
+
+	// A deleted domain can be added again
+	if err := store.CreateCustomDomain(&models.CustomDomain{Hostname: "dev.example.org", UserID: other.ID}); err != nil {
+		t.Errorf("CreateCustomDomain after delete: %v", err)
+	}
+}
+
+func TestDeviceCertLifecycle(t *testing.T) {
+	store := setupTestStore(t)
+	userID := createTestUser(t, store)
+	cert := &models.DeviceCert{UserID: userID, Name: "laptop", Fingerprint: "ab12", ExpiresAt: time.Now().Add(time.Hour)}
+	if err := store.CreateDeviceCert(cert); err != nil {
+		t.Fatalf("CreateDeviceCert: %v", err)
+	}
+	if err := store.CreateDeviceCert(&models.DeviceCert{UserID: userID, Fingerprint: "ab12"}); err != ErrDuplicateKey {
+		t.Errorf("duplicate CreateDeviceCert = %v, want ErrDuplicateKey", err)
+	}
+	expired := &models.DeviceCert{UserID: userID, Name: "old", Fingerprint: "cd34", ExpiresAt: time.Now().Add(-time.Hour)}
+	if err := store.CreateDeviceCert(expired); err != nil {
+		t.Fatalf("CreateDeviceCert: %v", err)
+	}
+
+	got, err := store.ValidateDeviceCert("ab12")
+	if err != nil {
+		t.Fatalf("ValidateDeviceCert: %v", err)
+	}
+	if got.User.ID != userID || got.Name != "laptop" || got.LastSeenAt == nil {
+		t.Errorf("ValidateDeviceCert = %+v, want laptop of user %d with LastSeenAt", got, userID)
+	}
+	if _, err := store.ValidateDeviceCert("cd34"); err != ErrNotFound {
+		t.Errorf("ValidateDeviceCert(expired) = %v, want ErrNotFound", err)
+	}
+
+	// Only the owner can revoke, and only once
+	if err := store.RevokeDeviceCert(cert.ID, userID+1); err != ErrNotFound {
+		t.Errorf("RevokeDeviceCert(other user) = %v, want ErrNotFound", err)
+	}
+	if err := store.RevokeDeviceCert(cert.ID, userID); err != nil {
+		t.Fatalf("RevokeDeviceCert: %v", err)
+	}
+	if err := store.RevokeDeviceCert(cert.ID, userID); err != ErrNotFound {
+		t.Errorf("second RevokeDeviceCert = %v, want ErrNotFound", err)
+	}
+	if _, err := store.ValidateDeviceCert("ab12"); err != ErrNotFound {
+		t.Errorf("ValidateDeviceCert(revoked) = %v, want ErrNotFound", err)
+	}
+
+	certs, err := store.GetUserDeviceCerts(userID)
+	if err != nil || len(certs) != 2 || certs[0].RevokedAt == nil {
+		t.Errorf("GetUserDeviceCerts = %+v, %v; want both, the first revoked", certs, err)
+	}
+}
+
+func TestSetUserSessionLimits(t *testing.T) {
+	store := setupTestStore(t)
+	userID := createTestUser(t, store)
+
+	idle := 30
+	unlimited := 0
+	if err := store.SetUserSessionLimits(userID, models.SessionLimits{IdleTimeoutMinutes: &idle, MaxStreams: &unlimited}); err != nil {
+		t.Fatalf("SetUserSessionLimits: %v", err)
+	}
+	user, err := store.GetUserByID(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.MaxSessionMinutes != nil || user.IdleTimeoutMinutes == nil || *user.IdleTimeoutMinutes != 30 || user.MaxStreams == nil || *user.MaxStreams != 0 {
+		t.Errorf("limits = %+v, want idle 30 and unlimited streams", user.SessionLimits)
+	}
+
+	// Nil fields go back to the server default
+	if err := store.SetUserSessionLimits(userID, models.SessionLimits{}); err != nil {
+		t.Fatal(err)
+	}
+	if user, _ = store.GetUserByID(userID); user.IdleTimeoutMinutes != nil || user.MaxStreams != nil {
+		t.Errorf("limits after reset = %+v, want all nil", user.SessionLimits)
+	}
+
+	if err := store.SetUserSessionLimits(userID+100, models.SessionLimits{}); err != ErrNotFound {
+		t.Errorf("SetUserSessionLimits(unknown user) = %v, want ErrNotFound", err)
+	}
+}
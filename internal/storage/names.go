@@ -0,0 +1,16 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+)
+
+// GenerateDomainName generates a unique domain slug using a cryptographically random suffix.
+// Format: <prefix>-<suffix>-<6-hex-chars>, e.g. "misty-river-3f7a2c".
+// This avoids collisions that occurred when using time.Unix()%1000.
+func GenerateDomainName(prefix, suffix string) string {
+	b := make([]byte, 3)
+	rand.Read(b)
+	return fmt.Sprintf("%s-%s-%s", prefix, suffix, hex.EncodeToString(b))
+}
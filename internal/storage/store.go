@@ -19,6 +19,7 @@ type Store interface {
 	AcceptTerms(userID uint) error
 	LinkYandexAccount(userID uint, yandexID string) error
 	LinkTelegramAccount(userID uint, telegramID int64) error
+	SetUserSessionLimits(userID uint, limits models.SessionLimits) error
 
 	// Token operations
 	ValidateToken(tokenStr string) (*models.User, error)
@@ -29,8 +30,24 @@ type Store interface {
 	// Domain operations
 	GetUserDomains(userID uint) ([]models.Domain, error)
 	ValidateDomainOwnership(domainName string, userID uint) (bool, error)
+	DomainExists(domainName string) (bool, error)
 	CreateDomain(domain *models.Domain) error
 
+	// Custom domain operations
+	CreateCustomDomain(domain *models.CustomDomain) error
+	GetUserCustomDomains(userID uint) ([]models.CustomDomain, error)
+	GetCustomDomain(hostname string, userID uint) (*models.CustomDomain, error)
+	MarkCustomDomainVerified(id uint) error
+	DeleteCustomDomain(hostname string, userID uint) error
+	ValidateCustomDomainOwnership(hostname string, userID uint) (bool, error)
+	IsVerifiedCustomDomain(hostname string) (bool, error)
+
+	// Device certificate operations
+	CreateDeviceCert(cert *models.DeviceCert) error
+	GetUserDeviceCerts(userID uint) ([]models.DeviceCert, error)
+	RevokeDeviceCert(id, userID uint) error
+	ValidateDeviceCert(fingerprint string) (*models.DeviceCert, error)
+
 	// Abuse report operations
 	CreateAbuseReport(report *models.AbuseReport) error
 	GetAbuseReports(status string) ([]models.AbuseReport, error)
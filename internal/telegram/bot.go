@@ -9,12 +9,19 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
+	"gopublic/internal/models"
 	"gopublic/internal/storage"
 )
 
+// Announcer broadcasts operator messages to connected clients.
+type Announcer interface {
+	Announce(level, message string) int
+}
+
 // Bot handles Telegram bot interactions for admin statistics and auth
 type Bot struct {
 	token         string
@@ -26,6 +33,9 @@ type Bot struct {
 	client        *http.Client
 	ctx           context.Context
 	cancel        context.CancelFunc
+
+	// Announcer delivers /announce messages to clients (nil = command disabled)
+	Announcer Announcer
 }
 
 // NewBot creates a new Telegram bot instance
@@ -273,7 +283,109 @@ func (b *Bot) handleUpdate(update Update) {
 		b.sendMessage(msg.Chat.ID, "Привет! Я бот GoPublic.\n\nИспользуйте /stats для просмотра статистики.")
 	case text == "/help":
 		b.sendHelp(msg.Chat.ID)
+	case strings.HasPrefix(text, "/announce"):
+		b.announce(msg.Chat.ID, strings.TrimSpace(strings.TrimPrefix(text, "/announce")))
+	case strings.HasPrefix(text, "/limits"):
+		b.sessionLimits(msg.Chat.ID, strings.Fields(strings.TrimPrefix(text, "/limits")))
+	}
+}
+
+// NotifyAdmin sends a security alert to the admin without blocking.
+func (b *Bot) NotifyAdmin(text string) {
+	if b.ctx == nil {
+		return // Not started: no token or admin configured
+	}
+	go b.sendMessage(b.adminID, text)
+}
+
+func (b *Bot) announce(chatID int64, message string) {
+	if b.Announcer == nil {
+		b.sendMessage(chatID, "❌ Рассылка недоступна")
+		return
+	}
+	if message == "" {
+		b.sendMessage(chatID, "Использование: /announce текст сообщения")
+		return
+	}
+	sent := b.Announcer.Announce("info", message)
+	b.sendMessage(chatID, fmt.Sprintf("📣 Сообщение отправлено клиентам: %d", sent))
+}
+
+const limitsUsage = "Использование: /limits ID [сессия\\_мин простой\\_мин потоки]\nЧисло или «-» (по умолчанию), 0 — без ограничения"
+
+// sessionLimits shows or sets the session policy overrides of a user.
+func (b *Bot) sessionLimits(chatID int64, args []string) {
+	if len(args) != 1 && len(args) != 4 {
+		b.sendMessage(chatID, limitsUsage)
+		return
+	}
+	userID, err := strconv.ParseUint(args[0], 10, 32)
+	if err != nil {
+		b.sendMessage(chatID, limitsUsage)
+		return
+	}
+
+	if len(args) == 4 {
+		var values [3]*int
+		for i, arg := range args[1:] {
+			if values[i], err = parseLimit(arg); err != nil {
+				b.sendMessage(chatID, limitsUsage)
+				return
+			}
+		}
+		limits := models.SessionLimits{MaxSessionMinutes: values[0], IdleTimeoutMinutes: values[1], MaxStreams: values[2]}
+		if err := storage.SetUserSessionLimits(uint(userID), limits); err != nil {
+			b.sendMessage(chatID, fmt.Sprintf("❌ Не удалось сохранить лимиты: %v", err))
+			return
+		}
+	}
+
+	user, err := storage.GetUserByID(uint(userID))
+	if err != nil {
+		b.sendMessage(chatID, fmt.Sprintf("❌ Пользователь не найден: %v", err))
+		return
+	}
+	var sb strings.Builder
+	info := storage.UserStats{
+		UserID:     user.ID,
+		TelegramID: user.TelegramID,
+		YandexID:   user.YandexID,
+		Email:      user.Email,
+		Username:   user.Username,
+		FirstName:  user.FirstName,
+		LastName:   user.LastName,
+	}
+	sb.WriteString(fmt.Sprintf("⚙️ *Лимиты сессий пользователя #%d*\n%s\n\n", user.ID, formatUserInfo(info)))
+	sb.WriteString(fmt.Sprintf("Длительность сессии: %s\n", formatLimit(user.MaxSessionMinutes, " мин")))
+	sb.WriteString(fmt.Sprintf("Простой без потоков: %s\n", formatLimit(user.IdleTimeoutMinutes, " мин")))
+	sb.WriteString(fmt.Sprintf("Одновременных потоков: %s\n", formatLimit(user.MaxStreams, "")))
+	if len(args) == 4 {
+		sb.WriteString("\n_Применяется к новым подключениям_")
+	}
+	b.sendMessage(chatID, sb.String())
+}
+
+// parseLimit parses a /limits value: "-" for the server default or a
+// non-negative number.
+func parseLimit(arg string) (*int, error) {
+	if arg == "-" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid limit %q", arg)
+	}
+	return &n, nil
+}
+
+func formatLimit(v *int, unit string) string {
+	switch {
+	case v == nil:
+		return "по умолчанию"
+	case *v == 0:
+		return "без ограничения"
 	}
+	return fmt.Sprintf("%d%s", *v, unit)
 }
 
 func (b *Bot) sendStats(chatID int64) {
@@ -331,6 +443,9 @@ func (b *Bot) sendHelp(chatID int64) {
 	help := `🤖 *Команды бота:*
 
 /stats — Показать статистику
+/announce текст — Отправить сообщение всем подключённым клиентам
+/limits ID — Показать лимиты сессий пользователя
+/limits ID сессия простой потоки — Задать лимиты (минуты, минуты, число; «-» — по умолчанию, 0 — без ограничения)
 /help — Показать справку
 
 Бот показывает статистику только администратору.`
@@ -0,0 +1,186 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// ALPN is the TLS application protocol negotiated on QUIC connections.
+const ALPN = "gopublic"
+
+// maxQUICStreams bounds the concurrent streams each side may open; every
+// public request is one stream.
+const maxQUICStreams = 10000
+
+// ErrGoingAway is returned by Accept after GoAway.
+var ErrGoingAway = errors.New("session is going away")
+
+// quicConfig keeps idle connections alive like the yamux keepalive does.
+func quicConfig() *quic.Config {
+	return &quic.Config{
+		KeepAlivePeriod:       10 * time.Second,
+		MaxIdleTimeout:        30 * time.Second,
+		MaxIncomingStreams:    maxQUICStreams,
+		MaxIncomingUniStreams: -1,
+	}
+}
+
+// quicTLSConfig copies tlsConf and restricts ALPN to ALPN.
+func quicTLSConfig(tlsConf *tls.Config) *tls.Config {
+	c := tlsConf.Clone()
+	c.NextProtos = []string{ALPN}
+	return c
+}
+
+// QUICListener accepts QUIC sessions from tunnel clients.
+type QUICListener struct {
+	ln *quic.Listener
+}
+
+// ListenQUIC listens for QUIC sessions on the UDP address addr. tlsConf must
+// carry a certificate; QUIC has no plaintext mode.
+func ListenQUIC(addr string, tlsConf *tls.Config) (*QUICListener, error) {
+	ln, err := quic.ListenAddr(addr, quicTLSConfig(tlsConf), quicConfig())
+	if err != nil {
+		return nil, err
+	}
+	return &QUICListener{ln: ln}, nil
+}
+
+// Accept waits for the next client session.
+func (l *QUICListener) Accept(ctx context.Context) (Session, error) {
+	conn, err := l.ln.Accept(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newQUICSession(conn), nil
+}
+
+// Close stops listening. Accepted sessions stay open.
+func (l *QUICListener) Close() error {
+	return l.ln.Close()
+}
+
+// Addr returns the local UDP address.
+func (l *QUICListener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// DialQUIC opens a QUIC session to the server at addr.
+func DialQUIC(ctx context.Context, addr string, tlsConf *tls.Config) (Session, error) {
+	conn, err := quic.DialAddr(ctx, addr, quicTLSConfig(tlsConf), quicConfig())
+	if err != nil {
+		return nil, err
+	}
+	return newQUICSession(conn), nil
+}
+
+// quicSession adapts a QUIC connection to Session. Each stream is a native
+// QUIC stream, so a lost packet only stalls the stream it belongs to, and
+// the connection survives the client changing networks.
+type quicSession struct {
+	conn      *quic.Conn
+	streams   atomic.Int64
+	goingAway atomic.Bool
+}
+
+func newQUICSession(conn *quic.Conn) *quicSession {
+	return &quicSession{conn: conn}
+}
+
+func (s *quicSession) Open() (net.Conn, error) {
+	stream, err := s.conn.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return s.wrap(stream), nil
+}
+
+func (s *quicSession) Accept() (net.Conn, error) {
+	for {
+		stream, err := s.conn.AcceptStream(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		if s.goingAway.Load() {
+			// QUIC has no GOAWAY frame; refuse the stream instead
+			stream.CancelRead(0)
+			stream.CancelWrite(0)
+			continue
+		}
+		return s.wrap(stream), nil
+	}
+}
+
+func (s *quicSession) Close() error {
+	return s.conn.CloseWithError(0, "")
+}
+
+func (s *quicSession) IsClosed() bool {
+	return s.conn.Context().Err() != nil
+}
+
+func (s *quicSession) CloseChan() <-chan struct{} {
+	return s.conn.Context().Done()
+}
+
+func (s *quicSession) NumStreams() int {
+	return int(s.streams.Load())
+}
+
+func (s *quicSession) GoAway() error {
+	s.goingAway.Store(true)
+	return nil
+}
+
+func (s *quicSession) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// PeerCertificate returns the client certificate verified during the QUIC
+// handshake, or nil if the client sent none.
+func (s *quicSession) PeerCertificate() *x509.Certificate {
+	if certs := s.conn.ConnectionState().TLS.PeerCertificates; len(certs) > 0 {
+		return certs[0]
+	}
+	return nil
+}
+
+func (s *quicSession) wrap(stream *quic.Stream) net.Conn {
+	s.streams.Add(1)
+	return &quicStream{Stream: stream, session: s}
+}
+
+// quicStream is a QUIC stream with the net.Conn methods it lacks.
+type quicStream struct {
+	*quic.Stream
+	session   *quicSession
+	closeOnce sync.Once
+}
+
+// Close ends the sending side like closing a yamux stream does: the peer
+// reads EOF, and data it still sends can be read until it closes too.
+func (s *quicStream) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		err = s.Stream.Close()
+		s.session.streams.Add(-1)
+	})
+	return err
+}
+
+func (s *quicStream) LocalAddr() net.Addr {
+	return s.session.conn.LocalAddr()
+}
+
+func (s *quicStream) RemoteAddr() net.Addr {
+	return s.session.conn.RemoteAddr()
+}
@@ -0,0 +1,127 @@
+package transport
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// selfSignedTLS returns a server config with a throwaway certificate for localhost.
+func selfSignedTLS(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+// quicPair returns the client and server ends of a QUIC session over localhost.
+func quicPair(t *testing.T) (client, server Session) {
+	t.Helper()
+	ln, err := ListenQUIC("127.0.0.1:0", selfSignedTLS(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, err = DialQUIC(ctx, ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = ln.Accept(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestQUICSession_Streams(t *testing.T) {
+	client, server := quicPair(t)
+
+	stream, err := client.Open()
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if _, err := stream.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	stream.Close()
+
+	accepted, err := server.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	if server.NumStreams() != 1 {
+		t.Errorf("NumStreams() = %d, want 1", server.NumStreams())
+	}
+
+	// Closing is a half-close: the peer reads EOF but can still answer
+	data, err := io.ReadAll(accepted)
+	if err != nil || string(data) != "ping" {
+		t.Fatalf("read %q, %v; want ping", data, err)
+	}
+	if _, err := accepted.Write([]byte("pong")); err != nil {
+		t.Fatalf("reply after half-close: %v", err)
+	}
+	accepted.Close()
+	if server.NumStreams() != 0 {
+		t.Errorf("NumStreams() = %d after Close, want 0", server.NumStreams())
+	}
+
+	reply, err := io.ReadAll(stream)
+	if err != nil || string(reply) != "pong" {
+		t.Errorf("reply %q, %v; want pong", reply, err)
+	}
+}
+
+func TestQUICSession_GoAwayAndClose(t *testing.T) {
+	client, server := quicPair(t)
+
+	server.GoAway()
+	go server.Accept() // Refuses streams until the session closes
+
+	stream, err := client.Open()
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	stream.Write([]byte("late"))
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := stream.Read(make([]byte, 1)); err == nil || err == io.EOF {
+		t.Errorf("stream opened after GoAway read %v, want reset", err)
+	}
+
+	client.Close()
+	select {
+	case <-server.CloseChan():
+	case <-time.After(5 * time.Second):
+		t.Fatal("server session not closed after the client closed")
+	}
+	if !server.IsClosed() {
+		t.Error("IsClosed() = false after close")
+	}
+}
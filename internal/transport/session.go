@@ -0,0 +1,40 @@
+// Package transport abstracts the multiplexed connection between a tunnel
+// client and the server. Streams are net.Conns on either yamux over TCP or
+// native QUIC streams, so the handshake and proxying code works with both.
+package transport
+
+import (
+	"crypto/x509"
+	"net"
+)
+
+// Session is a multiplexed connection between client and server.
+// *yamux.Session implements it.
+type Session interface {
+	// Open opens a new stream to the peer.
+	Open() (net.Conn, error)
+	// Accept waits for the next stream opened by the peer.
+	Accept() (net.Conn, error)
+	// Close closes the session and all of its streams.
+	Close() error
+	// IsClosed reports whether the session has been closed.
+	IsClosed() bool
+	// CloseChan is closed when the session closes.
+	CloseChan() <-chan struct{}
+	// NumStreams returns the number of open streams.
+	NumStreams() int
+	// GoAway stops accepting new streams from the peer; open streams continue.
+	GoAway() error
+	// RemoteAddr returns the address of the peer.
+	RemoteAddr() net.Addr
+}
+
+// PeerCertificate returns the client certificate a session's own TLS
+// handshake verified. It is nil for clients without one and for yamux
+// sessions, whose TLS belongs to the underlying connection.
+func PeerCertificate(session Session) *x509.Certificate {
+	if s, ok := session.(interface{ PeerCertificate() *x509.Certificate }); ok {
+		return s.PeerCertificate()
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// WebSocketPath is where the public HTTPS ingress accepts the control plane
+// for clients that can only reach port 443.
+const WebSocketPath = "/_gopublic/tunnel"
+
+// WebSocketHandler upgrades requests to a binary WebSocket and hands it to
+// serve as a plain byte stream. serve must not return before it is done
+// with the connection.
+func WebSocketHandler(serve func(net.Conn)) http.Handler {
+	// The client is not a browser, so there is no Origin to check
+	return websocket.Server{Handler: func(ws *websocket.Conn) {
+		ws.PayloadType = websocket.BinaryFrame
+		serve(&wsConn{Conn: ws, remote: wsAddr(ws.Request().RemoteAddr)})
+	}}
+}
+
+// DialWebSocket opens the control plane as a WebSocket to the HTTPS ingress
+// at addr, usually port 443, through proxyURL unless it is nil.
+func DialWebSocket(ctx context.Context, addr string, tlsConf *tls.Config, proxyURL *url.URL) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := DialViaProxy(ctx, addr, proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	c := tlsConf.Clone()
+	if c.ServerName == "" {
+		c.ServerName = host
+	}
+	c.NextProtos = []string{"http/1.1"}
+	tlsConn := tls.Client(conn, c)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	config, err := websocket.NewConfig("wss://"+addr+WebSocketPath, "https://"+host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ws, err := websocket.NewClient(config, tlsConn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("websocket handshake: %w", err)
+	}
+	conn.SetDeadline(time.Time{})
+	ws.PayloadType = websocket.BinaryFrame
+	return &wsConn{Conn: ws, remote: wsAddr(conn.RemoteAddr().String())}, nil
+}
+
+// wsConn is a WebSocket with the peer's network address; websocket.Conn
+// reports the URL instead.
+type wsConn struct {
+	*websocket.Conn
+	remote net.Addr
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// wsAddr is the "tcp" address of the peer of a WebSocket.
+type wsAddr string
+
+func (a wsAddr) Network() string { return "tcp" }
+func (a wsAddr) String() string  { return string(a) }
@@ -0,0 +1,48 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// echoServer serves the control plane path and echoes every byte back.
+func echoServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewTLSServer(WebSocketHandler(func(conn net.Conn) {
+		io.Copy(conn, conn)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestWebSocket_ByteStream(t *testing.T) {
+	srv := echoServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := DialWebSocket(ctx, srv.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true}, nil)
+	if err != nil {
+		t.Fatalf("DialWebSocket: %v", err)
+	}
+	defer conn.Close()
+
+	// Writes may be split into frames differently than they are read
+	conn.Write([]byte("hello "))
+	conn.Write([]byte("world"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, len("hello world"))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(buf) != "hello world" {
+		t.Errorf("echo = %q, want %q", buf, "hello world")
+	}
+	if _, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err != nil {
+		t.Errorf("RemoteAddr() = %q, want host:port", conn.RemoteAddr())
+	}
+}
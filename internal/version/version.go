@@ -1,6 +1,52 @@
 package version
 
+import (
+	"strconv"
+	"strings"
+)
+
 // Version is the current version of the application.
 // It can be overridden at build time via ldflags:
 // -ldflags "-X gopublic/internal/version.Version=1.0.0"
 var Version = "dev"
+
+// IsDev reports whether v is a development build that was not tagged.
+func IsDev(v string) bool {
+	return v == "" || strings.HasPrefix(v, "dev")
+}
+
+// Compare compares two dotted versions such as "v1.2.3" and "1.10".
+// It returns -1, 0 or 1. A leading "v" and any pre-release or build suffix
+// ("-rc1", "+abc") are ignored; missing components count as zero.
+func Compare(a, b string) int {
+	pa, pb := parse(a), parse(b)
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var x, y int
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		if x < y {
+			return -1
+		}
+		if x > y {
+			return 1
+		}
+	}
+	return 0
+}
+
+func parse(v string) []int {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	if i := strings.IndexAny(v, "-+"); i != -1 {
+		v = v[:i]
+	}
+	var parts []int
+	for _, s := range strings.Split(v, ".") {
+		n, _ := strconv.Atoi(s)
+		parts = append(parts, n)
+	}
+	return parts
+}
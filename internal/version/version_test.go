@@ -0,0 +1,34 @@
+package version
+
+import "testing"
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.2.3", "1.2.3", 0},
+		{"v1.2.3", "1.2.3", 0},
+		{"1.2", "1.2.0", 0},
+		{"1.2.3", "1.2.4", -1},
+		{"1.10.0", "1.9.9", 1},
+		{"v2.0.0-rc1", "v1.9.0", 1},
+		{"1.0.0+build5", "1.0.0", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.a+"_"+tt.b, func(t *testing.T) {
+			if got := Compare(tt.a, tt.b); got != tt.want {
+				t.Errorf("Compare(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsDev(t *testing.T) {
+	for v, want := range map[string]bool{"": true, "dev": true, "dev-abc123": true, "v1.0.0": false} {
+		if got := IsDev(v); got != want {
+			t.Errorf("IsDev(%q) = %v, want %v", v, got, want)
+		}
+	}
+}
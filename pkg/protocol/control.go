@@ -0,0 +1,69 @@
+package protocol
+
+// ControlType identifies the kind of a ControlMessage.
+type ControlType string
+
+const (
+	ControlPing         ControlType = "ping"          // Either side; answered with pong
+	ControlPong         ControlType = "pong"          // Echoes the ping's Seq and SentAt
+	ControlUsage        ControlType = "usage"         // Server -> client: current bandwidth usage
+	ControlQuotaWarning ControlType = "quota_warning" // Server -> client: usage is close to or over the limit
+	ControlAnnouncement ControlType = "announcement"  // Server -> client: message from the operator
+	ControlDisconnect   ControlType = "disconnect"    // Server -> client: reason the session is about to be closed
+	ControlBind         ControlType = "bind"          // Client -> server: bind Domain to this session
+	ControlRelease      ControlType = "release"       // Client -> server: release Domain from this session
+	ControlResult       ControlType = "result"        // Server -> client: outcome of the bind/release/close with the same Seq
+	ControlClose        ControlType = "close"         // Client -> server: the client is shutting down and won't reconnect
+)
+
+// Disconnect reasons sent with ControlDisconnect.
+const (
+	DisconnectReplaced = "replaced"        // Another client connected with --force
+	DisconnectShutdown = "server_shutdown" // Server is shutting down
+	DisconnectPolicy   = "policy"          // A session policy ended the session; Code tells which
+)
+
+// ControlMessage is a typed message on the control stream. Only the payload
+// matching Type is set. Messages are newline-delimited JSON.
+type ControlMessage struct {
+	Type ControlType `json:"type"`
+
+	// Seq correlates a ping with its pong and a bind/release/close with its result
+	Seq    uint64 `json:"seq,omitempty"`
+	SentAt int64  `json:"sent_at,omitempty"` // Unix nanoseconds on the sender's clock
+
+	// Bind / release / result. Requests carry the subdomain as in
+	// TunnelRequest; a successful bind result carries the bound hostname.
+	Domain string `json:"domain,omitempty"`
+	Error  string `json:"error,omitempty"` // Set on a failed result
+
+	Usage        *ServerStats  `json:"usage,omitempty"`
+	Quota        *QuotaWarning `json:"quota,omitempty"`
+	Announcement *Announcement `json:"announcement,omitempty"`
+	Disconnect   *Disconnect   `json:"disconnect,omitempty"`
+}
+
+// QuotaWarning tells the client how close it is to the daily bandwidth limit.
+type QuotaWarning struct {
+	Used     int64 `json:"used"`     // Bytes used today
+	Limit    int64 `json:"limit"`    // Daily limit in bytes
+	Exceeded bool  `json:"exceeded"` // Public URLs answer 429 until the limit resets
+}
+
+// Announcement is a free-form message from the server operator.
+type Announcement struct {
+	Level   string `json:"level"` // "info" or "warn"
+	Message string `json:"message"`
+}
+
+// Disconnect explains why the server is closing the session.
+type Disconnect struct {
+	Reason  string `json:"reason"` // One of the Disconnect* constants
+	Message string `json:"message"`
+	// Code is set for DisconnectPolicy; the client decides from it whether
+	// to reconnect.
+	Code ErrorCode `json:"code,omitempty"`
+	// ReconnectIn tells a client whose server is shutting down how many
+	// seconds to wait before reconnecting, instead of backing off.
+	ReconnectIn int `json:"reconnect_in,omitempty"`
+}
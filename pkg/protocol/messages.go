@@ -4,21 +4,126 @@ package protocol
 type ErrorCode string
 
 const (
-	ErrorCodeNone             ErrorCode = ""
-	ErrorCodeInvalidToken     ErrorCode = "invalid_token"
-	ErrorCodeAlreadyConnected ErrorCode = "already_connected"
-	ErrorCodeNoDomains        ErrorCode = "no_domains"
+	ErrorCodeNone               ErrorCode = ""
+	ErrorCodeInvalidToken       ErrorCode = "invalid_token"
+	ErrorCodeAlreadyConnected   ErrorCode = "already_connected"
+	ErrorCodeNoDomains          ErrorCode = "no_domains"
+	ErrorCodeIncompatibleClient ErrorCode = "incompatible_client" // Client is older than InitResponse.MinClientVersion
+	ErrorCodeDomainReserved     ErrorCode = "domain_reserved"     // Domain is held for a reconnecting client; retry later
+	ErrorCodeRateLimited        ErrorCode = "rate_limited"        // Too many failed token attempts from the client's IP; retry later
+	ErrorCodeSessionExpired     ErrorCode = "session_expired"     // Session reached its maximum duration; reconnect for a new one
+	ErrorCodeIdleTimeout        ErrorCode = "idle_timeout"        // Session carried no streams for too long; don't reconnect on its own
 )
 
+// ProtocolVersion is the handshake protocol version spoken by this build.
+// Clients that predate negotiation send no version, which is treated as 0.
+const ProtocolVersion = 1
+
+// Capabilities advertised by either side during the handshake. A feature is
+// only used when the peer lists it, so new features can ship without
+// breaking deployed clients or servers.
+const (
+	CapabilityStreamHeader   = "stream_header"   // Typed streams start with a StreamHeader
+	CapabilityTCPTunnels     = "tcp_tunnels"     // Raw TCP tunnels on public ports
+	CapabilityUDPTunnels     = "udp_tunnels"     // UDP tunnels on public ports
+	CapabilityTLSPassthrough = "tls_passthrough" // SNI-routed TLS passthrough domains
+	// CapabilityControlStream keeps the handshake stream open after InitResponse
+	// to carry ControlMessage values in both directions.
+	CapabilityControlStream = "control_stream"
+	// CapabilityRuntimeBind allows bind/release control messages on a live session.
+	CapabilityRuntimeBind = "runtime_bind"
+	// CapabilityResume lets a reconnecting client reclaim its domains with
+	// InitResponse.ResumeToken while the server keeps them reserved.
+	CapabilityResume = "resume"
+	// CapabilitySharedDomains lets several sessions of a user serve the same
+	// domains when they all set TunnelRequest.Shared.
+	CapabilitySharedDomains = "shared_domains"
+	// CapabilityEphemeralDomains binds a random throwaway domain when
+	// TunnelRequest.Ephemeral is set.
+	CapabilityEphemeralDomains = "ephemeral_domains"
+	// CapabilityAccessPolicy enforces TunnelRequest.Access at the ingress.
+	CapabilityAccessPolicy = "access_policy"
+	// CapabilityLoginWall enforces AccessPolicy.Login, making visitors sign in
+	// before they reach the tunnel.
+	CapabilityLoginWall = "login_wall"
+	// CapabilityCloseNotice accepts ControlClose, so a client that shuts down
+	// has its domains released at once instead of held for a reconnect.
+	CapabilityCloseNotice = "close_notice"
+)
+
+// HasCapability reports whether caps contains capability.
+func HasCapability(caps []string, capability string) bool {
+	for _, c := range caps {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
 // AuthRequest is the first message sent by the client to authenticate using a token.
 type AuthRequest struct {
 	Token string `json:"token"`
 	Force bool   `json:"force,omitempty"` // Force disconnect existing session
+
+	ClientVersion   string   `json:"client_version,omitempty"`   // Release version of the CLI, e.g. "v1.4.0"
+	ProtocolVersion int      `json:"protocol_version,omitempty"` // Handshake protocol version
+	Capabilities    []string `json:"capabilities,omitempty"`     // Features the client supports
+	ResumeToken     string   `json:"resume_token,omitempty"`     // From the previous InitResponse, to reclaim reserved domains
 }
 
 // TunnelRequest follows authentication to request binding of specific domains.
 type TunnelRequest struct {
 	RequestedDomains []string `json:"requested_domains"`
+	TCPTunnels       []string `json:"tcp_tunnels,omitempty"` // Names of raw TCP tunnels to expose on public ports
+	UDPTunnels       []string `json:"udp_tunnels,omitempty"` // Names of UDP tunnels to expose on public ports
+	// TLSDomains are bound in passthrough mode: the server forwards raw TLS
+	// bytes selected by SNI and the client terminates TLS itself.
+	TLSDomains []string `json:"tls_domains,omitempty"`
+	// Shared opts in to serving the domains together with other shared
+	// sessions of the same user; the server load balances between them.
+	// Without it, a domain served by another session is a conflict.
+	Shared bool `json:"shared,omitempty"`
+	// Ephemeral asks for a random domain that lives only as long as the
+	// session and is never stored. The user's own domains are only bound
+	// when requested explicitly.
+	Ephemeral bool `json:"ephemeral,omitempty"`
+	// Access restricts who may reach HTTP domains, keyed by the name as
+	// given in RequestedDomains. Domains without a policy are public.
+	Access map[string]*AccessPolicy `json:"access,omitempty"`
+}
+
+// AccessPolicy restricts who may reach an HTTP domain. The ingress checks it
+// before opening a stream, so rejected visitors never reach the client nor
+// count toward its bandwidth. When credentials are set, a request needs one
+// of them; the deny list wins over the allow list.
+type AccessPolicy struct {
+	BasicAuth   []string     `json:"basic_auth,omitempty"`   // "user:password" pairs for HTTP basic auth
+	BearerToken string       `json:"bearer_token,omitempty"` // Accepted as "Authorization: Bearer <token>"
+	AllowCIDRs  []string     `json:"allow_cidrs,omitempty"`  // Only visitors from these networks (empty = any)
+	DenyCIDRs   []string     `json:"deny_cidrs,omitempty"`   // Visitors from these networks are refused
+	Login       *LoginPolicy `json:"login,omitempty"`        // Visitors must sign in first (nil = no login)
+}
+
+// Login providers of a LoginPolicy
+const (
+	LoginProviderDashboard = "dashboard" // The dashboard's Telegram and Yandex login
+	LoginProviderOIDC      = "oidc"      // The OpenID Connect provider configured on the server
+)
+
+// LoginPolicy sends visitors to a login page and lets in only the
+// identities on Allow. The client receives the identity of each visitor in
+// the X-Gopublic-User header.
+type LoginPolicy struct {
+	Provider string   `json:"provider,omitempty"` // LoginProviderDashboard (default) or LoginProviderOIDC
+	Allow    []string `json:"allow"`              // "tg:<telegram id>", "oidc:<subject>", "user@example.com" or "*@example.com"
+}
+
+// PortBinding describes a public TCP or UDP port assigned to a named tunnel.
+type PortBinding struct {
+	Name string `json:"name"`
+	Port int    `json:"port"`
+	Addr string `json:"addr"` // Public host:port visitors connect to
 }
 
 // ServerStats contains user bandwidth statistics from the server.
@@ -33,8 +138,21 @@ type InitResponse struct {
 	Success   bool      `json:"success"`
 	Error     string    `json:"error,omitempty"`
 	ErrorCode ErrorCode `json:"error_code,omitempty"` // Structured error code
-	// AssignedDomains could be useful if we support random assignment (future),
-	// but for now it confirms what was bound.
-	BoundDomains []string     `json:"bound_domains,omitempty"`
-	ServerStats  *ServerStats `json:"server_stats,omitempty"` // User bandwidth statistics
+	// BoundDomains confirms what was bound, including the random domain of
+	// an ephemeral request.
+	BoundDomains []string      `json:"bound_domains,omitempty"`
+	TCPBindings  []PortBinding `json:"tcp_bindings,omitempty"` // Public ports bound for raw TCP tunnels
+	UDPBindings  []PortBinding `json:"udp_bindings,omitempty"` // Public ports bound for UDP tunnels
+	TLSDomains   []string      `json:"tls_domains,omitempty"`  // Domains bound in TLS passthrough mode
+	ServerStats  *ServerStats  `json:"server_stats,omitempty"` // User bandwidth statistics
+
+	ServerVersion    string   `json:"server_version,omitempty"`
+	ProtocolVersion  int      `json:"protocol_version,omitempty"`
+	Capabilities     []string `json:"capabilities,omitempty"`       // Features the server supports
+	MinClientVersion string   `json:"min_client_version,omitempty"` // Oldest client release the server accepts
+
+	// ResumeToken reclaims this session's domains on reconnect while the
+	// server keeps them reserved for ResumeGraceSeconds after session loss.
+	ResumeToken        string `json:"resume_token,omitempty"`
+	ResumeGraceSeconds int    `json:"resume_grace_seconds,omitempty"`
 }
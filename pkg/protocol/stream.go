@@ -0,0 +1,120 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Stream protocols carried over a yamux stream opened by the server.
+const (
+	StreamProtoHTTP = "http"
+	StreamProtoTCP  = "tcp"
+	StreamProtoTLS  = "tls" // Raw TLS bytes for a passthrough domain
+	StreamProtoUDP  = "udp" // Length-prefixed datagrams of one UDP flow
+)
+
+// StreamHeaderMagic is the first byte of a stream that starts with a StreamHeader.
+// HTTP request lines never start with a NUL byte, so clients can tell a typed
+// stream apart from a legacy stream that carries a raw HTTP request.
+const StreamHeaderMagic byte = 0x00
+
+// maxStreamHeaderSize bounds the encoded header to protect against garbage input.
+const maxStreamHeaderSize = 16 * 1024
+
+// StreamHeader is written by the server at the start of a typed stream.
+// HTTP streams carry one too when the client has the stream_header
+// capability, so the client learns the visitor without trusting request headers.
+type StreamHeader struct {
+	Proto  string `json:"proto"`            // One of the StreamProto* constants
+	Name   string `json:"name,omitempty"`   // Tunnel name for raw TCP and UDP streams
+	Domain string `json:"domain,omitempty"` // Bound domain the stream was routed by
+	// RemoteAddr is the public visitor's address as seen by the server.
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	TLSVersion string `json:"tls_version,omitempty"` // e.g. "TLS 1.3"; empty for plain HTTP
+	SNI        string `json:"sni,omitempty"`         // Server name the visitor asked for
+	RequestID  string `json:"request_id,omitempty"`  // Assigned by the ingress to HTTP requests
+}
+
+// WriteStreamHeader writes the magic byte, a big-endian uint16 length and the JSON header.
+func WriteStreamHeader(w io.Writer, h *StreamHeader) error {
+	payload, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	if len(payload) > maxStreamHeaderSize {
+		return fmt.Errorf("stream header too large: %d bytes", len(payload))
+	}
+	buf := make([]byte, 3+len(payload))
+	buf[0] = StreamHeaderMagic
+	binary.BigEndian.PutUint16(buf[1:3], uint16(len(payload)))
+	copy(buf[3:], payload)
+	_, err = w.Write(buf)
+	return err
+}
+
+// HasStreamHeader reports whether the next byte in r is StreamHeaderMagic.
+// It does not consume any input.
+func HasStreamHeader(r *bufio.Reader) bool {
+	b, err := r.Peek(1)
+	return err == nil && b[0] == StreamHeaderMagic
+}
+
+// ReadStreamHeader reads a header written by WriteStreamHeader.
+func ReadStreamHeader(r io.Reader) (*StreamHeader, error) {
+	var prefix [3]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	if prefix[0] != StreamHeaderMagic {
+		return nil, errors.New("missing stream header")
+	}
+	size := int(binary.BigEndian.Uint16(prefix[1:3]))
+	if size > maxStreamHeaderSize {
+		return nil, fmt.Errorf("stream header too large: %d bytes", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	var h StreamHeader
+	if err := json.Unmarshal(payload, &h); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// MaxDatagramSize is the largest UDP payload that fits in a datagram frame.
+const MaxDatagramSize = 65535
+
+// WriteDatagram writes one UDP payload as a big-endian uint16 length followed by the data.
+func WriteDatagram(w io.Writer, p []byte) error {
+	if len(p) > MaxDatagramSize {
+		return fmt.Errorf("datagram too large: %d bytes", len(p))
+	}
+	buf := make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(buf[:2], uint16(len(p)))
+	copy(buf[2:], p)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadDatagram reads one frame written by WriteDatagram into buf and returns
+// the payload length. buf must be at least MaxDatagramSize bytes long.
+func ReadDatagram(r io.Reader, buf []byte) (int, error) {
+	var prefix [2]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return 0, err
+	}
+	size := int(binary.BigEndian.Uint16(prefix[:]))
+	if size > len(buf) {
+		return 0, fmt.Errorf("datagram too large: %d bytes", size)
+	}
+	if _, err := io.ReadFull(r, buf[:size]); err != nil {
+		return 0, err
+	}
+	return size, nil
+}